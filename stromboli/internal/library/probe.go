@@ -0,0 +1,170 @@
+// Package library reads what's in the files being served: the streams
+// ffprobe finds in them and which of those matter for playing them.
+package library
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProbeTimeout is how long one ffprobe may take
+var ProbeTimeout = 30 * time.Second
+
+// ErrProbeTimeout is what a probe that ran out of time returns
+var ErrProbeTimeout = errors.New("ffprobe timed out")
+
+// ProbeStream is one of a file's streams, as ffprobe describes it
+type ProbeStream struct {
+	Index       int               `json:"index"`
+	CodecType   string            `json:"codec_type"`
+	CodecName   string            `json:"codec_name"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	Channels    int               `json:"channels"`
+	Duration    string            `json:"duration"`
+	FieldOrder  string            `json:"field_order"`
+	FrameRate   string            `json:"avg_frame_rate"` // A fraction such as 30000/1001
+	Disposition map[string]int    `json:"disposition"`
+	Tags        map[string]string `json:"tags"`
+}
+
+// ProbeResult is ffprobe's JSON output for a file
+type ProbeResult struct {
+	Streams []ProbeStream `json:"streams"`
+	Format  struct {
+		Duration string `json:"duration"`
+		BitRate  string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// ProbeOutput runs ffprobe, or a handler's stand-in for it, until ctx is
+// done or ProbeTimeout passes. A process stuck reading a dying disk may not
+// die when killed, so it's left behind rather than waited for.
+func ProbeOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, ProbeTimeout)
+	defer cancel()
+
+	type result struct {
+		output []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	cmd := exec.CommandContext(ctx, name, args...)
+	go func() {
+		output, err := cmd.Output()
+		done <- result{output, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err == nil || ctx.Err() == nil {
+			return r.output, r.err
+		}
+	case <-ctx.Done():
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, ErrProbeTimeout
+	}
+	return nil, ctx.Err()
+}
+
+// StreamsOfType returns all streams of the given codec type ("video", "audio", ...)
+func (p *ProbeResult) StreamsOfType(codecType string) []ProbeStream {
+	var streams []ProbeStream
+	for _, s := range p.Streams {
+		if s.CodecType == codecType {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
+// Interlaced reports whether a video stream is made of fields rather than
+// frames, as broadcast captures usually are
+func (s *ProbeStream) Interlaced() bool {
+	switch s.FieldOrder {
+	case "tt", "bb", "tb", "bt":
+		return true
+	}
+	return false
+}
+
+// FramesPerSecond is the stream's average frames per second, or 0 if unknown
+func (s *ProbeStream) FramesPerSecond() float64 {
+	num, den, _ := strings.Cut(s.FrameRate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if den == "" {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// MainVideoStream picks the stream most likely to be the feature itself.
+// Cover art and thumbnails are ignored, then the largest resolution wins,
+// falling back to the longest duration and finally the default flag.
+func (p *ProbeResult) MainVideoStream() *ProbeStream {
+	var best *ProbeStream
+	for i := range p.Streams {
+		s := &p.Streams[i]
+		if s.CodecType != "video" || s.Disposition["attached_pic"] == 1 || s.Disposition["timed_thumbnails"] == 1 {
+			continue
+		}
+		if best == nil || betterVideoStream(s, best) {
+			best = s
+		}
+	}
+	return best
+}
+
+func betterVideoStream(a, b *ProbeStream) bool {
+	if areaA, areaB := a.Width*a.Height, b.Width*b.Height; areaA != areaB {
+		return areaA > areaB
+	}
+	if durA, durB := a.Seconds(), b.Seconds(); durA != durB {
+		return durA > durB
+	}
+	return a.Disposition["default"] == 1 && b.Disposition["default"] != 1
+}
+
+// MainAudioStream picks the default audio stream, or the first one if none is flagged.
+// Broadcast captures often list empty audio streams and audio description
+// tracks, which are passed over when there's anything else.
+func (p *ProbeResult) MainAudioStream() *ProbeStream {
+	audio := p.StreamsOfType("audio")
+	if len(audio) == 0 {
+		return nil
+	}
+
+	var usable []ProbeStream
+	for _, s := range audio {
+		if s.Channels > 0 && s.Disposition["visual_impaired"] == 0 {
+			usable = append(usable, s)
+		}
+	}
+	if len(usable) > 0 {
+		audio = usable
+	}
+	for i := range audio {
+		if audio[i].Disposition["default"] == 1 {
+			return &audio[i]
+		}
+	}
+	return &audio[0]
+}
+
+// Seconds is the stream's duration, or 0 if unknown
+func (s *ProbeStream) Seconds() float64 {
+	d, _ := strconv.ParseFloat(s.Duration, 64)
+	return d
+}
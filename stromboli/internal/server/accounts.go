@@ -0,0 +1,349 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"video-browser/stromboli/internal/webui"
+)
+
+// Accounts are people who signed up through an invite link and sign in
+// with a password of their own, kept in the data directory
+const (
+	accountsFile = "accounts.json"
+	invitesFile  = "invites.json"
+)
+
+// How long an invite link works for if nobody uses it, and the shortest
+// password it takes
+const (
+	inviteLifetime    = 7 * 24 * time.Hour
+	minPasswordLength = 8
+)
+
+type account struct {
+	PasswordHash string    `json:"passwordHash"`
+	Guest        bool      `json:"guest,omitempty"`
+	Created      time.Time `json:"created"`
+	InvitedBy    string    `json:"invitedBy,omitempty"`
+}
+
+// invite is a single-use link for signing up, keyed by its token
+type invite struct {
+	Token   string    `json:"token"`
+	Guest   bool      `json:"guest"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	By      string    `json:"by,omitempty"`
+}
+
+var (
+	accountsMutex sync.Mutex
+	accounts      = map[string]*account{}
+	invites       = map[string]*invite{}
+)
+
+// setupInvites checks the role invites give when they don't say
+func setupInvites(c *Config) error {
+	if c.InviteRole != "" && c.InviteRole != "guest" && c.InviteRole != "member" {
+		return fmt.Errorf("invite role %q isn't guest or member", c.InviteRole)
+	}
+	return nil
+}
+
+func loadAccounts() {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	if err := loadJSON(accountsFile, &accounts); err != nil {
+		log.Printf("Error loading accounts: %v", err)
+	}
+	if err := loadJSON(invitesFile, &invites); err != nil {
+		log.Printf("Error loading invites: %v", err)
+	}
+}
+
+// saveAccounts writes the accounts and invites to disk. Callers must hold
+// accountsMutex.
+func saveAccounts() {
+	if err := saveJSON(accountsFile, accounts); err != nil {
+		log.Printf("Error saving accounts: %v", err)
+	}
+	if err := saveJSON(invitesFile, invites); err != nil {
+		log.Printf("Error saving invites: %v", err)
+	}
+}
+
+// reloadAccounts replaces the accounts and invites with what's on disk
+func reloadAccounts() {
+	accountsMutex.Lock()
+	accounts = map[string]*account{}
+	invites = map[string]*invite{}
+	accountsMutex.Unlock()
+	loadAccounts()
+}
+
+// accountExists reports whether someone has an account with this name
+func accountExists(name string) bool {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	return accounts[name] != nil
+}
+
+// hasAccounts reports whether anyone has signed up from an invite
+func hasAccounts() bool {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	return len(accounts) > 0
+}
+
+// accountIsGuest reports whether a request is signed in to an account
+// that was invited as a guest
+func accountIsGuest(r *http.Request) bool {
+	session := requestSignIn(r)
+	if session == nil || !session.Local {
+		return false
+	}
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	a := accounts[session.User]
+	return a != nil && a.Guest
+}
+
+// validAccountName keeps names usable as keys in the config file's rules,
+// where @ starts a group and * means everyone else
+func validAccountName(name string) bool {
+	return name != "" && len(name) <= 64 && !strings.ContainsAny(name, "@*,/\\") &&
+		strings.TrimSpace(name) == name
+}
+
+// nameInUse reports whether someone other than an account already goes by
+// a name: the config file's rules name them, or they've used the server
+// through the proxy or provider. An account taking the name would get
+// their folders, groups and history.
+func nameInUse(name string) bool {
+	c := config()
+	lists := [][]string{c.Guests, c.Admins}
+	for _, members := range c.Groups {
+		lists = append(lists, members)
+	}
+	for _, list := range lists {
+		if slices.Contains(list, name) {
+			return true
+		}
+	}
+	if _, ok := c.Access[name]; ok {
+		return true
+	}
+	if _, ok := c.StreamLimits[name]; ok {
+		return true
+	}
+
+	preferencesMutex.Lock()
+	_, ok := userPreferences[name]
+	preferencesMutex.Unlock()
+	if ok {
+		return true
+	}
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	return history[name] != nil
+}
+
+// handleInvites lists the invites waiting to be used (GET /api/invites),
+// makes one (POST, with ?role=guest for a guest account) or withdraws one
+// (DELETE /api/invites/{token})
+func handleInvites(w http.ResponseWriter, r *http.Request) {
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/invites"), "/")
+
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	for t, inv := range invites {
+		if time.Now().After(inv.Expires) {
+			delete(invites, t)
+		}
+	}
+
+	switch {
+	case token != "" && r.Method == http.MethodDelete:
+		if invites[token] == nil {
+			http.Error(w, "Invite not found", http.StatusNotFound)
+			return
+		}
+		delete(invites, token)
+		saveAccounts()
+		w.WriteHeader(http.StatusNoContent)
+
+	case token == "" && r.Method == http.MethodGet:
+		list := []*invite{}
+		for _, inv := range invites {
+			list = append(list, inv)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case token == "" && r.Method == http.MethodPost:
+		role := r.URL.Query().Get("role")
+		if role == "" {
+			role = config().InviteRole
+		}
+		if role != "" && role != "guest" && role != "member" {
+			http.Error(w, "Role must be guest or member", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		inv := &invite{
+			Token:   randomString() + randomString(),
+			Guest:   role == "guest",
+			Created: now,
+			Expires: now.Add(inviteLifetime),
+			By:      requestUser(r),
+		}
+		invites[inv.Token] = inv
+		saveAccounts()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"url":     requestScheme(r) + "://" + r.Host + "/auth/invite/" + inv.Token,
+			"expires": inv.Expires,
+			"guest":   inv.Guest,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveAccountForm shows the sign-in or sign-up form
+func serveAccountForm(w http.ResponseWriter, r *http.Request, status int, titleKey string, action string, name string, errorText string) {
+	lang := negotiateLanguage(r.Header.Get("Accept-Language"))
+	messages := messagesFor(lang)
+	autocomplete := "current-password"
+	if titleKey == "account.signUp" {
+		autocomplete = "new-password"
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(status)
+	webui.ServeVersioned(w, "account.html", "text/html",
+		"__LANG__", html.EscapeString(lang),
+		"__TITLE__", html.EscapeString(messages[titleKey]),
+		"__ACTION__", html.EscapeString(action),
+		"__ERROR__", html.EscapeString(errorText),
+		"__NAME_LABEL__", html.EscapeString(messages["account.name"]),
+		"__NAME__", html.EscapeString(name),
+		"__PASSWORD_LABEL__", html.EscapeString(messages["account.password"]),
+		"__PASSWORD_AUTOCOMPLETE__", autocomplete,
+		"__MIN_LENGTH__", strconv.Itoa(minPasswordLength),
+		"__BUTTON__", html.EscapeString(messages[titleKey]))
+}
+
+// handleInviteSignUp shows the form for setting up an account from an
+// invite (GET /auth/invite/{token}) and makes the account (POST), signing
+// the new user in
+func handleInviteSignUp(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/auth/invite/")
+	messages := messagesFor(negotiateLanguage(r.Header.Get("Accept-Language")))
+
+	accountsMutex.Lock()
+	inv := invites[token]
+	accountsMutex.Unlock()
+	if inv == nil || time.Now().After(inv.Expires) {
+		http.Error(w, messages["account.inviteInvalid"], http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodGet {
+		serveAccountForm(w, r, http.StatusOK, "account.signUp", r.URL.Path, "", "")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PostFormValue("name")
+	password := r.PostFormValue("password")
+	if !validAccountName(name) {
+		serveAccountForm(w, r, http.StatusBadRequest, "account.signUp", r.URL.Path, name, messages["account.nameInvalid"])
+		return
+	}
+	if len(password) < minPasswordLength || len(password) > 72 {
+		serveAccountForm(w, r, http.StatusBadRequest, "account.signUp", r.URL.Path, name, messages["account.passwordInvalid"])
+		return
+	}
+	if nameInUse(name) {
+		serveAccountForm(w, r, http.StatusConflict, "account.signUp", r.URL.Path, name, messages["account.nameTaken"])
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Cannot create account", http.StatusInternalServerError)
+		return
+	}
+
+	accountsMutex.Lock()
+	// Someone else may have used the invite, or the name, in the meantime
+	if invites[token] != inv {
+		accountsMutex.Unlock()
+		http.Error(w, messages["account.inviteInvalid"], http.StatusNotFound)
+		return
+	}
+	if accounts[name] != nil {
+		accountsMutex.Unlock()
+		serveAccountForm(w, r, http.StatusConflict, "account.signUp", r.URL.Path, name, messages["account.nameTaken"])
+		return
+	}
+	accounts[name] = &account{PasswordHash: string(hash), Guest: inv.Guest, Created: time.Now(), InvitedBy: inv.By}
+	delete(invites, token)
+	saveAccounts()
+	accountsMutex.Unlock()
+
+	log.Printf("Account %s created from an invite", name)
+	session := signedIn{User: name, Local: true, Expires: time.Now().Add(signInLifetime)}
+	setSignedCookie(w, r, sessionCookie, "/", session, session.Expires)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// handlePasswordSignIn shows the form for signing in to an account (GET
+// /auth/password?next=) and checks the password (POST)
+func handlePasswordSignIn(w http.ResponseWriter, r *http.Request) {
+	action := "/auth/password"
+	if next := r.URL.Query().Get("next"); next != "" {
+		action += "?next=" + url.QueryEscape(next)
+	}
+	if r.Method == http.MethodGet {
+		serveAccountForm(w, r, http.StatusOK, "account.signIn", action, "", "")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PostFormValue("name")
+	accountsMutex.Lock()
+	a := accounts[name]
+	accountsMutex.Unlock()
+	if a == nil || bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(r.PostFormValue("password"))) != nil {
+		log.Printf("Failed sign-in for %q", name)
+		messages := messagesFor(negotiateLanguage(r.Header.Get("Accept-Language")))
+		serveAccountForm(w, r, http.StatusUnauthorized, "account.signIn", action, name, messages["account.wrongPassword"])
+		return
+	}
+
+	session := signedIn{User: name, Local: true, Expires: time.Now().Add(signInLifetime)}
+	setSignedCookie(w, r, sessionCookie, "/", session, session.Expires)
+	http.Redirect(w, r, localRedirect(r.URL.Query().Get("next")), http.StatusSeeOther)
+}
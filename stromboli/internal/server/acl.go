@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+)
+
+// setupAccess checks the folders in the access rules and cleans them up,
+// along with the stream limits keyed the same way
+func setupAccess(c *Config) error {
+	for who, folders := range c.Access {
+		for i, folder := range folders {
+			cleaned, err := cleanAPIPath(folder, runtime.GOOS == "windows")
+			if err != nil {
+				return fmt.Errorf("access for %s: folder %q: %v", who, folder, err)
+			}
+			folders[i] = cleaned
+		}
+	}
+	for who, limit := range c.StreamLimits {
+		if limit < 0 {
+			return fmt.Errorf("stream limit for %s can't be negative", who)
+		}
+	}
+	return nil
+}
+
+// requestGroups lists the groups the user is in, from the proxy's groups
+// header and the config file's groups
+func requestGroups(r *http.Request, user string) []string {
+	var groups []string
+	if session := requestSignIn(r); session != nil {
+		groups = append(groups, session.Groups...)
+	}
+	groups = append(groups, proxyGroups(r)...)
+	for group, members := range config().Groups {
+		for _, member := range members {
+			if user != "" && member == user {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
+
+// allowedFolders lists the folders a request may see, or reports that it
+// may see everything
+func allowedFolders(r *http.Request) (folders []string, all bool) {
+	if len(config().Access) == 0 {
+		return nil, true
+	}
+	user := requestUser(r)
+	matched := false
+	if user != "" {
+		if rule, ok := config().Access[user]; ok {
+			folders, matched = append(folders, rule...), true
+		}
+	}
+	for _, group := range requestGroups(r, user) {
+		if rule, ok := config().Access["@"+group]; ok {
+			folders, matched = append(folders, rule...), true
+		}
+	}
+	if !matched {
+		folders = config().Access["*"]
+	}
+	for _, folder := range folders {
+		if folder == "" {
+			return nil, true
+		}
+	}
+	return folders, false
+}
+
+// canAccess reports whether a request may use a file or folder, which has
+// to be inside one of its folders
+func canAccess(r *http.Request, path string) bool {
+	folders, all := allowedFolders(r)
+	if all {
+		return true
+	}
+	for _, folder := range folders {
+		if path == folder || strings.HasPrefix(path, folder+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// canBrowse reports whether a request may list a folder: one of its own,
+// or one on the way down to them
+func canBrowse(r *http.Request, path string) bool {
+	if canAccess(r, path) {
+		return true
+	}
+	folders, _ := allowedFolders(r)
+	for _, folder := range folders {
+		if path == "" || strings.HasPrefix(folder, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRequestPath is resolvePath for handlers, also refusing paths
+// outside the folders the request may see
+func resolveRequestPath(r *http.Request, p string) (string, string, bool) {
+	cleaned, fullPath, ok := resolvePath(p)
+	if !ok || !canAccess(r, cleaned) {
+		return "", "", false
+	}
+	return cleaned, fullPath, true
+}
@@ -0,0 +1,25 @@
+package server
+
+import "net/http"
+
+// isAdmin reports whether a request comes from someone listed as an admin
+// in the config file. Guests and peers never are, even when a group
+// they're in is listed.
+func isAdmin(r *http.Request) bool {
+	if requestPeer(r) != "" || isGuest(r) {
+		return false
+	}
+	return listsRequest(config().Admins, r)
+}
+
+// requireAdmin keeps everyone but admins out of handlers that hand out
+// access to the server, copy all of its data or reload its config
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			http.Error(w, "Only admins can do this", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"video-browser/stromboli/internal/library"
+)
+
+// Audio formats listed for playing on their own, such as audiobooks and
+// podcasts, with the types browsers need to play them. Ogg is left to
+// videoFormats.
+var listeningFormats = map[string]string{
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".m4b":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+}
+
+// Audio files at least this long get audiobook controls, set with
+// -audiobook-minutes
+var audiobookMinutes = 20
+
+// chapter is a chapter marked in an audiobook or video's metadata
+type chapter struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Title string  `json:"title"`
+}
+
+// probeChapters reads the chapters of M4B, MP3 (ID3 CHAP frames), MKV and
+// the like
+func probeChapters(ctx context.Context, fullPath string) ([]chapter, error) {
+	args := []string{"-v", "error", "-show_chapters", "-of", "json"}
+	output, err := library.ProbeOutput(ctx, "ffprobe", append(args, inputFile(fullPath)...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Chapters []struct {
+			StartTime string            `json:"start_time"`
+			EndTime   string            `json:"end_time"`
+			Tags      map[string]string `json:"tags"`
+		} `json:"chapters"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, err
+	}
+
+	chapters := []chapter{}
+	for i, c := range result.Chapters {
+		start, _ := strconv.ParseFloat(c.StartTime, 64)
+		end, _ := strconv.ParseFloat(c.EndTime, 64)
+		title := c.Tags["title"]
+		if title == "" {
+			title = "Chapter " + strconv.Itoa(i+1)
+		}
+		chapters = append(chapters, chapter{Start: start, End: end, Title: title})
+	}
+	return chapters, nil
+}
+
+// handleChapters lists a file's chapters (GET /api/chapters?path=)
+func handleChapters(w http.ResponseWriter, r *http.Request) {
+	// Security check: paths can't leave the root
+	_, fullPath, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if !fileExists(fullPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	chapters, err := probeChapters(r.Context(), fullPath)
+	if err != nil {
+		http.Error(w, "Cannot read chapters", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chapters)
+}
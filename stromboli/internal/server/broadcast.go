@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"video-browser/stromboli/internal/library"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// Container each kind of broadcast target takes
+var broadcastFormats = map[string]string{
+	"rtmp":  "flv",
+	"rtmps": "flv",
+	"srt":   "mpegts",
+	"udp":   "mpegts",
+}
+
+// setupBroadcast checks the config file's broadcast targets
+func setupBroadcast(c *Config) error {
+	for name, target := range c.BroadcastTargets {
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%s: %q isn't a URL", name, target)
+		}
+		if _, ok := broadcastFormats[u.Scheme]; !ok {
+			return fmt.Errorf("%s: can't broadcast to %s, only rtmp, rtmps, srt and udp", name, u.Scheme)
+		}
+	}
+	return nil
+}
+
+// broadcastArgs builds the ffmpeg arguments pushing a file to a target as
+// it plays, from start seconds in. Live services want a steady bitrate and
+// a keyframe every couple of seconds.
+func broadcastArgs(fullPath string, probe *library.ProbeResult, target string, start float64) []string {
+	u, _ := url.Parse(target)
+	args := []string{"-re", "-ss", strconv.FormatFloat(start, 'f', 3, 64)}
+	args = append(args, inputFile(fullPath)...)
+	args = append(args, transcode.StreamMapArgs(probe, false)...)
+	if filter := transcode.VideoFilter(probe, config().MaxHeight, config().MaxFrameRate); filter != "" {
+		args = append(args, "-vf", filter)
+	}
+	args = append(args,
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-b:v", "4500k",
+		"-maxrate", "4500k",
+		"-bufsize", "9000k",
+		"-g", "60",
+		"-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+		"-b:a", "160k",
+		"-ar", "44100",
+		"-ac", "2",
+		"-f", broadcastFormats[u.Scheme],
+		"-progress", "pipe:1",
+		"-nostats",
+		"-loglevel", "error",
+		target,
+	)
+	return args
+}
+
+// runBroadcastJob pushes a file to one of the config file's broadcast
+// targets, named by the target param, until it ends or the job is
+// cancelled. The start param skips into the file.
+func runBroadcastJob(ctx context.Context, job *backgroundJob) error {
+	_, fullPath, ok := resolvePath(job.Path)
+	if !ok {
+		return errors.New("Invalid path")
+	}
+	if _, err := os.Stat(fullPath); err != nil {
+		return errors.New("File not found")
+	}
+	name := job.Params["target"]
+	target, ok := config().BroadcastTargets[name]
+	if !ok {
+		return errors.New("Unknown broadcast target")
+	}
+	var start float64
+	if s := job.Params["start"]; s != "" {
+		var err error
+		if start, err = strconv.ParseFloat(s, 64); err != nil || start < 0 {
+			return errors.New("Invalid start")
+		}
+	}
+
+	probe, err := probeFile(ctx, fullPath)
+	if err != nil {
+		log.Printf("Error probing %s, assuming first video and audio streams: %v", job.Path, err)
+	}
+	var duration float64
+	if probe != nil {
+		duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	}
+
+	log.Printf("Broadcasting %s to %s", job.Path, name)
+	cmd := exec.CommandContext(ctx, "ffmpeg", broadcastArgs(fullPath, probe, target, start)...)
+	var stderr tailBuffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.New("Encoding error")
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.New(classifyStartError(err).Message)
+	}
+
+	readProgress(stdout, duration-start, job.setProgress)
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			log.Printf("Stopped broadcasting %s to %s", job.Path, name)
+			return nil
+		}
+		// ffmpeg's output can give away the stream key, so it isn't logged
+		log.Printf("Broadcast of %s to %s failed: %v", job.Path, name, err)
+		return errors.New(classifyFFmpegError(stderr.String()).Message)
+	}
+	log.Printf("Finished broadcasting %s to %s", job.Path, name)
+	return nil
+}
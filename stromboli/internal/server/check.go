@@ -0,0 +1,252 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkJob tracks the background corruption check
+type checkJob struct {
+	mu      sync.Mutex
+	running bool
+	total   int
+	done    int
+	current string
+	broken  []string
+}
+
+type checkStatus struct {
+	Running bool     `json:"running"`
+	Total   int      `json:"total"`
+	Done    int      `json:"done"`
+	Current string   `json:"current,omitempty"`
+	Broken  []string `json:"broken"`
+}
+
+var corruptionCheck checkJob
+
+// checkFile decodes the whole file, reporting any errors ffmpeg hits
+func checkFile(fullPath string) (bool, string) {
+	var stderr tailBuffer
+	args := append([]string{"-v", "error"}, inputFile(fullPath)...)
+	cmd := exec.Command("ffmpeg", append(args, "-f", "null", "-")...)
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	output := strings.TrimSpace(stderr.String())
+	if err == nil && output == "" {
+		return false, ""
+	}
+	if output == "" {
+		output = err.Error()
+	}
+
+	// The first line is usually the most telling
+	firstLine, _, _ := strings.Cut(output, "\n")
+	return true, firstLine
+}
+
+// recordCheck stores a check result in the library index
+func recordCheck(relativePath string, corrupt bool, message string) {
+	info, err := os.Stat(filepath.Join(rootDir, relativePath))
+	if err != nil {
+		return
+	}
+
+	libraryMutex.Lock()
+	defer libraryMutex.Unlock()
+
+	entry := libraryIndex[relativePath]
+	if entry == nil || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		entry = newIndexEntry(relativePath, info)
+		libraryIndex[relativePath] = entry
+	}
+	entry.Corrupt = corrupt
+	entry.CheckError = message
+	entry.Checked = time.Now()
+
+	if err := saveLibrary(); err != nil {
+		log.Printf("Error saving library index: %v", err)
+	}
+}
+
+// runCheck checks each file in turn, updating the job as it goes
+func (j *checkJob) runCheck(paths []string) {
+	for _, path := range paths {
+		j.mu.Lock()
+		j.current = path
+		j.mu.Unlock()
+
+		corrupt, message := checkFile(filepath.Join(rootDir, path))
+		recordCheck(path, corrupt, message)
+		if corrupt {
+			log.Printf("Corruption check: %s is damaged: %s", path, message)
+		}
+
+		j.mu.Lock()
+		j.done++
+		if corrupt {
+			j.broken = append(j.broken, path)
+		}
+		j.mu.Unlock()
+	}
+
+	j.mu.Lock()
+	j.running = false
+	j.current = ""
+	j.mu.Unlock()
+	log.Printf("Corruption check finished: %d files checked", len(paths))
+}
+
+// start begins checking the given files unless a check is already running
+func (j *checkJob) start(paths []string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running {
+		return false
+	}
+	j.running = true
+	j.total = len(paths)
+	j.done = 0
+	j.broken = nil
+	go j.runCheck(paths)
+	return true
+}
+
+func (j *checkJob) status() checkStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return checkStatus{
+		Running: j.running,
+		Total:   j.total,
+		Done:    j.done,
+		Current: j.current,
+		Broken:  append([]string{}, j.broken...),
+	}
+}
+
+// checkUnchecked is the scheduled task, checking indexed files that haven't been checked yet
+func checkUnchecked() error {
+	libraryMutex.RLock()
+	var paths []string
+	for path, entry := range libraryIndex {
+		if entry.Checked.IsZero() {
+			paths = append(paths, path)
+		}
+	}
+	libraryMutex.RUnlock()
+
+	if !corruptionCheck.start(paths) {
+		return fmt.Errorf("a corruption check is already running")
+	}
+	return nil
+}
+
+// checkPaths expands a file or directory under rootDir into the videos to check
+func checkPaths(path string) ([]string, error) {
+	info, err := os.Stat(filepath.Join(rootDir, path))
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{filepath.Clean(path)}, nil
+	}
+	return collectVideos(path, true)
+}
+
+// handleCheck starts a check of a file or folder (POST) or reports progress (GET)
+func handleCheck(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		path := r.URL.Query().Get("path")
+
+		// Security check: paths can't leave the root
+		path, _, ok := resolveRequestPath(r, path)
+		if !ok {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+
+		paths, err := checkPaths(path)
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if !corruptionCheck.start(paths) {
+			http.Error(w, "A check is already running", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(corruptionCheck.status())
+}
+
+// runCheckCommand implements "stromboli check [paths...]", checking files
+// from the command line and recording the results in the index
+func runCheckCommand(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	dir := fs.String("d", ".", "Library directory")
+	fs.StringVar(&dataDir, "data", defaultDataDir(), "Directory the library index is stored in")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: stromboli check [-d dir] [-data dir] [path ...]")
+		fmt.Fprintln(fs.Output(), "Checks videos for corruption. Paths are relative to the library and default to all of it.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var err error
+	rootDir, err = filepath.Abs(*dir)
+	if err != nil {
+		log.Fatal("Invalid directory:", err)
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		log.Fatal("Cannot create data directory:", err)
+	}
+	loadLibrary()
+
+	targets := fs.Args()
+	if len(targets) == 0 {
+		targets = []string{""}
+	}
+
+	var paths []string
+	for _, target := range targets {
+		found, err := checkPaths(target)
+		if err != nil {
+			log.Fatalf("Cannot check %s: %v", target, err)
+		}
+		paths = append(paths, found...)
+	}
+
+	broken := 0
+	for _, path := range paths {
+		corrupt, message := checkFile(filepath.Join(rootDir, path))
+		recordCheck(path, corrupt, message)
+		if corrupt {
+			broken++
+			fmt.Printf("BROKEN %s: %s\n", path, message)
+		} else {
+			fmt.Printf("OK     %s\n", path)
+		}
+	}
+
+	fmt.Printf("%d files checked, %d broken\n", len(paths), broken)
+	if broken > 0 {
+		os.Exit(1)
+	}
+}
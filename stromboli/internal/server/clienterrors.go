@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+const clientErrorsFile = "client_errors.json"
+
+// Largest report a player may send, and the most of its message kept
+const (
+	maxClientErrorReport  = 4096
+	maxClientErrorMessage = 300
+)
+
+// Kinds of trouble a player reports: the four MediaError codes, and
+// playback that keeps stalling
+var clientErrorKinds = []string{"aborted", "network", "decode", "unsupported", "stalled"}
+
+// clientErrors is what players have reported going wrong with a file,
+// counted per device type and browser
+type clientErrors struct {
+	Path    string                         `json:"path"`
+	Count   int                            `json:"count"`
+	Time    time.Time                      `json:"time"`
+	Devices map[string]*deviceClientErrors `json:"devices"`
+}
+
+type deviceClientErrors struct {
+	Count   int            `json:"count"`
+	Kinds   map[string]int `json:"kinds"`
+	Message string         `json:"message,omitempty"` // The latest one
+	Mode    string         `json:"mode,omitempty"`    // direct or transcode
+	Profile string         `json:"profile,omitempty"`
+	Time    time.Time      `json:"time"`
+}
+
+var (
+	clientErrorsMutex sync.Mutex
+	clientErrorFiles  = map[string]*clientErrors{}
+)
+
+func loadClientErrors() {
+	clientErrorsMutex.Lock()
+	defer clientErrorsMutex.Unlock()
+	if err := loadJSON(clientErrorsFile, &clientErrorFiles); err != nil {
+		log.Printf("Error loading client errors: %v", err)
+	}
+}
+
+// saveClientErrors writes the reports to disk and tells pages how many
+// files have them. Callers must hold clientErrorsMutex.
+func saveClientErrors() {
+	if err := saveJSON(clientErrorsFile, clientErrorFiles); err != nil {
+		log.Printf("Error saving client errors: %v", err)
+	}
+	publishEvent("clientErrors", len(clientErrorFiles))
+}
+
+// browserName picks the browser out of a user agent. Edge and Opera
+// mention Chrome, and Chrome mentions Safari, so they go first.
+func browserName(userAgent string) string {
+	agent := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(agent, "edg/") || strings.Contains(agent, "edga/") || strings.Contains(agent, "edgios/"):
+		return "Edge"
+	case strings.Contains(agent, "opr/"):
+		return "Opera"
+	case strings.Contains(agent, "firefox/") || strings.Contains(agent, "fxios/"):
+		return "Firefox"
+	case strings.Contains(agent, "chrome/") || strings.Contains(agent, "crios/") || strings.Contains(agent, "chromium/"):
+		return "Chrome"
+	case strings.Contains(agent, "safari/"):
+		return "Safari"
+	}
+	return "Other"
+}
+
+// recordClientError counts a player's report against its file, dropping
+// the file reported longest ago once there are too many
+func recordClientError(path string, device string, kind string, message string, mode string, profile string) {
+	clientErrorsMutex.Lock()
+	defer clientErrorsMutex.Unlock()
+	now := time.Now()
+	file := clientErrorFiles[path]
+	if file == nil {
+		file = &clientErrors{Path: path, Devices: map[string]*deviceClientErrors{}}
+		clientErrorFiles[path] = file
+	}
+	file.Count++
+	file.Time = now
+	errs := file.Devices[device]
+	if errs == nil {
+		errs = &deviceClientErrors{Kinds: map[string]int{}}
+		file.Devices[device] = errs
+	}
+	errs.Count++
+	errs.Kinds[kind]++
+	if message != "" {
+		errs.Message = message
+	}
+	errs.Mode = mode
+	errs.Profile = profile
+	errs.Time = now
+
+	if len(clientErrorFiles) > maxFailures {
+		oldest := path
+		for p, f := range clientErrorFiles {
+			if f.Time.Before(clientErrorFiles[oldest].Time) {
+				oldest = p
+			}
+		}
+		delete(clientErrorFiles, oldest)
+	}
+	saveClientErrors()
+}
+
+// handleClientErrors takes a player's report of a failed or stalling file
+// (POST /api/client-errors), lists the files players have had trouble with,
+// most reports first (GET), or dismisses one (DELETE ?path=). Guests'
+// players report too, but only others see the list.
+func handleClientErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		reportClientError(w, r)
+		return
+	}
+	if isGuest(r) {
+		http.Error(w, "Guests can't do this", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		path, _, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+		if !ok {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		clientErrorsMutex.Lock()
+		if _, ok := clientErrorFiles[path]; ok {
+			delete(clientErrorFiles, path)
+			saveClientErrors()
+		}
+		clientErrorsMutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientErrorsMutex.Lock()
+	list := make([]clientErrors, 0, len(clientErrorFiles))
+	for _, file := range clientErrorFiles {
+		if canAccess(r, file.Path) {
+			list = append(list, *file)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Time.After(list[j].Time)
+	})
+	// Encoded while still locked, as the device counts are shared
+	data, err := json.Marshal(list)
+	clientErrorsMutex.Unlock()
+	if err != nil {
+		http.Error(w, "Cannot list client errors", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// reportClientError reads a player's report and counts it against the
+// file, under the device type and browser it came from
+func reportClientError(w http.ResponseWriter, r *http.Request) {
+	var report struct {
+		Path    string `json:"path"`
+		Kind    string `json:"kind"`
+		Message string `json:"message"`
+		Mode    string `json:"mode"`
+		Profile string `json:"profile"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxClientErrorReport)).Decode(&report); err != nil {
+		http.Error(w, "Invalid report", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(clientErrorKinds, report.Kind) {
+		http.Error(w, "Unknown kind of error", http.StatusBadRequest)
+		return
+	}
+	if report.Mode != "direct" && report.Mode != "transcode" {
+		report.Mode = ""
+	}
+	if _, ok := transcode.FindProfile(report.Profile); !ok {
+		report.Profile = ""
+	}
+
+	// Security check: paths can't leave the root, and only files in the
+	// library are counted
+	path, fullPath, ok := resolveRequestPath(r, report.Path)
+	if !ok || !fileExists(fullPath) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	message := strings.ToValidUTF8(report.Message, "")
+	if len(message) > maxClientErrorMessage {
+		message = strings.ToValidUTF8(message[:maxClientErrorMessage], "")
+	}
+	device := requestDeviceProfile(r).Name + " / " + browserName(r.UserAgent())
+	recordClientError(path, device, report.Kind, message, report.Mode, report.Profile)
+	w.WriteHeader(http.StatusNoContent)
+}
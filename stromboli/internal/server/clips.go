@@ -0,0 +1,307 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Limits on what a clip can be, GIFs being far larger per second
+const (
+	maxClipLength = 120.0
+	maxGIFLength  = 15.0
+	maxClipSize   = 100 << 20
+)
+
+// clipJob cuts a segment of a video into a short MP4 or GIF. It runs as a
+// clip job, one at a time by default. Clips found already made have no job.
+type clipJob struct {
+	mu     sync.Mutex
+	ID     string
+	Path   string
+	Start  float64
+	End    float64
+	Format string
+	Size   int64
+	output string
+	job    *backgroundJob
+}
+
+type clipStatus struct {
+	ID       string  `json:"id"`
+	Path     string  `json:"path"`
+	Start    float64 `json:"start"`
+	End      float64 `json:"end"`
+	Format   string  `json:"format"`
+	State    string  `json:"state"`
+	Progress float64 `json:"progress"`
+	Error    string  `json:"error,omitempty"`
+	Size     int64   `json:"size,omitempty"`
+}
+
+var (
+	clipMutex sync.Mutex
+	clipJobs  = map[string]*clipJob{}
+)
+
+func clipDir() string {
+	return filepath.Join(dataDir, "clips")
+}
+
+// clipJobID identifies a clip by its source and range, so asking for the
+// same clip twice reuses the first one
+func clipJobID(fullPath string, info os.FileInfo, start, end float64, format string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%.3f|%.3f|%s", fullPath, info.ModTime().UnixNano(), start, end, format)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (j *clipJob) snapshot() clipStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := clipStatus{
+		ID:       j.ID,
+		Path:     j.Path,
+		Start:    j.Start,
+		End:      j.End,
+		Format:   j.Format,
+		State:    jobDone,
+		Progress: 1,
+		Size:     j.Size,
+	}
+	if j.job != nil {
+		job := j.job.snapshot()
+		status.State, status.Progress, status.Error = job.State, job.Progress, job.Error
+	}
+	return status
+}
+
+// clipOptions reads and checks a clip's range and format
+func clipOptions(get func(string) string) (start float64, end float64, format string, err error) {
+	format = get("format")
+	if format == "" {
+		format = "mp4"
+	}
+	if format != "mp4" && format != "gif" {
+		return 0, 0, "", errors.New("Unknown format")
+	}
+
+	start, err1 := strconv.ParseFloat(get("start"), 64)
+	end, err2 := strconv.ParseFloat(get("end"), 64)
+	if err1 != nil || err2 != nil || start < 0 || end <= start {
+		return 0, 0, "", errors.New("Invalid clip range")
+	}
+
+	limit := maxClipLength
+	if format == "gif" {
+		limit = maxGIFLength
+	}
+	if end-start > limit {
+		return 0, 0, "", fmt.Errorf("Clips can be at most %.0f seconds long", limit)
+	}
+	return start, end, format, nil
+}
+
+// clipArgs builds the ffmpeg arguments for the clip's format. GIFs get a
+// palette generated from the clip itself so colours don't band.
+func clipArgs(fullPath string, start, end float64, format string, output string) []string {
+	args := []string{"-ss", strconv.FormatFloat(start, 'f', 3, 64)}
+	args = append(args, inputFile(fullPath)...)
+	args = append(args, "-t", strconv.FormatFloat(end-start, 'f', 3, 64))
+
+	if format == "gif" {
+		args = append(args,
+			"-vf", "fps=12,scale='min(480,iw)':-2:flags=lanczos,split[a][b];[a]palettegen[p];[b][p]paletteuse",
+			"-an",
+			"-f", "gif",
+		)
+	} else {
+		args = append(args,
+			"-map", "0:v:0",
+			"-map", "0:a:0?",
+			"-c:v", "libx264",
+			"-preset", "veryfast",
+			"-crf", "23",
+			"-vf", "scale=-2:'min(1080,ih)'",
+			"-pix_fmt", "yuv420p",
+			"-c:a", "aac",
+			"-b:a", "128k",
+			"-ac", "2",
+			"-movflags", "+faststart",
+			"-f", "mp4",
+		)
+	}
+
+	return append(args,
+		"-fs", strconv.Itoa(maxClipSize),
+		"-progress", "pipe:1",
+		"-nostats",
+		"-loglevel", "error",
+		"-y", output,
+	)
+}
+
+func (j *clipJob) run(ctx context.Context, fullPath string) error {
+	log.Printf("Creating %s clip of %s from %.1fs to %.1fs", j.Format, j.Path, j.Start, j.End)
+
+	if err := os.MkdirAll(clipDir(), 0755); err != nil {
+		return errors.New("Cannot create clips directory")
+	}
+
+	tmp := j.output + ".tmp"
+	cmd := exec.CommandContext(ctx, "ffmpeg", clipArgs(fullPath, j.Start, j.End, j.Format, tmp)...)
+	var stderr tailBuffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.New("Encoding error")
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.New(classifyStartError(err).Message)
+	}
+
+	readProgress(stdout, j.End-j.Start, j.job.setProgress)
+
+	if err := cmd.Wait(); err != nil {
+		os.Remove(tmp)
+		log.Printf("Clip of %s failed: %v", j.Path, err)
+		return errors.New(classifyFFmpegError(stderr.String()).Message)
+	}
+
+	if err := os.Rename(tmp, j.output); err != nil {
+		return errors.New("Cannot save clip")
+	}
+
+	if info, err := os.Stat(j.output); err == nil {
+		j.mu.Lock()
+		j.Size = info.Size()
+		j.mu.Unlock()
+	}
+	log.Printf("Clip of %s ready", j.Path)
+	return nil
+}
+
+// runClipJob makes the clip a clip job asks for, with its start, end and
+// format in the params
+func runClipJob(ctx context.Context, job *backgroundJob) error {
+	_, fullPath, ok := resolvePath(job.Path)
+	if !ok {
+		return errors.New("Invalid path")
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return errors.New("File not found")
+	}
+	start, end, format, err := clipOptions(func(key string) string { return job.Params[key] })
+	if err != nil {
+		return err
+	}
+
+	id := clipJobID(fullPath, info, start, end, format)
+	clipMutex.Lock()
+	clip := clipJobs[id]
+	if clip == nil || clip.job != job {
+		clip = &clipJob{ID: id, Path: job.Path, Start: start, End: end, Format: format, output: filepath.Join(clipDir(), id+"."+format), job: job}
+		clipJobs[id] = clip
+	}
+	clipMutex.Unlock()
+	return clip.run(ctx, fullPath)
+}
+
+// handleClipCreate queues a clip (POST /api/clip?path&start&end&format=mp4|gif)
+func handleClipCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	path := query.Get("path")
+
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() && discType(fullPath) == "" {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	start, end, format, err := clipOptions(query.Get)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := clipJobID(fullPath, info, start, end, format)
+	output := filepath.Join(clipDir(), id+"."+format)
+
+	clipMutex.Lock()
+	job := clipJobs[id]
+	if job == nil || job.snapshot().State == jobFailed || job.snapshot().State == jobCancelled {
+		job = &clipJob{ID: id, Path: path, Start: start, End: end, Format: format, output: output}
+
+		if existing, err := os.Stat(output); err == nil {
+			job.Size = existing.Size()
+		} else {
+			job.job = enqueueJob("clip", path, map[string]string{
+				"start":  query.Get("start"),
+				"end":    query.Get("end"),
+				"format": format,
+			})
+		}
+		clipJobs[id] = job
+	}
+	clipMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.snapshot())
+}
+
+// handleClip serves GET /api/clip/{id} for job status and
+// GET /api/clip/{id}/file to download the finished clip
+func handleClip(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/clip/"), "/")
+
+	clipMutex.Lock()
+	job := clipJobs[id]
+	clipMutex.Unlock()
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job.snapshot())
+	case "file":
+		status := job.snapshot()
+		if status.State != jobDone {
+			http.Error(w, "Clip not ready", http.StatusConflict)
+			return
+		}
+		base := strings.TrimSuffix(filepath.Base(status.Path), filepath.Ext(status.Path))
+		name := fmt.Sprintf("%s-%.0f-%.0f.%s", base, status.Start, status.End, status.Format)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		http.ServeFile(w, r, job.output)
+	default:
+		http.Error(w, "Unknown clip action", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const collectionsFile = "collections.json"
+
+// collection is a virtual folder of files from anywhere in the library,
+// such as "Christmas movies". Smart playlists are collections that pick
+// their videos from the index with rules rather than holding items.
+type collection struct {
+	ID      string      `json:"id"`
+	Name    string      `json:"name"`
+	Items   []string    `json:"items"`
+	Match   string      `json:"match,omitempty"` // all or any of the rules
+	Rules   []smartRule `json:"rules,omitempty"`
+	Created time.Time   `json:"created"`
+}
+
+// smart reports whether the collection is a smart playlist
+func (c *collection) smart() bool {
+	return len(c.Rules) > 0
+}
+
+var (
+	collectionsMutex sync.Mutex
+	collections      = map[string]*collection{}
+)
+
+func loadCollections() {
+	collectionsMutex.Lock()
+	defer collectionsMutex.Unlock()
+	if err := loadJSON(collectionsFile, &collections); err != nil {
+		log.Printf("Error loading collections: %v", err)
+	}
+}
+
+// saveCollections writes the collections to disk. Callers must hold
+// collectionsMutex.
+func saveCollections() {
+	if err := saveJSON(collectionsFile, collections); err != nil {
+		log.Printf("Error saving collections: %v", err)
+	}
+}
+
+// collectionEntries are the collections listed at the top of the library,
+// sorted by name
+func collectionEntries() []FileInfo {
+	collectionsMutex.Lock()
+	defer collectionsMutex.Unlock()
+	entries := []FileInfo{}
+	for _, c := range collections {
+		entries = append(entries, FileInfo{Name: c.Name, IsDir: true, Collection: c.ID, ModTime: c.Created})
+	}
+	sort.Slice(entries, func(i, j int) bool { return strings.ToLower(entries[i].Name) < strings.ToLower(entries[j].Name) })
+	return entries
+}
+
+// collectionSummary is a collection without its items
+type collectionSummary struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Smart bool   `json:"smart,omitempty"`
+}
+
+// handleCollections lists collections (GET /api/collections), creates one
+// (POST with {"name": ...}, and "match" and "rules" for a smart playlist),
+// shows one with its files (GET /api/collections/{id}), renames one or
+// replaces its items or rules (PUT with {"name": ..., "items": [...]}),
+// deletes one (DELETE), or adds and removes a file (POST and DELETE
+// /api/collections/{id}/items?path=)
+func handleCollections(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/collections"), "/")
+	id, sub, _ := strings.Cut(rest, "/")
+	if r.Method != http.MethodGet && isGuest(r) {
+		http.Error(w, "Guests can't do this", http.StatusForbidden)
+		return
+	}
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			collectionsMutex.Lock()
+			list := []collectionSummary{}
+			for _, c := range collections {
+				list = append(list, collectionSummary{c.ID, c.Name, len(c.Items), c.smart()})
+			}
+			collectionsMutex.Unlock()
+			sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name) })
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+		case http.MethodPost:
+			var req struct {
+				Name  string      `json:"name"`
+				Match string      `json:"match"`
+				Rules []smartRule `json:"rules"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			c := &collection{ID: newSessionID(), Name: strings.TrimSpace(req.Name), Items: []string{}, Created: time.Now()}
+			if len(req.Rules) > 0 {
+				if err := checkSmartRules(req.Match, req.Rules); err != nil {
+					http.Error(w, "Invalid rules: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				c.Match, c.Rules = req.Match, req.Rules
+			}
+			collectionsMutex.Lock()
+			collections[c.ID] = c
+			saveCollections()
+			collectionsMutex.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(collectionSummary{c.ID, c.Name, 0, c.smart()})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	collectionsMutex.Lock()
+	c := collections[id]
+	collectionsMutex.Unlock()
+	if c == nil {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case sub == "items" && c.smart():
+		http.Error(w, "Smart playlists pick their own videos", http.StatusBadRequest)
+		return
+	case sub == "items" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		// Security check: paths can't leave the root
+		path, fullPath, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+		if path == "" || !ok {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPost && !fileExists(fullPath) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		collectionsMutex.Lock()
+		c.Items = slices.DeleteFunc(c.Items, func(item string) bool { return item == path })
+		if r.Method == http.MethodPost {
+			c.Items = append(c.Items, path)
+		}
+		saveCollections()
+		collectionsMutex.Unlock()
+	case sub != "":
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	case r.Method == http.MethodGet:
+	case r.Method == http.MethodPut:
+		var req struct {
+			Name  *string      `json:"name"`
+			Items *[]string    `json:"items"`
+			Match string       `json:"match"`
+			Rules *[]smartRule `json:"rules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		// A smart playlist keeps to rules, and a collection to its items
+		if req.Rules != nil && (!c.smart() || len(*req.Rules) == 0) || req.Items != nil && c.smart() {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if req.Rules != nil {
+			if err := checkSmartRules(req.Match, *req.Rules); err != nil {
+				http.Error(w, "Invalid rules: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		var items []string
+		if req.Items != nil {
+			items = []string{}
+			for _, item := range *req.Items {
+				// Security check: paths can't leave the root
+				path, _, ok := resolveRequestPath(r, item)
+				if path == "" || !ok {
+					http.Error(w, "Invalid path", http.StatusBadRequest)
+					return
+				}
+				if !slices.Contains(items, path) {
+					items = append(items, path)
+				}
+			}
+		}
+		collectionsMutex.Lock()
+		if req.Name != nil {
+			c.Name = strings.TrimSpace(*req.Name)
+		}
+		if items != nil {
+			c.Items = items
+		}
+		if req.Rules != nil {
+			c.Match, c.Rules = req.Match, *req.Rules
+		}
+		saveCollections()
+		collectionsMutex.Unlock()
+	case r.Method == http.MethodDelete:
+		collectionsMutex.Lock()
+		delete(collections, id)
+		saveCollections()
+		collectionsMutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	collectionsMutex.Lock()
+	name, items, match, rules := c.Name, slices.Clone(c.Items), c.Match, slices.Clone(c.Rules)
+	collectionsMutex.Unlock()
+
+	// Smart playlists are worked out afresh each time from the index
+	if len(rules) > 0 {
+		items = smartPlaylistPaths(requestUser(r), match, rules)
+	}
+
+	// Files that have gone away, or that the user can't see, are left out
+	device := requestDeviceProfile(r)
+	files := []FileInfo{}
+	for _, item := range items {
+		if !canAccess(r, item) {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(rootDir, filepath.FromSlash(item)))
+		if err != nil {
+			continue
+		}
+		files = append(files, indexedFileInfo(item, info, device))
+	}
+	probePending(files, device)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID    string      `json:"id"`
+		Name  string      `json:"name"`
+		Items []FileInfo  `json:"items"`
+		Match string      `json:"match,omitempty"`
+		Rules []smartRule `json:"rules,omitempty"`
+	}{id, name, files, match, rules})
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Comic archives read in the browser. CBZ is a zip file read directly, CBR
+// is a RAR file which needs unrar on the PATH.
+var comicFormats = map[string]bool{
+	".cbz": true,
+	".cbr": true,
+}
+
+// Extracted pages of comics nobody has opened for this long are pruned
+const comicPageRetention = 30 * 24 * time.Hour
+
+// comicIndex is the page list of an archive as it was when listed
+type comicIndex struct {
+	modTime time.Time
+	pages   []string // Names inside the archive, in reading order
+}
+
+var (
+	comicsMutex sync.Mutex
+	comics      = map[string]comicIndex{}
+)
+
+// comicPages lists an archive's images in reading order, remembering the
+// list until the archive changes
+func comicPages(fullPath string, modTime time.Time) ([]string, error) {
+	comicsMutex.Lock()
+	index, ok := comics[fullPath]
+	comicsMutex.Unlock()
+	if ok && index.modTime.Equal(modTime) {
+		return index.pages, nil
+	}
+
+	var names []string
+	if strings.ToLower(filepath.Ext(fullPath)) == ".cbr" {
+		output, err := exec.Command("unrar", "lb", "--", fullPath).Output()
+		if err != nil {
+			return nil, fmt.Errorf("unrar: %v", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		for scanner.Scan() {
+			names = append(names, strings.TrimSpace(scanner.Text()))
+		}
+	} else {
+		archive, err := zip.OpenReader(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range archive.File {
+			if !f.FileInfo().IsDir() {
+				names = append(names, f.Name)
+			}
+		}
+		archive.Close()
+	}
+
+	// Pages are named to sort in order, ignoring the folders some archives
+	// keep them in and the metadata files alongside
+	var pages []string
+	for _, name := range names {
+		base := filepath.Base(filepath.ToSlash(name))
+		if imageFormats[strings.ToLower(filepath.Ext(name))] && !strings.HasPrefix(base, ".") {
+			pages = append(pages, name)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return strings.ToLower(pages[i]) < strings.ToLower(pages[j])
+	})
+
+	comicsMutex.Lock()
+	comics[fullPath] = comicIndex{modTime: modTime, pages: pages}
+	comicsMutex.Unlock()
+	return pages, nil
+}
+
+// comicPageDir returns where an archive's extracted pages are cached. The
+// modification time is part of the key so replaced archives are read again.
+func comicPageDir(fullPath string, modTime time.Time) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d", fullPath, modTime.UnixNano())))
+	return filepath.Join(dataDir, "comics", hex.EncodeToString(sum[:]))
+}
+
+// extractPage copies one page out of an archive to dest
+func extractPage(fullPath string, name string, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if strings.ToLower(filepath.Ext(fullPath)) == ".cbr" {
+		cmd := exec.Command("unrar", "p", "-inul", "--", fullPath, name)
+		cmd.Stdout = out
+		err = cmd.Run()
+	} else {
+		err = extractZipPage(fullPath, name, out)
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+func extractZipPage(fullPath string, name string, out io.Writer) error {
+	archive, err := zip.OpenReader(fullPath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	page, err := archive.Open(name)
+	if err != nil {
+		return err
+	}
+	defer page.Close()
+	_, err = io.Copy(out, page)
+	return err
+}
+
+// handleComic gives the number of pages in a comic (GET /api/comic?path=),
+// or one page, counting from 0 (GET /api/comic?path=&page=)
+func handleComic(w http.ResponseWriter, r *http.Request) {
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+	if !ok || !comicFormats[strings.ToLower(filepath.Ext(fullPath))] {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	pages, err := comicPages(fullPath, info.ModTime())
+	if err != nil {
+		log.Printf("Error reading comic %s: %v", path, err)
+		http.Error(w, "Cannot read comic", http.StatusInternalServerError)
+		return
+	}
+
+	pageParam := r.URL.Query().Get("page")
+	if pageParam == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"pages": len(pages)})
+		return
+	}
+	page, err := strconv.Atoi(pageParam)
+	if err != nil || page < 0 || page >= len(pages) {
+		http.Error(w, "No such page", http.StatusNotFound)
+		return
+	}
+
+	dir := comicPageDir(fullPath, info.ModTime())
+	dest := filepath.Join(dir, strconv.Itoa(page)+strings.ToLower(filepath.Ext(pages[page])))
+	if !fileExists(dest) {
+		if err := extractPage(fullPath, pages[page], dest); err != nil {
+			log.Printf("Error extracting page %d of %s: %v", page, path, err)
+			http.Error(w, "Cannot read page", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Opening the comic keeps its pages from being pruned
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+
+	w.Header().Set("Cache-Control", "max-age=86400")
+	http.ServeFile(w, r, dest)
+}
+
+// pruneComicPages removes the extracted pages of comics that haven't been
+// read for a while
+func pruneComicPages() {
+	comicsDir := filepath.Join(dataDir, "comics")
+	entries, err := os.ReadDir(comicsDir)
+	if err != nil {
+		return
+	}
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < comicPageRetention {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(comicsDir, entry.Name())); err == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("Pruned the pages of %d comics", removed)
+	}
+}
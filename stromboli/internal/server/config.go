@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// Config holds the settings that are too involved for command line flags.
+// It is read from the JSON file given with -config.
+type Config struct {
+	// Cron expressions for maintenance tasks, keyed by task name
+	Tasks map[string]string `json:"tasks"`
+
+	// Video formats added, changed or (when null) removed, keyed by extension
+	Formats map[string]*fileFormat `json:"formats"`
+
+	// Extra file types and how to probe and transcode them
+	Handlers []fileHandler `json:"handlers"`
+
+	// Text or image stamped onto transcoded streams
+	Watermark *watermarkConfig `json:"watermark"`
+
+	// Addresses to listen on, in place of the -p port
+	Listen []listenConfig `json:"listen"`
+
+	// Caps on every transcode, for servers that can't encode more. Players
+	// can ask for lower ones.
+	MaxHeight    int `json:"maxHeight"`
+	MaxFrameRate int `json:"maxFrameRate"`
+
+	// How offline copies are encoded: the profile used when a job doesn't
+	// name one, and profiles changing or adding to the built-in ones
+	PrepareProfile  string                     `json:"prepareProfile"`
+	PrepareProfiles map[string]json.RawMessage `json:"prepareProfiles"`
+
+	// Headers in which the reverse proxy that signs people in passes their
+	// user name and comma-separated groups. They're only believed from the
+	// trusted proxies below, so naming them without any is refused.
+	UserHeader   string `json:"userHeader"`
+	GroupsHeader string `json:"groupsHeader"`
+
+	// Addresses or networks of the proxies whose user headers are believed,
+	// Remote-User and X-Forwarded-User unless named above. Without any,
+	// no request's headers are.
+	TrustedProxies []string `json:"trustedProxies"`
+	trustedProxies []*net.IPNet
+
+	// An OpenID Connect provider people sign in through. Its groups count
+	// like the proxy's.
+	OIDC *oidcConfig `json:"oidc"`
+
+	// What accounts made from invite links are when the invite doesn't
+	// say: "member", the default, or "guest"
+	InviteRole string `json:"inviteRole"`
+
+	// Groups defined here rather than by the proxy, listing their members
+	Groups map[string][]string `json:"groups"`
+
+	// The folders people can see, keyed by user name, @group, or * for
+	// everyone not otherwise listed. "" is the whole library. Without any
+	// rules everyone sees everything.
+	Access map[string][]string `json:"access"`
+
+	// Who only gets to browse and play, keyed like the access rules with *
+	// for anyone not signed in, and the bitrate each of their streams is
+	// held to in kbit/s
+	Guests       []string `json:"guests"`
+	GuestBitrate int      `json:"guestBitrate"`
+
+	// Who administers the server, inviting people, exporting and importing
+	// its data, reloading this file and broadcasting. Listed like guests,
+	// so @group takes in the provider's and the proxy's groups. Without
+	// any nobody does.
+	Admins []string `json:"admins"`
+
+	// Minutes a direct play can sit paused before the browser's requests for
+	// more of the file are held until it plays again. 0 never holds them.
+	DirectPauseMinutes int `json:"directPauseMinutes"`
+
+	// How many videos each person may play at once, keyed like the access
+	// rules. 0 is no limit.
+	StreamLimits map[string]int `json:"streamLimits"`
+
+	// Days after being watched that videos in a folder go to the trash,
+	// keyed by folder with "" for the whole library. The deepest folder
+	// listed wins, and a negative number keeps its videos.
+	DeleteWatched map[string]int `json:"deleteWatched"`
+
+	// Days videos stay in the trash before being deleted for good. 0 keeps
+	// them until the trash folder is emptied by hand.
+	TrashDays int `json:"trashDays"`
+
+	// Rules moving new files out of a watch folder into place
+	Organize *organizeConfig `json:"organize"`
+
+	// How many jobs of each type may run at once, keyed by type
+	JobLimits map[string]int `json:"jobLimits"`
+
+	// Hours of the day, like "01:00-06:00", in which the pregenerate task
+	// works through new videos
+	OffPeak string `json:"offPeak"`
+
+	// Networks, as addresses or CIDR, whose players count as coming in over
+	// the internet even though their addresses are private, like a VPN's
+	ExternalNetworks []string `json:"externalNetworks"`
+	externalNetworks []*net.IPNet
+
+	// Quality profiles transcodes start at on the local network and over
+	// the internet, "high" and "medium" unless set. Players can pick their
+	// own in the settings.
+	LANProfile string `json:"lanProfile"`
+	WANProfile string `json:"wanProfile"`
+
+	// How transcodes' bitrate and CRF change with the height of the picture
+	// being encoded, from the shortest height up. Each gives the bitrate it
+	// needs next to 1080p and what to add to the CRF, with a maxHeight of 0
+	// on the last for anything taller. Built-in rules are used unless set.
+	EncoderRules []transcode.EncoderRule `json:"encoderRules"`
+
+	// What plays when a video ends for people who haven't chosen: "off",
+	// "folder" for the next video in the folder, or "episode" for only the
+	// next episode of the same show, "folder" unless set. The countdown
+	// gives that many seconds to cancel it first, 10 unless set.
+	AutoplayMode      string `json:"autoplayMode"`
+	AutoplayCountdown int    `json:"autoplayCountdown"`
+
+	// Where files can be broadcast to, such as an RTMP ingest URL with its
+	// stream key or OBS listening for SRT, keyed by the name to pick them by
+	BroadcastTargets map[string]string `json:"broadcastTargets"`
+
+	// Other Stromboli servers whose libraries are listed as top-level
+	// folders, keyed by the folder name, with the token to connect with
+	RemoteLibraries map[string]*remoteLibrary `json:"remoteLibraries"`
+
+	// Servers that may list this one's library, keyed by name with the
+	// token they connect with. Their requests count as that user for the
+	// access rules.
+	Peers map[string]string `json:"peers"`
+
+	// Secret remote transcoding workers connect with. Without one, workers
+	// are turned away.
+	WorkerSecret string `json:"workerSecret"`
+}
+
+// currentConfig is replaced whole when the file is reloaded, so requests
+// see either the old settings or the new ones
+var currentConfig atomic.Pointer[Config]
+
+func init() {
+	currentConfig.Store(&Config{Tasks: map[string]string{}})
+}
+
+// config is the config in use. Anything reading several settings that
+// belong together should call it once and keep the result.
+func config() *Config {
+	return currentConfig.Load()
+}
+
+// readConfig parses a config file, "" being one with nothing in it
+func readConfig(path string) (*Config, error) {
+	c := &Config{Tasks: map[string]string{}}
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func loadConfig(path string) error {
+	c, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	currentConfig.Store(c)
+	return nil
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"video-browser/stromboli/internal/library"
+)
+
+// Credits detection settings, in seconds
+const (
+	creditsSearchWindow = 480 // How far from the end to look
+	minCreditsLength    = 15
+	creditsCutSlack     = 1.5 // How far the sound dropping out may be from the picture going black
+)
+
+// Lines blackdetect and silencedetect write to ffmpeg's output
+var (
+	blackPattern        = regexp.MustCompile(`black_start:\s*([\d.]+)\s+black_end:\s*([\d.]+)`)
+	silenceStartPattern = regexp.MustCompile(`silence_start:\s*(-?[\d.]+)`)
+	silenceEndPattern   = regexp.MustCompile(`silence_end:\s*([\d.]+)`)
+	cueTimePattern      = regexp.MustCompile(`-->\s*(?:(\d+):)?(\d{2}):(\d{2})\.(\d{3})`)
+)
+
+// span is a stretch of a file, in seconds from its start
+type span struct {
+	start, end float64
+}
+
+// findCreditsStart works out where an episode's end credits begin, and
+// reports false if nothing near the end looks like them
+func findCreditsStart(ctx context.Context, path string) (float64, bool) {
+	fullPath := filepath.Join(rootDir, filepath.FromSlash(path))
+	probe, err := probeFile(ctx, fullPath)
+	if err != nil {
+		return 0, false
+	}
+	duration, _ := strconv.ParseFloat(probe.Format.Duration, 64)
+	if duration < 2*minCreditsLength {
+		return 0, false
+	}
+	from := max(0, duration-creditsSearchWindow)
+	black, silence, err := detectCuts(ctx, fullPath, from)
+	if err != nil {
+		return 0, false
+	}
+	return creditsCut(black, silence, lastSubtitleEnd(ctx, path, probe), duration)
+}
+
+// creditsCut picks the start of the credits: the first cut to black with
+// the sound dropping out at the same time, which credits starting over
+// music don't have between their cards. With subtitles it has to come
+// after the last line of dialogue, and the end of that line stands in when
+// there's no such cut.
+func creditsCut(black []span, silence []span, lastLine float64, duration float64) (float64, bool) {
+	fits := func(t float64) bool {
+		return t >= lastLine-creditsCutSlack && duration-t >= minCreditsLength && duration-t <= creditsSearchWindow
+	}
+	for _, b := range black {
+		if !fits(b.start) {
+			continue
+		}
+		for _, s := range silence {
+			if s.start <= b.end+creditsCutSlack && s.end >= b.start-creditsCutSlack {
+				return b.start, true
+			}
+		}
+	}
+	if lastLine > 0 && fits(lastLine) {
+		return lastLine, true
+	}
+	return 0, false
+}
+
+// detectCuts runs ffmpeg over the end of a file from the given point,
+// listing where the picture goes black and where the sound goes quiet
+func detectCuts(ctx context.Context, fullPath string, from float64) ([]span, []span, error) {
+	args := []string{"-ss", strconv.FormatFloat(from, 'f', 3, 64)}
+	args = append(args, inputFile(fullPath)...)
+	args = append(args,
+		"-vf", "blackdetect=d=0.3:pix_th=0.10",
+		"-af", "silencedetect=noise=-40dB:d=0.5",
+		"-f", "null", "-",
+	)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, nil, err
+	}
+
+	// Seeking before the input starts its timestamps from zero
+	var black, silence []span
+	for _, match := range blackPattern.FindAllStringSubmatch(stderr.String(), -1) {
+		start, _ := strconv.ParseFloat(match[1], 64)
+		end, _ := strconv.ParseFloat(match[2], 64)
+		black = append(black, span{from + start, from + end})
+	}
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if match := silenceStartPattern.FindStringSubmatch(line); match != nil {
+			start, _ := strconv.ParseFloat(match[1], 64)
+			silence = append(silence, span{from + max(0, start), -1})
+		} else if match := silenceEndPattern.FindStringSubmatch(line); match != nil && len(silence) > 0 {
+			end, _ := strconv.ParseFloat(match[1], 64)
+			silence[len(silence)-1].end = from + end
+		}
+	}
+	// Silence running to the end of the file has no end line
+	if n := len(silence); n > 0 && silence[n-1].end < 0 {
+		silence[n-1].end = from + creditsSearchWindow
+	}
+	return black, silence, nil
+}
+
+// lastSubtitleEnd is when the last subtitle of a video goes off screen,
+// from its sidecar subtitles or else its first embedded text subtitles, or
+// 0 if it has neither
+func lastSubtitleEnd(ctx context.Context, path string, probe *library.ProbeResult) float64 {
+	fullPath := filepath.Join(rootDir, filepath.FromSlash(path))
+	var args []string
+	if entries, err := os.ReadDir(filepath.Dir(fullPath)); err == nil {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if tracks := sidecarTracks(filepath.Base(fullPath), names, subtitleFormats); len(tracks) > 0 {
+			args = []string{"-i", filepath.Join(filepath.Dir(fullPath), tracks[0].Name)}
+		}
+	}
+	if args == nil {
+		for i, s := range probe.StreamsOfType("subtitle") {
+			switch s.CodecName {
+			case "subrip", "ass", "ssa", "webvtt", "mov_text", "text":
+				args = append(inputFile(fullPath), "-map", "0:s:"+strconv.Itoa(i))
+			}
+			if args != nil {
+				break
+			}
+		}
+	}
+	if args == nil {
+		return 0
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", append(args, "-f", "webvtt", "-loglevel", "error", "pipe:1")...)
+	output, err := cmd.Output()
+	if err != nil {
+		return 0
+	}
+	last := 0.0
+	for _, match := range cueTimePattern.FindAllStringSubmatch(string(output), -1) {
+		hours, _ := strconv.Atoi(match[1])
+		minutes, _ := strconv.Atoi(match[2])
+		seconds, _ := strconv.Atoi(match[3])
+		millis, _ := strconv.Atoi(match[4])
+		last = max(last, float64(hours*3600+minutes*60+seconds)+float64(millis)/1000)
+	}
+	return last
+}
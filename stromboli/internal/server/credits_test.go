@@ -0,0 +1,30 @@
+package server
+
+import "testing"
+
+func TestCreditsCut(t *testing.T) {
+	// A 45 minute episode: a scene change with its sound carrying on, the
+	// cut to the credits, then the credit cards going black over music
+	black := []span{{2400, 2400.5}, {2580, 2581}, {2620, 2620.4}, {2650, 2650.4}}
+	silence := []span{{2579.5, 2582}}
+	tests := []struct {
+		name     string
+		black    []span
+		silence  []span
+		lastLine float64
+		want     float64
+		ok       bool
+	}{
+		{"cut with silence", black, silence, 0, 2580, true},
+		{"after the last line", black, append([]span{{2399, 2401}}, silence...), 2500, 2580, true},
+		{"last line without a cut", black, nil, 2590, 2590, true},
+		{"too close to the end", []span{{2690, 2691}}, []span{{2690, 2692}}, 0, 0, false},
+		{"nothing found", black, nil, 0, 0, false},
+	}
+	for _, test := range tests {
+		got, ok := creditsCut(test.black, test.silence, test.lastLine, 2700)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%s: creditsCut = %v, %v, want %v, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// Cookie the settings toggle sets, "1" for on and "0" for off, overriding
+// the browser's Save-Data hint either way
+const dataSaverCookie = "dataSaver"
+
+// Width of thumbnails sent with data saver on
+const dataSaverThumbnailWidth = 160
+
+// dataSaver reports whether a request's browser wants to save data. The
+// whole session then streams at the lowest quality, transcodes rather than
+// sends files as they are, gets smaller thumbnails and doesn't autoplay.
+func dataSaver(r *http.Request) bool {
+	if cookie, err := r.Cookie(dataSaverCookie); err == nil && (cookie.Value == "1" || cookie.Value == "0") {
+		return cookie.Value == "1"
+	}
+	return strings.EqualFold(strings.TrimSpace(r.Header.Get("Save-Data")), "on")
+}
+
+// dataSaverProfile is the lowest quality profile
+func dataSaverProfile() transcode.Profile {
+	return transcode.Profiles[len(transcode.Profiles)-1]
+}
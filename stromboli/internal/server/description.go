@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Files that describe a folder, in order of preference
+var descriptionFiles = []string{"README.md", "readme.md", "description.txt"}
+
+// Descriptions larger than this are ignored rather than rendered
+const maxDescriptionSize = 256 << 10
+
+type folderDescription struct {
+	Source string `json:"source"`
+	HTML   string `json:"html"`
+}
+
+// renderPlainText turns a text file into paragraphs, keeping line breaks
+func renderPlainText(text string) string {
+	var out strings.Builder
+	for _, block := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		block = strings.TrimSpace(block)
+		if block == "" {
+			continue
+		}
+		out.WriteString("<p>" + strings.ReplaceAll(html.EscapeString(block), "\n", "<br>") + "</p>\n")
+	}
+	return out.String()
+}
+
+// handleDescription renders a folder's README.md or description.txt, or
+// returns 204 when it has neither
+func handleDescription(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	for _, name := range descriptionFiles {
+		info, err := os.Stat(filepath.Join(fullPath, name))
+		if err != nil || info.IsDir() || info.Size() > maxDescriptionSize {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(fullPath, name))
+		if err != nil {
+			continue
+		}
+
+		description := folderDescription{Source: name}
+		if strings.HasSuffix(strings.ToLower(name), ".md") {
+			description.HTML = renderMarkdown(string(data))
+		} else {
+			description.HTML = renderPlainText(string(data))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(description)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// requestDeviceProfile is the device profile the user picked, or the one
+// their user agent suggests
+func requestDeviceProfile(r *http.Request) transcode.Device {
+	device, ok := transcode.FindDevice(getPreferences(requestUser(r)).DeviceProfile)
+	if !ok {
+		device = transcode.DetectDevice(r.UserAgent())
+	}
+	device.DataSaver = dataSaver(r)
+	return device
+}
+
+// Resolutions and frame rates a player can cap its transcodes at
+var (
+	heightLimits    = []int{2160, 1440, 1080, 720, 480}
+	frameRateLimits = []int{60, 30, 25, 24}
+)
+
+// requestLimits reads the caps a request asks for, 0 where it doesn't
+// ask. Only the listed values are taken, so every player asking for 720p
+// shares its warmed up starts.
+func requestLimits(r *http.Request) (int, int, error) {
+	var maxHeight, maxFrameRate int
+	if s := r.URL.Query().Get("maxHeight"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || !slices.Contains(heightLimits, n) {
+			return 0, 0, errors.New("Unsupported maxHeight")
+		}
+		maxHeight = n
+	}
+	if s := r.URL.Query().Get("maxFrameRate"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || !slices.Contains(frameRateLimits, n) {
+			return 0, 0, errors.New("Unsupported maxFrameRate")
+		}
+		maxFrameRate = n
+	}
+	return maxHeight, maxFrameRate, nil
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"video-browser/stromboli/internal/library"
+)
+
+// Kinds of disc backup that play as a single video
+const (
+	discDVD    = "dvd"
+	discBluray = "bluray"
+)
+
+// DVDs rarely have more titles than this worth considering for the main one
+const maxDVDTitles = 30
+
+var (
+	discMutex sync.Mutex
+	isoKinds  = map[string]string{} // Keyed by path, size and modification time
+	dvdTitles = map[string]int{}
+)
+
+// discType reports whether a path is a DVD or Blu-ray backup: an ISO image,
+// a VIDEO_TS or BDMV folder, or a folder holding one of those
+func discType(fullPath string) string {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return ""
+	}
+
+	if !info.IsDir() {
+		if strings.ToLower(filepath.Ext(fullPath)) != ".iso" {
+			return ""
+		}
+		return isoKind(fullPath, info)
+	}
+
+	switch strings.ToUpper(filepath.Base(fullPath)) {
+	case "VIDEO_TS":
+		return discDVD
+	case "BDMV":
+		return discBluray
+	}
+	if fileExists(filepath.Join(fullPath, "VIDEO_TS", "VIDEO_TS.IFO")) {
+		return discDVD
+	}
+	if fileExists(filepath.Join(fullPath, "BDMV", "index.bdmv")) {
+		return discBluray
+	}
+	return ""
+}
+
+// isoKind tells DVD images from Blu-ray ones by the folder names near the
+// start of the image, assuming DVD when neither turns up
+func isoKind(fullPath string, info os.FileInfo) string {
+	key := fmt.Sprintf("%s|%d|%d", fullPath, info.Size(), info.ModTime().UnixNano())
+
+	discMutex.Lock()
+	kind, ok := isoKinds[key]
+	discMutex.Unlock()
+	if ok {
+		return kind
+	}
+
+	kind = discDVD
+	if f, err := os.Open(fullPath); err == nil {
+		head := make([]byte, 4<<20)
+		n, _ := io.ReadFull(f, head)
+		f.Close()
+		if bytes.Contains(head[:n], []byte("BDMV")) && !bytes.Contains(head[:n], []byte("VIDEO_TS")) {
+			kind = discBluray
+		}
+	}
+
+	discMutex.Lock()
+	isoKinds[key] = kind
+	discMutex.Unlock()
+	return kind
+}
+
+// dvdMainTitle finds the longest title on a DVD, which is almost always the
+// feature rather than menus, trailers or extras
+func dvdMainTitle(fullPath string) int {
+	discMutex.Lock()
+	title, ok := dvdTitles[fullPath]
+	discMutex.Unlock()
+	if ok {
+		return title
+	}
+
+	title = 1
+	longest := 0.0
+	for n := 1; n <= maxDVDTitles; n++ {
+		output, err := library.ProbeOutput(context.Background(), "ffprobe",
+			"-v", "error",
+			"-f", "dvdvideo",
+			"-title", strconv.Itoa(n),
+			"-show_entries", "format=duration",
+			"-of", "json",
+			"-i", fullPath,
+		)
+		if err != nil {
+			// Titles are numbered consecutively, so the first gap is the end
+			break
+		}
+
+		var result library.ProbeResult
+		if json.Unmarshal(output, &result) != nil {
+			continue
+		}
+		if duration, _ := strconv.ParseFloat(result.Format.Duration, 64); duration > longest {
+			title, longest = n, duration
+		}
+	}
+
+	discMutex.Lock()
+	dvdTitles[fullPath] = title
+	discMutex.Unlock()
+	return title
+}
+
+// discInput returns the ffmpeg arguments that open a disc's main title
+func discInput(fullPath string, kind string) []string {
+	if kind == discBluray {
+		// libbluray wants the disc root, above BDMV
+		if strings.ToUpper(filepath.Base(fullPath)) == "BDMV" {
+			fullPath = filepath.Dir(fullPath)
+		}
+		// With no playlist chosen the longest is played
+		return []string{"-i", "bluray:" + fullPath}
+	}
+	return []string{"-f", "dvdvideo", "-title", strconv.Itoa(dvdMainTitle(fullPath)), "-i", fullPath}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Documents opened in the document viewer. PDFs use the browser's own
+// viewer, EPUBs are shown a chapter at a time straight out of the archive.
+var documentFormats = map[string]bool{
+	".pdf":  true,
+	".epub": true,
+}
+
+// Page counts are only looked for this far into a PDF, as the page tree
+// usually comes early and reading a huge scan through would be slow
+const pdfScanLimit = 16 << 20
+
+// The /Count of the root page tree is the largest one in the file
+var pdfCountPattern = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+
+// pdfPageCount finds how many pages a PDF has, or 0 when the page tree is
+// compressed out of reach
+func pdfPageCount(fullPath string) int {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, pdfScanLimit))
+	if err != nil {
+		return 0
+	}
+	pages := 0
+	for _, match := range pdfCountPattern.FindAllSubmatch(data, -1) {
+		count := match[1]
+		if count == nil {
+			count = match[2]
+		}
+		if n, err := strconv.Atoi(string(count)); err == nil && n > pages {
+			pages = n
+		}
+	}
+	return pages
+}
+
+// epubBook is what the viewer needs from an EPUB's package file: its title
+// and the chapters in reading order, as paths inside the archive
+type epubBook struct {
+	Title    string
+	Chapters []string
+}
+
+// readEpub finds the package file through the container and reads its spine
+func readEpub(archive *zip.Reader) (epubBook, error) {
+	var book epubBook
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := readZipXML(archive, "META-INF/container.xml", &container); err != nil {
+		return book, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return book, os.ErrNotExist
+	}
+	opfPath := container.Rootfiles[0].FullPath
+
+	var opf struct {
+		Title    string `xml:"metadata>title"`
+		Manifest []struct {
+			ID   string `xml:"id,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"manifest>item"`
+		Spine []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"spine>itemref"`
+	}
+	if err := readZipXML(archive, opfPath, &opf); err != nil {
+		return book, err
+	}
+
+	hrefs := map[string]string{}
+	for _, item := range opf.Manifest {
+		hrefs[item.ID] = item.Href
+	}
+	book.Title = strings.TrimSpace(opf.Title)
+	for _, item := range opf.Spine {
+		href := hrefs[item.IDRef]
+		if unescaped, err := url.PathUnescape(href); err == nil {
+			href = unescaped
+		}
+		if href != "" {
+			book.Chapters = append(book.Chapters, path.Join(path.Dir(opfPath), href))
+		}
+	}
+	return book, nil
+}
+
+func readZipXML(archive *zip.Reader, name string, v interface{}) error {
+	file, err := archive.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return xml.NewDecoder(file).Decode(v)
+}
+
+// epubURL is where a file inside an EPUB is served, keeping the archive's
+// folders so the chapters' relative links to images and styles work
+func epubURL(bookPath string, name string) string {
+	return "/api/epub/" + (&url.URL{Path: bookPath + "!/" + name}).EscapedPath()
+}
+
+// handleDocument describes a PDF or EPUB for the viewer (GET /api/document?path=)
+func handleDocument(w http.ResponseWriter, r *http.Request) {
+	// Security check: paths can't leave the root
+	docPath, fullPath, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	if !ok || !documentFormats[ext] {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if !fileExists(fullPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	result := map[string]interface{}{}
+	if ext == ".pdf" {
+		result["type"] = "pdf"
+		result["url"] = fileURL(r, docPath)
+		result["pages"] = pdfPageCount(fullPath)
+	} else {
+		archive, err := zip.OpenReader(fullPath)
+		if err != nil {
+			http.Error(w, "Cannot read book", http.StatusInternalServerError)
+			return
+		}
+		defer archive.Close()
+		book, err := readEpub(&archive.Reader)
+		if err != nil || len(book.Chapters) == 0 {
+			log.Printf("Error reading EPUB %s: %v", docPath, err)
+			http.Error(w, "Cannot read book", http.StatusInternalServerError)
+			return
+		}
+		chapters := make([]string, len(book.Chapters))
+		for i, chapter := range book.Chapters {
+			chapters[i] = epubURL(docPath, chapter)
+		}
+		result["type"] = "epub"
+		result["title"] = book.Title
+		result["chapters"] = chapters
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleEpub serves a file from inside an EPUB (GET /api/epub/{book}!/{file}).
+// Books are someone else's HTML, so their scripts aren't run.
+func handleEpub(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/epub/")
+	split := strings.Index(strings.ToLower(rest), ".epub!/")
+	if split < 0 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	bookPath, name := rest[:split+len(".epub")], rest[split+len(".epub!/"):]
+
+	// Security check: paths can't leave the root
+	_, fullPath, ok := resolveRequestPath(r, bookPath)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	archive, err := zip.OpenReader(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer archive.Close()
+
+	file, err := archive.Open(path.Clean(name))
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Cannot read book", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Security-Policy", "script-src 'none'; object-src 'none'")
+	w.Header().Set("Cache-Control", "max-age=86400")
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
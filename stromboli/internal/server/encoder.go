@@ -0,0 +1,11 @@
+package server
+
+import (
+	"video-browser/stromboli/internal/transcode"
+)
+
+// setupEncoderRules puts the config's encoder rules in use, or the built-in
+// ones if it has none
+func setupEncoderRules(c *Config) error {
+	return transcode.SetEncoderRules(c.EncoderRules)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bootID changes every time the server starts, so clients can tell a
+// restart apart from a dropped connection
+var bootID = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+type serverEvent struct {
+	Name string
+	Data []byte
+}
+
+// Clients listening on /api/events
+var (
+	eventsMutex  sync.Mutex
+	eventClients = map[chan serverEvent]bool{}
+)
+
+// publishEvent sends an event to every connected client. Clients that
+// aren't keeping up miss it rather than holding up everyone else.
+func publishEvent(name string, data interface{}) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	event := serverEvent{Name: name, Data: encoded}
+
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	for client := range eventClients {
+		select {
+		case client <- event:
+		default:
+		}
+	}
+}
+
+// handleEvents is a server-sent events channel pushing updates to the UI.
+// Browsers reconnect on their own when it drops, and the hello event each
+// connection starts with carries the boot ID.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	client := make(chan serverEvent, 16)
+	eventsMutex.Lock()
+	eventClients[client] = true
+	eventsMutex.Unlock()
+	defer func() {
+		eventsMutex.Lock()
+		delete(eventClients, client)
+		eventsMutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx holding events back
+
+	hello, _ := json.Marshal(map[string]string{"boot": bootID})
+	fmt.Fprintf(w, "event: hello\ndata: %s\n\n", hello)
+	flusher.Flush()
+
+	// Comments keep proxies from timing out an idle connection
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-client:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name, event.Data)
+			flusher.Flush()
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// exportManifest is the archive entry describing the export
+const exportManifest = "stromboli-export.json"
+
+// Largest archive POST /api/import takes
+const maxImportSize = 512 << 20
+
+// stateFile is a data directory file that's part of the server's state,
+// with how to load it again into a running server
+type stateFile struct {
+	name   string
+	reload func()
+}
+
+// stateFiles are what an export holds: preferences, the watch history,
+// markers, ratings and tags, collections and smart playlists, the trash,
+// the library index and its logs, accounts and invites, and the key stream
+// links are signed with. Caches and the sessions in flight are left out.
+var stateFiles = []stateFile{
+	{preferencesFile, func() {
+		preferencesMutex.Lock()
+		userPreferences = map[string]preferences{}
+		preferencesMutex.Unlock()
+		loadPreferences()
+	}},
+	{historyFile, func() {
+		historyMutex.Lock()
+		history = map[string]map[string]*watchEntry{}
+		historyMutex.Unlock()
+		loadHistory()
+	}},
+	{markersFile, func() {
+		markersMutex.Lock()
+		markers = map[string]*introMarker{}
+		markersMutex.Unlock()
+		loadMarkers()
+	}},
+	{labelsFile, func() {
+		labelsMutex.Lock()
+		labels = map[string]*itemLabels{}
+		labelsMutex.Unlock()
+		loadLabels()
+	}},
+	{collectionsFile, func() {
+		collectionsMutex.Lock()
+		collections = map[string]*collection{}
+		collectionsMutex.Unlock()
+		loadCollections()
+	}},
+	{trashFile, func() {
+		trashMutex.Lock()
+		trash = trashState{}
+		trashMutex.Unlock()
+		loadTrash()
+	}},
+	{indexFile, func() {
+		libraryMutex.Lock()
+		libraryIndex = map[string]*indexEntry{}
+		libraryMutex.Unlock()
+		loadLibrary()
+		aggregateStats()
+	}},
+	{failuresFile, func() {
+		failuresMutex.Lock()
+		failures = map[string]*transcodeFailure{}
+		failuresMutex.Unlock()
+		loadFailures()
+	}},
+	{clientErrorsFile, func() {
+		clientErrorsMutex.Lock()
+		clientErrorFiles = map[string]*clientErrors{}
+		clientErrorsMutex.Unlock()
+		loadClientErrors()
+	}},
+	{organizeFile, func() {
+		organizeMutex.Lock()
+		organizeMoves = []organizeMove{}
+		organizeMutex.Unlock()
+		loadOrganizeMoves()
+	}},
+	{accountsFile, reloadAccounts},
+	{invitesFile, reloadAccounts},
+	{tokenKeyFile, func() {
+		if err := loadTokenKey(); err != nil {
+			log.Printf("Error loading stream token key: %v", err)
+		}
+	}},
+}
+
+// writeExport writes the state files there are in the data directory to a
+// zip archive
+func writeExport(w io.Writer) error {
+	archive := zip.NewWriter(w)
+	manifest, err := json.Marshal(map[string]interface{}{"version": version, "exported": time.Now()})
+	if err != nil {
+		return err
+	}
+	entry, err := archive.Create(exportManifest)
+	if err != nil {
+		return err
+	}
+	if _, err := entry.Write(manifest); err != nil {
+		return err
+	}
+
+	for _, file := range stateFiles {
+		data, err := os.ReadFile(filepath.Join(dataDir, file.name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		entry, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err := entry.Write(data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// readImport writes the state files in an export into the data directory,
+// replacing those there, and returns the ones it wrote. Anything else in
+// the archive is ignored. Nothing is written unless the whole archive reads.
+func readImport(r io.ReaderAt, size int64) ([]stateFile, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := map[string][]byte{}
+	manifest := false
+	for _, entry := range archive.File {
+		if entry.Name == exportManifest {
+			manifest = true
+			continue
+		}
+		for _, file := range stateFiles {
+			if entry.Name != file.name {
+				continue
+			}
+			reader, err := entry.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", entry.Name, err)
+			}
+			if file.name != tokenKeyFile && !json.Valid(data) {
+				return nil, fmt.Errorf("%s isn't valid JSON", entry.Name)
+			}
+			contents[file.name] = data
+		}
+	}
+	if !manifest {
+		return nil, errors.New("not a Stromboli export")
+	}
+
+	var written []stateFile
+	for _, file := range stateFiles {
+		data, ok := contents[file.name]
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dataDir, file.name)
+		if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+			return written, err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return written, err
+		}
+		written = append(written, file)
+	}
+	return written, nil
+}
+
+// handleExport downloads the server's state as a zip archive
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := writeExport(&buf); err != nil {
+		log.Printf("Cannot export state: %v", err)
+		http.Error(w, "Cannot export", http.StatusInternalServerError)
+		return
+	}
+	name := "stromboli-" + time.Now().Format("2006-01-02") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Write(buf.Bytes())
+}
+
+// handleImport replaces the server's state with an export POSTed to it,
+// loading it in straight away
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, "Archive too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	written, err := readImport(bytes.NewReader(data), int64(len(data)))
+	for _, file := range written {
+		file.reload()
+	}
+	if err != nil {
+		log.Printf("Cannot import state: %v", err)
+		http.Error(w, "Cannot import: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	names := []string{}
+	for _, file := range written {
+		names = append(names, file.name)
+	}
+	log.Printf("Imported %d state files", len(names))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+// runExportCommand writes the state in a data directory to an archive
+func runExportCommand(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.StringVar(&dataDir, "data", defaultDataDir(), "Directory the state is stored in")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: stromboli export [-data dir] file.zip")
+		fmt.Fprintln(fs.Output(), "Saves watch history, preferences, collections and the rest of the server's state to an archive.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	out, err := os.Create(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeExport(out); err != nil {
+		log.Fatal("Cannot export: ", err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Exported %s to %s\n", dataDir, fs.Arg(0))
+}
+
+// runImportCommand replaces the state in a data directory with an export.
+// The server should be stopped, or it will write over it.
+func runImportCommand(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.StringVar(&dataDir, "data", defaultDataDir(), "Directory to store the state in")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: stromboli import [-data dir] file.zip")
+		fmt.Fprintln(fs.Output(), "Replaces the server's state with an export. Stop the server first.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		log.Fatal("Cannot create data directory:", err)
+	}
+	archive, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer archive.Close()
+	info, err := archive.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	written, err := readImport(archive, info.Size())
+	if err != nil {
+		log.Fatal("Cannot import: ", err)
+	}
+	for _, file := range written {
+		fmt.Printf("Imported %s\n", file.name)
+	}
+}
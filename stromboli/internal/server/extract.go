@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// audioFormat is a format audio can be extracted to
+type audioFormat struct {
+	Extension string
+	Args      []string
+}
+
+var audioExtractFormats = map[string]audioFormat{
+	"mp3":  {Extension: ".mp3", Args: []string{"-c:a", "libmp3lame", "-q:a", "2", "-f", "mp3"}},
+	"aac":  {Extension: ".m4a", Args: []string{"-c:a", "aac", "-b:a", "192k", "-f", "ipod"}},
+	"flac": {Extension: ".flac", Args: []string{"-c:a", "flac", "-f", "flac"}},
+}
+
+// Extractions are quick but still take turns
+var extractSlots = make(chan struct{}, 1)
+
+// extractJob rips the audio of a video to a file of its own
+type extractJob struct {
+	mu       sync.Mutex
+	ID       string
+	Path     string
+	Format   string
+	State    string
+	Progress float64
+	Error    string
+	Size     int64
+	output   string
+}
+
+type extractStatus struct {
+	ID       string  `json:"id"`
+	Path     string  `json:"path"`
+	Format   string  `json:"format"`
+	State    string  `json:"state"`
+	Progress float64 `json:"progress"`
+	Error    string  `json:"error,omitempty"`
+	Size     int64   `json:"size,omitempty"`
+}
+
+var (
+	extractMutex sync.Mutex
+	extractJobs  = map[string]*extractJob{}
+)
+
+func extractDir() string {
+	return filepath.Join(dataDir, "audio")
+}
+
+func extractJobID(fullPath string, info os.FileInfo, format string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%s", fullPath, info.ModTime().UnixNano(), format)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (j *extractJob) snapshot() extractStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return extractStatus{ID: j.ID, Path: j.Path, Format: j.Format, State: j.State, Progress: j.Progress, Error: j.Error, Size: j.Size}
+}
+
+func (j *extractJob) set(state string, errMsg string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.State = state
+	j.Error = errMsg
+}
+
+func (j *extractJob) run(fullPath string) {
+	extractSlots <- struct{}{}
+	defer func() { <-extractSlots }()
+
+	j.set(jobRunning, "")
+	log.Printf("Extracting %s audio from %s", j.Format, j.Path)
+
+	probe, err := probeFile(context.Background(), fullPath)
+	if err != nil {
+		log.Printf("Error probing %s, assuming first audio stream: %v", j.Path, err)
+	}
+	audioMap := "0:a:0"
+	var duration float64
+	if probe != nil {
+		audio := probe.MainAudioStream()
+		if audio == nil {
+			j.set(jobFailed, "The video has no audio")
+			return
+		}
+		audioMap = "0:" + strconv.Itoa(audio.Index)
+		duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	}
+
+	if err := os.MkdirAll(extractDir(), 0755); err != nil {
+		j.set(jobFailed, "Cannot create audio directory")
+		return
+	}
+
+	tmp := j.output + ".tmp"
+	args := append(inputFile(fullPath), "-map", audioMap, "-vn")
+	args = append(args, audioExtractFormats[j.Format].Args...)
+	args = append(args,
+		"-progress", "pipe:1",
+		"-nostats",
+		"-loglevel", "error",
+		"-y", tmp,
+	)
+
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr tailBuffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		j.set(jobFailed, "Extraction error")
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		j.set(jobFailed, classifyStartError(err).Message)
+		return
+	}
+
+	readProgress(stdout, duration, func(progress float64) {
+		j.mu.Lock()
+		j.Progress = progress
+		j.mu.Unlock()
+	})
+
+	if err := cmd.Wait(); err != nil {
+		os.Remove(tmp)
+		log.Printf("Audio extraction from %s failed: %v", j.Path, err)
+		j.set(jobFailed, classifyFFmpegError(stderr.String()).Message)
+		return
+	}
+
+	if err := os.Rename(tmp, j.output); err != nil {
+		j.set(jobFailed, "Cannot save audio")
+		return
+	}
+
+	j.mu.Lock()
+	j.State = jobDone
+	j.Progress = 1
+	if info, err := os.Stat(j.output); err == nil {
+		j.Size = info.Size()
+	}
+	j.mu.Unlock()
+	log.Printf("Audio from %s ready", j.Path)
+}
+
+// handleExtractAudio serves /api/extract-audio/{path}?format=mp3|aac|flac.
+// POST starts extracting (or returns the existing job), GET reports progress
+// and GET with download=1 fetches the finished file.
+func handleExtractAudio(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/extract-audio/")
+
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() && discType(fullPath) == "" {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = "mp3"
+	}
+	format, ok := audioExtractFormats[formatName]
+	if !ok {
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+		return
+	}
+
+	id := extractJobID(fullPath, info, formatName)
+	output := filepath.Join(extractDir(), id+format.Extension)
+
+	extractMutex.Lock()
+	job := extractJobs[id]
+	if r.Method == http.MethodPost && (job == nil || job.snapshot().State == jobFailed) {
+		job = &extractJob{ID: id, Path: path, Format: formatName, State: jobQueued, output: output}
+
+		if existing, err := os.Stat(output); err == nil {
+			job.State = jobDone
+			job.Progress = 1
+			job.Size = existing.Size()
+		} else {
+			go job.run(fullPath)
+		}
+		extractJobs[id] = job
+	}
+	extractMutex.Unlock()
+
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet && r.URL.Query().Get("download") == "1" {
+		if job.snapshot().State != jobDone {
+			http.Error(w, "Audio not ready", http.StatusConflict)
+			return
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) + format.Extension
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		http.ServeFile(w, r, output)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.snapshot())
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const failuresFile = "failures.json"
+
+// Failures kept, dropping the oldest, so a broken drive can't grow the file forever
+const maxFailures = 500
+
+// Lines of ffmpeg output kept with each failure
+const failureStderrLines = 20
+
+// retryOptions change how a transcode runs, to get past what made it fail
+type retryOptions struct {
+	Software    bool // Plain ffmpeg, without the file type's commands or input options and without copying streams
+	Tolerant    bool // Carry on past damaged packets rather than stopping
+	NoAudio     bool // Leave out audio that won't decode
+	NoSubtitles bool // Don't burn in subtitles
+}
+
+// Names of the retry options in the retry= parameter
+const (
+	retrySoftware    = "software"
+	retryTolerant    = "tolerant"
+	retryNoAudio     = "noaudio"
+	retryNoSubtitles = "nosubtitles"
+)
+
+// parseRetry reads a comma-separated list of retry options
+func parseRetry(s string) (retryOptions, error) {
+	var retry retryOptions
+	if s == "" {
+		return retry, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		switch name {
+		case retrySoftware:
+			retry.Software = true
+		case retryTolerant:
+			retry.Tolerant = true
+		case retryNoAudio:
+			retry.NoAudio = true
+		case retryNoSubtitles:
+			retry.NoSubtitles = true
+		default:
+			return retry, fmt.Errorf("Unknown retry option %q", name)
+		}
+	}
+	return retry, nil
+}
+
+func (r retryOptions) String() string {
+	var names []string
+	for _, option := range []struct {
+		set  bool
+		name string
+	}{
+		{r.Software, retrySoftware},
+		{r.Tolerant, retryTolerant},
+		{r.NoAudio, retryNoAudio},
+		{r.NoSubtitles, retryNoSubtitles},
+	} {
+		if option.set {
+			names = append(names, option.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Retry options worth trying for each kind of failure, most likely first.
+// Missing files and permissions need fixing on the server instead.
+var suggestedRetries = map[string][]string{
+	"corrupt_file":      {retryTolerant},
+	"no_audio":          {retryNoAudio},
+	"unsupported_codec": {retrySoftware, retryNoAudio},
+	"transcode_failed":  {retrySoftware, retryNoSubtitles, retryTolerant},
+}
+
+// transcodeFailure is the last failed transcode of a file
+type transcodeFailure struct {
+	Path    string    `json:"path"`
+	Code    string    `json:"code"`
+	Message string    `json:"message"`
+	Profile string    `json:"profile"`
+	Retry   string    `json:"retry,omitempty"` // Options the failed attempt ran with
+	Count   int       `json:"count"`           // Failures since the file last played
+	Time    time.Time `json:"time"`
+	Stderr  []string  `json:"stderr,omitempty"` // The end of ffmpeg's output
+}
+
+var (
+	failuresMutex sync.Mutex
+	failures      = map[string]*transcodeFailure{}
+)
+
+func loadFailures() {
+	failuresMutex.Lock()
+	defer failuresMutex.Unlock()
+	if err := loadJSON(failuresFile, &failures); err != nil {
+		log.Printf("Error loading transcode failures: %v", err)
+	}
+}
+
+// saveFailures writes the failures to disk and tells pages how many there
+// are. Callers must hold failuresMutex.
+func saveFailures() {
+	if err := saveJSON(failuresFile, failures); err != nil {
+		log.Printf("Error saving transcode failures: %v", err)
+	}
+	publishEvent("failures", len(failures))
+}
+
+// recordFailure notes a failed transcode, with the last lines ffmpeg wrote.
+// A missing ffmpeg fails every file alike, so it isn't held against any of
+// them.
+func recordFailure(path string, streamErr *streamError, profile string, retry retryOptions, stderr []string) {
+	if streamErr.Code == "ffmpeg_missing" {
+		return
+	}
+	failuresMutex.Lock()
+	defer failuresMutex.Unlock()
+	failure := failures[path]
+	if failure == nil {
+		failure = &transcodeFailure{Path: path}
+		failures[path] = failure
+	}
+	failure.Code = streamErr.Code
+	failure.Message = streamErr.Message
+	failure.Profile = profile
+	failure.Retry = retry.String()
+	failure.Count++
+	failure.Time = time.Now()
+	failure.Stderr = stderr[max(len(stderr)-failureStderrLines, 0):]
+
+	if len(failures) > maxFailures {
+		oldest := path
+		for p, f := range failures {
+			if f.Time.Before(failures[oldest].Time) {
+				oldest = p
+			}
+		}
+		delete(failures, oldest)
+	}
+	saveFailures()
+}
+
+// clearFailure forgets a file's failure once it has played
+func clearFailure(path string) {
+	failuresMutex.Lock()
+	defer failuresMutex.Unlock()
+	if _, ok := failures[path]; ok {
+		delete(failures, path)
+		saveFailures()
+	}
+}
+
+// handleFailures lists failed transcodes, newest first, with the retry
+// options worth trying (GET /api/failures), or dismisses one
+// (DELETE /api/failures?path=)
+func handleFailures(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		path, _, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+		if !ok {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		clearFailure(path)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type failureInfo struct {
+		transcodeFailure
+		Suggested []string `json:"suggested,omitempty"`
+	}
+	failuresMutex.Lock()
+	list := make([]failureInfo, 0, len(failures))
+	for _, failure := range failures {
+		if !canAccess(r, failure.Path) {
+			continue
+		}
+		list = append(list, failureInfo{*failure, suggestedRetries[failure.Code]})
+	}
+	failuresMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
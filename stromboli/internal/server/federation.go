@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteLibrary is another Stromboli server whose library is listed here as
+// a top-level folder, with requests for its files passed on to it
+type remoteLibrary struct {
+	URL   string `json:"url"`
+	Token string `json:"token"` // One of the other server's peers tokens
+
+	// Send players straight to the other server for videos and streams
+	// rather than passing them through this one, for servers the browser
+	// can reach itself
+	Redirect bool `json:"redirect"`
+
+	base *url.URL
+}
+
+// How long a stream session on another server is remembered, so requests
+// about it go to that server too
+const remoteSessionLifetime = 24 * time.Hour
+
+var (
+	remoteSessionsMutex sync.Mutex
+	remoteSessions      = map[string]remoteSession{}
+)
+
+type remoteSession struct {
+	library string
+	started time.Time
+}
+
+// setupRemoteLibraries checks the config file's remote libraries
+func setupRemoteLibraries(c *Config) error {
+	for name, library := range c.RemoteLibraries {
+		if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			return fmt.Errorf("%q can't be a folder name", name)
+		}
+		if library == nil {
+			return fmt.Errorf("%s: no URL", name)
+		}
+		u, err := url.Parse(library.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("%s: %q isn't an http or https URL", name, library.URL)
+		}
+		library.base = u
+		if library.Redirect {
+			if err := checkRedirect(library); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkRedirect asks a remote library's server whether players sent
+// straight to it could play its videos. They get there without this
+// server's token, so it mustn't ask them to sign in or for stream tokens.
+// A server that can't be reached right now is given the benefit of the
+// doubt.
+func checkRedirect(library *remoteLibrary) error {
+	target := *library.base
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/api/server-info"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Cannot reach %s to check players can be sent there: %v", library.URL, err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var info serverInfo
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&info) != nil {
+		return errors.New("redirect needs a server players can use without signing in")
+	}
+	if slices.Contains(info.Features, "stream-tokens") {
+		return errors.New("redirect doesn't work with a server using -stream-tokens")
+	}
+	return nil
+}
+
+// requestPeer is the name of the server a request comes from, when it
+// carries one of the config file's peer tokens
+func requestPeer(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return ""
+	}
+	for name, token := range config().Peers {
+		if token != "" && subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) == 1 {
+			return name
+		}
+	}
+	return ""
+}
+
+// remoteLibraryOf finds the remote library a path is in, and the path on
+// the other server. Peers only get this server's own library, so two
+// servers listing each other don't go round in circles.
+func remoteLibraryOf(r *http.Request, path string) (string, *remoteLibrary, string) {
+	if requestPeer(r) != "" {
+		return "", nil, ""
+	}
+	name, rest, _ := strings.Cut(path, "/")
+	library := config().RemoteLibraries[name]
+	if library == nil || library.base == nil {
+		return "", nil, ""
+	}
+	return name, library, rest
+}
+
+// remoteLibraryEntries lists the remote libraries at the top of the library
+func remoteLibraryEntries(r *http.Request) []FileInfo {
+	entries := []FileInfo{}
+	if requestPeer(r) != "" {
+		return entries
+	}
+	for name := range config().RemoteLibraries {
+		if canBrowse(r, name) {
+			entries = append(entries, FileInfo{Name: name, Path: name, IsDir: true, Remote: true})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return strings.ToLower(entries[i].Name) < strings.ToLower(entries[j].Name) })
+	return entries
+}
+
+// federate wraps a handler so requests for files in a remote library go to
+// its server. The file is the rest of the URL after prefix, or the path
+// parameter when prefix is "".
+func federate(prefix string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Query().Get("path")
+		if prefix != "" {
+			p = strings.TrimPrefix(r.URL.Path, prefix)
+		}
+		cleaned, err := cleanAPIPath(p, false)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		name, library, rest := remoteLibraryOf(r, cleaned)
+		if library == nil {
+			next(w, r)
+			return
+		}
+
+		// Security check: the access rules cover remote libraries as folders
+		if !canAccess(r, cleaned) {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		query.Del("token")
+		urlPath := r.URL.Path
+		if prefix != "" {
+			urlPath = prefix + rest
+		} else {
+			query.Set("path", rest)
+		}
+		if session := query.Get("session"); session != "" && prefix == "/api/stream/" {
+			rememberRemoteSession(session, name)
+		}
+		if library.Redirect && (prefix == "/api/video/" || prefix == "/api/stream/") {
+			target := *library.base
+			target.Path = strings.TrimSuffix(target.Path, "/") + urlPath
+			target.RawQuery = query.Encode()
+			http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+			return
+		}
+		proxyToRemote(w, r, name, library, urlPath, query, nil)
+	}
+}
+
+// federateSessions wraps the session handler so requests about a stream
+// from a remote library go to the server playing it
+func federateSessions(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/session/"), "/")
+		remoteSessionsMutex.Lock()
+		session, ok := remoteSessions[id]
+		remoteSessionsMutex.Unlock()
+		library := config().RemoteLibraries[session.library]
+		if !ok || library == nil || library.base == nil {
+			next(w, r)
+			return
+		}
+		var modify func(*http.Response) error
+		if action == "resume" {
+			modify = prefixResumePath(session.library)
+		}
+		proxyToRemote(w, r, session.library, library, r.URL.Path, r.URL.Query(), modify)
+	}
+}
+
+// rememberRemoteSession notes which remote library a stream session plays
+// from, forgetting ones long finished
+func rememberRemoteSession(id string, library string) {
+	remoteSessionsMutex.Lock()
+	defer remoteSessionsMutex.Unlock()
+	for other, session := range remoteSessions {
+		if time.Since(session.started) > remoteSessionLifetime {
+			delete(remoteSessions, other)
+		}
+	}
+	if _, ok := remoteSessions[id]; !ok {
+		remoteSessions[id] = remoteSession{library: library, started: time.Now()}
+	}
+}
+
+// proxyToRemote passes a request on to a remote library's server, signed in
+// with its token, and streams back the answer. modify, if set, can rewrite
+// the answer first.
+func proxyToRemote(w http.ResponseWriter, r *http.Request, name string, library *remoteLibrary, urlPath string, query url.Values, modify func(*http.Response) error) {
+	target := *library.base
+	target.Path = strings.TrimSuffix(target.Path, "/") + urlPath
+	target.RawQuery = query.Encode()
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL = &target
+			out.Host = target.Host
+			// Who the person is here means nothing there, and mustn't be
+			// mistaken for someone signed in by the other server's proxy
+			for _, header := range append(userHeaders(), groupsHeaders()...) {
+				out.Header.Del(header)
+			}
+			out.Header.Del("Cookie")
+			out.Header.Del("Accept-Encoding")
+			out.Header.Set("Authorization", "Bearer "+library.Token)
+		},
+		FlushInterval:  -1,
+		ModifyResponse: modify,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if r.Context().Err() == nil {
+				log.Printf("Error reaching remote library %s: %v", name, err)
+			}
+			http.Error(w, "Remote library unavailable", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// prefixListing rewrites another server's folder listing so its paths are
+// under the remote library's folder. Its own collections stay with it.
+func prefixListing(name string) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return nil
+		}
+		var files []FileInfo
+		err := json.NewDecoder(resp.Body).Decode(&files)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		listing := []FileInfo{}
+		for _, file := range files {
+			if file.Collection != "" {
+				continue
+			}
+			file.Path = name + "/" + file.Path
+			for i := range file.Parts {
+				file.Parts[i] = name + "/" + file.Parts[i]
+			}
+			listing = append(listing, file)
+		}
+		if total, err := strconv.Atoi(resp.Header.Get("X-Total-Count")); err == nil {
+			resp.Header.Set("X-Total-Count", strconv.Itoa(total-(len(files)-len(listing))))
+		}
+		return replaceBody(resp, listing)
+	}
+}
+
+// prefixResumePath rewrites the path in a remote session's saved state
+func prefixResumePath(name string) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return nil
+		}
+		var state map[string]interface{}
+		err := json.NewDecoder(resp.Body).Decode(&state)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if path, ok := state["path"].(string); ok {
+			state["path"] = name + "/" + path
+		}
+		return replaceBody(resp, state)
+	}
+}
+
+// replaceBody swaps a proxied answer's body for v as JSON
+func replaceBody(resp *http.Response, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	resp.Header.Del("Content-Encoding")
+	return nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Amount of ffmpeg stderr kept for error classification
+const stderrTailSize = 8192
+
+// tailBuffer is an io.Writer keeping only the last stderrTailSize bytes written
+type tailBuffer struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.data = append(t.data, p...)
+	if len(t.data) > stderrTailSize {
+		t.data = t.data[len(t.data)-stderrTailSize:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.data)
+}
+
+// Lines of a stream's ffmpeg output kept for error classification and the
+// failed transcodes list
+const stderrTailLines = 50
+
+// lineTail keeps the last stderrTailLines lines added to it
+type lineTail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (t *lineTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > stderrTailLines {
+		t.lines = slices.Delete(t.lines, 0, len(t.lines)-stderrTailLines)
+	}
+}
+
+// Lines returns the lines kept, oldest first
+func (t *lineTail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.lines)
+}
+
+func (t *lineTail) String() string {
+	lines := t.Lines()
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// streamError is a user-facing description of why a transcode failed
+type streamError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Known ffmpeg stderr fragments, checked in order so the most specific wins
+var ffmpegErrorPatterns = []struct {
+	fragments []string
+	err       streamError
+}{
+	{
+		[]string{"Permission denied"},
+		streamError{"permission_denied", "The server doesn't have permission to read this file."},
+	},
+	{
+		[]string{"No such file or directory"},
+		streamError{"not_found", "This file no longer exists."},
+	},
+	{
+		[]string{"Stream map '0:a:0' matches no streams", "does not contain any stream"},
+		streamError{"no_audio", "This file has no audio stream."},
+	},
+	{
+		[]string{"Stream map '0:v:0' matches no streams"},
+		streamError{"no_video", "This file has no video stream."},
+	},
+	{
+		[]string{"Decoder (codec", "Unknown decoder", "is not supported", "Unsupported codec", "not currently supported"},
+		streamError{"unsupported_codec", "This file uses a codec that can't be transcoded."},
+	},
+	{
+		[]string{"Invalid data found when processing input", "moov atom not found", "EBML header parsing failed", "corrupt", "Truncating packet", "error while decoding"},
+		streamError{"corrupt_file", "This file appears to be damaged or incomplete."},
+	},
+}
+
+// classifyFFmpegError turns ffmpeg stderr output into a meaningful error
+func classifyFFmpegError(stderr string) *streamError {
+	for _, pattern := range ffmpegErrorPatterns {
+		for _, fragment := range pattern.fragments {
+			if strings.Contains(stderr, fragment) {
+				err := pattern.err
+				return &err
+			}
+		}
+	}
+	return &streamError{"transcode_failed", "Transcoding failed for an unknown reason."}
+}
+
+// classifyStartError describes a failure to launch ffmpeg at all
+func classifyStartError(err error) *streamError {
+	if errors.Is(err, exec.ErrNotFound) {
+		return &streamError{"ffmpeg_missing", "ffmpeg is not installed on the server."}
+	}
+	return &streamError{"transcode_failed", "The transcoder could not be started."}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"os/exec"
+	"strconv"
+)
+
+// Audio fingerprints follow Haitsma and Kalker: each frame gets 32 bits,
+// one per pair of neighbouring frequency bands, set when the difference in
+// energy between the bands grew since the previous frame. That survives
+// changes in volume and encoding, so the same intro gives nearly the same
+// bits in every episode.
+const (
+	fingerprintRate  = 8000 // Samples per second decoded for fingerprinting
+	fingerprintFrame = 1024 // Samples per FFT frame
+	fingerprintHop   = 256  // Samples between frame starts
+	fingerprintBands = 33
+	fingerprintLow   = 300.0  // Hz
+	fingerprintHigh  = 2000.0 // Hz
+
+	// Frames match when no more than this many of their bits differ
+	maxBitErrors = 9
+
+	// Frames a matching run may skip over, about a second
+	maxMatchGap = 16
+)
+
+// frameSeconds is how far apart fingerprint frames are
+const frameSeconds = float64(fingerprintHop) / fingerprintRate
+
+// decodeAudio reads the first seconds of a file's audio as mono samples
+func decodeAudio(fullPath string, seconds float64) ([]float64, error) {
+	args := inputFile(fullPath)
+	args = append(args,
+		"-t", strconv.FormatFloat(seconds, 'f', 0, 64),
+		"-vn",
+		"-ac", "1",
+		"-ar", strconv.Itoa(fingerprintRate),
+		"-f", "s16le",
+		"-loglevel", "error",
+		"pipe:1",
+	)
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr tailBuffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(stdout)
+	if waitErr := cmd.Wait(); waitErr != nil {
+		return nil, fmt.Errorf("%v: %s", waitErr, stderr.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]float64, len(data)/2)
+	for i := range samples {
+		samples[i] = float64(int16(binary.LittleEndian.Uint16(data[i*2:])))
+	}
+	return samples, nil
+}
+
+// fft is an in-place radix-2 Cooley-Tukey transform. len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := x[start+k], w*x[start+k+size/2]
+				x[start+k] = even + odd
+				x[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
+
+// fingerprint turns samples into one 32 bit word per frame
+func fingerprint(samples []float64) []uint32 {
+	// Band edges spaced logarithmically, as hearing is, in FFT bins
+	var edges [fingerprintBands + 1]int
+	for b := range edges {
+		freq := fingerprintLow * math.Pow(fingerprintHigh/fingerprintLow, float64(b)/fingerprintBands)
+		edges[b] = int(freq * fingerprintFrame / fingerprintRate)
+	}
+
+	window := make([]float64, fingerprintFrame)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(fingerprintFrame-1))
+	}
+
+	var prints []uint32
+	var previous [fingerprintBands]float64
+	frame := make([]complex128, fingerprintFrame)
+	for start := 0; start+fingerprintFrame <= len(samples); start += fingerprintHop {
+		for i := range frame {
+			frame[i] = complex(samples[start+i]*window[i], 0)
+		}
+		fft(frame)
+
+		var energy [fingerprintBands]float64
+		for b := 0; b < fingerprintBands; b++ {
+			for bin := edges[b]; bin < max(edges[b+1], edges[b]+1); bin++ {
+				energy[b] += real(frame[bin])*real(frame[bin]) + imag(frame[bin])*imag(frame[bin])
+			}
+		}
+
+		if start > 0 {
+			var word uint32
+			for b := 0; b < fingerprintBands-1; b++ {
+				if energy[b]-energy[b+1]-(previous[b]-previous[b+1]) > 0 {
+					word |= 1 << b
+				}
+			}
+			prints = append(prints, word)
+		}
+		previous = energy
+	}
+	return prints
+}
+
+// commonSegment finds the longest stretch two fingerprints share, at any
+// offset between them. It returns where it starts in each, in frames, and
+// its length.
+func commonSegment(a, b []uint32) (startA, startB, length int) {
+	for offset := -(len(b) - 1); offset < len(a); offset++ {
+		start, last := -1, -1
+		for i := max(0, offset); i < len(a) && i-offset < len(b); i++ {
+			if bits.OnesCount32(a[i]^b[i-offset]) > maxBitErrors {
+				continue
+			}
+			if start < 0 || i-last > maxMatchGap {
+				start = i
+			}
+			last = i
+			if last-start+1 > length {
+				startA, startB, length = start, start-offset, last-start+1
+			}
+		}
+	}
+	return startA, startB, length
+}
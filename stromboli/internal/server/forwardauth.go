@@ -0,0 +1,153 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers forward-auth proxies such as Authelia, Authentik and Traefik's
+// pass the user and their groups in, read when the config file trusts a
+// proxy without naming its headers
+var (
+	defaultUserHeaders   = []string{"Remote-User", "X-Forwarded-User"}
+	defaultGroupsHeaders = []string{"Remote-Groups", "X-Forwarded-Groups"}
+)
+
+// setupForwardAuth checks the addresses of the trusted proxies. Headers
+// naming the user are only believed from them, so setting the headers
+// without any is a mistake.
+func setupForwardAuth(c *Config) error {
+	if len(c.TrustedProxies) == 0 && (c.UserHeader != "" || c.GroupsHeader != "") {
+		return errors.New("userHeader and groupsHeader need the proxy's address in trustedProxies")
+	}
+	networks, err := parseNetworks(c.TrustedProxies)
+	c.trustedProxies = networks
+	return err
+}
+
+// parseNetworks reads a list of addresses and CIDR networks, an address
+// being a network of its own
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range list {
+		cidr := entry
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("%q isn't an IP address or network", entry)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't an IP address or network", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// inNetworks reports whether an address is in any of the networks
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the player's address. Behind trusted proxies it's the last
+// one in X-Forwarded-For that isn't a proxy's.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || len(config().TrustedProxies) == 0 || !inNetworks(ip, config().trustedProxies) {
+		return ip
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !inNetworks(hop, config().trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// fromTrustedProxy reports whether a request's user headers can be
+// believed, having come from one of the trusted proxies. With none listed
+// nobody is trusted.
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && inNetworks(ip, config().trustedProxies)
+}
+
+// userHeaders and groupsHeaders are the headers the proxy in front of the
+// server passes the user and their groups in
+func userHeaders() []string {
+	if config().UserHeader != "" {
+		return []string{config().UserHeader}
+	}
+	if len(config().TrustedProxies) > 0 {
+		return defaultUserHeaders
+	}
+	return nil
+}
+
+func groupsHeaders() []string {
+	if config().GroupsHeader != "" {
+		return []string{config().GroupsHeader}
+	}
+	if len(config().TrustedProxies) > 0 {
+		return defaultGroupsHeaders
+	}
+	return nil
+}
+
+// proxyUser is who the proxy in front of the server says made a request
+func proxyUser(r *http.Request) string {
+	if !fromTrustedProxy(r) {
+		return ""
+	}
+	for _, header := range userHeaders() {
+		if user := r.Header.Get(header); user != "" {
+			return user
+		}
+	}
+	return ""
+}
+
+// proxyGroups is the groups the proxy says the user is in
+func proxyGroups(r *http.Request) []string {
+	if !fromTrustedProxy(r) {
+		return nil
+	}
+	var groups []string
+	for _, header := range groupsHeaders() {
+		for _, group := range strings.Split(r.Header.Get(header), ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"time"
+)
+
+// isGuest reports whether a request comes from a guest, who can browse and
+// play but not change or copy anything. Guests are listed in the config
+// file by user name, @group, or * for anyone the proxy hasn't signed in,
+// or were invited as one.
+func isGuest(r *http.Request) bool {
+	return accountIsGuest(r) || listsRequest(config().Guests, r)
+}
+
+// listsRequest reports whether a list of people in the config file takes
+// in a request's user: by name, by @group, or with * when nobody is
+// signed in
+func listsRequest(list []string, r *http.Request) bool {
+	if len(list) == 0 {
+		return false
+	}
+	user := requestUser(r)
+	if user == "" {
+		return slices.Contains(list, "*")
+	}
+	if slices.Contains(list, user) {
+		return true
+	}
+	for _, group := range requestGroups(r, user) {
+		if slices.Contains(list, "@"+group) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyGuests keeps guests out of handlers that change the library, make
+// copies of files or run jobs on the server. Peers are kept out too, as
+// their token is for listing and playing this library on another server.
+func denyGuests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isGuest(r) || requestPeer(r) != "" {
+			http.Error(w, "Guests can't do this", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// limitGuests holds each of a guest's streams to the configured bitrate,
+// so a few guests can't use up the server's upload
+func limitGuests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config().GuestBitrate > 0 && isGuest(r) {
+			w = &throttledWriter{ResponseWriter: w, rate: config().GuestBitrate * 1000 / 8, start: time.Now()}
+		}
+		next(w, r)
+	}
+}
+
+// throttledWriter writes no faster than rate bytes a second on average.
+// Writes are split up so the sleeps between them stay short.
+type throttledWriter struct {
+	http.ResponseWriter
+	rate  int
+	start time.Time
+	sent  int64
+}
+
+// Unwrap lets http.ResponseController flush the stream underneath
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	chunkSize := max(t.rate/10, 4096)
+	for len(p) > 0 {
+		chunk := p[:min(len(p), chunkSize)]
+		n, err := t.ResponseWriter.Write(chunk)
+		written += n
+		t.sent += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+
+		due := time.Duration(float64(t.sent) / float64(t.rate) * float64(time.Second))
+		if ahead := due - time.Since(t.start); ahead > 0 {
+			time.Sleep(ahead)
+		}
+	}
+	return written, nil
+}
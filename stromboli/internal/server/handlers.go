@@ -0,0 +1,158 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fileHandler lets the config file teach stromboli about extra file types
+// without changing the code. Commands are argument lists in which {file},
+// {start} and {container} are replaced with the full path, start offset in
+// seconds and output container.
+type fileHandler struct {
+	// Extensions claimed, with the leading dot
+	Extensions []string `json:"extensions"`
+
+	// ffmpeg and ffprobe options placed before the input, e.g. ["-f", "dvdvideo"]
+	InputArgs []string `json:"inputArgs,omitempty"`
+
+	// Command printing ffprobe -of json style output, in place of ffprobe
+	Probe []string `json:"probe,omitempty"`
+
+	// Command writing the stream to stdout, in place of ffmpeg
+	Transcode []string `json:"transcode,omitempty"`
+}
+
+// Handlers keyed by lower case extension
+var fileHandlers = map[string]*fileHandler{}
+
+// fileFormat changes how files with an extension are listed and played
+type fileFormat struct {
+	// Played by the browser as is rather than transcoded
+	Direct bool `json:"direct"`
+
+	// Content type the file is served with when played as is
+	MimeType string `json:"mimeType,omitempty"`
+}
+
+// normalizeExtension lower cases an extension and gives it its leading dot
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// The format tables as built in, which the config file's formats and
+// handlers are laid over afresh each time it's read
+var (
+	builtinVideoFormats  = maps.Clone(videoFormats)
+	builtinNativeFormats = maps.Clone(nativeFormats)
+	builtinMimeTypes     = maps.Clone(videoMimeTypes)
+)
+
+// setupFormats lays the config file's formats over the built-in ones. A
+// format set to null stops its files being listed as videos. The tables
+// are swapped in whole, as requests may be reading the old ones.
+func setupFormats(c *Config) error {
+	video, native, mimeTypes := maps.Clone(builtinVideoFormats), maps.Clone(builtinNativeFormats), maps.Clone(builtinMimeTypes)
+	for ext, format := range c.Formats {
+		if ext == "" || ext == "." {
+			return errors.New("format with no extension")
+		}
+		ext = normalizeExtension(ext)
+		if format == nil {
+			delete(video, ext)
+			delete(native, ext)
+			delete(mimeTypes, ext)
+			continue
+		}
+		video[ext] = true
+		if format.Direct {
+			native[ext] = true
+		} else {
+			delete(native, ext)
+		}
+		if format.MimeType != "" {
+			mimeTypes[ext] = format.MimeType
+		}
+	}
+	videoFormats, nativeFormats, videoMimeTypes = video, native, mimeTypes
+	return nil
+}
+
+// setupHandlers registers the handlers from the config file, adding their
+// extensions to the recognised video formats
+func setupHandlers(c *Config) error {
+	handlers, video, native := map[string]*fileHandler{}, maps.Clone(videoFormats), maps.Clone(nativeFormats)
+	for i := range c.Handlers {
+		handler := &c.Handlers[i]
+		if len(handler.Extensions) == 0 {
+			return fmt.Errorf("handler %d claims no extensions", i+1)
+		}
+		for _, ext := range handler.Extensions {
+			ext = normalizeExtension(ext)
+			handlers[ext] = handler
+			video[ext] = true
+
+			// Whatever the browser makes of it, claimed files go through the transcoder
+			delete(native, ext)
+		}
+	}
+	fileHandlers, videoFormats, nativeFormats = handlers, video, native
+	return nil
+}
+
+// handlerFor returns the configured handler for a file, if there is one
+func handlerFor(path string) *fileHandler {
+	dot := strings.LastIndex(path, ".")
+	if dot < 0 {
+		return nil
+	}
+	return fileHandlers[strings.ToLower(path[dot:])]
+}
+
+// Input options for formats that need help without any configuration.
+// Broadcast captures often start mid-stream with broken timestamps and
+// damaged packets from weak signal.
+var builtinInputArgs = map[string][]string{
+	".ts":   {"-fflags", "+genpts+discardcorrupt"},
+	".m2ts": {"-fflags", "+genpts+discardcorrupt"},
+	".mts":  {"-fflags", "+genpts+discardcorrupt"},
+}
+
+// inputArgs returns the options to put before a file's -i
+func inputArgs(path string) []string {
+	if handler := handlerFor(path); handler != nil {
+		return handler.InputArgs
+	}
+	return builtinInputArgs[strings.ToLower(filepath.Ext(path))]
+}
+
+// inputFile returns the ffmpeg arguments that open a file, including any
+// options its handler needs. Disc backups open at their main title.
+func inputFile(fullPath string) []string {
+	if kind := discType(fullPath); kind != "" {
+		return discInput(fullPath, kind)
+	}
+	return append(append([]string{}, inputArgs(fullPath)...), "-i", fullPath)
+}
+
+// expandCommand fills in a handler command's placeholders
+func expandCommand(command []string, fullPath string, start float64, container string) []string {
+	replacer := strings.NewReplacer(
+		"{file}", fullPath,
+		"{start}", strconv.FormatFloat(start, 'f', 3, 64),
+		"{container}", container,
+	)
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = replacer.Replace(arg)
+	}
+	return args
+}
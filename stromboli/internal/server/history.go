@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const historyFile = "history.json"
+
+// Videos this close to the end count as watched
+const watchedThreshold = 0.95
+
+// Number of entries shown in the continue watching row
+const continueLimit = 12
+
+type watchEntry struct {
+	Path        string    `json:"path"`
+	Position    float64   `json:"position"`
+	Duration    float64   `json:"duration"`
+	Watched     bool      `json:"watched"`
+	LastWatched time.Time `json:"lastWatched"`
+}
+
+// Watch history by user and then path. Everyone signed in, or named by
+// the proxy, has their own, and "" is everyone else's.
+var (
+	historyMutex sync.Mutex
+	history      = map[string]map[string]*watchEntry{}
+)
+
+func loadHistory() {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	if err := loadJSON(historyFile, &history); err != nil {
+		history = map[string]map[string]*watchEntry{}
+		if !migrateHistory() {
+			log.Printf("Error loading watch history: %v", err)
+		}
+	}
+	// Earlier Windows builds recorded paths with backslashes
+	for _, entries := range history {
+		for key, entry := range entries {
+			if slashed := apiPath(key); slashed != key {
+				delete(entries, key)
+				entry.Path = slashed
+				entries[slashed] = entry
+			}
+		}
+	}
+}
+
+// migrateHistory reads the history file as it was before each user had
+// their own, one list everyone shared. It carries on as the history of
+// everyone who had settings saved then, and of everyone else. Callers
+// must hold historyMutex.
+func migrateHistory() bool {
+	var shared map[string]*watchEntry
+	if err := loadJSON(historyFile, &shared); err != nil {
+		return false
+	}
+	preferencesMutex.Lock()
+	users := []string{""}
+	for user := range userPreferences {
+		if user != "" {
+			users = append(users, user)
+		}
+	}
+	preferencesMutex.Unlock()
+
+	for _, user := range users {
+		entries := userHistory(user)
+		for path, entry := range shared {
+			copied := *entry
+			entries[path] = &copied
+		}
+	}
+	saveHistory()
+	return true
+}
+
+// userHistory is a user's history, made empty if they have none yet.
+// Callers must hold historyMutex.
+func userHistory(user string) map[string]*watchEntry {
+	entries := history[user]
+	if entries == nil {
+		entries = map[string]*watchEntry{}
+		history[user] = entries
+	}
+	return entries
+}
+
+// historyOf copies a user's history, to go through without holding
+// historyMutex
+func historyOf(user string) map[string]watchEntry {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	entries := make(map[string]watchEntry, len(history[user]))
+	for path, entry := range history[user] {
+		entries[path] = *entry
+	}
+	return entries
+}
+
+// saveHistory writes the history to disk. Callers must hold historyMutex.
+func saveHistory() {
+	if err := saveJSON(historyFile, history); err != nil {
+		log.Printf("Error saving watch history: %v", err)
+	}
+}
+
+// recordProgress saves how far into a file a user got
+func recordProgress(ctx context.Context, user string, path string, position float64, duration float64) *watchEntry {
+	historyMutex.Lock()
+	entries := userHistory(user)
+	entry := entries[path]
+	if entry == nil {
+		entry = &watchEntry{Path: path}
+		entries[path] = entry
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	_, isAudio := listeningFormats[ext]
+	needsDuration := entry.Duration == 0 && duration == 0 && (videoFormats[ext] || isAudio)
+	historyMutex.Unlock()
+
+	// Transcoded streams don't report a duration to the player, so ask ffprobe
+	// once. Documents whose length isn't known have nothing to probe.
+	if needsDuration {
+		if probe, err := probeFile(ctx, filepath.Join(rootDir, path)); err == nil {
+			duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+		}
+	}
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	if duration > 0 {
+		entry.Duration = duration
+	}
+	entry.Position = position
+	entry.LastWatched = time.Now()
+	entry.Watched = entry.Duration > 0 && position >= entry.Duration*watchedThreshold
+	saveHistory()
+
+	result := *entry
+	return &result
+}
+
+// handleProgress stores (POST) or returns (GET) the playback position of a video
+func handleProgress(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// Security check: paths can't leave the root
+		path, _, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+		if path == "" || !ok {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+
+		historyMutex.Lock()
+		entry := history[requestUser(r)][path]
+		var data []byte
+		if entry != nil {
+			data, _ = json.Marshal(entry)
+		}
+		historyMutex.Unlock()
+
+		if entry == nil {
+			http.Error(w, "No progress recorded", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+
+	case http.MethodPost:
+		var req struct {
+			Path     string  `json:"path"`
+			Position float64 `json:"position"`
+			Duration float64 `json:"duration"`
+			Session  string  `json:"session"`
+			Paused   bool    `json:"paused"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		// Security check: paths can't leave the root
+		path, _, ok := resolveRequestPath(r, req.Path)
+		if path == "" || !ok {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+
+		entry := recordProgress(r.Context(), requestUser(r), path, req.Position, req.Duration)
+		if req.Session != "" {
+			updateSessionPosition(req.Session, requestUser(r), path, req.Position)
+			if s := getSession(req.Session); s != nil && s.Mode == modeDirect && s.User == requestUser(r) {
+				s.setPaused(req.Paused)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entry)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type continueItem struct {
+	FileInfo
+	Position  float64 `json:"position"`
+	Duration  float64 `json:"duration"`
+	Progress  float64 `json:"progress"`
+	Thumbnail string  `json:"thumbnail"`
+}
+
+// handleContinue lists the user's partly watched videos, most recently
+// watched first
+func handleContinue(w http.ResponseWriter, r *http.Request) {
+	var entries []watchEntry
+	for _, entry := range historyOf(requestUser(r)) {
+		if !entry.Watched && entry.Position > 0 {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastWatched.After(entries[j].LastWatched)
+	})
+	if len(entries) > continueLimit {
+		entries = entries[:continueLimit]
+	}
+
+	device := requestDeviceProfile(r)
+	items := []continueItem{}
+	for _, entry := range entries {
+		// Skip anything that has since been moved or deleted, or the user can't see
+		info, err := os.Stat(filepath.Join(rootDir, entry.Path))
+		if err != nil || !canAccess(r, entry.Path) {
+			continue
+		}
+
+		item := continueItem{
+			FileInfo:  newFileInfo(r.Context(), entry.Path, info, device),
+			Position:  entry.Position,
+			Duration:  entry.Duration,
+			Thumbnail: "/api/thumbnail/" + (&url.URL{Path: filepath.ToSlash(entry.Path)}).EscapedPath(),
+		}
+		if entry.Duration > 0 {
+			item.Progress = entry.Position / entry.Duration
+		}
+		items = append(items, item)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
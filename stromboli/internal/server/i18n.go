@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"video-browser/stromboli/internal/webui"
+)
+
+// defaultLanguage is the pack every other one falls back to for missing strings
+const defaultLanguage = "en"
+
+// languagePacks maps a language tag ("de", "pt-br") to its UI strings.
+// Packs are flat JSON objects of message key to text, with {name}
+// placeholders for values filled in by the page.
+var languagePacks = map[string]map[string]string{}
+
+// loadLanguagePacks reads the packs built into the web UI, then any in
+// dir, which add languages or override individual strings of built-in ones
+func loadLanguagePacks(dir string) error {
+	if err := readLanguagePacks(webui.LanguagePacks()); err != nil {
+		return err
+	}
+	if dir == "" {
+		return nil
+	}
+	return readLanguagePacks(os.DirFS(dir))
+}
+
+func readLanguagePacks(fsys fs.FS) error {
+	names, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return &fs.PathError{Op: "parse", Path: name, Err: err}
+		}
+
+		lang := strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+		if languagePacks[lang] == nil {
+			languagePacks[lang] = map[string]string{}
+		}
+		for key, text := range messages {
+			languagePacks[lang][key] = text
+		}
+	}
+	return nil
+}
+
+// negotiateLanguage picks the best available pack for an Accept-Language
+// header, trying each tag in order of preference and then its base
+// language, so "de-AT" is served "de" when there's no Austrian pack
+func negotiateLanguage(acceptLanguage string) string {
+	type candidate struct {
+		tag     string
+		quality float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = v
+			}
+		}
+		if quality > 0 {
+			candidates = append(candidates, candidate{tag, quality})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].quality > candidates[j].quality
+	})
+
+	for _, c := range candidates {
+		if _, ok := languagePacks[c.tag]; ok {
+			return c.tag
+		}
+		base, _, _ := strings.Cut(c.tag, "-")
+		if _, ok := languagePacks[base]; ok {
+			return base
+		}
+	}
+	return defaultLanguage
+}
+
+// messagesFor returns every UI string in a language, with the default
+// language filling in anything the pack hasn't translated yet
+func messagesFor(lang string) map[string]string {
+	messages := map[string]string{}
+	for key, text := range languagePacks[defaultLanguage] {
+		messages[key] = text
+	}
+	for key, text := range languagePacks[lang] {
+		messages[key] = text
+	}
+	return messages
+}
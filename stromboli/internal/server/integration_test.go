@@ -0,0 +1,1129 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"video-browser/stromboli/internal/library"
+)
+
+// Stand-ins for ffprobe and ffmpeg. ffprobe describes .mkv files as HEVC
+// and everything else as H.264 with AAC, and never finishes with files
+// named as stuck. ffmpeg streams filler to stdout
+// until it's killed, writing its process ID to $FAKE_FFMPEG_PIDFILE first,
+// and writes a small file for any other output.
+const (
+	fakeFFprobe = `#!/bin/sh
+for last; do :; done
+case "$last" in
+*stuck*) exec sleep 60 ;;
+*.mkv) video=hevc ;;
+*) video=h264 ;;
+esac
+printf '{"streams":[{"index":0,"codec_type":"video","codec_name":"%s","width":1920,"height":1080,"avg_frame_rate":"24/1"},{"index":1,"codec_type":"audio","codec_name":"aac","channels":2}],"format":{"duration":"60.0"}}\n' "$video"
+`
+	fakeFFmpeg = `#!/bin/sh
+for last; do :; done
+if [ "$last" = "pipe:1" ]; then
+	echo $$ > "$FAKE_FFMPEG_PIDFILE"
+	while :; do
+		printf '%4096s' ''
+		sleep 0.01
+	done
+fi
+echo frame > "$last"
+`
+)
+
+// testServer runs the server's routes against a temporary library, with
+// the fake ffmpeg and ffprobe first on the PATH
+type testServer struct {
+	*httptest.Server
+	root    string
+	pidFile string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffmpeg is a shell script")
+	}
+	dir := t.TempDir()
+
+	bin := filepath.Join(dir, "bin")
+	writeTestFile(t, filepath.Join(bin, "ffprobe"), fakeFFprobe, 0755)
+	writeTestFile(t, filepath.Join(bin, "ffmpeg"), fakeFFmpeg, 0755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	pidFile := filepath.Join(dir, "ffmpeg.pid")
+	t.Setenv("FAKE_FFMPEG_PIDFILE", pidFile)
+
+	root := filepath.Join(dir, "library")
+	writeTestFile(t, filepath.Join(root, "Films", "Heat.mp4"), "0123456789abcdef", 0644)
+	writeTestFile(t, filepath.Join(root, "Films", "Alien.mkv"), "matroska", 0644)
+	writeTestFile(t, filepath.Join(root, "Shows", "Season 1", "Episode 1.mp4"), "episode", 0644)
+	writeTestFile(t, filepath.Join(dir, "secret.txt"), "outside the library", 0644)
+
+	rootDir = root
+	dataDir = filepath.Join(dir, "data")
+	currentConfig.Store(&Config{})
+	probeSlots = make(chan struct{}, 1)
+	warmupEnabled = false
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(routes())
+	t.Cleanup(server.Close)
+	return &testServer{Server: server, root: root, pidFile: pidFile}
+}
+
+func writeTestFile(t *testing.T, path string, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get fetches a URL on the server, returning the status and body
+func (s *testServer) get(t *testing.T, path string, header http.Header) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestBrowse(t *testing.T) {
+	s := newTestServer(t)
+
+	status, body := s.get(t, "/api/browse?path=", nil)
+	if status != http.StatusOK {
+		t.Fatalf("browsing the root: %d %s", status, body)
+	}
+	var root []FileInfo
+	if err := json.Unmarshal([]byte(body), &root); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range root {
+		if !file.IsDir {
+			t.Errorf("%s isn't listed as a folder", file.Name)
+		}
+		names = append(names, file.Name)
+	}
+	if strings.Join(names, ",") != "Films,Shows" {
+		t.Errorf("root lists %v, want Films and Shows", names)
+	}
+
+	status, body = s.get(t, "/api/browse?path=Films", nil)
+	if status != http.StatusOK {
+		t.Fatalf("browsing Films: %d %s", status, body)
+	}
+	var films []FileInfo
+	if err := json.Unmarshal([]byte(body), &films); err != nil {
+		t.Fatal(err)
+	}
+	playback := map[string]string{}
+	for _, file := range films {
+		playback[file.Path] = file.Playback
+	}
+	want := map[string]string{"Films/Heat.mp4": playDirect, "Films/Alien.mkv": playTranscode}
+	for path, method := range want {
+		if playback[path] != method {
+			t.Errorf("%s plays by %q, want %q", path, playback[path], method)
+		}
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	s := newTestServer(t)
+	writeTestFile(t, filepath.Join(s.root, "Films", "Dying disk.stuck.mp4"), "unreadable", 0644)
+	defer func(timeout time.Duration) { library.ProbeTimeout = timeout }(library.ProbeTimeout)
+	library.ProbeTimeout = 100 * time.Millisecond
+
+	started := time.Now()
+	status, body := s.get(t, "/api/browse?path=Films", nil)
+	if status != http.StatusOK {
+		t.Fatalf("browsing Films: %d %s", status, body)
+	}
+	if elapsed := time.Since(started); elapsed > probeWait {
+		t.Errorf("listing took %s", elapsed)
+	}
+	var films []FileInfo
+	if err := json.Unmarshal([]byte(body), &films); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range films {
+		if file.Path == "Films/Dying disk.stuck.mp4" {
+			if file.Pending || file.Playback != playTranscode {
+				t.Errorf("the unreadable file is listed as %+v", file)
+			}
+			return
+		}
+	}
+	t.Error("the unreadable file isn't listed")
+}
+
+func TestDirectPlay(t *testing.T) {
+	s := newTestServer(t)
+
+	status, body := s.get(t, "/api/video/Films/Heat.mp4", nil)
+	if status != http.StatusOK || body != "0123456789abcdef" {
+		t.Fatalf("direct play: %d %q", status, body)
+	}
+
+	status, body = s.get(t, "/api/video/Films/Heat.mp4", http.Header{"Range": {"bytes=4-7"}})
+	if status != http.StatusPartialContent || body != "4567" {
+		t.Errorf("range request: %d %q, want 206 \"4567\"", status, body)
+	}
+
+	resp, err := s.Client().Head(s.URL + "/api/video/Films/Alien.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "video/x-matroska" {
+		t.Errorf("MKV is sent as %q", got)
+	}
+}
+
+// A session's state and stats are only told to whoever is playing it
+func TestSessionOwner(t *testing.T) {
+	s := newTestServer(t)
+	config().TrustedProxies = []string{"127.0.0.1"}
+	if err := setupForwardAuth(config()); err != nil {
+		t.Fatal(err)
+	}
+	ada, bob := http.Header{"Remote-User": {"ada"}}, http.Header{"Remote-User": {"bob"}}
+	if status, _ := s.get(t, "/api/video/Films/Heat.mp4?session=ada-heat", ada); status != http.StatusOK {
+		t.Fatalf("direct play: %d", status)
+	}
+	for _, path := range []string{"/api/session/ada-heat", "/api/session/ada-heat/stats"} {
+		if status, _ := s.get(t, path, ada); status != http.StatusOK {
+			t.Errorf("ada's own %s: %d", path, status)
+		}
+		if status, _ := s.get(t, path, bob); status != http.StatusNotFound {
+			t.Errorf("bob got ada's %s: %d", path, status)
+		}
+	}
+	resp, err := s.Client().Post(s.URL+"/api/session/ada-heat/fallback", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("someone else moved ada's session on: %d", resp.StatusCode)
+	}
+}
+
+// A transcode's ffmpeg is killed once the player goes away
+func TestTranscodeKilledOnDisconnect(t *testing.T) {
+	s := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/api/stream/Films/Alien.mkv?session=disconnect", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stream: %d", resp.StatusCode)
+	}
+	streamID := resp.Header.Get("X-Stream-ID")
+	if !strings.HasPrefix(streamID, "disconnect.") {
+		t.Errorf("stream ID is %q", streamID)
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, 16<<10)); err != nil {
+		t.Fatalf("reading the stream: %v", err)
+	}
+	if session := getSession("disconnect"); session == nil || session.info().Done {
+		t.Fatal("the session isn't streaming")
+	}
+	if stats := getSession("disconnect").stats(); stats.StreamID != streamID {
+		t.Errorf("session stats have stream ID %q, want %q", stats.StreamID, streamID)
+	}
+
+	cancel()
+	resp.Body.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		session := getSession("disconnect")
+		transcodeMutex.Lock()
+		_, running := activeCmds["disconnect"]
+		transcodeMutex.Unlock()
+		if session.info().Done && !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ffmpeg is still running after the player went away")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	pid, err := os.ReadFile(s.pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("/proc/" + strings.TrimSpace(string(pid))); err == nil && runtime.GOOS == "linux" {
+		t.Errorf("ffmpeg process %s is still running", strings.TrimSpace(string(pid)))
+	}
+}
+
+// A segment's end has to come after its start, and not too long after
+func TestStreamSegmentEnd(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, query := range []string{"start=30&end=30", "start=30&end=20", "start=0&end=601", "end=soon"} {
+		resp, err := s.Client().Get(s.URL + "/api/stream/Films/Alien.mkv?session=segment&" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
+
+// Nothing outside the library can be reached, however the path is written
+func TestPathEscapes(t *testing.T) {
+	s := newTestServer(t)
+
+	paths := []string{
+		"../secret.txt",
+		"..%2fsecret.txt",
+		"%2e%2e/secret.txt",
+		"Films/../../secret.txt",
+		"Films%2f..%2f..%2fsecret.txt",
+		"/" + filepath.ToSlash(filepath.Join(filepath.Dir(s.root), "secret.txt")),
+	}
+	endpoints := []string{"/api/video/", "/api/stream/", "/api/thumbnail/", "/api/subtitles/", "/api/browse?path=", "/api/progress?path="}
+
+	for _, endpoint := range endpoints {
+		for _, path := range paths {
+			separator := "?"
+			if strings.Contains(endpoint, "?") {
+				separator = "&"
+			}
+			status, body := s.get(t, endpoint+path+separator+"session=escape", nil)
+			if status == http.StatusOK && strings.Contains(body, "outside the library") {
+				t.Errorf("%s%s read a file outside the library", endpoint, path)
+			}
+		}
+	}
+
+	// Browsing above the root never lists what's there
+	status, body := s.get(t, "/api/browse?path=..", nil)
+	if status == http.StatusOK && strings.Contains(body, "secret.txt") {
+		t.Errorf("browsing .. listed the folder above the library: %s", body)
+	}
+}
+
+func TestOrganize(t *testing.T) {
+	s := newTestServer(t)
+	writeTestFile(t, filepath.Join(s.root, "Incoming", "Fargo.S01E02.720p.mkv"), "episode", 0644)
+	writeTestFile(t, filepath.Join(s.root, "Incoming", "Fargo.S01E02.720p.eng.srt"), "subtitles", 0644)
+	writeTestFile(t, filepath.Join(s.root, "Incoming", "Fargo.S01E03.720p.mkv"), "still copying", 0644)
+	settled := time.Now().Add(-time.Hour)
+	for _, name := range []string{"Fargo.S01E02.720p.mkv", "Fargo.S01E02.720p.eng.srt"} {
+		if err := os.Chtimes(filepath.Join(s.root, "Incoming", name), settled, settled); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config().Organize = &organizeConfig{
+		Folder: "Incoming",
+		Rules: []organizeRule{{
+			Match: `^(?P<show>[^/]+?)\.S(?P<season>\d+)E(?P<episode>\d+)[^/]*\.(?P<ext>mkv|mp4)$`,
+			Dest:  "Shows/${show}/Season ${season}/${show} S${season}E${episode}.${ext}",
+		}},
+	}
+	if err := setupOrganize(config()); err != nil {
+		t.Fatal(err)
+	}
+	if err := scanLibrary(context.Background(), func(float64) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"Fargo S01E02.mkv", "Fargo S01E02.eng.srt"} {
+		if !fileExists(filepath.Join(s.root, "Shows", "Fargo", "Season 01", name)) {
+			t.Errorf("%s wasn't moved into Shows/Fargo/Season 01", name)
+		}
+	}
+	if !fileExists(filepath.Join(s.root, "Incoming", "Fargo.S01E03.720p.mkv")) {
+		t.Error("a file still being copied in was moved")
+	}
+	libraryMutex.RLock()
+	_, indexed := libraryIndex["Shows/Fargo/Season 01/Fargo S01E02.mkv"]
+	_, pending := libraryIndex["Incoming/Fargo.S01E03.720p.mkv"]
+	libraryMutex.RUnlock()
+	if !indexed || pending {
+		t.Errorf("indexed the moved file: %v, the one still being copied in: %v", indexed, pending)
+	}
+
+	status, body := s.get(t, "/api/organize", nil)
+	var moves []organizeMove
+	if err := json.Unmarshal([]byte(body), &moves); err != nil || status != http.StatusOK {
+		t.Fatalf("activity log: %d %s", status, body)
+	}
+	if len(moves) != 1 || moves[0].From != "Incoming/Fargo.S01E02.720p.mkv" || moves[0].Error != "" {
+		t.Errorf("activity log is %+v", moves)
+	}
+}
+
+func TestSmartPlaylist(t *testing.T) {
+	s := newTestServer(t)
+	old := time.Now().AddDate(0, -2, 0)
+	if err := os.Chtimes(filepath.Join(s.root, "Films", "Heat.mp4"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := scanLibrary(context.Background(), func(float64) {}); err != nil {
+		t.Fatal(err)
+	}
+	history = map[string]map[string]*watchEntry{"": {"Films/Alien.mkv": {Path: "Films/Alien.mkv", Watched: true}}}
+	t.Cleanup(func() { history = map[string]map[string]*watchEntry{} })
+
+	rules := []smartRule{
+		{Field: "watched", Op: "is", Value: "false"},
+		{Field: "added", Op: "within", Value: "30"},
+		{Field: "duration", Op: "<", Value: "30"},
+	}
+	if err := checkSmartRules("all", rules); err != nil {
+		t.Fatal(err)
+	}
+	if paths := smartPlaylistPaths("", "all", rules); strings.Join(paths, ",") != "Shows/Season 1/Episode 1.mp4" {
+		t.Errorf("unwatched, recent and short: %v", paths)
+	}
+	if paths := smartPlaylistPaths("", "any", rules[:2]); len(paths) != 3 {
+		t.Errorf("unwatched or recent: %v", paths)
+	}
+
+	for _, bad := range []smartRule{
+		{Field: "duration", Op: "contains", Value: "30"},
+		{Field: "added", Op: "within", Value: "soon"},
+		{Field: "folder", Op: "in", Value: "Films\x00"},
+		{Field: "size", Op: ">", Value: "1"},
+	} {
+		if checkSmartRules("all", []smartRule{bad}) == nil {
+			t.Errorf("accepted %+v", bad)
+		}
+	}
+}
+
+func TestNextUp(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{"Fargo.S01E01.mkv", "Fargo.S01E02.mkv", "Fargo.S01E03.mkv", "Fargo.S02E01.mkv"} {
+		writeTestFile(t, filepath.Join(s.root, "Shows", "Fargo", name), "episode", 0644)
+	}
+	writeTestFile(t, filepath.Join(s.root, "Shows", "Frasier", "Frasier 1x01.mp4"), "episode", 0644)
+	writeTestFile(t, filepath.Join(s.root, "Shows", "Frasier", "Frasier 1x02.mp4"), "episode", 0644)
+	if err := scanLibrary(context.Background(), func(float64) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fargo's third episode was seen ahead of the second, which was watched
+	// last, and Frasier's second is only partway through
+	now := time.Now()
+	history = map[string]map[string]*watchEntry{"": {
+		"Shows/Fargo/Fargo.S01E01.mkv":   {Watched: true, LastWatched: now.Add(-3 * time.Hour)},
+		"Shows/Fargo/Fargo.S01E03.mkv":   {Watched: true, LastWatched: now.Add(-2 * time.Hour)},
+		"Shows/Fargo/Fargo.S01E02.mkv":   {Watched: true, LastWatched: now.Add(-time.Hour)},
+		"Shows/Frasier/Frasier 1x01.mp4": {Watched: true, LastWatched: now.Add(-5 * time.Hour)},
+		"Shows/Frasier/Frasier 1x02.mp4": {Position: 60, LastWatched: now.Add(-4 * time.Hour)},
+		"Shows/Season 1/Episode 1.mp4":   {Watched: true, LastWatched: now},
+	}}
+	t.Cleanup(func() { history = map[string]map[string]*watchEntry{} })
+
+	status, body := s.get(t, "/api/nextup", nil)
+	var items []nextUpItem
+	if err := json.Unmarshal([]byte(body), &items); err != nil || status != http.StatusOK {
+		t.Fatalf("next up: %d %s", status, body)
+	}
+	if len(items) != 1 || items[0].Path != "Shows/Fargo/Fargo.S02E01.mkv" || items[0].Series != "Fargo" {
+		t.Errorf("next up is %+v", items)
+	}
+
+	// Autoplay's next episode carries on into the next season
+	status, body = s.get(t, "/api/nextup?path="+url.QueryEscape("Shows/Fargo/Fargo.S01E03.mkv"), nil)
+	var next nextUpItem
+	if err := json.Unmarshal([]byte(body), &next); err != nil || next.Path != "Shows/Fargo/Fargo.S02E01.mkv" {
+		t.Errorf("episode after S01E03: %d %s", status, body)
+	}
+	if status, _ := s.get(t, "/api/nextup?path="+url.QueryEscape("Shows/Fargo/Fargo.S02E01.mkv"), nil); status != http.StatusNotFound {
+		t.Errorf("episode after the last one: %d", status)
+	}
+
+	// Someone else's shows aren't next up for ada, or in ada's continue row
+	config().TrustedProxies = []string{"127.0.0.1"}
+	if err := setupForwardAuth(config()); err != nil {
+		t.Fatal(err)
+	}
+	ada := http.Header{"Remote-User": {"ada"}}
+	if _, body := s.get(t, "/api/nextup", ada); body != "[]\n" {
+		t.Errorf("next up for someone who hasn't watched anything: %s", body)
+	}
+	if _, body := s.get(t, "/api/continue", ada); body != "[]\n" {
+		t.Errorf("continue watching for someone who hasn't watched anything: %s", body)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s := newTestServer(t)
+	readOnly = true
+	t.Cleanup(func() { readOnly = false })
+	writeTestFile(t, filepath.Join(s.root, "Incoming", "Fargo.S01E02.mkv"), "episode", 0644)
+	settled := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(s.root, "Incoming", "Fargo.S01E02.mkv"), settled, settled); err != nil {
+		t.Fatal(err)
+	}
+	config().Organize = &organizeConfig{Rules: []organizeRule{{Match: `^Incoming/(.*)$`, Dest: "Shows/$1"}}}
+	if err := setupOrganize(config()); err != nil {
+		t.Fatal(err)
+	}
+	if err := scanLibrary(context.Background(), func(float64) {}); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(filepath.Join(s.root, "Incoming", "Fargo.S01E02.mkv")) {
+		t.Error("organize moved a file")
+	}
+
+	resp, err := s.Client().Post(s.URL+"/api/collections", "application/json", strings.NewReader(`{"name":"Heists"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("creating a collection: %d", resp.StatusCode)
+	}
+	if status, body := s.get(t, "/api/collections", nil); status != http.StatusOK {
+		t.Errorf("listing collections: %d %s", status, body)
+	}
+}
+
+func TestRemoteLibrary(t *testing.T) {
+	s := newTestServer(t)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer attic-token" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		switch {
+		case r.URL.Path == "/api/browse" && r.URL.Query().Get("path") == "Films":
+			w.Header().Set("X-Total-Count", "1")
+			w.Write([]byte(`[{"name":"Brazil.mkv","path":"Films/Brazil.mkv","isVideo":true}]`))
+		case r.URL.Path == "/api/video/Films/Brazil.mkv":
+			w.Write([]byte("remote video"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(remote.Close)
+	config().RemoteLibraries = map[string]*remoteLibrary{"Attic": {URL: remote.URL, Token: "attic-token"}}
+	if err := setupRemoteLibraries(config()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, body := s.get(t, "/api/browse?path=", nil); !strings.Contains(body, `"path":"Attic","isDir":true`) {
+		t.Errorf("library root doesn't list the remote library: %s", body)
+	}
+	if _, body := s.get(t, "/api/browse?path=Attic/Films", nil); !strings.Contains(body, `"path":"Attic/Films/Brazil.mkv"`) {
+		t.Errorf("remote listing: %s", body)
+	}
+	if status, body := s.get(t, "/api/video/Attic/Films/Brazil.mkv", nil); status != http.StatusOK || body != "remote video" {
+		t.Errorf("remote video: %d %s", status, body)
+	}
+
+	// Players sent there wouldn't have the token it asks for
+	config().RemoteLibraries["Attic"].Redirect = true
+	if err := setupRemoteLibraries(config()); err == nil {
+		t.Error("redirect accepted for a server that turns players away")
+	}
+	config().RemoteLibraries["Attic"].Redirect = false
+
+	// Peers get this server's own library only
+	config().Peers = map[string]string{"kitchen": "kitchen-token"}
+	peer := http.Header{"Authorization": {"Bearer kitchen-token"}}
+	if _, body := s.get(t, "/api/browse?path=", peer); strings.Contains(body, "Attic") {
+		t.Errorf("remote library listed to a peer: %s", body)
+	}
+
+	// and can't change it or run anything
+	for _, endpoint := range []string{"/api/import", "/api/collections", "/api/config/reload"} {
+		req, _ := http.NewRequest(http.MethodPost, s.URL+endpoint, strings.NewReader("{}"))
+		req.Header = peer
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("peer got %d from %s", resp.StatusCode, endpoint)
+		}
+	}
+}
+
+func TestSignIn(t *testing.T) {
+	s := newTestServer(t)
+	tokenKey = []byte("0123456789abcdef0123456789abcdef")
+	var nonce string
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 provider.URL,
+				"authorization_endpoint": provider.URL + "/authorize",
+				"token_endpoint":         provider.URL + "/token",
+			})
+		case "/token":
+			if id, secret, _ := r.BasicAuth(); id != "stromboli" || secret != "shh" || r.FormValue("code") != "good" {
+				http.Error(w, "Bad client", http.StatusUnauthorized)
+				return
+			}
+			claims, _ := json.Marshal(map[string]interface{}{
+				"iss": provider.URL, "aud": "stromboli", "exp": time.Now().Add(time.Hour).Unix(),
+				"nonce": nonce, "preferred_username": "ada", "groups": []string{"family"},
+			})
+			json.NewEncoder(w).Encode(map[string]string{"id_token": "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"})
+		}
+	}))
+	t.Cleanup(provider.Close)
+	config().OIDC = &oidcConfig{Issuer: provider.URL, ClientID: "stromboli", ClientSecret: "shh"}
+	config().Access = map[string][]string{"@family": {"Films"}}
+	if err := setupOIDC(config()); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := s.get(t, "/api/browse?path=Films", nil); status != http.StatusUnauthorized {
+		t.Errorf("browsing without signing in: %d", status)
+	}
+
+	client := s.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(s.URL + "/auth/login?next=/api/browse%3Fpath%3DFilms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	authorize, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce = authorize.Query().Get("nonce")
+
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/auth/callback?code=good&state="+authorize.Query().Get("state"), nil)
+	for _, cookie := range resp.Cookies() {
+		req.AddCookie(cookie)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if next := resp.Header.Get("Location"); next != "/api/browse?path=Films" {
+		t.Fatalf("callback: %d, sent to %q", resp.StatusCode, next)
+	}
+
+	header := http.Header{}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == sessionCookie {
+			header.Add("Cookie", cookie.Name+"="+cookie.Value)
+		}
+	}
+	if status, body := s.get(t, "/api/browse?path=Films", header); status != http.StatusOK || !strings.Contains(body, "Heat.mp4") {
+		t.Errorf("browsing once signed in: %d %s", status, body)
+	}
+	if status, _ := s.get(t, "/api/browse?path=Shows", header); status != http.StatusBadRequest {
+		t.Errorf("the group's access rule wasn't applied: %d", status)
+	}
+
+	// The ID token's groups make admins
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header = header
+	if isAdmin(req) {
+		t.Error("admin without being listed")
+	}
+	config().Admins = []string{"@family"}
+	if !isAdmin(req) {
+		t.Error("the provider's group didn't make an admin")
+	}
+	config().Guests = []string{"@family"}
+	if isAdmin(req) {
+		t.Error("a guest is an admin")
+	}
+}
+
+func TestSignInIssuer(t *testing.T) {
+	newTestServer(t)
+	discovered, signedBy := "", ""
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 discovered,
+				"authorization_endpoint": provider.URL + "/authorize",
+				"token_endpoint":         provider.URL + "/token",
+			})
+		case "/token":
+			claims, _ := json.Marshal(map[string]interface{}{
+				"iss": signedBy, "aud": "stromboli", "exp": time.Now().Add(time.Hour).Unix(), "nonce": "n",
+			})
+			json.NewEncoder(w).Encode(map[string]string{"id_token": "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"})
+		}
+	}))
+	t.Cleanup(provider.Close)
+	config().OIDC = &oidcConfig{Issuer: provider.URL, ClientID: "stromboli", ClientSecret: "shh"}
+	ctx := context.Background()
+
+	for _, issuer := range []string{"", "https://elsewhere.example"} {
+		discovered = issuer
+		oidcProviders = map[string]*oidcProvider{}
+		if _, err := discoverProvider(ctx, provider.URL); err == nil {
+			t.Errorf("discovery naming issuer %q was accepted", issuer)
+		}
+	}
+
+	discovered = provider.URL
+	oidcProviders = map[string]*oidcProvider{}
+	discovery, err := discoverProvider(ctx, provider.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issuer := range []string{"", "https://elsewhere.example"} {
+		signedBy = issuer
+		if _, err := exchangeCode(httptest.NewRequest(http.MethodGet, "/auth/callback", nil), discovery, "good", "n"); err == nil {
+			t.Errorf("ID token from %q was accepted", issuer)
+		}
+	}
+	signedBy = provider.URL
+	if _, err := exchangeCode(httptest.NewRequest(http.MethodGet, "/auth/callback", nil), discovery, "good", "n"); err != nil {
+		t.Errorf("ID token from the provider: %v", err)
+	}
+}
+
+// Only a trusted proxy says whether the browser came over HTTPS, which
+// decides the callback URL and whether cookies are secure
+func TestRequestScheme(t *testing.T) {
+	newTestServer(t)
+	r := httptest.NewRequest(http.MethodGet, "/auth/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if scheme := requestScheme(r); scheme != "http" {
+		t.Errorf("anyone's X-Forwarded-Proto was believed: %s", scheme)
+	}
+
+	config().TrustedProxies = []string{"192.0.2.1"}
+	if err := setupForwardAuth(config()); err != nil {
+		t.Fatal(err)
+	}
+	if scheme := requestScheme(r); scheme != "https" {
+		t.Errorf("the trusted proxy's X-Forwarded-Proto was ignored: %s", scheme)
+	}
+}
+
+func TestTrustedProxy(t *testing.T) {
+	s := newTestServer(t)
+	config().Access = map[string][]string{"ada": {"Films"}}
+	user := http.Header{"Remote-User": {"ada"}}
+
+	config().TrustedProxies = []string{"127.0.0.1"}
+	if err := setupForwardAuth(config()); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := s.get(t, "/api/browse?path=Films", user); status != http.StatusOK {
+		t.Errorf("user from the trusted proxy: %d", status)
+	}
+
+	config().TrustedProxies = []string{"10.0.0.0/8"}
+	if err := setupForwardAuth(config()); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := s.get(t, "/api/browse?path=Films", user); status != http.StatusBadRequest {
+		t.Errorf("user header from an untrusted address was believed: %d", status)
+	}
+
+	// Without a trusted proxy nobody's headers are believed
+	config().TrustedProxies = nil
+	config().UserHeader = "Remote-User"
+	if err := setupForwardAuth(config()); err == nil {
+		t.Error("userHeader accepted without trustedProxies")
+	}
+	if status, _ := s.get(t, "/api/browse?path=Films", user); status != http.StatusBadRequest {
+		t.Errorf("user header believed with no trusted proxy: %d", status)
+	}
+}
+
+// Each person has their own history, and the one everyone shared before
+// is carried over to all of them
+func TestHistoryPerUser(t *testing.T) {
+	s := newTestServer(t)
+	t.Cleanup(func() {
+		history = map[string]map[string]*watchEntry{}
+		userPreferences = map[string]preferences{}
+	})
+	writeTestFile(t, filepath.Join(dataDir, historyFile), `{"Films/Heat.mp4": {"path": "Films/Heat.mp4", "position": 600, "duration": 6000}}`, 0644)
+	userPreferences = map[string]preferences{"ada": defaultPreferences}
+	loadHistory()
+	for _, user := range []string{"", "ada"} {
+		if entry := history[user]["Films/Heat.mp4"]; entry == nil || entry.Position != 600 {
+			t.Errorf("%q's history after the upgrade: %+v", user, history[user])
+		}
+	}
+
+	config().TrustedProxies = []string{"127.0.0.1"}
+	if err := setupForwardAuth(config()); err != nil {
+		t.Fatal(err)
+	}
+	recordProgress(context.Background(), "ada", "Films/Alien.mkv", 60, 7000)
+	progress := "/api/progress?path=Films/Alien.mkv"
+	if status, _ := s.get(t, progress, http.Header{"Remote-User": {"ada"}}); status != http.StatusOK {
+		t.Errorf("ada's own progress: %d", status)
+	}
+	if status, _ := s.get(t, progress, http.Header{"Remote-User": {"bob"}}); status != http.StatusNotFound {
+		t.Errorf("bob sees ada's progress: %d", status)
+	}
+	if _, body := s.get(t, "/api/continue", nil); strings.Contains(body, "Alien") {
+		t.Errorf("ada's film carries on for everyone: %s", body)
+	}
+
+	history = map[string]map[string]*watchEntry{}
+	loadHistory()
+	if history["ada"]["Films/Alien.mkv"] == nil {
+		t.Error("per-user history wasn't saved")
+	}
+}
+
+// Reloading swaps the config under requests already being served
+func TestConfigReload(t *testing.T) {
+	s := newTestServer(t)
+	configFile = filepath.Join(t.TempDir(), "stromboli.json")
+	t.Cleanup(func() { configFile = "" })
+	writeTestFile(t, configFile, `{"maxHeight": 720}`, 0644)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if resp, err := s.Client().Get(s.URL + "/api/browse?path=Films"); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := reloadConfig(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if config().MaxHeight != 720 {
+		t.Errorf("reloaded config has maxHeight %d", config().MaxHeight)
+	}
+}
+
+// Progress is only told for files the user can see
+func TestProgressAccess(t *testing.T) {
+	s := newTestServer(t)
+	recordProgress(context.Background(), "", "Shows/Season 1/Episode 1.mp4", 60, 1200)
+	if status, _ := s.get(t, "/api/progress?path=Shows/Season%201/Episode%201.mp4", nil); status != http.StatusOK {
+		t.Fatalf("progress without access rules: %d", status)
+	}
+
+	config().Access = map[string][]string{"ada": {"Films"}}
+	config().TrustedProxies = []string{"127.0.0.1"}
+	if err := setupForwardAuth(config()); err != nil {
+		t.Fatal(err)
+	}
+	user := http.Header{"Remote-User": {"ada"}}
+	if status, _ := s.get(t, "/api/progress?path=Shows/Season%201/Episode%201.mp4", user); status != http.StatusBadRequest {
+		t.Errorf("progress outside the user's folders: %d", status)
+	}
+}
+
+// Exports, imports, reloads and broadcasts are for admins, not every member
+func TestAdminOnly(t *testing.T) {
+	s := newTestServer(t)
+	config().TrustedProxies = []string{"127.0.0.1"}
+	if err := setupForwardAuth(config()); err != nil {
+		t.Fatal(err)
+	}
+	config().BroadcastTargets = map[string]string{"twitch": "rtmp://live.example/app/key"}
+	endpoints := map[string]string{
+		"/api/export":        http.MethodGet,
+		"/api/import":        http.MethodPost,
+		"/api/config/reload": http.MethodPost,
+		"/api/invites":       http.MethodPost,
+		"/api/jobs?type=broadcast&path=Films/Heat.mp4": http.MethodPost,
+	}
+	status := func(method string, endpoint string, user string) int {
+		req, _ := http.NewRequest(method, s.URL+endpoint, nil)
+		req.Header.Set("Remote-User", user)
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	config().Admins = []string{"ada"}
+	for endpoint, method := range endpoints {
+		if got := status(method, endpoint, "bob"); got != http.StatusForbidden {
+			t.Errorf("member got %d from %s", got, endpoint)
+		}
+	}
+	if got := status(http.MethodGet, "/api/export", "ada"); got != http.StatusOK {
+		t.Errorf("admin's export: %d", got)
+	}
+	if got := status(http.MethodGet, "/api/jobs", "bob"); got != http.StatusOK {
+		t.Errorf("member's job list: %d", got)
+	}
+}
+
+func TestInvite(t *testing.T) {
+	s := newTestServer(t)
+	tokenKey = []byte("0123456789abcdef0123456789abcdef")
+	client := s.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	// Only admins invite people, and without sign-in nobody is one unless
+	// * is listed
+	resp, err := client.Post(s.URL+"/api/invites?role=guest", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("invite without being an admin: %d", resp.StatusCode)
+	}
+	config().Admins = []string{"*"}
+	resp, err = client.Post(s.URL+"/api/invites?role=guest", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		URL string `json:"url"`
+	}
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	invitePath := created.URL[strings.Index(created.URL, "/auth/invite/"):]
+
+	if status, body := s.get(t, invitePath, nil); status != http.StatusOK || !strings.Contains(body, `name="password"`) {
+		t.Fatalf("invite form: %d %s", status, body)
+	}
+	signUp := func() *http.Response {
+		resp, err := client.PostForm(s.URL+invitePath, map[string][]string{"name": {"grace"}, "password": {"correct horse"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp = signUp()
+	if resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) == 0 {
+		t.Fatalf("signing up: %d", resp.StatusCode)
+	}
+	if again := signUp(); again.StatusCode != http.StatusNotFound {
+		t.Errorf("invite worked twice: %d", again.StatusCode)
+	}
+
+	resp, err = client.PostForm(s.URL+"/auth/password", map[string][]string{"name": {"grace"}, "password": {"wrong"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong password: %d", resp.StatusCode)
+	}
+	resp, err = client.PostForm(s.URL+"/auth/password", map[string][]string{"name": {"grace"}, "password": {"correct horse"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cookie := resp.Cookies()[0]
+
+	// Invited as a guest, so they can't invite anyone themselves
+	header := http.Header{"Cookie": {cookie.Name + "=" + cookie.Value}}
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/api/invites", nil)
+	req.Header = header
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("guest account made an invite: %d", resp.StatusCode)
+	}
+
+	// and what they watch is kept as theirs
+	t.Cleanup(func() { history = map[string]map[string]*watchEntry{} })
+	req, _ = http.NewRequest(http.MethodPost, s.URL+"/api/progress", strings.NewReader(`{"path": "Films/Heat.mp4", "position": 60, "duration": 6000}`))
+	req.Header = header
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if status, _ := s.get(t, "/api/progress?path=Films/Heat.mp4", header); status != http.StatusOK {
+		t.Errorf("account's own progress: %d", status)
+	}
+	if status, _ := s.get(t, "/api/progress?path=Films/Heat.mp4", nil); status != http.StatusNotFound {
+		t.Errorf("account's progress shown to everyone: %d", status)
+	}
+}
+
+// Invitees can't take the name of someone the config file or the proxy
+// already knows, and with it their folders and history
+func TestInviteNameInUse(t *testing.T) {
+	s := newTestServer(t)
+	tokenKey = []byte("0123456789abcdef0123456789abcdef")
+	t.Cleanup(func() { userPreferences = map[string]preferences{} })
+	config().Admins = []string{"*"}
+	config().Access = map[string][]string{"dad": {""}, "*": {"Films"}}
+	userPreferences = map[string]preferences{"ada": defaultPreferences}
+	client := s.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	resp, err := client.Post(s.URL+"/api/invites", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		URL string `json:"url"`
+	}
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	invitePath := created.URL[strings.Index(created.URL, "/auth/invite/"):]
+
+	signUp := func(name string) int {
+		resp, err := client.PostForm(s.URL+invitePath, map[string][]string{"name": {name}, "password": {"correct horse"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, name := range []string{"dad", "ada"} {
+		if status := signUp(name); status != http.StatusConflict {
+			t.Errorf("signing up as %s, who's already known: %d", name, status)
+		}
+	}
+	if status := signUp("hopper"); status != http.StatusSeeOther {
+		t.Errorf("signing up with a new name: %d", status)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	s := newTestServer(t)
+	report := func(agent string, body string) int {
+		req, _ := http.NewRequest(http.MethodPost, s.URL+"/api/client-errors", strings.NewReader(body))
+		req.Header.Set("User-Agent", agent)
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	iphone := "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1"
+	for i := 0; i < 2; i++ {
+		if status := report(iphone, `{"path":"Films/Alien.mkv","kind":"decode","message":"PIPELINE_ERROR_DECODE","mode":"direct"}`); status != http.StatusNoContent {
+			t.Fatalf("reporting: %d", status)
+		}
+	}
+	report(iphone, `{"path":"Films/Alien.mkv","kind":"stalled","mode":"transcode","profile":"medium"}`)
+	if status := report(iphone, `{"path":"../secret.txt","kind":"decode"}`); status != http.StatusBadRequest {
+		t.Errorf("report outside the library: %d", status)
+	}
+	if status := report(iphone, `{"path":"Films/Heat.mp4","kind":"melted"}`); status != http.StatusBadRequest {
+		t.Errorf("unknown kind: %d", status)
+	}
+
+	status, body := s.get(t, "/api/client-errors", nil)
+	var list []clientErrors
+	json.Unmarshal([]byte(body), &list)
+	if status != http.StatusOK || len(list) != 1 || list[0].Count != 3 {
+		t.Fatalf("listing: %d %s", status, body)
+	}
+	errs := list[0].Devices["iphone / Safari"]
+	if errs == nil || errs.Kinds["decode"] != 2 || errs.Kinds["stalled"] != 1 || errs.Message != "PIPELINE_ERROR_DECODE" {
+		t.Errorf("iPhone's errors: %s", body)
+	}
+}
+
+func TestViewers(t *testing.T) {
+	s := newTestServer(t)
+	heartbeat := func(body string) int {
+		resp, err := s.Client().Post(s.URL+"/api/heartbeat", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := heartbeat(`{"session":"living-room","path":"Films/Heat.mp4"}`); status != http.StatusNoContent {
+		t.Fatalf("heartbeat: %d", status)
+	}
+	heartbeat(`{"session":"bedroom","path":"Films/Heat.mp4","paused":true}`)
+	if status := heartbeat(`{"session":"../x","path":"Films/Heat.mp4"}`); status != http.StatusBadRequest {
+		t.Errorf("heartbeat with a bad session: %d", status)
+	}
+
+	_, body := s.get(t, "/api/browse?path=Films", nil)
+	var files []FileInfo
+	json.Unmarshal([]byte(body), &files)
+	for _, file := range files {
+		want := 0
+		if file.Name == "Heat.mp4" {
+			want = 2
+		}
+		if file.Watching != want {
+			t.Errorf("%s watched by %d, want %d", file.Name, file.Watching, want)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, s.URL+"/api/heartbeat?session=bedroom", nil)
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Quiet players drop off too
+	viewersMutex.Lock()
+	viewers["living-room"].seen = time.Now().Add(-viewerTimeout - time.Second)
+	viewersMutex.Unlock()
+	if _, body := s.get(t, "/api/viewers", nil); !strings.Contains(body, `"count":0`) {
+		t.Errorf("viewers after closing: %s", body)
+	}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const markersFile = "markers.json"
+
+// Intro detection settings, in seconds
+const (
+	introSearchWindow = 360 // How far into each episode to look
+	minIntroLength    = 15
+	maxIntroLength    = 180 // Anything longer is more likely a shared recap or a duplicate file
+)
+
+// introMarker is where an episode's intro starts and ends, and where its
+// end credits start
+type introMarker struct {
+	IntroStart   float64 `json:"introStart"`
+	IntroEnd     float64 `json:"introEnd"`
+	CreditsStart float64 `json:"creditsStart,omitempty"`
+	Auto         bool    `json:"auto"` // Found by analysis rather than set by hand
+}
+
+var (
+	markersMutex sync.Mutex
+	markers      = map[string]*introMarker{}
+)
+
+func loadMarkers() {
+	markersMutex.Lock()
+	defer markersMutex.Unlock()
+	if err := loadJSON(markersFile, &markers); err != nil {
+		log.Printf("Error loading markers: %v", err)
+	}
+	// Earlier Windows builds recorded paths with backslashes
+	for key, marker := range markers {
+		if slashed := apiPath(key); slashed != key {
+			delete(markers, key)
+			markers[slashed] = marker
+		}
+	}
+}
+
+// introJob tracks the latest intro analysis, which runs as an analyze job
+type introJob struct {
+	mu      sync.Mutex
+	path    string
+	total   int
+	done    int
+	found   int
+	credits int
+	job     *backgroundJob
+}
+
+type introStatus struct {
+	Running bool   `json:"running"`
+	Path    string `json:"path"`
+	Total   int    `json:"total"`
+	Done    int    `json:"done"`
+	Found   int    `json:"found"`
+	Credits int    `json:"credits"` // Episodes whose end credits were found
+}
+
+var introAnalysis introJob
+
+// analyze fingerprints the start of every episode, then compares each with
+// its neighbours to find the stretch of audio they share. It looks for
+// where each episode's end credits start on the way.
+func (j *introJob) analyze(ctx context.Context, job *backgroundJob, episodes []string) error {
+	j.mu.Lock()
+	j.path, j.total, j.done, j.found, j.credits, j.job = job.Path, len(episodes), 0, 0, 0, job
+	j.mu.Unlock()
+
+	prints := make([][]uint32, len(episodes))
+	credits := map[string]float64{}
+	for i, episode := range episodes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		samples, err := decodeAudio(filepath.Join(rootDir, episode), introSearchWindow)
+		if err != nil {
+			log.Printf("Intro analysis: cannot decode %s: %v", episode, err)
+		} else {
+			prints[i] = fingerprint(samples)
+		}
+		if start, ok := findCreditsStart(ctx, episode); ok {
+			credits[episode] = start
+		}
+
+		j.mu.Lock()
+		j.done++
+		j.mu.Unlock()
+		job.setProgress(float64(i+1) / float64(len(episodes)))
+	}
+
+	// Each episode is compared with the next, the last with the one before
+	found := map[string]*introMarker{}
+	for i := 0; i+1 < len(episodes); i++ {
+		if prints[i] == nil || prints[i+1] == nil {
+			continue
+		}
+		startA, startB, length := commonSegment(prints[i], prints[i+1])
+		seconds := float64(length) * frameSeconds
+		if seconds < minIntroLength || seconds > maxIntroLength {
+			continue
+		}
+
+		found[episodes[i]] = &introMarker{
+			IntroStart: float64(startA) * frameSeconds,
+			IntroEnd:   float64(startA)*frameSeconds + seconds,
+			Auto:       true,
+		}
+		if found[episodes[i+1]] == nil {
+			found[episodes[i+1]] = &introMarker{
+				IntroStart: float64(startB) * frameSeconds,
+				IntroEnd:   float64(startB)*frameSeconds + seconds,
+				Auto:       true,
+			}
+		}
+	}
+
+	markersMutex.Lock()
+	for _, path := range episodes {
+		intro, creditsStart := found[path], credits[path]
+		if intro == nil && creditsStart == 0 {
+			continue
+		}
+		// Markers set by hand are kept, only getting credits they lack
+		existing := markers[path]
+		if existing != nil && !existing.Auto {
+			if existing.CreditsStart == 0 {
+				existing.CreditsStart = creditsStart
+			}
+			continue
+		}
+		marker := &introMarker{Auto: true}
+		if existing != nil {
+			*marker = *existing
+		}
+		if intro != nil {
+			marker.IntroStart, marker.IntroEnd = intro.IntroStart, intro.IntroEnd
+		}
+		if creditsStart > 0 {
+			marker.CreditsStart = creditsStart
+		}
+		markers[path] = marker
+	}
+	if err := saveJSON(markersFile, markers); err != nil {
+		log.Printf("Error saving markers: %v", err)
+	}
+	markersMutex.Unlock()
+
+	j.mu.Lock()
+	j.found, j.credits = len(found), len(credits)
+	j.mu.Unlock()
+	log.Printf("Intro analysis finished: found intros in %d and credits in %d of %d episodes", len(found), len(credits), len(episodes))
+	return nil
+}
+
+// start queues an analysis of a folder's episodes unless one is already
+// waiting or running
+func (j *introJob) start(path string, episodes int) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.job != nil && j.job.snapshot().active() {
+		return false
+	}
+	j.path, j.total, j.done, j.found, j.credits = path, episodes, 0, 0, 0
+	j.job = enqueueJob("analyze", path, nil)
+	return true
+}
+
+func (j *introJob) status() introStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	running := j.job != nil && j.job.snapshot().active()
+	return introStatus{Running: running, Path: j.path, Total: j.total, Done: j.done, Found: j.found, Credits: j.credits}
+}
+
+// runAnalyzeJob finds the intros of the episodes in an analyze job's folder
+func runAnalyzeJob(ctx context.Context, job *backgroundJob) error {
+	episodes, err := collectVideos(job.Path, false)
+	if err != nil {
+		return errors.New("Cannot read directory")
+	}
+	if len(episodes) < 2 {
+		return errors.New("Intros are found by comparing episodes, so at least two are needed")
+	}
+	sort.Strings(episodes)
+	return introAnalysis.analyze(ctx, job, episodes)
+}
+
+// handleIntroAnalysis starts finding the intros of the episodes in a folder
+// (POST ?path=) or reports progress (GET)
+func handleIntroAnalysis(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		path := r.URL.Query().Get("path")
+
+		// Security check: paths can't leave the root
+		path, _, ok := resolveRequestPath(r, path)
+		if !ok {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+
+		episodes, err := collectVideos(path, false)
+		if err != nil {
+			http.Error(w, "Cannot read directory", http.StatusNotFound)
+			return
+		}
+		if len(episodes) < 2 {
+			http.Error(w, "Intros are found by comparing episodes, so at least two are needed", http.StatusBadRequest)
+			return
+		}
+		if !introAnalysis.start(path, len(episodes)) {
+			http.Error(w, "An analysis is already running", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(introAnalysis.status())
+}
+
+// handleMarkers returns a video's intro and credits marker, or 204 if it has none
+func handleMarkers(w http.ResponseWriter, r *http.Request) {
+	path, _, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	markersMutex.Lock()
+	marker := markers[path]
+	markersMutex.Unlock()
+
+	if marker == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(marker)
+}
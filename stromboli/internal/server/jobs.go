@@ -0,0 +1,341 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+const jobsFile = "jobs.json"
+
+// Finished jobs are kept in the list for this long
+const jobRetention = 7 * 24 * time.Hour
+
+// jobType is a kind of background job: how many may run at once and what
+// running one does. Run reports progress through the job and stops when
+// the context is cancelled.
+type jobType struct {
+	limit int
+	slots chan struct{}
+	run   func(ctx context.Context, job *backgroundJob) error
+	live  bool // Not started over after a restart, as it would be from the beginning
+	admin bool // Only admins may start or stop one, as it reaches outside the server
+}
+
+// Job types by name. The config file's jobLimits can raise or lower how
+// many of each run at once.
+var jobTypes = map[string]*jobType{
+	"scan":       {limit: 1, run: runScanJob},
+	"thumbnails": {limit: 1, run: runThumbnailsJob},
+	"prepare":    {limit: 1, run: runPrepareJob},
+	"analyze":    {limit: 1, run: runAnalyzeJob},
+	"clip":       {limit: 1, run: runClipJob},
+	"broadcast":  {limit: 1, run: runBroadcastJob, live: true, admin: true},
+}
+
+type jobStatus struct {
+	ID       string            `json:"id"`
+	Type     string            `json:"type"`
+	Path     string            `json:"path,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+	State    string            `json:"state"`
+	Progress float64           `json:"progress"`
+	Error    string            `json:"error,omitempty"`
+	Created  time.Time         `json:"created"`
+	Started  *time.Time        `json:"started,omitempty"`
+	Finished *time.Time        `json:"finished,omitempty"`
+}
+
+// active reports whether the job is still waiting or running
+func (s jobStatus) active() bool {
+	return s.State == jobQueued || s.State == jobRunning
+}
+
+// backgroundJob is one job in the queue. Jobs are saved as they change
+// state, and ones a restart interrupted are queued again.
+type backgroundJob struct {
+	mu sync.Mutex
+	jobStatus
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var (
+	jobsMutex sync.Mutex
+	jobs      = map[string]*backgroundJob{}
+)
+
+// setupJobs applies the configured limits and picks up the jobs left over
+// from the last run
+func setupJobs() error {
+	for name, jt := range jobTypes {
+		if limit, ok := config().JobLimits[name]; ok {
+			if limit < 1 {
+				return errors.New(name + ": limit must be at least 1")
+			}
+			jt.limit = limit
+		}
+		jt.slots = make(chan struct{}, jt.limit)
+	}
+	for name := range config().JobLimits {
+		if jobTypes[name] == nil {
+			return errors.New("unknown job type " + name)
+		}
+	}
+
+	var saved []jobStatus
+	if err := loadJSON(jobsFile, &saved); err != nil {
+		log.Printf("Error loading jobs: %v", err)
+	}
+	requeued := 0
+	jobsMutex.Lock()
+	for _, status := range saved {
+		if jobTypes[status.Type] == nil {
+			continue
+		}
+		job := &backgroundJob{jobStatus: status}
+		if status.active() && jobTypes[status.Type].live {
+			now := time.Now()
+			job.State = jobFailed
+			job.Error = "Interrupted by a restart"
+			job.Finished = &now
+		} else if status.active() {
+			job.State = jobQueued
+			job.Progress = 0
+			job.Started = nil
+			job.start()
+			requeued++
+		}
+		jobs[job.ID] = job
+	}
+	jobsMutex.Unlock()
+	if requeued > 0 {
+		log.Printf("Requeued %d jobs the last shutdown interrupted", requeued)
+	}
+	return nil
+}
+
+// enqueueJob adds a job to the queue, to run once one of its type's slots
+// is free
+func enqueueJob(jobType string, path string, params map[string]string) *backgroundJob {
+	job := &backgroundJob{jobStatus: jobStatus{
+		ID:      newSessionID(),
+		Type:    jobType,
+		Path:    path,
+		Params:  params,
+		State:   jobQueued,
+		Created: time.Now(),
+	}}
+	jobsMutex.Lock()
+	jobs[job.ID] = job
+	job.start()
+	saveJobs()
+	jobsMutex.Unlock()
+	return job
+}
+
+// start runs the job in the background. Callers must hold jobsMutex.
+func (j *backgroundJob) start() {
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	go j.run()
+}
+
+func (j *backgroundJob) run() {
+	jt := jobTypes[j.Type]
+	select {
+	case jt.slots <- struct{}{}:
+	case <-j.ctx.Done():
+		j.finish(nil)
+		return
+	}
+	defer func() { <-jt.slots }()
+
+	now := time.Now()
+	j.mu.Lock()
+	j.State = jobRunning
+	j.Started = &now
+	j.mu.Unlock()
+	j.changed()
+
+	j.finish(jt.run(j.ctx, j))
+}
+
+// finish records how the job ended
+func (j *backgroundJob) finish(err error) {
+	now := time.Now()
+	j.mu.Lock()
+	j.Finished = &now
+	switch {
+	case j.ctx.Err() != nil:
+		j.State = jobCancelled
+	case err != nil:
+		j.State = jobFailed
+		j.Error = err.Error()
+		log.Printf("Job %s (%s %s) failed: %v", j.ID, j.Type, j.Path, err)
+	default:
+		j.State = jobDone
+		j.Progress = 1
+	}
+	j.mu.Unlock()
+	j.cancel()
+	j.changed()
+}
+
+// changed saves the queue and tells pages about the job
+func (j *backgroundJob) changed() {
+	jobsMutex.Lock()
+	saveJobs()
+	jobsMutex.Unlock()
+	publishEvent("job", j.snapshot())
+}
+
+func (j *backgroundJob) setProgress(progress float64) {
+	j.mu.Lock()
+	j.Progress = progress
+	j.mu.Unlock()
+}
+
+func (j *backgroundJob) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.jobStatus
+}
+
+// saveJobs writes the queue to disk, dropping jobs that finished long ago.
+// Callers must hold jobsMutex.
+func saveJobs() {
+	cutoff := time.Now().Add(-jobRetention)
+	saved := []jobStatus{}
+	for id, job := range jobs {
+		status := job.snapshot()
+		if status.Finished != nil && status.Finished.Before(cutoff) {
+			delete(jobs, id)
+			continue
+		}
+		saved = append(saved, status)
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].Created.Before(saved[j].Created)
+	})
+	if err := saveJSON(jobsFile, saved); err != nil {
+		log.Printf("Error saving jobs: %v", err)
+	}
+}
+
+func findJob(id string) *backgroundJob {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	return jobs[id]
+}
+
+// handleJobs lists jobs, newest first (GET /api/jobs?type=), queues one
+// (POST /api/jobs?type=&path=, other parameters going to the job), shows
+// one (GET /api/jobs/{id}) or cancels one (DELETE /api/jobs/{id})
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/")
+	if id != "" {
+		job := findJob(id)
+		if job == nil || !canAccess(r, job.snapshot().Path) {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			if jobTypes[job.snapshot().Type].admin && !isAdmin(r) {
+				http.Error(w, "Only admins can do this", http.StatusForbidden)
+				return
+			}
+			if !job.snapshot().active() {
+				http.Error(w, "Job has already finished", http.StatusConflict)
+				return
+			}
+			job.cancel()
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job.snapshot())
+		return
+	}
+
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		jobsMutex.Lock()
+		list := []jobStatus{}
+		for _, job := range jobs {
+			status := job.snapshot()
+			if (query.Get("type") == "" || status.Type == query.Get("type")) && canAccess(r, status.Path) {
+				list = append(list, status)
+			}
+		}
+		jobsMutex.Unlock()
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Created.After(list[j].Created)
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case http.MethodPost:
+		jobType := query.Get("type")
+		if jobTypes[jobType] == nil {
+			http.Error(w, "Unknown job type", http.StatusBadRequest)
+			return
+		}
+		if jobTypes[jobType].admin && !isAdmin(r) {
+			http.Error(w, "Only admins can do this", http.StatusForbidden)
+			return
+		}
+
+		// Security check: paths can't leave the root
+		path, fullPath, ok := resolveRequestPath(r, query.Get("path"))
+		if !ok {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(fullPath); err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		params := map[string]string{}
+		for key := range query {
+			if key != "type" && key != "path" {
+				params[key] = query.Get(key)
+			}
+		}
+		job := enqueueJob(jobType, path, params)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job.snapshot())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func runScanJob(ctx context.Context, job *backgroundJob) error {
+	return scanLibrary(ctx, job.setProgress)
+}
+
+func runThumbnailsJob(ctx context.Context, job *backgroundJob) error {
+	return generateMissingThumbnails(ctx, job.setProgress)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const labelsFile = "labels.json"
+
+// Most tags one file or folder can have
+const maxTags = 20
+
+// tagPattern is what tags may be made of, which also keeps them safe in the
+// inline handlers of the file list
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N} _-]{0,31}$`)
+
+// itemLabels are the star rating and tags given to a file or folder
+type itemLabels struct {
+	Rating int      `json:"rating,omitempty"` // 1 to 5 stars, 0 for none
+	Tags   []string `json:"tags,omitempty"`
+}
+
+var (
+	labelsMutex sync.Mutex
+	labels      = map[string]*itemLabels{}
+)
+
+func loadLabels() {
+	labelsMutex.Lock()
+	defer labelsMutex.Unlock()
+	if err := loadJSON(labelsFile, &labels); err != nil {
+		log.Printf("Error loading ratings and tags: %v", err)
+	}
+}
+
+// saveLabels writes the labels to disk. Callers must hold labelsMutex.
+func saveLabels() {
+	if err := saveJSON(labelsFile, labels); err != nil {
+		log.Printf("Error saving ratings and tags: %v", err)
+	}
+}
+
+// labelsOf returns a copy of the labels given to a path
+func labelsOf(path string) itemLabels {
+	labelsMutex.Lock()
+	defer labelsMutex.Unlock()
+	if l := labels[path]; l != nil {
+		return itemLabels{Rating: l.Rating, Tags: slices.Clone(l.Tags)}
+	}
+	return itemLabels{}
+}
+
+// normalizeTags trims and lower cases tags and drops repeats, reporting
+// false if any isn't allowed
+func normalizeTags(tags []string) ([]string, bool) {
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagPattern.MatchString(tag) {
+			return nil, false
+		}
+		if !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxTags {
+		return nil, false
+	}
+	sort.Strings(normalized)
+	return normalized, true
+}
+
+// matches reports whether labels pass a listing's tag and minimum rating
+// filters, either of which may be empty
+func (l itemLabels) matches(tag string, minRating int) bool {
+	if tag != "" && !slices.Contains(l.Tags, tag) {
+		return false
+	}
+	return l.Rating >= minRating
+}
+
+// handleLabels returns (GET) or replaces (PUT) the rating and tags of a
+// file or folder (?path=)
+func handleLabels(w http.ResponseWriter, r *http.Request) {
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+	if path == "" || !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !fileExists(fullPath) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		var update itemLabels
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if update.Rating < 0 || update.Rating > 5 {
+			http.Error(w, "Ratings go from 0 to 5", http.StatusBadRequest)
+			return
+		}
+		tags, ok := normalizeTags(update.Tags)
+		if !ok {
+			http.Error(w, "Invalid tags", http.StatusBadRequest)
+			return
+		}
+		update.Tags = tags
+
+		labelsMutex.Lock()
+		if update.Rating == 0 && len(update.Tags) == 0 {
+			delete(labels, path)
+		} else {
+			labels[path] = &update
+		}
+		saveLabels()
+		labelsMutex.Unlock()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labelsOf(path))
+}
+
+// handleTags lists the tags in use on what the user can see, with how many
+// files and folders have each
+func handleTags(w http.ResponseWriter, r *http.Request) {
+	type tagCount struct {
+		Tag   string `json:"tag"`
+		Count int    `json:"count"`
+	}
+	counts := map[string]int{}
+	labelsMutex.Lock()
+	for path, l := range labels {
+		if !canAccess(r, path) {
+			continue
+		}
+		for _, tag := range l.Tags {
+			counts[tag]++
+		}
+	}
+	labelsMutex.Unlock()
+
+	list := []tagCount{}
+	for tag, count := range counts {
+		list = append(list, tagCount{tag, count})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tag < list[j].Tag })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
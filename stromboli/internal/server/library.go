@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const indexFile = "index.json"
+
+// indexEntry is what the library index knows about a video file
+type indexEntry struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	Duration   float64   `json:"duration"`
+	VideoCodec string    `json:"videoCodec,omitempty"`
+	AudioCodec string    `json:"audioCodec,omitempty"`
+	Width      int       `json:"width,omitempty"`
+	Height     int       `json:"height,omitempty"`
+	FrameRate  float64   `json:"frameRate,omitempty"`
+	ProbeError string    `json:"probeError,omitempty"`
+	Corrupt    bool      `json:"corrupt,omitempty"`
+	CheckError string    `json:"checkError,omitempty"`
+	Checked    time.Time `json:"checked,omitempty"`
+}
+
+type libraryStats struct {
+	Videos        int       `json:"videos"`
+	TotalSize     int64     `json:"totalSize"`
+	TotalDuration float64   `json:"totalDuration"`
+	Updated       time.Time `json:"updated"`
+}
+
+var (
+	libraryMutex  sync.RWMutex
+	libraryIndex  = map[string]*indexEntry{}
+	libraryTotals libraryStats
+)
+
+func loadLibrary() {
+	libraryMutex.Lock()
+	defer libraryMutex.Unlock()
+	if err := loadJSON(indexFile, &libraryIndex); err != nil {
+		log.Printf("Error loading library index: %v", err)
+	}
+	// Earlier Windows builds keyed the index with backslashes
+	for key, entry := range libraryIndex {
+		if slashed := apiPath(key); slashed != key {
+			delete(libraryIndex, key)
+			entry.Path = slashed
+			libraryIndex[slashed] = entry
+		}
+	}
+}
+
+// saveLibrary writes the index to disk. Callers must hold libraryMutex.
+func saveLibrary() error {
+	return saveJSON(indexFile, libraryIndex)
+}
+
+func newIndexEntry(relativePath string, info os.FileInfo) *indexEntry {
+	entry := &indexEntry{
+		Path:    relativePath,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+
+	probe, err := probeFile(context.Background(), filepath.Join(rootDir, relativePath))
+	if err != nil {
+		entry.ProbeError = err.Error()
+		return entry
+	}
+
+	entry.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	if video := probe.MainVideoStream(); video != nil {
+		entry.VideoCodec = video.CodecName
+		entry.Width = video.Width
+		entry.Height = video.Height
+		entry.FrameRate = math.Round(video.FramesPerSecond()*1000) / 1000
+	}
+	if audio := probe.MainAudioStream(); audio != nil {
+		entry.AudioCodec = audio.CodecName
+	}
+	return entry
+}
+
+// scanLibrary walks the whole library, probing new and changed videos and
+// dropping files that have gone away. Progress is how many of the videos
+// needing a probe have had one. A scan stopped while probing keeps what it
+// has probed, for the next one to carry on from.
+func scanLibrary(ctx context.Context, report func(float64)) error {
+	libraryMutex.RLock()
+	known := make(map[string]*indexEntry, len(libraryIndex))
+	for path, entry := range libraryIndex {
+		known[path] = entry
+	}
+	libraryMutex.RUnlock()
+
+	type change struct {
+		rel  string
+		info os.FileInfo
+	}
+	found := map[string]*indexEntry{}
+	var changed []change
+
+	err := filepath.WalkDir(rootDir, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// Skip unreadable directories rather than abandoning the scan
+			log.Printf("Scan: %v", err)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if p != rootDir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !videoFormats[strings.ToLower(filepath.Ext(d.Name()))] {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := relativeAPIPath(p)
+		if err != nil {
+			return nil
+		}
+
+		if entry := known[rel]; entry != nil && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+			found[rel] = entry
+			return nil
+		}
+
+		changed = append(changed, change{rel, info})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	probed := len(changed)
+	for i, c := range changed {
+		if ctx.Err() != nil {
+			for _, rest := range changed[i:] {
+				if known[rest.rel] != nil {
+					found[rest.rel] = known[rest.rel]
+				}
+			}
+			probed = i
+			break
+		}
+		report(float64(i) / float64(len(changed)))
+		rel := c.rel
+		if known[rel] == nil {
+			if rel = organize(rel, c.info); rel == "" {
+				continue
+			}
+		}
+		found[rel] = newIndexEntry(rel, c.info)
+	}
+
+	removed := 0
+	for path := range known {
+		if found[path] == nil {
+			removed++
+		}
+	}
+
+	libraryMutex.Lock()
+	libraryIndex = found
+	err = saveLibrary()
+	libraryMutex.Unlock()
+
+	if probed < len(changed) {
+		log.Printf("Library scan stopped: %d videos, %d of %d probed, %d removed", len(found), probed, len(changed), removed)
+		if err == nil {
+			err = ctx.Err()
+		}
+	} else {
+		log.Printf("Library scan complete: %d videos, %d probed, %d removed", len(found), len(changed), removed)
+	}
+
+	// Open smart playlists are worked out from the index, so they refresh
+	if probed > 0 || removed > 0 {
+		publishEvent("library", len(found))
+	}
+	return err
+}
+
+// Ways to scan the library at startup, set with -scan-on-start
+const (
+	scanOnStartWait       = "wait"
+	scanOnStartBackground = "background"
+)
+
+// scanOnStart indexes the library before the server takes any requests, or
+// queues a scan job to do it in the background, so the first listings of a
+// big library don't set off an ffprobe for every file in them
+func scanOnStart(mode string) error {
+	switch mode {
+	case "":
+	case scanOnStartWait:
+		log.Printf("Scanning the library before serving")
+		next := 0.1
+		err := scanLibrary(context.Background(), func(progress float64) {
+			if progress >= next {
+				log.Printf("Library scan %d%% done", int(progress*100))
+				for progress >= next {
+					next += 0.1
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return aggregateStats()
+	case scanOnStartBackground:
+		job := enqueueJob("scan", "", nil)
+		log.Printf("Scanning the library in the background as job %s", job.ID)
+	default:
+		return errors.New("unknown mode " + mode)
+	}
+	return nil
+}
+
+// aggregateStats totals up the library index
+func aggregateStats() error {
+	libraryMutex.Lock()
+	defer libraryMutex.Unlock()
+
+	libraryTotals = libraryStats{Updated: time.Now()}
+	for _, entry := range libraryIndex {
+		libraryTotals.Videos++
+		libraryTotals.TotalSize += entry.Size
+		libraryTotals.TotalDuration += entry.Duration
+	}
+	return nil
+}
+
+// pregenerateThumbnails creates thumbnails for indexed videos that don't have one yet
+func pregenerateThumbnails() error {
+	return generateMissingThumbnails(context.Background(), func(float64) {})
+}
+
+// generateMissingThumbnails is pregenerateThumbnails for thumbnail jobs,
+// reporting how far through the library it is. The newest videos go first,
+// being the likeliest to be looked at.
+func generateMissingThumbnails(ctx context.Context, report func(float64)) error {
+	libraryMutex.RLock()
+	var entries []indexEntry
+	for _, entry := range libraryIndex {
+		entries = append(entries, *entry)
+	}
+	libraryMutex.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime.After(entries[j].ModTime) })
+
+	generated := 0
+	for i, entry := range entries {
+		if ctx.Err() != nil {
+			log.Printf("Generated %d thumbnails before stopping", generated)
+			return ctx.Err()
+		}
+		report(float64(i) / float64(len(entries)))
+		fullPath := filepath.Join(rootDir, entry.Path)
+		thumb := thumbnailPath(fullPath, entry.ModTime, thumbnailWidth)
+		if fileExists(thumb) || entry.ProbeError != "" {
+			continue
+		}
+		if err := generateThumbnail(context.Background(), fullPath, thumb, thumbnailWidth); err != nil {
+			log.Printf("Error generating thumbnail for %s: %v", entry.Path, err)
+			continue
+		}
+		generated++
+	}
+
+	log.Printf("Generated %d thumbnails", generated)
+	return nil
+}
+
+// pruneCaches removes thumbnails of files no longer in the library, along
+// with expired offline copies, warm-ups, sessions, logs and comic pages
+func pruneCaches() error {
+	libraryMutex.RLock()
+	indexed := len(libraryIndex) > 0
+	wanted := make(map[string]bool, 2*len(libraryIndex))
+	for _, entry := range libraryIndex {
+		for _, width := range []int{thumbnailWidth, dataSaverThumbnailWidth} {
+			wanted[filepath.Base(thumbnailPath(filepath.Join(rootDir, entry.Path), entry.ModTime, width))] = true
+		}
+	}
+	libraryMutex.RUnlock()
+
+	// Without an index every thumbnail would look unused
+	removed := 0
+	thumbDir := filepath.Join(dataDir, "thumbnails")
+	if entries, err := os.ReadDir(thumbDir); err == nil && indexed {
+		for _, entry := range entries {
+			if !wanted[entry.Name()] {
+				os.Remove(filepath.Join(thumbDir, entry.Name()))
+				removed++
+			}
+		}
+	}
+
+	offlineMutex.Lock()
+	pruneOfflineCopies()
+	offlineMutex.Unlock()
+
+	pruneWarmups()
+
+	sessionsMutex.Lock()
+	pruneSessions()
+	sessionsMutex.Unlock()
+
+	pruneSessionLogs()
+	pruneComicPages()
+
+	log.Printf("Pruned %d unused thumbnails", removed)
+	return nil
+}
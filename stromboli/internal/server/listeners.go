@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Server timeouts. Ordinary responses get a write timeout so stuck clients
+// don't hold connections open, and handlers that stream for as long as a
+// video plays lift it for their own request with longResponse.
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = time.Minute
+	writeTimeout      = 2 * time.Minute
+	idleTimeout       = 2 * time.Minute
+	maxHeaderBytes    = 64 << 10
+)
+
+// listenConfig is one address the server listens on. Addresses are
+// host:port, http://host:port, https://host:port or unix:/path/to.sock.
+type listenConfig struct {
+	Address string `json:"address"`
+	Cert    string `json:"cert,omitempty"` // For https, falling back to -tls-cert
+	Key     string `json:"key,omitempty"`
+}
+
+// listener is a parsed listenConfig ready to open
+type listener struct {
+	network string // tcp or unix
+	address string
+	tls     bool
+	cert    string
+	key     string
+}
+
+func (l listener) url() string {
+	switch {
+	case l.network == "unix":
+		return "unix:" + l.address
+	case l.tls:
+		return "https://" + displayHost(l.address)
+	default:
+		return "http://" + displayHost(l.address)
+	}
+}
+
+// displayHost fills in localhost for addresses listening on every interface
+func displayHost(address string) string {
+	if strings.HasPrefix(address, ":") {
+		return "localhost" + address
+	}
+	return address
+}
+
+func parseListener(c listenConfig, defaultCert string, defaultKey string) (listener, error) {
+	address := c.Address
+	l := listener{network: "tcp"}
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		l.network = "unix"
+		address = strings.TrimPrefix(address, "unix:")
+	case strings.HasPrefix(address, "https://"):
+		l.tls = true
+		address = strings.TrimPrefix(address, "https://")
+	case strings.HasPrefix(address, "http://"):
+		address = strings.TrimPrefix(address, "http://")
+	}
+	if address == "" {
+		return l, fmt.Errorf("listen address %q has no address", c.Address)
+	}
+	if l.network == "tcp" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return l, fmt.Errorf("listen address %q: %v", c.Address, err)
+		}
+	}
+	l.address = address
+
+	if l.tls {
+		l.cert, l.key = c.Cert, c.Key
+		if l.cert == "" {
+			l.cert, l.key = defaultCert, defaultKey
+		}
+		if l.cert == "" || l.key == "" {
+			return l, fmt.Errorf("listen address %q needs a certificate and key", c.Address)
+		}
+	}
+	return l, nil
+}
+
+// setupListeners works out the addresses to listen on: -listen flags, then
+// the config file, then the -p port on every interface
+func setupListeners(flags []string, port string, cert string, key string) ([]listener, error) {
+	configs := config().Listen
+	if len(flags) > 0 {
+		configs = nil
+		for _, address := range flags {
+			configs = append(configs, listenConfig{Address: address})
+		}
+	}
+	if len(configs) == 0 {
+		configs = []listenConfig{{Address: ":" + port}}
+	}
+
+	var listeners []listener
+	for _, c := range configs {
+		l, err := parseListener(c, cert, key)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// open starts listening. A socket file left by a server that didn't shut
+// down cleanly is replaced.
+func (l listener) open() (net.Listener, error) {
+	if l.network == "unix" {
+		if info, err := os.Lstat(l.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(l.address)
+		}
+		ln, err := net.Listen("unix", l.address)
+		if err != nil {
+			return nil, err
+		}
+		// The reverse proxy usually runs as another user
+		os.Chmod(l.address, 0666)
+		return ln, nil
+	}
+	return net.Listen("tcp", l.address)
+}
+
+// newServer configures a server for one listener. ServeTLS adds HTTP/2 to
+// the protocols offered, so browsers use it over https.
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			NextProtos: []string{"h2", "http/1.1"},
+		},
+	}
+}
+
+// longResponse lifts the write timeout for handlers whose responses last as
+// long as the video, like streams, downloads and server-sent events
+func longResponse(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			log.Printf("Cannot lift write timeout for %s: %v", r.URL.Path, err)
+		}
+		next(w, r)
+	}
+}
+
+// serve listens on every address, returning when any of them fails
+func serve(listeners []listener, handler http.Handler) error {
+	var opened []net.Listener
+	for _, l := range listeners {
+		ln, err := l.open()
+		if err != nil {
+			for _, o := range opened {
+				o.Close()
+			}
+			return fmt.Errorf("cannot listen on %s: %v", l.url(), err)
+		}
+		opened = append(opened, ln)
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		ln, l := opened[i], l
+		log.Printf("Server starting on %s", l.url())
+		go func() {
+			server := newServer(handler)
+			var err error
+			if l.tls {
+				err = server.ServeTLS(ln, l.cert, l.key)
+			} else {
+				err = server.Serve(ln)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("%s: %v", l.url(), err)
+			}
+		}()
+	}
+	return <-errs
+}
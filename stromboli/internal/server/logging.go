@@ -0,0 +1,224 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directory for per-session ffmpeg logs, empty means ffmpeg output goes to the main log
+var sessionLogDir string
+var logMaxAge time.Duration
+
+// rotatingWriter is an io.Writer that writes to a log file, rotating it once
+// it grows past maxSize and pruning rotated files older than maxAge.
+type rotatingWriter struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	file    *os.File
+	size    int64
+}
+
+func newRotatingWriter(path string, maxSize int64, maxAge time.Duration) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	w.prune()
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			// Keep writing to the current file rather than losing output
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) rotate() error {
+	w.file.Close()
+
+	// Rotating more than once a second adds a number, so nothing is overwritten
+	base := w.path + "." + time.Now().Format("20060102-150405")
+	rotated := base
+	for i := 1; fileExists(rotated); i++ {
+		rotated = base + "-" + strconv.Itoa(i)
+	}
+	if err := os.Rename(w.path, rotated); err != nil {
+		return w.reopen(rotated, err)
+	}
+	if err := w.open(); err != nil {
+		return w.reopen(rotated, err)
+	}
+	go w.prune()
+	return nil
+}
+
+// reopen goes back to the log file after a rotation failed, or on to the
+// file it was renamed to if it can't be opened, so output isn't lost
+func (w *rotatingWriter) reopen(rotated string, cause error) error {
+	if err := w.open(); err == nil {
+		return cause
+	}
+	if f, err := os.OpenFile(rotated, os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+		w.file = f
+	}
+	return cause
+}
+
+// prune removes rotated copies of the log file older than maxAge
+func (w *rotatingWriter) prune() {
+	if w.maxAge <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-w.maxAge)
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(m)
+		}
+	}
+}
+
+func setupLogging(logFile string, maxSizeMB int, maxAgeDays int, logDir string) error {
+	logMaxAge = time.Duration(maxAgeDays) * 24 * time.Hour
+
+	if logFile != "" {
+		w, err := newRotatingWriter(logFile, int64(maxSizeMB)*1024*1024, logMaxAge)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(w)
+	}
+
+	if logDir != "" {
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			return err
+		}
+		sessionLogDir = logDir
+		pruneSessionLogs()
+	}
+	return nil
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// streamLogger logs lines about one stream, each starting with the stream's
+// ID. The ID is the player's session ID with a part added for the request,
+// so a user's playback can be followed through a busy log, seeks and all.
+type streamLogger struct {
+	id string
+}
+
+// newStreamLogger gives a stream request its ID, sending it back in the
+// X-Stream-ID header
+func newStreamLogger(w http.ResponseWriter, sessionID string) streamLogger {
+	b := make([]byte, 3)
+	rand.Read(b)
+	l := streamLogger{sessionID + "." + hex.EncodeToString(b)}
+	w.Header().Set("X-Stream-ID", l.id)
+	return l
+}
+
+func (l streamLogger) Printf(format string, args ...interface{}) {
+	if l.id == "" {
+		log.Printf(format, args...)
+		return
+	}
+	log.Printf("[%s] %s", l.id, fmt.Sprintf(format, args...))
+}
+
+// openSessionLog returns the writer ffmpeg stderr should be copied to for a
+// single stream. Without a log directory it falls back to the main log.
+func openSessionLog(l streamLogger, path string) io.WriteCloser {
+	if sessionLogDir == "" {
+		return mainLogWriter{"[" + l.id + "] FFmpeg: "}
+	}
+
+	name := fmt.Sprintf("ffmpeg-%s-%s.log", time.Now().Format("20060102-150405"), l.id)
+	f, err := os.Create(filepath.Join(sessionLogDir, name))
+	if err != nil {
+		l.Printf("Error creating session log: %v", err)
+		return mainLogWriter{"[" + l.id + "] FFmpeg: "}
+	}
+	fmt.Fprintf(f, "# %s\n# Stream %s\n", path, l.id)
+	l.Printf("FFmpeg output logged to %s", f.Name())
+	return f
+}
+
+// pruneSessionLogs removes per-session ffmpeg logs older than the log max age
+func pruneSessionLogs() {
+	if sessionLogDir == "" || logMaxAge <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(sessionLogDir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-logMaxAge)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "ffmpeg-") {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(sessionLogDir, entry.Name()))
+		}
+	}
+}
+
+// mainLogWriter prefixes each write and sends it to the main log
+type mainLogWriter struct {
+	prefix string
+}
+
+func (m mainLogWriter) Write(p []byte) (int, error) {
+	log.Printf("%s%s", m.prefix, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+func (m mainLogWriter) Close() error { return nil }
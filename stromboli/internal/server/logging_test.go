@@ -0,0 +1,48 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Each rotation keeps its own file, however quickly they come
+func TestRotatingWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stromboli.log")
+	w, err := newRotatingWriter(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first line\n", "second line\n", "third line\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 2 {
+		t.Errorf("%d rotated files, want 2", len(rotated))
+	}
+}
+
+// A rotation that fails carries on writing to the log file
+func TestRotatingWriterFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stromboli.log")
+	w, err := newRotatingWriter(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("first line\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// With the file gone there's nothing to rename
+	os.Remove(path)
+	if _, err := w.Write([]byte("after a failed rotation\n")); err != nil {
+		t.Fatalf("writing after a failed rotation: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), "after a failed rotation") {
+		t.Errorf("log file has %q, %v", data, err)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// A small Markdown renderer for folder descriptions. It covers the common
+// block and inline syntax, and escapes everything else, so raw HTML in a
+// README is shown rather than run.
+
+var (
+	headingPattern     = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	orderedItemPattern = regexp.MustCompile(`^\d+[.)]\s+`)
+	rulePattern        = regexp.MustCompile(`^(?:-\s*){3,}$|^(?:\*\s*){3,}$|^(?:_\s*){3,}$`)
+	linkPattern        = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	strongPattern      = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	emphasisPattern    = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+)
+
+// renderMarkdown converts Markdown to HTML
+func renderMarkdown(src string) string {
+	var out strings.Builder
+	var paragraph []string
+	listTag := ""
+	inCode := false
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + renderInline(strings.Join(paragraph, " ")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if listTag != "" {
+			out.WriteString("</" + listTag + ">\n")
+			listTag = ""
+		}
+	}
+	openList := func(tag string) {
+		if listTag != tag {
+			closeList()
+			out.WriteString("<" + tag + ">\n")
+			listTag = tag
+		}
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") {
+			if inCode {
+				out.WriteString("</code></pre>\n")
+			} else {
+				flushParagraph()
+				closeList()
+				out.WriteString("<pre><code>")
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			out.WriteString(html.EscapeString(line) + "\n")
+			continue
+		}
+
+		switch {
+		case trimmed == "":
+			flushParagraph()
+			closeList()
+		case headingPattern.MatchString(trimmed):
+			flushParagraph()
+			closeList()
+			m := headingPattern.FindStringSubmatch(trimmed)
+			tag := "h" + string(rune('0'+len(m[1])))
+			out.WriteString("<" + tag + ">" + renderInline(m[2]) + "</" + tag + ">\n")
+		case rulePattern.MatchString(trimmed):
+			flushParagraph()
+			closeList()
+			out.WriteString("<hr>\n")
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ") || strings.HasPrefix(trimmed, "+ "):
+			flushParagraph()
+			openList("ul")
+			out.WriteString("<li>" + renderInline(trimmed[2:]) + "</li>\n")
+		case orderedItemPattern.MatchString(trimmed):
+			flushParagraph()
+			openList("ol")
+			out.WriteString("<li>" + renderInline(orderedItemPattern.ReplaceAllString(trimmed, "")) + "</li>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flushParagraph()
+			closeList()
+			out.WriteString("<blockquote>" + renderInline(strings.TrimSpace(trimmed[1:])) + "</blockquote>\n")
+		default:
+			closeList()
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+
+	if inCode {
+		out.WriteString("</code></pre>\n")
+	}
+	flushParagraph()
+	closeList()
+	return out.String()
+}
+
+// renderInline handles code spans, links and emphasis within a line
+func renderInline(text string) string {
+	var out strings.Builder
+
+	// Odd pieces are inside backticks and left as they are
+	for i, piece := range strings.Split(text, "`") {
+		escaped := html.EscapeString(piece)
+		if i%2 == 1 {
+			out.WriteString("<code>" + escaped + "</code>")
+			continue
+		}
+
+		escaped = linkPattern.ReplaceAllStringFunc(escaped, func(link string) string {
+			m := linkPattern.FindStringSubmatch(link)
+			if !safeLink(html.UnescapeString(m[2])) {
+				return m[1]
+			}
+			return `<a href="` + m[2] + `" target="_blank" rel="noopener">` + m[1] + "</a>"
+		})
+		escaped = strongPattern.ReplaceAllString(escaped, "<strong>$1$2</strong>")
+		escaped = emphasisPattern.ReplaceAllString(escaped, "<em>$1$2</em>")
+		out.WriteString(escaped)
+	}
+	return out.String()
+}
+
+// safeLink allows web and mail links along with relative ones, keeping out
+// javascript: and the like
+func safeLink(url string) bool {
+	scheme, _, found := strings.Cut(url, ":")
+	if !found || strings.ContainsAny(scheme, "/?#") {
+		return true
+	}
+	switch strings.ToLower(scheme) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
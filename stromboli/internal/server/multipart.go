@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Matches the part marker in names like "Movie CD1", "Movie.part2" or "Movie (Disc 1)"
+var partPattern = regexp.MustCompile(`(?i)^(.*?)[\s._\-\[(]+(?:cd|disc|disk|part|pt)[\s._\-]*(\d{1,2})[\])]?(.*)$`)
+
+// partKey returns what identifies a file's set of parts along with its part
+// number, or ok=false if the name has no part marker
+func partKey(name string) (key string, number int, ok bool) {
+	ext := filepath.Ext(name)
+	m := partPattern.FindStringSubmatch(strings.TrimSuffix(name, ext))
+	if m == nil {
+		return "", 0, false
+	}
+	number, _ = strconv.Atoi(m[2])
+	return strings.ToLower(m[1] + "|" + m[3] + ext), number, true
+}
+
+// groupParts finds multi-part sets among file names in one directory.
+// The result maps the first part of each set to all of its parts in order.
+func groupParts(names []string) map[string][]string {
+	type part struct {
+		name   string
+		number int
+	}
+	sets := map[string][]part{}
+	for _, name := range names {
+		if key, number, ok := partKey(name); ok {
+			sets[key] = append(sets[key], part{name, number})
+		}
+	}
+
+	groups := map[string][]string{}
+	for _, parts := range sets {
+		if len(parts) < 2 {
+			continue
+		}
+		sort.Slice(parts, func(i, j int) bool { return parts[i].number < parts[j].number })
+		var names []string
+		for _, p := range parts {
+			names = append(names, p.name)
+		}
+		groups[names[0]] = names
+	}
+	return groups
+}
+
+// partsOf returns the relative paths of every part in the set starting with
+// the given file, or nil if it isn't the first part of a set
+func partsOf(relativePath string) []string {
+	dir := filepath.Dir(relativePath)
+	entries, err := os.ReadDir(filepath.Join(rootDir, dir))
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && videoFormats[strings.ToLower(filepath.Ext(entry.Name()))] {
+			names = append(names, entry.Name())
+		}
+	}
+
+	var parts []string
+	for _, name := range groupParts(names)[filepath.Base(relativePath)] {
+		parts = append(parts, apiPath(filepath.Join(dir, name)))
+	}
+	return parts
+}
+
+// writeConcatList writes an ffmpeg concat demuxer list of the given files,
+// returning the list's path. The caller removes it when done.
+func writeConcatList(fullPaths []string) (string, error) {
+	f, err := os.CreateTemp("", "stromboli-concat-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	for _, p := range fullPaths {
+		// Single quotes are escaped by closing the quote, adding \' and reopening it
+		escaped := strings.ReplaceAll(p, "'", `'\''`)
+		if _, err := fmt.Fprintf(f, "file '%s'\n", escaped); err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+	return f.Name(), nil
+}
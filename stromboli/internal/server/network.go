@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// Profiles transcodes start at when the config file doesn't say: the best
+// for players on the local network, and a capped bitrate for ones coming
+// in over the internet
+const (
+	defaultLANProfile = "high"
+	defaultWANProfile = "medium"
+)
+
+// setupNetworks checks the external networks and the profiles for each
+// side of the router
+func setupNetworks(c *Config) error {
+	networks, err := parseNetworks(c.ExternalNetworks)
+	if err != nil {
+		return err
+	}
+	c.externalNetworks = networks
+	for _, name := range []string{c.LANProfile, c.WANProfile} {
+		if name != "" && !isQualityProfile(name) {
+			return fmt.Errorf("unknown profile %q", name)
+		}
+	}
+	return nil
+}
+
+// isQualityProfile reports whether a profile is a step on the quality ladder
+func isQualityProfile(name string) bool {
+	for _, p := range transcode.Profiles {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// onLocalNetwork reports whether a request comes from a private, loopback
+// or link-local address that isn't in one of the external networks, like
+// a VPN's
+func onLocalNetwork(r *http.Request) bool {
+	ip := clientIP(r)
+	if ip == nil || inNetworks(ip, config().externalNetworks) {
+		return false
+	}
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
+
+// startProfile is the profile a player's transcodes start at: the one the
+// user picked, or else the one for the network they're on
+func startProfile(r *http.Request) transcode.Profile {
+	name := getPreferences(requestUser(r)).Quality
+	if name == "" && onLocalNetwork(r) {
+		name = config().LANProfile
+		if name == "" {
+			name = defaultLANProfile
+		}
+	} else if name == "" {
+		name = config().WANProfile
+		if name == "" {
+			name = defaultWANProfile
+		}
+	}
+	profile, ok := transcode.FindProfile(name)
+	if !ok {
+		return transcode.Profiles[0]
+	}
+	return profile
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStartProfile(t *testing.T) {
+	saved := config()
+	t.Cleanup(func() { currentConfig.Store(saved) })
+	currentConfig.Store(&Config{
+		TrustedProxies:   []string{"172.18.0.2"},
+		ExternalNetworks: []string{"10.8.0.0/24"},
+	})
+	if err := setupForwardAuth(config()); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupNetworks(config()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		addr      string
+		forwarded string
+		want      string
+	}{
+		{"loopback", "127.0.0.1:5000", "", "high"},
+		{"home network", "192.168.1.20:5000", "", "high"},
+		{"internet", "203.0.113.9:5000", "", "medium"},
+		{"vpn", "10.8.0.5:5000", "", "medium"},
+		{"through the proxy from home", "172.18.0.2:5000", "192.168.1.20", "high"},
+		{"through the proxy from outside", "172.18.0.2:5000", "192.168.1.20, 203.0.113.9", "medium"},
+		{"forwarded by someone else", "203.0.113.9:5000", "192.168.1.20", "medium"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/stream/a.mkv", nil)
+			r.RemoteAddr = tt.addr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := startProfile(r).Name; got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
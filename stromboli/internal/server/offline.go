@@ -0,0 +1,384 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"video-browser/stromboli/internal/library"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// Finished offline copies are deleted after this long
+const offlineRetention = 7 * 24 * time.Hour
+
+// prepareProfile is how offline copies are encoded. They're made ahead of
+// time rather than while someone watches, so they can afford slower presets
+// and two passes for a smaller file at the same quality.
+type prepareProfile struct {
+	Preset       string `json:"preset"`
+	CRF          int    `json:"crf"`     // Quality of single-pass encodes
+	TwoPass      bool   `json:"twoPass"` // Encode twice at Bitrate, spending bits where they're needed
+	Bitrate      string `json:"bitrate"` // Average video bitrate of two-pass encodes
+	MaxRate      string `json:"maxRate"`
+	BufSize      string `json:"bufSize"`
+	MaxHeight    int    `json:"maxHeight"`
+	AudioBitrate string `json:"audioBitrate"`
+}
+
+// Prepare profiles by name. The config can change them or add more.
+var prepareProfiles = map[string]prepareProfile{
+	"fast": {Preset: "veryfast", CRF: 26, MaxRate: "2M", BufSize: "4M", MaxHeight: 720, AudioBitrate: "128k"},
+	"best": {Preset: "slow", CRF: 24, TwoPass: true, Bitrate: "1200k", MaxRate: "2M", BufSize: "4M", MaxHeight: 720, AudioBitrate: "128k"},
+}
+
+const defaultPrepareProfile = "fast"
+
+// The prepare profiles as built in, which the config's are laid over
+var builtinPrepareProfiles = maps.Clone(prepareProfiles)
+
+// setupPrepareProfiles lays the config's prepare profiles over the built-in
+// ones. Settings a profile leaves out keep the built-in profile's values, or
+// fast's for a new profile.
+func setupPrepareProfiles(c *Config) error {
+	profiles := maps.Clone(builtinPrepareProfiles)
+	for name, raw := range c.PrepareProfiles {
+		profile, ok := profiles[name]
+		if !ok {
+			profile = profiles[defaultPrepareProfile]
+			profile.Bitrate = profiles["best"].Bitrate
+		}
+		if err := json.Unmarshal(raw, &profile); err != nil {
+			return fmt.Errorf("prepare profile %s: %v", name, err)
+		}
+		profiles[name] = profile
+	}
+	if c.PrepareProfile == "" {
+		c.PrepareProfile = defaultPrepareProfile
+	}
+	if _, ok := profiles[c.PrepareProfile]; !ok {
+		return fmt.Errorf("unknown prepare profile %q", c.PrepareProfile)
+	}
+	prepareProfiles = profiles
+	return nil
+}
+
+// offlineJob is a background transcode of a file to a phone-friendly copy.
+// It runs as a prepare job, one at a time by default so it doesn't starve
+// live streams. Copies found already made have no job.
+type offlineJob struct {
+	mu      sync.Mutex
+	ID      string
+	Path    string
+	Profile string
+	Size    int64
+	output  string
+	profile prepareProfile
+	job     *backgroundJob
+}
+
+type offlineStatus struct {
+	ID       string  `json:"id"`
+	Path     string  `json:"path"`
+	Profile  string  `json:"profile"`
+	State    string  `json:"state"`
+	Progress float64 `json:"progress"`
+	Error    string  `json:"error,omitempty"`
+	Size     int64   `json:"size,omitempty"`
+}
+
+var (
+	offlineMutex sync.Mutex
+	offlineJobs  = map[string]*offlineJob{}
+)
+
+func offlineDir() string {
+	return filepath.Join(dataDir, "offline")
+}
+
+// offlineJobID is derived from the file, its modification time and the
+// profile's settings, so asking twice for the same copy reuses it
+func offlineJobID(fullPath string, info os.FileInfo, profile prepareProfile) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%+v", fullPath, info.ModTime().UnixNano(), profile)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (j *offlineJob) snapshot() offlineStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := offlineStatus{ID: j.ID, Path: j.Path, Profile: j.Profile, State: jobDone, Progress: 1, Size: j.Size}
+	if j.job != nil {
+		job := j.job.snapshot()
+		status.State, status.Progress, status.Error = job.State, job.Progress, job.Error
+	}
+	return status
+}
+
+// readProgress follows the key=value lines ffmpeg writes with -progress,
+// reporting how far through the given duration it has got
+func readProgress(r io.Reader, duration float64, report func(float64)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		if (key == "out_time_us" || key == "out_time_ms") && duration > 0 {
+			// Despite the name, out_time_ms is also in microseconds
+			us, _ := strconv.ParseFloat(value, 64)
+			report(min(us/1e6/duration, 1))
+		}
+	}
+}
+
+func (j *offlineJob) run(ctx context.Context, fullPath string) error {
+	log.Printf("Preparing offline copy of %s (%s)", j.Path, j.Profile)
+
+	probe, err := probeFile(ctx, fullPath)
+	if err != nil {
+		log.Printf("Error probing %s, assuming first video and audio streams: %v", j.Path, err)
+	}
+	var duration float64
+	if probe != nil {
+		duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	}
+
+	if err := os.MkdirAll(offlineDir(), 0755); err != nil {
+		return errors.New("Cannot create offline directory")
+	}
+
+	tmp := j.output + ".tmp.mp4"
+	passLog := j.output + ".pass"
+	defer func() {
+		logs, _ := filepath.Glob(passLog + "*")
+		for _, log := range logs {
+			os.Remove(log)
+		}
+	}()
+
+	passes := []int{0}
+	if j.profile.TwoPass {
+		passes = []int{1, 2}
+	}
+	for i, pass := range passes {
+		cmd := exec.CommandContext(ctx, "ffmpeg", offlineArgs(fullPath, probe, j.profile, pass, passLog, tmp)...)
+		var stderr tailBuffer
+		cmd.Stderr = &stderr
+
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return errors.New("Transcoding error")
+		}
+		if err := cmd.Start(); err != nil {
+			return errors.New(classifyStartError(err).Message)
+		}
+
+		// Each pass takes its share of the progress bar
+		readProgress(stdout, duration, func(progress float64) {
+			j.job.setProgress((float64(i) + progress) / float64(len(passes)))
+		})
+
+		if err := cmd.Wait(); err != nil {
+			os.Remove(tmp)
+			log.Printf("Offline copy of %s failed: %v", j.Path, err)
+			return errors.New(classifyFFmpegError(stderr.String()).Message)
+		}
+	}
+
+	if err := os.Rename(tmp, j.output); err != nil {
+		return errors.New("Cannot save offline copy")
+	}
+
+	if info, err := os.Stat(j.output); err == nil {
+		j.mu.Lock()
+		j.Size = info.Size()
+		j.mu.Unlock()
+	}
+	log.Printf("Offline copy of %s ready", j.Path)
+	return nil
+}
+
+// runPrepareJob makes the offline copy a prepare job asks for, with the
+// profile in its params. The copy's status is kept under its own ID too,
+// including for jobs queued again after a restart.
+func runPrepareJob(ctx context.Context, job *backgroundJob) error {
+	_, fullPath, ok := resolvePath(job.Path)
+	if !ok {
+		return errors.New("Invalid path")
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return errors.New("File not found")
+	}
+	profileName := job.Params["profile"]
+	if profileName == "" {
+		profileName = config().PrepareProfile
+	}
+	profile, ok := prepareProfiles[profileName]
+	if !ok {
+		return errors.New("Unknown prepare profile")
+	}
+
+	id := offlineJobID(fullPath, info, profile)
+	offlineMutex.Lock()
+	prepared := offlineJobs[id]
+	if prepared == nil || prepared.job != job {
+		prepared = &offlineJob{ID: id, Path: job.Path, Profile: profileName, output: filepath.Join(offlineDir(), id+".mp4"), profile: profile, job: job}
+		offlineJobs[id] = prepared
+	}
+	offlineMutex.Unlock()
+	return prepared.run(ctx, fullPath)
+}
+
+// offlineArgs builds the ffmpeg arguments for one pass of an offline copy:
+// 0 for a single pass, or 1 and 2. The first of two passes only analyses
+// the video, leaving its notes in passLog for the second.
+func offlineArgs(fullPath string, probe *library.ProbeResult, profile prepareProfile, pass int, passLog string, output string) []string {
+	args := inputFile(fullPath)
+	args = append(args, transcode.StreamMapArgs(probe, false)...)
+	args = append(args, "-c:v", "libx264", "-preset", profile.Preset)
+	if pass > 0 {
+		args = append(args, "-b:v", profile.Bitrate, "-pass", strconv.Itoa(pass), "-passlogfile", passLog)
+	} else {
+		args = append(args, "-crf", strconv.Itoa(profile.CRF))
+	}
+	args = append(args,
+		"-maxrate", profile.MaxRate,
+		"-bufsize", profile.BufSize,
+	)
+	if filter := transcode.VideoFilter(probe, profile.MaxHeight, 0); filter != "" {
+		args = append(args, "-vf", filter)
+	}
+	args = append(args, "-pix_fmt", "yuv420p")
+
+	progress := []string{"-progress", "pipe:1", "-nostats", "-loglevel", "error"}
+	if pass == 1 {
+		args = append(args, "-an", "-f", "null")
+		args = append(args, progress...)
+		return append(args, "-y", os.DevNull)
+	}
+	args = append(args,
+		"-c:a", "aac",
+		"-b:a", profile.AudioBitrate,
+		"-ac", "2",
+		"-movflags", "+faststart",
+	)
+	args = append(args, progress...)
+	return append(args, "-y", output)
+}
+
+// pruneOfflineCopies deletes old offline copies along with their jobs
+func pruneOfflineCopies() {
+	entries, err := os.ReadDir(offlineDir())
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-offlineRetention)
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(offlineDir(), entry.Name()))
+			delete(offlineJobs, strings.TrimSuffix(entry.Name(), ".mp4"))
+		}
+	}
+}
+
+// handleOfflineCreate starts preparing an offline copy, or returns the
+// existing job if one has already been made for this file
+func handleOfflineCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() && discType(fullPath) == "" {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Slower, smaller copies can be asked for per job with ?profile=
+	profileName := r.URL.Query().Get("profile")
+	if profileName == "" {
+		profileName = config().PrepareProfile
+	}
+	profile, ok := prepareProfiles[profileName]
+	if !ok {
+		http.Error(w, "Unknown prepare profile", http.StatusBadRequest)
+		return
+	}
+
+	id := offlineJobID(fullPath, info, profile)
+	output := filepath.Join(offlineDir(), id+".mp4")
+
+	offlineMutex.Lock()
+	pruneOfflineCopies()
+	job := offlineJobs[id]
+	if job == nil || job.snapshot().State == jobFailed || job.snapshot().State == jobCancelled {
+		job = &offlineJob{ID: id, Path: path, Profile: profileName, output: output, profile: profile}
+
+		// A copy from before a restart can be reused as is
+		if existing, err := os.Stat(output); err == nil {
+			job.Size = existing.Size()
+		} else {
+			job.job = enqueueJob("prepare", path, map[string]string{"profile": profileName})
+		}
+		offlineJobs[id] = job
+	}
+	offlineMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.snapshot())
+}
+
+// handleOffline serves GET /api/offline/{id} for job status and
+// GET /api/offline/{id}/file to download the finished copy
+func handleOffline(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/offline/"), "/")
+
+	offlineMutex.Lock()
+	job := offlineJobs[id]
+	offlineMutex.Unlock()
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job.snapshot())
+	case "file":
+		if job.snapshot().State != jobDone {
+			http.Error(w, "Offline copy not ready", http.StatusConflict)
+			return
+		}
+		name := strings.TrimSuffix(filepath.Base(job.Path), filepath.Ext(job.Path)) + ".mp4"
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		http.ServeFile(w, r, job.output)
+	default:
+		http.Error(w, "Unknown offline action", http.StatusNotFound)
+	}
+}
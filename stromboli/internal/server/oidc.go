@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcConfig has people sign in through an OpenID Connect provider, such
+// as Authelia or Keycloak, before they can use the server
+type oidcConfig struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+
+	// This server's /auth/callback as the provider knows it, worked out
+	// from the request when left out
+	RedirectURL string `json:"redirectUrl"`
+
+	// What is asked for, and the claims in the ID token holding the user
+	// name and their groups
+	Scopes      []string `json:"scopes"`
+	UserClaim   string   `json:"userClaim"`
+	GroupsClaim string   `json:"groupsClaim"`
+}
+
+// How long signing in lasts, and how long the provider has to send the
+// browser back
+const (
+	signInLifetime   = 7 * 24 * time.Hour
+	signInAttemptTTL = 10 * time.Minute
+)
+
+const (
+	sessionCookie = "stromboli_session"
+	signInCookie  = "stromboli_signin"
+)
+
+// oidcProvider is what the provider's discovery document says about it
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+var (
+	oidcMutex     sync.Mutex
+	oidcProviders = map[string]*oidcProvider{}
+	oidcClient    = &http.Client{Timeout: 10 * time.Second}
+)
+
+// signedIn is who a session cookie says signed in, until when
+type signedIn struct {
+	User    string    `json:"user"`
+	Groups  []string  `json:"groups,omitempty"`
+	Local   bool      `json:"local,omitempty"` // To an account here rather than through the provider
+	Expires time.Time `json:"expires"`
+}
+
+// signInAttempt is kept in a cookie while the browser is off at the provider
+type signInAttempt struct {
+	State   string    `json:"state"`
+	Nonce   string    `json:"nonce"`
+	Next    string    `json:"next"`
+	Expires time.Time `json:"expires"`
+}
+
+// setupOIDC checks the config file's sign-in settings and fills in defaults
+func setupOIDC(c *Config) error {
+	if c.OIDC == nil {
+		return nil
+	}
+	u, err := url.Parse(c.OIDC.Issuer)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("issuer %q isn't a URL", c.OIDC.Issuer)
+	}
+	if c.OIDC.ClientID == "" {
+		return errors.New("no client ID")
+	}
+	if len(c.OIDC.Scopes) == 0 {
+		c.OIDC.Scopes = []string{"openid", "profile", "email", "groups"}
+	}
+	if c.OIDC.UserClaim == "" {
+		c.OIDC.UserClaim = "preferred_username"
+	}
+	if c.OIDC.GroupsClaim == "" {
+		c.OIDC.GroupsClaim = "groups"
+	}
+	return nil
+}
+
+// discoverProvider fetches the provider's endpoints, once per issuer, so a
+// provider that's down at startup doesn't stop the server
+func discoverProvider(ctx context.Context, issuer string) (*oidcProvider, error) {
+	oidcMutex.Lock()
+	defer oidcMutex.Unlock()
+	if provider := oidcProviders[issuer]; provider != nil {
+		return provider, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: %s", resp.Status)
+	}
+	provider := &oidcProvider{}
+	if err := json.NewDecoder(resp.Body).Decode(provider); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" {
+		return nil, errors.New("discovery: endpoints missing")
+	}
+	// ID tokens are checked against the issuer, so it has to be the one
+	// configured rather than whatever the document says
+	if provider.Issuer == "" || strings.TrimSuffix(provider.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("discovery: issuer %q isn't %q", provider.Issuer, issuer)
+	}
+	oidcProviders[issuer] = provider
+	return provider, nil
+}
+
+// cookieSignature signs a cookie's contents with the stream token key
+func cookieSignature(name string, payload string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte("cookie"))
+	mac.Write([]byte{0})
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setSignedCookie stores v in a cookie only this server can have written
+func setSignedCookie(w http.ResponseWriter, r *http.Request, name string, path string, v interface{}, expires time.Time) {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    payload + "." + cookieSignature(name, payload),
+		Path:     path,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// readSignedCookie reads a cookie set by setSignedCookie into v
+func readSignedCookie(r *http.Request, name string, v interface{}) bool {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	payload, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(cookieSignature(name, payload))) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	return err == nil && json.Unmarshal(data, v) == nil
+}
+
+// requestSignIn is who signed in, through the provider or to an account
+// that still exists, if anyone
+func requestSignIn(r *http.Request) *signedIn {
+	var session signedIn
+	if !readSignedCookie(r, sessionCookie, &session) || time.Now().After(session.Expires) || session.User == "" {
+		return nil
+	}
+	if session.Local && !accountExists(session.User) || !session.Local && config().OIDC == nil {
+		return nil
+	}
+	return &session
+}
+
+// requestScheme is how the browser reached the server, going by the proxy
+// in front of it if it's a trusted one
+func requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && fromTrustedProxy(r) {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requireSignIn turns away requests from people who haven't signed in,
+// while sign-in is set up. Pages send them to the provider.
+func requireSignIn(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config().OIDC == nil || requestSignIn(r) != nil || requestPeer(r) != "" ||
+			strings.HasPrefix(r.URL.Path, "/auth/") || strings.HasPrefix(r.URL.Path, "/static/") ||
+			strings.HasPrefix(r.URL.Path, "/api/worker/") || r.URL.Path == "/sw.js" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			http.Error(w, "Sign-in required", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+	})
+}
+
+// localRedirect is where to go after signing in: only somewhere on this
+// server, so a link can't send people elsewhere
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// handleSignIn sends the browser to the provider (GET /auth/login?next=)
+func handleSignIn(w http.ResponseWriter, r *http.Request) {
+	if config().OIDC == nil {
+		http.Error(w, "Sign-in isn't set up", http.StatusNotFound)
+		return
+	}
+	provider, err := discoverProvider(r.Context(), config().OIDC.Issuer)
+	if err != nil {
+		log.Printf("Cannot reach the sign-in provider: %v", err)
+		http.Error(w, "Sign-in provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	next := localRedirect(r.URL.Query().Get("next"))
+	attempt := signInAttempt{State: randomString(), Nonce: randomString(), Next: next, Expires: time.Now().Add(signInAttemptTTL)}
+	setSignedCookie(w, r, signInCookie, "/auth/", attempt, attempt.Expires)
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {config().OIDC.ClientID},
+		"redirect_uri":  {redirectURL(r)},
+		"scope":         {strings.Join(config().OIDC.Scopes, " ")},
+		"state":         {attempt.State},
+		"nonce":         {attempt.Nonce},
+	}
+	target := provider.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// redirectURL is where the provider sends the browser back to
+func redirectURL(r *http.Request) string {
+	if config().OIDC.RedirectURL != "" {
+		return config().OIDC.RedirectURL
+	}
+	return requestScheme(r) + "://" + r.Host + "/auth/callback"
+}
+
+// handleSignInCallback finishes signing in once the provider sends the
+// browser back with a code (GET /auth/callback)
+func handleSignInCallback(w http.ResponseWriter, r *http.Request) {
+	if config().OIDC == nil {
+		http.Error(w, "Sign-in isn't set up", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	var attempt signInAttempt
+	if !readSignedCookie(r, signInCookie, &attempt) || time.Now().After(attempt.Expires) || query.Get("state") != attempt.State {
+		http.Error(w, "Sign-in expired, try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: signInCookie, Path: "/auth/", MaxAge: -1})
+	if reason := query.Get("error"); reason != "" {
+		http.Error(w, "Sign-in refused: "+reason, http.StatusForbidden)
+		return
+	}
+
+	provider, err := discoverProvider(r.Context(), config().OIDC.Issuer)
+	if err != nil {
+		log.Printf("Cannot reach the sign-in provider: %v", err)
+		http.Error(w, "Sign-in provider unavailable", http.StatusBadGateway)
+		return
+	}
+	claims, err := exchangeCode(r, provider, query.Get("code"), attempt.Nonce)
+	if err != nil {
+		log.Printf("Sign-in failed: %v", err)
+		http.Error(w, "Sign-in failed", http.StatusForbidden)
+		return
+	}
+
+	session := signedIn{Expires: time.Now().Add(signInLifetime)}
+	session.User, _ = claims[config().OIDC.UserClaim].(string)
+	if session.User == "" {
+		session.User, _ = claims["sub"].(string)
+	}
+	switch groups := claims[config().OIDC.GroupsClaim].(type) {
+	case string:
+		session.Groups = []string{groups}
+	case []interface{}:
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				session.Groups = append(session.Groups, name)
+			}
+		}
+	}
+	setSignedCookie(w, r, sessionCookie, "/", session, session.Expires)
+	log.Printf("%s signed in", session.User)
+	http.Redirect(w, r, attempt.Next, http.StatusFound)
+}
+
+// exchangeCode trades the code for an ID token and returns its claims. The
+// token comes straight from the provider over the connection just made, so
+// as the spec allows its signature isn't checked, only what it says.
+func exchangeCode(r *http.Request, provider *oidcProvider, code string, nonce string) (map[string]interface{}, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURL(r)},
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(config().OIDC.ClientID), url.QueryEscape(config().OIDC.ClientSecret))
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint: %w", err)
+	}
+
+	parts := strings.Split(tokens.IDToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("no ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("ID token: %w", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("ID token: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss == "" || iss != provider.Issuer {
+		return nil, fmt.Errorf("ID token from %v", claims["iss"])
+	}
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == config().OIDC.ClientID
+	case []interface{}:
+		for _, a := range aud {
+			audience = audience || a == config().OIDC.ClientID
+		}
+	}
+	if !audience {
+		return nil, errors.New("ID token is for another client")
+	}
+	if exp, ok := claims["exp"].(float64); !ok || time.Now().Unix() > int64(exp) {
+		return nil, errors.New("ID token expired")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("ID token nonce doesn't match")
+	}
+	return claims, nil
+}
+
+// handleSignOut forgets the sign-in and signs out of the provider too when
+// it allows (GET /auth/logout)
+func handleSignOut(w http.ResponseWriter, r *http.Request) {
+	session := requestSignIn(r)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	target := "/"
+	if config().OIDC != nil && session != nil && !session.Local {
+		if provider, err := discoverProvider(r.Context(), config().OIDC.Issuer); err == nil && provider.EndSessionEndpoint != "" {
+			query := url.Values{
+				"client_id":                {config().OIDC.ClientID},
+				"post_logout_redirect_uri": {requestScheme(r) + "://" + r.Host + "/"},
+			}
+			target = provider.EndSessionEndpoint + "?" + query.Encode()
+		}
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const organizeFile = "organize.json"
+
+// Moves kept in the activity log, dropping the oldest
+const maxOrganizeMoves = 500
+
+// Files changed more recently than this may still be copying in, so they
+// are left for the next scan
+const organizeSettle = time.Minute
+
+// organizeConfig has the library scan tidy away new files it finds in a
+// watch folder, moving each to where the first rule matching it says
+type organizeConfig struct {
+	// Folder new files are picked up from, "" being the whole library
+	Folder string `json:"folder"`
+
+	// Only log where files would go, without moving them
+	DryRun bool `json:"dryRun"`
+
+	Rules []organizeRule `json:"rules"`
+}
+
+// organizeRule matches a file's path within the watch folder and gives its
+// new path in the library, in which $1 or ${name} stand for the pattern's
+// groups
+type organizeRule struct {
+	Match string `json:"match"`
+	Dest  string `json:"dest"`
+
+	pattern *regexp.Regexp
+}
+
+// organizeMove is an entry in the activity log
+type organizeMove struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	DryRun bool      `json:"dryRun,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+var (
+	organizeMutex sync.Mutex
+	organizeMoves = []organizeMove{}
+)
+
+// setupOrganize compiles the config file's organize rules
+func setupOrganize(c *Config) error {
+	org := c.Organize
+	if org == nil {
+		return nil
+	}
+	folder, err := cleanAPIPath(org.Folder, runtime.GOOS == "windows")
+	if err != nil {
+		return fmt.Errorf("folder %q: %w", org.Folder, err)
+	}
+	org.Folder = folder
+	if len(org.Rules) == 0 {
+		return errors.New("no rules")
+	}
+	for i := range org.Rules {
+		rule := &org.Rules[i]
+		if rule.Dest == "" {
+			return fmt.Errorf("rule %d has no destination", i+1)
+		}
+		pattern, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		rule.pattern = pattern
+	}
+	return nil
+}
+
+func loadOrganizeMoves() {
+	organizeMutex.Lock()
+	defer organizeMutex.Unlock()
+	if err := loadJSON(organizeFile, &organizeMoves); err != nil {
+		log.Printf("Error loading organize activity: %v", err)
+	}
+}
+
+// recordOrganizeMove adds a move to the activity log
+func recordOrganizeMove(move organizeMove) {
+	if move.Error != "" {
+		log.Printf("Cannot organize %s into %s: %s", move.From, move.To, move.Error)
+	} else if move.DryRun {
+		log.Printf("Would organize %s into %s", move.From, move.To)
+	} else {
+		log.Printf("Organized %s into %s", move.From, move.To)
+	}
+
+	organizeMutex.Lock()
+	defer organizeMutex.Unlock()
+	organizeMoves = append(organizeMoves, move)
+	if len(organizeMoves) > maxOrganizeMoves {
+		organizeMoves = organizeMoves[len(organizeMoves)-maxOrganizeMoves:]
+	}
+	if err := saveJSON(organizeFile, organizeMoves); err != nil {
+		log.Printf("Error saving organize activity: %v", err)
+	}
+}
+
+// organize moves a file new to the index if a rule matches it, returning
+// where it is now. Files that may still be copying in are reported as "",
+// to be looked at again by the next scan.
+func organize(relativePath string, info os.FileInfo) string {
+	org := config().Organize
+	if org == nil {
+		return relativePath
+	}
+	name := relativePath
+	if org.Folder != "" {
+		var ok bool
+		if name, ok = strings.CutPrefix(relativePath, org.Folder+"/"); !ok {
+			return relativePath
+		}
+	}
+
+	for _, rule := range org.Rules {
+		match := rule.pattern.FindStringSubmatchIndex(name)
+		if match == nil {
+			continue
+		}
+		if time.Since(info.ModTime()) < organizeSettle {
+			return ""
+		}
+
+		// Security check: paths can't leave the root
+		dest := string(rule.pattern.ExpandString(nil, rule.Dest, name, match))
+		cleaned, err := cleanAPIPath(dest, runtime.GOOS == "windows")
+		if err == nil && cleaned == relativePath {
+			return relativePath
+		}
+
+		move := organizeMove{From: relativePath, To: cleaned, DryRun: org.DryRun || readOnly, Time: time.Now()}
+		switch {
+		case err != nil || cleaned == "":
+			move.To, move.Error = dest, "invalid destination"
+		case !move.DryRun:
+			if err := moveWithSidecars(relativePath, cleaned); err != nil {
+				move.Error = err.Error()
+			}
+		}
+		recordOrganizeMove(move)
+		if move.Error != "" || move.DryRun {
+			return relativePath
+		}
+		return move.To
+	}
+	return relativePath
+}
+
+// handleOrganize lists what the organize rules have moved, or would have
+// in a dry run, newest first
+func handleOrganize(w http.ResponseWriter, r *http.Request) {
+	organizeMutex.Lock()
+	list := []organizeMove{}
+	for i := len(organizeMoves) - 1; i >= 0; i-- {
+		move := organizeMoves[i]
+		if canAccess(r, move.From) && canAccess(r, move.To) {
+			list = append(list, move)
+		}
+	}
+	organizeMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Paths in the API are relative to rootDir and always use forward slashes,
+// whatever the OS. Backslashes would otherwise reach the UI on Windows,
+// where they read as escapes in the inline handlers of the file list.
+
+// Names Windows keeps for devices, with or without an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM0": true, "COM1": true, "COM2": true, "COM3": true, "COM4": true,
+	"COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT0": true, "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true,
+	"LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+var (
+	errAbsolutePath = errors.New("drive letters and UNC paths aren't library paths")
+	errReservedName = errors.New("reserved file name")
+	errInvalidPath  = errors.New("invalid path")
+)
+
+// cleanAPIPath normalises a path from a request: slashes only, no leading
+// slash, and no way above the root. On Windows backslashes are taken as
+// separators, and drive letters, UNC paths, alternate data streams and
+// device names are refused.
+func cleanAPIPath(p string, windows bool) (string, error) {
+	if strings.ContainsRune(p, 0) {
+		return "", errInvalidPath
+	}
+	if windows {
+		p = strings.ReplaceAll(p, `\`, "/")
+		if strings.HasPrefix(p, "//") || strings.ContainsRune(p, ':') {
+			return "", errAbsolutePath
+		}
+	}
+
+	cleaned := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if windows && cleaned != "" {
+		for _, name := range strings.Split(cleaned, "/") {
+			// Windows quietly drops trailing dots and spaces, so "a.mkv." is "a.mkv"
+			if strings.TrimRight(name, ". ") != name {
+				return "", errInvalidPath
+			}
+			base, _, _ := strings.Cut(name, ".")
+			if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+				return "", errReservedName
+			}
+		}
+	}
+	return cleaned, nil
+}
+
+// resolvePath cleans a path from a request and maps it onto the filesystem
+// under rootDir, reporting false for paths that aren't allowed
+func resolvePath(p string) (string, string, bool) {
+	cleaned, err := cleanAPIPath(p, runtime.GOOS == "windows")
+	if err != nil {
+		return "", "", false
+	}
+	return cleaned, filepath.Join(rootDir, filepath.FromSlash(cleaned)), true
+}
+
+// apiPath turns a relative filesystem path into the form the API uses
+func apiPath(relativePath string) string {
+	return filepath.ToSlash(relativePath)
+}
+
+// relativeAPIPath is the API path of a file found under rootDir
+func relativeAPIPath(fullPath string) (string, error) {
+	rel, err := filepath.Rel(rootDir, fullPath)
+	if err != nil {
+		return "", err
+	}
+	return apiPath(rel), nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanAPIPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		windows bool
+		want    string
+		err     error
+	}{
+		{"root", "", false, "", nil},
+		{"slash root", "/", false, "", nil},
+		{"nested", "Shows/Season 1/Episode 1.mkv", false, "Shows/Season 1/Episode 1.mkv", nil},
+		{"leading slash", "/Films/Heat.mkv", false, "Films/Heat.mkv", nil},
+		{"dot segments", "Shows/./Season 1/../Season 2/", false, "Shows/Season 2", nil},
+		{"escape", "../etc/passwd", false, "etc/passwd", nil},
+		{"escape nested", "Films/../../other/file.mkv", false, "other/file.mkv", nil},
+		{"null byte", "Films/a\x00.mkv", false, "", errInvalidPath},
+
+		// Backslashes are just characters in Unix file names
+		{"unix backslash", `Shows\Episode.mkv`, false, `Shows\Episode.mkv`, nil},
+		{"unix colon", "Films/Alien: Director's Cut.mkv", false, "Films/Alien: Director's Cut.mkv", nil},
+		{"unix reserved", "Films/con.mkv", false, "Films/con.mkv", nil},
+
+		{"windows backslashes", `Shows\Season 1\Episode 1.mkv`, true, "Shows/Season 1/Episode 1.mkv", nil},
+		{"windows mixed", `Shows/Season 1\Episode 1.mkv`, true, "Shows/Season 1/Episode 1.mkv", nil},
+		{"windows escape", `..\..\Windows\win.ini`, true, "Windows/win.ini", nil},
+		{"drive letter", `C:\Windows\win.ini`, true, "", errAbsolutePath},
+		{"drive letter slashes", "C:/Windows/win.ini", true, "", errAbsolutePath},
+		{"drive relative", "D:Films/Heat.mkv", true, "", errAbsolutePath},
+		{"unc", `\\server\share\Films\Heat.mkv`, true, "", errAbsolutePath},
+		{"unc slashes", "//server/share/Films/Heat.mkv", true, "", errAbsolutePath},
+		{"device namespace", `\\?\C:\Films\Heat.mkv`, true, "", errAbsolutePath},
+		{"alternate data stream", "Films/Heat.mkv:hidden", true, "", errAbsolutePath},
+		{"reserved", "Films/CON", true, "", errReservedName},
+		{"reserved lower case", "Films/nul", true, "", errReservedName},
+		{"reserved extension", "Films/aux.mkv", true, "", errReservedName},
+		{"reserved folder", "com1/Heat.mkv", true, "", errReservedName},
+		{"reserved trailing space", "Films/LPT9 .mkv", true, "", errReservedName},
+		{"reserved prefix allowed", "Films/Console.mkv", true, "Films/Console.mkv", nil},
+		{"trailing dot", "Films/Heat.mkv.", true, "", errInvalidPath},
+		{"trailing space", "Films /Heat.mkv", true, "", errInvalidPath},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cleanAPIPath(tt.path, tt.windows)
+			if err != tt.err {
+				t.Fatalf("cleanAPIPath(%q) error = %v, want %v", tt.path, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("cleanAPIPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvePathStaysInRoot(t *testing.T) {
+	oldRoot := rootDir
+	defer func() { rootDir = oldRoot }()
+	rootDir = filepath.Join(t.TempDir(), "media")
+
+	// A sibling sharing the root's name as a prefix used to get past the check
+	for _, p := range []string{"../media2/Heat.mkv", "../../media/../media2", "/../media2"} {
+		clean, full, ok := resolvePath(p)
+		if !ok {
+			continue
+		}
+		rel, err := filepath.Rel(rootDir, full)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			t.Errorf("resolvePath(%q) = %q, %q, outside the root", p, clean, full)
+		}
+	}
+
+	clean, full, ok := resolvePath("Shows/Season 1/Episode 1.mkv")
+	if !ok || clean != "Shows/Season 1/Episode 1.mkv" {
+		t.Fatalf("resolvePath of a nested video = %q, %v", clean, ok)
+	}
+	if want := filepath.Join(rootDir, "Shows", "Season 1", "Episode 1.mkv"); full != want {
+		t.Errorf("resolvePath of a nested video = %q, want %q", full, want)
+	}
+}
+
+func TestRelativeAPIPath(t *testing.T) {
+	oldRoot := rootDir
+	defer func() { rootDir = oldRoot }()
+	rootDir = filepath.Join(t.TempDir(), "media")
+
+	got, err := relativeAPIPath(filepath.Join(rootDir, "Shows", "Season 1", "Episode 1.mkv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Shows/Season 1/Episode 1.mkv"; got != want {
+		t.Errorf("relativeAPIPath = %q, want %q", got, want)
+	}
+}
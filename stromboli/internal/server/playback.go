@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"video-browser/stromboli/internal/library"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// How a file gets to the player
+const (
+	playDirect    = "direct"    // Sent as it is, for the browser to play
+	playRemux     = "remux"     // Video copied into a container the browser plays
+	playTranscode = "transcode" // Re-encoded
+)
+
+// fileCodecs is what the index or ffprobe found in a file
+type fileCodecs struct {
+	Video  string `json:"video,omitempty"`
+	Audio  string `json:"audio,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+
+	FrameRate float64 `json:"frameRate,omitempty"` // For stepping through frames
+}
+
+func probeCodecs(probe *library.ProbeResult) fileCodecs {
+	var codecs fileCodecs
+	if video := probe.MainVideoStream(); video != nil {
+		codecs.Video = video.CodecName
+		codecs.Width = video.Width
+		codecs.Height = video.Height
+		codecs.FrameRate = math.Round(video.FramesPerSecond()*1000) / 1000
+	}
+	if audio := probe.MainAudioStream(); audio != nil {
+		codecs.Audio = audio.CodecName
+	}
+	return codecs
+}
+
+// playbackDecision works out how a device plays a file from its codecs,
+// returning the method and why. The container only decides whether a file
+// the device can decode is sent as is or remuxed first. Remuxing copies
+// H.264 video, the one codec every transcode container takes, and converts
+// the audio if the device can't play it.
+func playbackDecision(ext string, codecs fileCodecs, device transcode.Device) (string, string) {
+	videoOK := codecs.Video == "" || slices.Contains(device.VideoCodecs, codecs.Video)
+	audioOK := codecs.Audio == "" || slices.Contains(device.AudioCodecs, codecs.Audio)
+	fits := device.MaxHeight == 0 || codecs.Height <= device.MaxHeight
+
+	switch {
+	case device.DataSaver:
+		return playTranscode, "Data saver is on, so everything is transcoded at the lowest quality"
+	case !videoOK:
+		return playTranscode, fmt.Sprintf("%s video doesn't play on %s", codecs.Video, device.Name)
+	case !fits:
+		return playTranscode, fmt.Sprintf("%dp is more than %s plays", codecs.Height, device.Name)
+	case nativeFormats[ext] && audioOK:
+		return playDirect, "The container and codecs play on " + device.Name
+	case codecs.Video != "h264" && !audioOK:
+		return playTranscode, fmt.Sprintf("%s audio doesn't play on %s, and only H.264 video can be copied while it's converted", codecs.Audio, device.Name)
+	case codecs.Video != "h264":
+		return playTranscode, fmt.Sprintf("The %s container doesn't play on %s, and only H.264 video can be copied into one that does", ext, device.Name)
+	case !audioOK:
+		return playRemux, fmt.Sprintf("%s audio doesn't play on %s, so it's converted while the video is copied", codecs.Audio, device.Name)
+	default:
+		return playRemux, fmt.Sprintf("The %s container doesn't play on %s, so the video is copied into one that does", ext, device.Name)
+	}
+}
+
+// decidePlayback fills in how a video plays from its codecs. Discs and
+// files with a handler always go through the transcoder.
+func (f *FileInfo) decidePlayback(codecs fileCodecs, device transcode.Device) {
+	f.Codecs = &codecs
+	switch {
+	case f.Disc != "":
+		f.Playback, f.PlaybackReason = playTranscode, "Discs are always transcoded"
+	case handlerFor(f.Path) != nil:
+		f.Playback, f.PlaybackReason = playTranscode, "Files with a handler are always transcoded"
+	default:
+		f.Playback, f.PlaybackReason = playbackDecision(strings.ToLower(filepath.Ext(f.Path)), codecs, device)
+	}
+	f.CanPlay = f.Playback == playDirect
+	f.NeedsTranscode = !f.CanPlay
+}
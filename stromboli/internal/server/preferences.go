@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+const preferencesFile = "preferences.json"
+
+// preferences are the UI settings that follow a user between devices
+type preferences struct {
+	ViewMode           string `json:"viewMode"`
+	Sort               string `json:"sort"`
+	Theme              string `json:"theme"`
+	SubtitleSize       int    `json:"subtitleSize"`
+	SubtitleColor      string `json:"subtitleColor"`      // #rrggbb
+	SubtitleBackground string `json:"subtitleBackground"` // none, translucent or solid
+	SubtitlePosition   string `json:"subtitlePosition"`   // bottom or top
+	FontSize           int    `json:"fontSize"`           // Percent, scaling the whole UI
+	DeleteOffer        bool   `json:"deleteOffer"`        // Offer to send videos to the trash once watched
+
+	// How each of the user's devices wants its audio, by device ID
+	DeviceAudio map[string]string `json:"deviceAudio,omitempty"`
+
+	// How transcodes mix surround sound: down to stereo, down to stereo
+	// with the dialogue brought up, or kept as 5.1
+	Downmix string `json:"downmix"`
+
+	// Device profile transcodes are fitted to, empty to go by the user agent
+	DeviceProfile string `json:"deviceProfile"`
+
+	// Quality profile transcodes start at, empty to go by whether the
+	// player is on the local network
+	Quality string `json:"quality,omitempty"`
+
+	// What plays when a video ends, off, folder or episode, after a
+	// countdown of this many seconds, 0 to go straight on
+	AutoplayMode      string `json:"autoplayMode"`
+	AutoplayCountdown int    `json:"autoplayCountdown"`
+
+	// Saved before there were autoplay modes, and read as folder or off
+	Autoplay bool `json:"autoplay,omitempty"`
+}
+
+// Autoplay modes, and the longest countdown before the next video
+const (
+	autoplayOff     = "off"
+	autoplayFolder  = "folder"
+	autoplayEpisode = "episode"
+
+	maxAutoplayCountdown = 60
+)
+
+// setupAutoplay checks the autoplay settings people get until they choose
+func setupAutoplay(c *Config) error {
+	if c.AutoplayMode != "" && c.AutoplayMode != autoplayOff && c.AutoplayMode != autoplayFolder && c.AutoplayMode != autoplayEpisode {
+		return fmt.Errorf("mode %q isn't off, folder or episode", c.AutoplayMode)
+	}
+	if c.AutoplayCountdown < 0 || c.AutoplayCountdown > maxAutoplayCountdown {
+		return fmt.Errorf("countdown of %d seconds isn't between 0 and %d", c.AutoplayCountdown, maxAutoplayCountdown)
+	}
+	return nil
+}
+
+// defaultAutoplay is the config file's autoplay mode and countdown
+func defaultAutoplay() (string, int) {
+	mode, countdown := config().AutoplayMode, config().AutoplayCountdown
+	if mode == "" {
+		mode = autoplayFolder
+	}
+	if countdown == 0 {
+		countdown = 10
+	}
+	return mode, countdown
+}
+
+// Device audio modes: downmixed to stereo AAC, or surround passed through as is
+const (
+	audioStereo      = "stereo"
+	audioPassthrough = "passthrough"
+)
+
+// Downmix modes, for audio that is re-encoded rather than passed through
+const (
+	downmixStereo   = "stereo"
+	downmixDialogue = "dialogue"
+	downmixSurround = "surround"
+)
+
+// Devices remembered per user, more than anyone has
+const maxDevices = 50
+
+var defaultPreferences = preferences{
+	ViewMode:           "list",
+	Sort:               "name",
+	Theme:              "dark",
+	SubtitleSize:       100,
+	SubtitleColor:      "#ffffff",
+	SubtitleBackground: "translucent",
+	SubtitlePosition:   "bottom",
+	FontSize:           100,
+	Downmix:            downmixStereo,
+}
+
+var (
+	preferencesMutex sync.Mutex
+	userPreferences  = map[string]preferences{}
+)
+
+// requestUser identifies who is making a request, from the user header
+// when the config file names one or trusts a proxy. Otherwise everyone is
+// the anonymous user and shares the same settings.
+func requestUser(r *http.Request) string {
+	if peer := requestPeer(r); peer != "" {
+		return peer
+	}
+	if session := requestSignIn(r); session != nil {
+		return session.User
+	}
+	return proxyUser(r)
+}
+
+func loadPreferences() {
+	preferencesMutex.Lock()
+	defer preferencesMutex.Unlock()
+	if err := loadJSON(preferencesFile, &userPreferences); err != nil {
+		log.Printf("Error loading preferences: %v", err)
+	}
+}
+
+func getPreferences(user string) preferences {
+	preferencesMutex.Lock()
+	defer preferencesMutex.Unlock()
+	if prefs, ok := userPreferences[user]; ok {
+		// Saved before the settings existed
+		if prefs.FontSize == 0 {
+			prefs.FontSize = defaultPreferences.FontSize
+		}
+		// The map is shared with the stored copy, which updates mustn't touch
+		prefs.DeviceAudio = maps.Clone(prefs.DeviceAudio)
+		if prefs.SubtitleColor == "" {
+			prefs.SubtitleColor = defaultPreferences.SubtitleColor
+			prefs.SubtitleBackground = defaultPreferences.SubtitleBackground
+			prefs.SubtitlePosition = defaultPreferences.SubtitlePosition
+		}
+		if prefs.Downmix == "" {
+			prefs.Downmix = defaultPreferences.Downmix
+		}
+		if prefs.AutoplayMode == "" {
+			prefs.AutoplayMode = autoplayOff
+			if prefs.Autoplay {
+				prefs.AutoplayMode, prefs.AutoplayCountdown = defaultAutoplay()
+			}
+			prefs.Autoplay = false
+		}
+		return prefs
+	}
+	prefs := defaultPreferences
+	prefs.AutoplayMode, prefs.AutoplayCountdown = defaultAutoplay()
+	return prefs
+}
+
+func (p preferences) valid() bool {
+	switch {
+	case p.ViewMode != "list" && p.ViewMode != "grid":
+		return false
+	case p.Sort != "name" && p.Sort != "newest" && p.Sort != "size":
+		return false
+	case p.Theme != "dark" && p.Theme != "light":
+		return false
+	case p.SubtitleSize < 50 || p.SubtitleSize > 300:
+		return false
+	case p.FontSize < 75 || p.FontSize > 200:
+		return false
+	case !validColor(p.SubtitleColor):
+		return false
+	case p.SubtitleBackground != "none" && p.SubtitleBackground != "translucent" && p.SubtitleBackground != "solid":
+		return false
+	case p.SubtitlePosition != "bottom" && p.SubtitlePosition != "top":
+		return false
+	case p.Downmix != downmixStereo && p.Downmix != downmixDialogue && p.Downmix != downmixSurround:
+		return false
+	case len(p.DeviceAudio) > maxDevices:
+		return false
+	case p.AutoplayMode != autoplayOff && p.AutoplayMode != autoplayFolder && p.AutoplayMode != autoplayEpisode:
+		return false
+	case p.AutoplayCountdown < 0 || p.AutoplayCountdown > maxAutoplayCountdown:
+		return false
+	}
+	if _, ok := transcode.FindDevice(p.DeviceProfile); p.DeviceProfile != "" && !ok {
+		return false
+	}
+	if p.Quality != "" && !isQualityProfile(p.Quality) {
+		return false
+	}
+	for device, mode := range p.DeviceAudio {
+		if len(device) > 64 || mode != audioStereo && mode != audioPassthrough {
+			return false
+		}
+	}
+	return true
+}
+
+// validColor accepts #rrggbb colours
+func validColor(color string) bool {
+	if len(color) != 7 || color[0] != '#' {
+		return false
+	}
+	_, err := strconv.ParseUint(color[1:], 16, 32)
+	return err == nil
+}
+
+// handlePreferences returns (GET) or updates (PUT) the user's preferences.
+// Updates only need to include the fields being changed.
+func handlePreferences(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(getPreferences(user))
+
+	case http.MethodPut:
+		prefs := getPreferences(user)
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if !prefs.valid() {
+			http.Error(w, "Invalid preferences", http.StatusBadRequest)
+			return
+		}
+
+		preferencesMutex.Lock()
+		userPreferences[user] = prefs
+		err := saveJSON(preferencesFile, userPreferences)
+		preferencesMutex.Unlock()
+		if err != nil {
+			log.Printf("Error saving preferences: %v", err)
+			http.Error(w, "Cannot save preferences", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(prefs)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// parseOffPeak reads hours given as "01:00-06:00" into minutes after
+// midnight. The end can come before the start, for hours running past
+// midnight.
+func parseOffPeak(hours string) (start, end int, err error) {
+	from, to, ok := strings.Cut(hours, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q isn't like 01:00-06:00", hours)
+	}
+	for i, clock := range []string{from, to} {
+		t, err := time.Parse("15:04", strings.TrimSpace(clock))
+		if err != nil {
+			return 0, 0, fmt.Errorf("%q isn't like 01:00-06:00", hours)
+		}
+		if i == 0 {
+			start = t.Hour()*60 + t.Minute()
+		} else {
+			end = t.Hour()*60 + t.Minute()
+		}
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("%q starts and ends at the same time", hours)
+	}
+	return start, end, nil
+}
+
+// setupOffPeak checks the config file's off-peak hours
+func setupOffPeak(c *Config) error {
+	if c.OffPeak == "" {
+		return nil
+	}
+	_, _, err := parseOffPeak(c.OffPeak)
+	return err
+}
+
+// offPeakEnd reports whether now is in the off-peak hours, and when they
+// end. Without off-peak hours any time will do, and there's no end.
+func offPeakEnd(hours string, now time.Time) (time.Time, bool) {
+	if hours == "" {
+		return time.Time{}, true
+	}
+	start, end, err := parseOffPeak(hours)
+	if err != nil {
+		return time.Time{}, false
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	minute := now.Hour()*60 + now.Minute()
+	switch {
+	case start < end && minute >= start && minute < end, start > end && minute < end:
+		return midnight.Add(time.Duration(end) * time.Minute), true
+	case start > end && minute >= start:
+		return midnight.AddDate(0, 0, 1).Add(time.Duration(end) * time.Minute), true
+	}
+	return time.Time{}, false
+}
+
+// pregenerate indexes new and changed videos and makes their thumbnails,
+// newest first, so browsing doesn't wait on ffprobe and ffmpeg. With
+// off-peak hours set it only works in them, leaving off when they end for
+// the next run to carry on.
+func pregenerate() error {
+	end, ok := offPeakEnd(config().OffPeak, time.Now())
+	if !ok {
+		log.Printf("Not pregenerating outside off-peak hours (%s)", config().OffPeak)
+		return nil
+	}
+	ctx := context.Background()
+	if !end.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, end)
+		defer cancel()
+	}
+
+	err := scanLibrary(ctx, func(float64) {})
+	if err == nil {
+		err = generateMissingThumbnails(ctx, func(float64) {})
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Off-peak hours are over, pregenerating stopped until the next run")
+		return nil
+	}
+	return err
+}
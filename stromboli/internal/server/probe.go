@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"video-browser/stromboli/internal/library"
+)
+
+// probeFile asks ffprobe for the stream layout of a file
+func probeFile(ctx context.Context, filePath string) (*library.ProbeResult, error) {
+	var output []byte
+	var err error
+	if handler := handlerFor(filePath); handler != nil && len(handler.Probe) > 0 {
+		args := expandCommand(handler.Probe, filePath, 0, "")
+		output, err = library.ProbeOutput(ctx, args[0], args[1:]...)
+	} else {
+		args := []string{
+			"-v", "error",
+			"-show_entries", "stream=index,codec_type,codec_name,width,height,channels,duration,field_order,avg_frame_rate:stream_disposition:stream_tags:format=duration,bit_rate",
+			"-of", "json",
+		}
+		output, err = library.ProbeOutput(ctx, "ffprobe", append(args, inputFile(filePath)...)...)
+	}
+	if errors.Is(err, library.ErrProbeTimeout) {
+		log.Printf("Gave up probing %s after %s", filePath, library.ProbeTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result library.ProbeResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// probeWorkers is how many ffprobes may run at once across every listing
+var probeWorkers = 4
+
+// probeSlots bounds the ffprobes running for listings, sized at startup
+var probeSlots chan struct{}
+
+// How long a listing waits on its probes before returning the rest as pending
+const probeWait = 2 * time.Second
+
+// probePending probes the files of a listing that the index knows nothing
+// about on a pool of workers. Probes that don't finish within probeWait are
+// left pending in the listing, and their results are pushed to the UI as
+// "probed" events when they come in.
+func probePending(files []FileInfo, device transcode.Device) {
+	type probed struct {
+		index int
+		file  FileInfo
+	}
+
+	var pending []int
+	for i := range files {
+		if files[i].Pending {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	jobs := make(chan int, len(pending))
+	for _, i := range pending {
+		jobs <- i
+	}
+	close(jobs)
+
+	// Buffered so workers never block once the listing has stopped waiting
+	results := make(chan probed, len(pending))
+	for n := 0; n < probeWorkers && n < len(pending); n++ {
+		go func() {
+			for i := range jobs {
+				file := files[i] // Workers only touch their own copy
+				probeSlots <- struct{}{}
+				// Probes outlive the listing that asked for them
+				probePlayability(context.Background(), &file, device)
+				<-probeSlots
+				results <- probed{i, file}
+			}
+		}()
+	}
+
+	timeout := time.NewTimer(probeWait)
+	defer timeout.Stop()
+	for remaining := len(pending); remaining > 0; remaining-- {
+		select {
+		case result := <-results:
+			files[result.index] = result.file
+		case <-timeout.C:
+			go func() {
+				for ; remaining > 0; remaining-- {
+					publishEvent("probed", (<-results).file)
+				}
+			}()
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// progressArgs make ffmpeg write its -progress report to stderr, among its
+// warnings, in place of the status line
+var progressArgs = []string{"-progress", "pipe:2", "-nostats"}
+
+// progressLine matches a key=value line of the -progress report. ffmpeg's
+// own messages have spaces or a [component] prefix, so don't match.
+var progressLine = regexp.MustCompile(`^(frame|fps|stream_\d+_\d+_q|bitrate|total_size|out_time_us|out_time_ms|out_time|dup_frames|drop_frames|speed|progress)=(\S*)$`)
+
+// How often a transcode's progress is sent to pages as an event
+const progressEventInterval = 2 * time.Second
+
+// transcodeProgress is how a transcode is going, from ffmpeg's -progress report
+type transcodeProgress struct {
+	OutTime       float64   `json:"outTime"` // Seconds of output ffmpeg has got to
+	Speed         float64   `json:"speed"`   // Times real time
+	Bitrate       float64   `json:"bitrate"` // Bits a second of output so far
+	FPS           float64   `json:"fps"`
+	Frames        int       `json:"frames"`
+	DroppedFrames int       `json:"droppedFrames"`
+	Updated       time.Time `json:"updated"`
+}
+
+// transcodeEvent is the progress of a session's transcode, as sent to pages
+type transcodeEvent struct {
+	Session string `json:"session"`
+	transcodeProgress
+}
+
+// parseProgressValue adds one key=value of the report to a progress, ignoring
+// values ffmpeg gives as N/A before it has them
+func (p *transcodeProgress) parseProgressValue(key, value string) {
+	switch key {
+	case "out_time_us":
+		if us, err := strconv.ParseFloat(value, 64); err == nil {
+			p.OutTime = us / 1e6
+		}
+	case "speed":
+		if speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64); err == nil {
+			p.Speed = speed
+		}
+	case "bitrate":
+		if kbits, err := strconv.ParseFloat(strings.TrimSuffix(value, "kbits/s"), 64); err == nil {
+			p.Bitrate = kbits * 1000
+		}
+	case "fps":
+		if fps, err := strconv.ParseFloat(value, 64); err == nil {
+			p.FPS = fps
+		}
+	case "frame":
+		if frames, err := strconv.Atoi(value); err == nil {
+			p.Frames = frames
+		}
+	case "drop_frames":
+		if dropped, err := strconv.Atoi(value); err == nil {
+			p.DroppedFrames = dropped
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Queues that haven't been touched for this long are discarded
+const queueRetention = 24 * time.Hour
+
+// playQueue is a server-side list of videos to play in order, so autoplay
+// can carry on across subdirectories
+type playQueue struct {
+	ID       string   `json:"id"`
+	Root     string   `json:"root"`
+	Shuffle  bool     `json:"shuffle"`
+	Items    []string `json:"items"`
+	Position int      `json:"position"`
+	lastUsed time.Time
+}
+
+var (
+	queuesMutex sync.Mutex
+	queues      = map[string]*playQueue{}
+)
+
+// collectVideos lists the videos in a directory, descending into
+// subdirectories when recursive is set. Hidden entries are skipped.
+func collectVideos(path string, recursive bool) ([]string, error) {
+	fullPath := filepath.Join(rootDir, path)
+	var videos []string
+
+	err := filepath.WalkDir(fullPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == fullPath {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if videoFormats[strings.ToLower(filepath.Ext(d.Name()))] {
+			rel, err := relativeAPIPath(p)
+			if err != nil {
+				return err
+			}
+			videos = append(videos, rel)
+		}
+		return nil
+	})
+
+	return videos, err
+}
+
+func handleQueueCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	// Security check: paths can't leave the root
+	path, _, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	recursive := r.URL.Query().Get("recursive") == "true"
+	shuffle := r.URL.Query().Get("shuffle") == "true"
+
+	videos, err := collectVideos(path, recursive)
+	if err != nil {
+		http.Error(w, "Cannot read directory", http.StatusInternalServerError)
+		return
+	}
+	if len(videos) == 0 {
+		http.Error(w, "No videos found", http.StatusNotFound)
+		return
+	}
+
+	if shuffle {
+		rand.Shuffle(len(videos), func(i, j int) { videos[i], videos[j] = videos[j], videos[i] })
+	}
+
+	q := &playQueue{
+		ID:       newSessionID(),
+		Root:     path,
+		Shuffle:  shuffle,
+		Items:    videos,
+		Position: -1,
+		lastUsed: time.Now(),
+	}
+
+	queuesMutex.Lock()
+	for id, old := range queues {
+		if time.Since(old.lastUsed) > queueRetention {
+			delete(queues, id)
+		}
+	}
+	queues[q.ID] = q
+	queuesMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q)
+}
+
+// handleQueue serves GET /api/queue/{id} and POST /api/queue/{id}/next, which
+// advances the queue and returns the next video to play
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/queue/"), "/")
+
+	queuesMutex.Lock()
+	q := queues[id]
+	queuesMutex.Unlock()
+	if q == nil {
+		http.Error(w, "Queue not found", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+		queuesMutex.Lock()
+		q.lastUsed = time.Now()
+		data, _ := json.Marshal(q)
+		queuesMutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	case "next":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		queuesMutex.Lock()
+		q.lastUsed = time.Now()
+		q.Position++
+		position := q.Position
+		var next string
+		if position < len(q.Items) {
+			next = q.Items[position]
+		}
+		queuesMutex.Unlock()
+
+		if next == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		info, err := os.Stat(filepath.Join(rootDir, next))
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newFileInfo(r.Context(), next, info, requestDeviceProfile(r)))
+	default:
+		http.Error(w, "Unknown queue action", http.StatusNotFound)
+	}
+}
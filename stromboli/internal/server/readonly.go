@@ -0,0 +1,29 @@
+package server
+
+import "net/http"
+
+// readOnly is set by -read-only, for libraries on storage that mustn't be
+// written to. Nothing is moved or deleted, and the endpoints that change
+// the library, collections and labels or start jobs only answer reads.
+// Watch history and preferences are still kept, in the data directory.
+var readOnly bool
+
+// denyReadOnly lets only GET and HEAD requests through to a handler while
+// the server is read-only, and always for peers
+func denyReadOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		if readOnly {
+			http.Error(w, "Server is read-only", http.StatusForbidden)
+			return
+		}
+		if requestPeer(r) != "" {
+			http.Error(w, "Peers can't do this", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
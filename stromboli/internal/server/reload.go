@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+// configFile is the -config file, read again on a reload
+var configFile string
+
+// reloadMutex keeps reloads from running over each other
+var reloadMutex sync.Mutex
+
+// applyConfig checks a config's settings and sets up what depends on them
+func applyConfig(c *Config) error {
+	if err := setupFormats(c); err != nil {
+		return fmt.Errorf("invalid format: %w", err)
+	}
+	if err := setupHandlers(c); err != nil {
+		return fmt.Errorf("invalid file handler: %w", err)
+	}
+	if err := setupWatermark(c); err != nil {
+		return fmt.Errorf("invalid watermark: %w", err)
+	}
+	if err := setupPrepareProfiles(c); err != nil {
+		return fmt.Errorf("invalid prepare profile: %w", err)
+	}
+	if err := setupForwardAuth(c); err != nil {
+		return fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	if err := setupInvites(c); err != nil {
+		return fmt.Errorf("invalid invite settings: %w", err)
+	}
+	if err := setupOIDC(c); err != nil {
+		return fmt.Errorf("invalid sign-in settings: %w", err)
+	}
+	if err := setupAccess(c); err != nil {
+		return fmt.Errorf("invalid access rules: %w", err)
+	}
+	if err := setupTrash(c); err != nil {
+		return fmt.Errorf("invalid trash settings: %w", err)
+	}
+	if err := setupOrganize(c); err != nil {
+		return fmt.Errorf("invalid organize rules: %w", err)
+	}
+	if err := setupOffPeak(c); err != nil {
+		return fmt.Errorf("invalid off-peak hours: %w", err)
+	}
+	if err := setupNetworks(c); err != nil {
+		return fmt.Errorf("invalid network settings: %w", err)
+	}
+	if err := setupEncoderRules(c); err != nil {
+		return fmt.Errorf("invalid encoder rules: %w", err)
+	}
+	if err := setupAutoplay(c); err != nil {
+		return fmt.Errorf("invalid autoplay settings: %w", err)
+	}
+	if err := setupBroadcast(c); err != nil {
+		return fmt.Errorf("invalid broadcast target: %w", err)
+	}
+	if err := setupRemoteLibraries(c); err != nil {
+		return fmt.Errorf("invalid remote library: %w", err)
+	}
+	setupWorkers(c)
+	return nil
+}
+
+// reloadConfig reads the config file again and puts it in place, leaving
+// the running config alone if there's anything wrong with it. Streams
+// already going carry on as they started, and new ones get the new
+// settings. It returns the settings that changed but only take effect on
+// a restart.
+func reloadConfig() ([]string, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	old := config()
+	fresh, err := readConfig(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load config: %w", err)
+	}
+	err = applyConfig(fresh)
+	if err == nil {
+		if err = rescheduleTasks(fresh); err != nil {
+			err = fmt.Errorf("invalid task schedule: %w", err)
+		}
+	}
+	if err != nil {
+		// The format tables, profiles and workers may have been switched
+		// over already, so set them up again from the config still in use
+		setupFormats(old)
+		setupHandlers(old)
+		setupPrepareProfiles(old)
+		setupEncoderRules(old)
+		setupWorkers(old)
+		return nil, err
+	}
+
+	var restart []string
+	if !reflect.DeepEqual(fresh.Listen, old.Listen) {
+		restart = append(restart, "listen")
+	}
+	if !reflect.DeepEqual(fresh.JobLimits, old.JobLimits) {
+		restart = append(restart, "jobLimits")
+	}
+	currentConfig.Store(fresh)
+
+	if len(restart) > 0 {
+		log.Printf("Reloaded config, restart for changes to %v to take effect", restart)
+	} else {
+		log.Printf("Reloaded config")
+	}
+	return restart, nil
+}
+
+// reloadOnSignal reloads the config file whenever the process gets SIGHUP
+func reloadOnSignal() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if _, err := reloadConfig(); err != nil {
+			log.Printf("Config not reloaded: %v", err)
+		}
+	}
+}
+
+// handleConfigReload reloads the config file (POST /api/config/reload)
+func handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	restart, err := reloadConfig()
+	if err != nil {
+		log.Printf("Config not reloaded: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if restart == nil {
+		restart = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"restartNeeded": restart})
+}
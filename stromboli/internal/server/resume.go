@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const resumeFile = "sessions.json"
+
+// Sessions quiet for longer than this aren't worth resuming
+const resumeWindow = 30 * time.Minute
+
+// resumeState is what a player needs to pick a session back up after the
+// server restarts and every stream with it
+type resumeState struct {
+	Path     string    `json:"path"`
+	Mode     string    `json:"mode"`
+	Profile  string    `json:"profile,omitempty"`
+	User     string    `json:"user"`
+	Position float64   `json:"position"`
+	Updated  time.Time `json:"updated"`
+}
+
+var (
+	resumeMutex  sync.Mutex
+	resumeStates = map[string]*resumeState{}
+)
+
+func loadResumeStates() {
+	resumeMutex.Lock()
+	defer resumeMutex.Unlock()
+	if err := loadJSON(resumeFile, &resumeStates); err != nil {
+		log.Printf("Error loading sessions: %v", err)
+	}
+	for id, state := range resumeStates {
+		if time.Since(state.Updated) > resumeWindow {
+			delete(resumeStates, id)
+		}
+	}
+}
+
+// saveResumeStates writes the sessions out, dropping stale ones. Callers
+// must hold resumeMutex.
+func saveResumeStates() {
+	for id, state := range resumeStates {
+		if time.Since(state.Updated) > resumeWindow {
+			delete(resumeStates, id)
+		}
+	}
+	if err := saveJSON(resumeFile, resumeStates); err != nil {
+		log.Printf("Error saving sessions: %v", err)
+	}
+}
+
+// rememberSession records a session as it starts
+func rememberSession(id string, state resumeState) {
+	state.Updated = time.Now()
+
+	resumeMutex.Lock()
+	defer resumeMutex.Unlock()
+	resumeStates[id] = &state
+	saveResumeStates()
+}
+
+// updateSessionPosition records how far into its video a session has got,
+// as reported by the player
+func updateSessionPosition(id string, user string, path string, position float64) {
+	resumeMutex.Lock()
+	defer resumeMutex.Unlock()
+
+	state := resumeStates[id]
+	if state == nil {
+		// Direct play sessions are only known once the player reports in
+		s := getSession(id)
+		if s == nil {
+			return
+		}
+		info := s.info()
+		state = &resumeState{Path: info.Path, Mode: info.Mode, User: user}
+		resumeStates[id] = state
+	}
+	if state.User != user || state.Path != path {
+		return
+	}
+
+	state.Position = position
+	state.Updated = time.Now()
+	saveResumeStates()
+}
+
+// handleSessionResume returns what a session was playing, and where, so a
+// player whose stream died with the server can carry on
+func handleSessionResume(w http.ResponseWriter, r *http.Request, id string) {
+	resumeMutex.Lock()
+	state := resumeStates[id]
+	var data []byte
+	if state != nil && state.User == requestUser(r) {
+		data, _ = json.Marshal(state)
+	}
+	resumeMutex.Unlock()
+
+	if data == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
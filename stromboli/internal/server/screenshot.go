@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// captureFrame extracts the frame at the given time as a full resolution PNG
+func captureFrame(fullPath string, seconds float64) ([]byte, error) {
+	var stdout bytes.Buffer
+	var stderr tailBuffer
+
+	// Seeking before the input is frame accurate when decoding, and much faster
+	args := append([]string{"-ss", strconv.FormatFloat(seconds, 'f', 3, 64)}, inputFile(fullPath)...)
+	cmd := exec.Command("ffmpeg", append(args,
+		"-frames:v", "1",
+		"-c:v", "png",
+		"-f", "image2pipe",
+		"-loglevel", "error",
+		"pipe:1",
+	)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("no frame at %.3fs", seconds)
+	}
+	return stdout.Bytes(), nil
+}
+
+// screenshotName names a capture after its video and timestamp
+func screenshotName(relativePath string, seconds float64) string {
+	base := strings.TrimSuffix(filepath.Base(relativePath), filepath.Ext(relativePath))
+	return fmt.Sprintf("%s-%s.png", base, strconv.FormatFloat(seconds, 'f', 3, 64))
+}
+
+// handleScreenshot captures a frame (POST /api/screenshot/{path}?t=SECONDS),
+// also keeping a copy in the screenshots folder when save=1
+func handleScreenshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/screenshot/")
+
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() && discType(fullPath) == "" {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	save := r.URL.Query().Get("save") == "1"
+	if save && readOnly {
+		http.Error(w, "Server is read-only", http.StatusForbidden)
+		return
+	}
+
+	seconds, err := strconv.ParseFloat(r.URL.Query().Get("t"), 64)
+	if err != nil || seconds < 0 {
+		http.Error(w, "Invalid time", http.StatusBadRequest)
+		return
+	}
+
+	frame, err := captureFrame(fullPath, seconds)
+	if err != nil {
+		log.Printf("Error capturing screenshot of %s: %v", path, err)
+		http.Error(w, "Cannot capture screenshot", http.StatusInternalServerError)
+		return
+	}
+
+	name := screenshotName(path, seconds)
+	if save {
+		dir := filepath.Join(dataDir, "screenshots")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("Error creating screenshots directory: %v", err)
+		} else if err := os.WriteFile(filepath.Join(dir, name), frame, 0644); err != nil {
+			log.Printf("Error saving screenshot %s: %v", name, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", name))
+	w.Write(frame)
+}
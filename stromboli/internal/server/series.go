@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// episodePattern finds the season and episode in names such as
+// "Fargo.S01E02.720p.mkv" or "Fargo 1x02.mkv", along with the show's name
+// before them, if any
+var episodePattern = regexp.MustCompile(`(?i)^(.*?)[ ._-]*(?:\bs(\d{1,2})[ ._-]?e(\d{1,3})|\b(\d{1,2})x(\d{2,3}))\b`)
+
+// seasonFolderPattern matches folders holding one season of a show, which
+// don't name the show
+var seasonFolderPattern = regexp.MustCompile(`(?i)^((season|series|staffel)[ ._-]*\d+|s\d{1,2})$`)
+
+// episodeInfo is what a video's path says about the show it belongs to
+type episodeInfo struct {
+	Series  string // The show's name as found
+	Season  int
+	Episode int
+}
+
+// parseEpisode works out the show, season and episode of a video from its
+// path, taking the show's name from the file name or else from the nearest
+// folder that isn't a season folder
+func parseEpisode(path string) (episodeInfo, bool) {
+	name := filepath.Base(path)
+	match := episodePattern.FindStringSubmatch(name)
+	if match == nil {
+		return episodeInfo{}, false
+	}
+	season, episode := match[2], match[3]
+	if season == "" {
+		season, episode = match[4], match[5]
+	}
+	info := episodeInfo{Series: strings.Join(strings.Fields(strings.NewReplacer(".", " ", "_", " ").Replace(match[1])), " ")}
+	info.Season, _ = strconv.Atoi(season)
+	info.Episode, _ = strconv.Atoi(episode)
+
+	folders := strings.Split(path, "/")
+	for i := len(folders) - 2; i >= 0 && info.Series == ""; i-- {
+		if !seasonFolderPattern.MatchString(folders[i]) {
+			info.Series = folders[i]
+		}
+	}
+	if info.Series == "" {
+		return episodeInfo{}, false
+	}
+	return info, true
+}
+
+// seriesEpisode is an indexed video known to be an episode of a show
+type seriesEpisode struct {
+	path string
+	episodeInfo
+}
+
+// nextUpEpisode is the episode to watch next in a show
+type nextUpEpisode struct {
+	seriesEpisode
+	lastWatched time.Time
+}
+
+// nextUpEpisodes finds, for each show in the index with an episode the
+// user has seen, the first unwatched episode after the one watched last.
+// Shows whose last episode is only partly watched are left to the continue
+// watching row. The shows watched most recently come first.
+func nextUpEpisodes(r *http.Request) []nextUpEpisode {
+	libraryMutex.RLock()
+	paths := make([]string, 0, len(libraryIndex))
+	for path := range libraryIndex {
+		paths = append(paths, path)
+	}
+	libraryMutex.RUnlock()
+
+	series := map[string][]seriesEpisode{}
+	for _, path := range paths {
+		if info, ok := parseEpisode(path); ok && canAccess(r, path) {
+			key := strings.ToLower(info.Series)
+			series[key] = append(series[key], seriesEpisode{path, info})
+		}
+	}
+
+	watched := historyOf(requestUser(r))
+
+	var next []nextUpEpisode
+	for _, episodes := range series {
+		sort.Slice(episodes, func(i, j int) bool {
+			a, b := episodes[i], episodes[j]
+			if a.Season != b.Season {
+				return a.Season < b.Season
+			}
+			if a.Episode != b.Episode {
+				return a.Episode < b.Episode
+			}
+			return a.path < b.path
+		})
+
+		last := -1
+		for i, episode := range episodes {
+			entry, seen := watched[episode.path]
+			if seen && (last < 0 || entry.LastWatched.After(watched[episodes[last].path].LastWatched)) {
+				last = i
+			}
+		}
+		if last < 0 || !watched[episodes[last].path].Watched {
+			continue
+		}
+		for _, episode := range episodes[last+1:] {
+			if !watched[episode.path].Watched {
+				next = append(next, nextUpEpisode{episode, watched[episodes[last].path].LastWatched})
+				break
+			}
+		}
+	}
+
+	sort.Slice(next, func(i, j int) bool { return next[i].lastWatched.After(next[j].lastWatched) })
+	return next
+}
+
+// episodeAfter finds the episode of the same show that follows a video in
+// the index, which may be in the next season's folder
+func episodeAfter(r *http.Request, path string) (seriesEpisode, bool) {
+	current, ok := parseEpisode(path)
+	if !ok {
+		return seriesEpisode{}, false
+	}
+	libraryMutex.RLock()
+	paths := make([]string, 0, len(libraryIndex))
+	for p := range libraryIndex {
+		paths = append(paths, p)
+	}
+	libraryMutex.RUnlock()
+
+	var next seriesEpisode
+	found := false
+	for _, p := range paths {
+		info, ok := parseEpisode(p)
+		if !ok || !strings.EqualFold(info.Series, current.Series) || !canAccess(r, p) {
+			continue
+		}
+		after := info.Season > current.Season || info.Season == current.Season && info.Episode > current.Episode
+		earlier := !found || info.Season < next.Season || info.Season == next.Season && (info.Episode < next.Episode || info.Episode == next.Episode && p < next.path)
+		if after && earlier {
+			next = seriesEpisode{p, info}
+			found = true
+		}
+	}
+	return next, found
+}
+
+type nextUpItem struct {
+	FileInfo
+	Series    string `json:"series"`
+	Season    int    `json:"season"`
+	Episode   int    `json:"episode"`
+	Thumbnail string `json:"thumbnail"`
+}
+
+// handleNextUp lists the next episode of each show being watched, most
+// recently watched show first. With ?path= it gives just the episode after
+// that one, for autoplay.
+func handleNextUp(w http.ResponseWriter, r *http.Request) {
+	device := requestDeviceProfile(r)
+	if r.URL.Query().Has("path") {
+		// Security check: paths can't leave the root
+		path, _, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+		if !ok {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		next, ok := episodeAfter(r, path)
+		if !ok {
+			http.Error(w, "No next episode", http.StatusNotFound)
+			return
+		}
+		item, ok := newNextUpItem(r, next, device)
+		if !ok {
+			http.Error(w, "No next episode", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(item)
+		return
+	}
+
+	items := []nextUpItem{}
+	for _, next := range nextUpEpisodes(r) {
+		if len(items) == continueLimit {
+			break
+		}
+		if item, ok := newNextUpItem(r, next.seriesEpisode, device); ok {
+			items = append(items, item)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// newNextUpItem describes an episode for the UI, if its file is still there
+func newNextUpItem(r *http.Request, episode seriesEpisode, device transcode.Device) (nextUpItem, bool) {
+	info, err := os.Stat(filepath.Join(rootDir, filepath.FromSlash(episode.path)))
+	if err != nil {
+		return nextUpItem{}, false
+	}
+	return nextUpItem{
+		FileInfo:  newFileInfo(r.Context(), episode.path, info, device),
+		Series:    episode.Series,
+		Season:    episode.Season,
+		Episode:   episode.Episode,
+		Thumbnail: "/api/thumbnail/" + (&url.URL{Path: episode.path}).EscapedPath(),
+	}, true
+}
@@ -0,0 +1,27 @@
+package server
+
+import "testing"
+
+func TestParseEpisode(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want episodeInfo
+		ok   bool
+	}{
+		{"scene name", "Incoming/Fargo.S01E02.720p.mkv", episodeInfo{"Fargo", 1, 2}, true},
+		{"spaced", "Shows/The Office - s03e10 - A Benihana Christmas.mp4", episodeInfo{"The Office", 3, 10}, true},
+		{"cross", "Shows/Frasier 2x05.avi", episodeInfo{"Frasier", 2, 5}, true},
+		{"show folder", "Shows/Fargo/Season 2/S02E03.mkv", episodeInfo{"Fargo", 2, 3}, true},
+		{"short season folder", "Shows/Fargo/s2/2x04 Fear and Trembling.mkv", episodeInfo{"Fargo", 2, 4}, true},
+		{"resolution", "Films/Heat 1920x1080.mkv", episodeInfo{}, false},
+		{"no episode", "Shows/Season 1/Episode 1.mp4", episodeInfo{}, false},
+		{"no show", "S01E01.mkv", episodeInfo{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parseEpisode(test.path)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%s: parseEpisode(%q) = %+v, %v, want %+v, %v", test.name, test.path, got, ok, test.want, test.ok)
+		}
+	}
+}
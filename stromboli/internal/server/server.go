@@ -0,0 +1,1006 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"video-browser/stromboli/internal/webui"
+
+	"video-browser/stromboli/internal/library"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+var rootDir string
+
+// Running transcodes by player session. A player seeking or switching
+// quality replaces its own transcode, leaving other players' alone.
+var (
+	transcodeMutex sync.Mutex
+	activeCmds     = map[string]*exec.Cmd{}
+)
+
+type FileInfo struct {
+	Name           string         `json:"name"`
+	Path           string         `json:"path"`
+	IsDir          bool           `json:"isDir"`
+	IsVideo        bool           `json:"isVideo"`
+	IsAudio        bool           `json:"isAudio,omitempty"`    // Audio to play on its own, like an audiobook
+	IsComic        bool           `json:"isComic,omitempty"`    // CBZ or CBR archive for the comic reader
+	IsDocument     bool           `json:"isDocument,omitempty"` // PDF or EPUB for the document viewer
+	CanPlay        bool           `json:"canPlay"`
+	NeedsTranscode bool           `json:"needsTranscode"`
+	Corrupt        bool           `json:"corrupt,omitempty"`
+	CheckError     string         `json:"checkError,omitempty"`
+	Disc           string         `json:"disc,omitempty"`
+	Parts          []string       `json:"parts,omitempty"`
+	AudioTracks    []sidecarTrack `json:"audioTracks,omitempty"`
+	Subtitles      []sidecarTrack `json:"subtitles,omitempty"`
+	Duration       float64        `json:"duration,omitempty"`
+	Pending        bool           `json:"pending,omitempty"` // Playability not probed yet
+	Codecs         *fileCodecs    `json:"codecs,omitempty"`
+	Playback       string         `json:"playback,omitempty"` // direct, remux or transcode
+	PlaybackReason string         `json:"playbackReason,omitempty"`
+	Size           int64          `json:"size"`
+	ModTime        time.Time      `json:"modTime"`
+	Rating         int            `json:"rating,omitempty"`
+	Tags           []string       `json:"tags,omitempty"`
+	Collection     string         `json:"collection,omitempty"` // ID of a virtual collection listed at the top
+	Remote         bool           `json:"remote,omitempty"`     // Another server's library listed at the top
+	Watching       int            `json:"watching,omitempty"`   // Players open on it right now
+}
+
+// Video formats that browsers can typically play natively
+var nativeFormats = map[string]bool{
+	".mp4":  true,
+	".webm": true,
+	".ogg":  true,
+}
+
+// All video formats we'll recognize
+var videoFormats = map[string]bool{
+	".mp4":  true,
+	".webm": true,
+	".ogg":  true,
+	".mkv":  true,
+	".avi":  true,
+	".mov":  true,
+	".wmv":  true,
+	".flv":  true,
+	".m4v":  true,
+	".mpg":  true,
+	".mpeg": true,
+	".3gp":  true,
+	".ts":   true, // Broadcast captures
+	".m2ts": true,
+	".mts":  true,
+	".iso":  true, // DVD and Blu-ray images
+}
+
+// MIME types for serving video files as they are. Go only knows a few video
+// types itself, and TVs can refuse files sent as application/octet-stream.
+var videoMimeTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".webm": "video/webm",
+	".ogg":  "video/ogg",
+	".mkv":  "video/x-matroska",
+	".avi":  "video/x-msvideo",
+	".mov":  "video/quicktime",
+	".wmv":  "video/x-ms-wmv",
+	".flv":  "video/x-flv",
+	".mpg":  "video/mpeg",
+	".mpeg": "video/mpeg",
+	".3gp":  "video/3gpp",
+	".ts":   "video/mp2t",
+	".m2ts": "video/mp2t",
+	".mts":  "video/mp2t",
+	".iso":  "application/x-iso9660-image",
+}
+
+// RunCommand runs one of the subcommands: check, self-update,
+// install-service, uninstall-service or worker. It reports false for any
+// other name.
+func RunCommand(name string, args []string) bool {
+	switch name {
+	case "check":
+		runCheckCommand(args)
+	case "self-update":
+		runSelfUpdateCommand(args)
+	case "install-service":
+		runInstallServiceCommand(args)
+	case "uninstall-service":
+		runUninstallServiceCommand(args)
+	case "worker":
+		runWorkerCommand(args)
+	case "export":
+		runExportCommand(args)
+	case "import":
+		runImportCommand(args)
+	default:
+		return false
+	}
+	return true
+}
+
+// Options are the settings the command line takes
+type Options struct {
+	Dir        string // Directory to serve
+	DataDir    string // Where watch history and caches are kept
+	ConfigFile string // JSON config file, if any
+	LangDir    string // Extra or replacement language packs
+
+	// Addresses ListenAndServe uses, in place of Port and the config file's
+	Listen          []string
+	Port            string
+	TLSCert, TLSKey string
+
+	LogFile       string // Logs go here rather than stdout when set
+	LogMaxSize    int    // Megabytes before the log file is rotated
+	LogMaxAgeDays int
+	LogDir        string // Per-session ffmpeg logs
+
+	Container        string // Default transcode container, mp4 or mpegts
+	Warmup           bool
+	StreamTokens     bool
+	WebRTC           bool
+	UpdateCheck      bool
+	ProbeWorkers     int
+	ProbeTimeout     time.Duration
+	ScanOnStart      string // "wait" to index the library before serving, or "background"
+	StreamBufferMB   int
+	AudiobookMinutes int
+	ReadOnly         bool // Never change the library or start jobs
+}
+
+// DefaultOptions are the command line's defaults
+func DefaultOptions() Options {
+	return Options{
+		Dir:              ".",
+		DataDir:          defaultDataDir(),
+		Port:             "8080",
+		LogMaxSize:       10,
+		LogMaxAgeDays:    7,
+		Container:        "mp4",
+		Warmup:           true,
+		UpdateCheck:      true,
+		ProbeWorkers:     4,
+		ProbeTimeout:     30 * time.Second,
+		StreamBufferMB:   16,
+		AudiobookMinutes: 20,
+	}
+}
+
+// Server is the web UI and API for one library. Its state is kept across
+// the package, so a program can only run one.
+type Server struct {
+	listeners []listener
+	handler   http.Handler
+}
+
+// New sets up a server: reading the config file, loading what was saved
+// last time and starting the maintenance schedule
+func New(opts Options) (*Server, error) {
+	defaultContainer = opts.Container
+	warmupEnabled = opts.Warmup
+	streamTokensEnabled = opts.StreamTokens
+	webrtcEnabled = opts.WebRTC
+	updateCheckEnabled = opts.UpdateCheck
+	probeWorkers = max(opts.ProbeWorkers, 1)
+	if opts.ProbeTimeout > 0 {
+		library.ProbeTimeout = opts.ProbeTimeout
+	}
+	streamBufferMB = opts.StreamBufferMB
+	audiobookMinutes = opts.AudiobookMinutes
+	readOnly = opts.ReadOnly
+	dataDir = opts.DataDir
+	probeSlots = make(chan struct{}, probeWorkers)
+
+	if _, ok := transcode.Containers[defaultContainer]; !ok {
+		return nil, errors.New("unknown container: " + defaultContainer)
+	}
+
+	configFile = opts.ConfigFile
+	if err := loadConfig(configFile); err != nil {
+		return nil, fmt.Errorf("cannot load config: %w", err)
+	}
+	if err := applyConfig(config()); err != nil {
+		return nil, err
+	}
+	listeners, err := setupListeners(opts.Listen, opts.Port, opts.TLSCert, opts.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %w", err)
+	}
+	if err := loadLanguagePacks(opts.LangDir); err != nil {
+		return nil, fmt.Errorf("cannot load language packs: %w", err)
+	}
+
+	if err := setupLogging(opts.LogFile, opts.LogMaxSize, opts.LogMaxAgeDays, opts.LogDir); err != nil {
+		return nil, fmt.Errorf("cannot set up logging: %w", err)
+	}
+
+	rootDir, err = filepath.Abs(opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid directory: %w", err)
+	}
+
+	if _, err := os.Stat(rootDir); os.IsNotExist(err) {
+		return nil, errors.New("directory does not exist: " + rootDir)
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create data directory: %w", err)
+	}
+	if err := setupStreamTokens(); err != nil {
+		return nil, err
+	}
+	loadPreferences()
+	loadHistory()
+	loadLibrary()
+	loadMarkers()
+	loadFailures()
+	loadClientErrors()
+	loadOrganizeMoves()
+	loadTrash()
+	loadLabels()
+	loadCollections()
+	loadAccounts()
+	loadResumeStates()
+	aggregateStats()
+	ffmpegVersion = detectFFmpegVersion()
+
+	if err := setupJobs(); err != nil {
+		return nil, fmt.Errorf("invalid job limits: %w", err)
+	}
+	if err := setupTasks(); err != nil {
+		return nil, fmt.Errorf("invalid task schedule: %w", err)
+	}
+	if err := scanOnStart(opts.ScanOnStart); err != nil {
+		return nil, fmt.Errorf("cannot scan library: %w", err)
+	}
+	go runScheduler()
+	go runUpdateChecks()
+	go expireViewers()
+	go reloadOnSignal()
+
+	logStartupSummary()
+	log.Printf("Serving directory: %s", rootDir)
+
+	return &Server{listeners: listeners, handler: routes()}, nil
+}
+
+// Handler serves the web UI and API, for programs with their own mux. The
+// UI asks for /api/ and /static/ from the root of the host, so it can't be
+// mounted under a prefix.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// ListenAndServe serves on the addresses in the options or the config file
+// until one fails
+func (s *Server) ListenAndServe() error {
+	return serve(s.listeners, s.handler)
+}
+
+// routes maps the web UI and the API onto a mux
+func routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleIndex)
+	mux.HandleFunc("/sw.js", handleServiceWorker)
+	mux.Handle("/static/", webui.Static())
+	mux.HandleFunc("/api/browse", handleBrowse)
+	mux.HandleFunc("/api/description", federate("", handleDescription))
+	mux.HandleFunc("/api/video/", longResponse(requireStreamToken("/api/video/", limitGuests(federate("/api/video/", handleVideo)))))
+	mux.HandleFunc("/api/stream/", longResponse(requireStreamToken("/api/stream/", limitGuests(federate("/api/stream/", handleStream)))))
+	mux.HandleFunc("/api/whep/", requireStreamToken("/api/whep/", denyGuests(handleWHEP)))
+	mux.HandleFunc("/api/webrtc/", handleWebRTCSession)
+	mux.HandleFunc("/api/token", handleToken)
+	mux.HandleFunc("/api/session/", federateSessions(handleSession))
+	mux.HandleFunc("/api/queue", handleQueueCreate)
+	mux.HandleFunc("/api/queue/", handleQueue)
+	mux.HandleFunc("/api/progress", handleProgress)
+	mux.HandleFunc("/api/continue", handleContinue)
+	mux.HandleFunc("/api/nextup", handleNextUp)
+	mux.HandleFunc("/api/surprise", handleSurprise)
+	mux.HandleFunc("/api/thumbnail/", federate("/api/thumbnail/", handleThumbnail))
+	mux.HandleFunc("/api/preferences", handlePreferences)
+	mux.HandleFunc("/api/labels", denyGuests(denyReadOnly(handleLabels)))
+	mux.HandleFunc("/api/tags", handleTags)
+	mux.HandleFunc("/api/collections", denyReadOnly(handleCollections))
+	mux.HandleFunc("/api/collections/", denyReadOnly(handleCollections))
+	mux.HandleFunc("/api/offline", denyGuests(denyReadOnly(handleOfflineCreate)))
+	mux.HandleFunc("/api/offline/", longResponse(denyGuests(denyReadOnly(handleOffline))))
+	mux.HandleFunc("/api/tasks", denyGuests(denyReadOnly(handleTasks)))
+	mux.HandleFunc("/api/tasks/", denyGuests(denyReadOnly(handleTasks)))
+	mux.HandleFunc("/api/export", requireAdmin(handleExport))
+	mux.HandleFunc("/api/import", requireAdmin(denyReadOnly(handleImport)))
+	mux.HandleFunc("/api/config/reload", requireAdmin(handleConfigReload))
+	mux.HandleFunc("/api/check", denyGuests(denyReadOnly(handleCheck)))
+	mux.HandleFunc("/api/usage", denyGuests(handleUsage))
+	mux.HandleFunc("/api/screenshot/", denyGuests(handleScreenshot))
+	mux.HandleFunc("/api/clip", denyGuests(denyReadOnly(handleClipCreate)))
+	mux.HandleFunc("/api/clip/", longResponse(denyGuests(denyReadOnly(handleClip))))
+	mux.HandleFunc("/api/extract-audio/", longResponse(denyGuests(denyReadOnly(handleExtractAudio))))
+	mux.HandleFunc("/api/subtitles/", federate("/api/subtitles/", handleSubtitles))
+	mux.HandleFunc("/api/events", longResponse(handleEvents))
+	mux.HandleFunc("/api/warmup", handleWarmup)
+	mux.HandleFunc("/api/speedtest", longResponse(handleSpeedTest))
+	mux.HandleFunc("/api/failures", denyGuests(handleFailures))
+	mux.HandleFunc("/api/client-errors", handleClientErrors)
+	mux.HandleFunc("/api/heartbeat", handleHeartbeat)
+	mux.HandleFunc("/api/viewers", handleViewers)
+	mux.HandleFunc("/api/server-info", handleServerInfo)
+	mux.HandleFunc("/api/intro/analyze", denyGuests(denyReadOnly(handleIntroAnalysis)))
+	mux.HandleFunc("/api/organize", denyGuests(denyReadOnly(handleOrganize)))
+	mux.HandleFunc("/api/trash", denyGuests(denyReadOnly(handleTrash)))
+	mux.HandleFunc("/api/trash/", denyGuests(denyReadOnly(handleTrash)))
+	mux.HandleFunc("/api/jobs", denyGuests(denyReadOnly(handleJobs)))
+	mux.HandleFunc("/api/jobs/", denyGuests(denyReadOnly(handleJobs)))
+	mux.HandleFunc("/api/invites", requireAdmin(denyReadOnly(handleInvites)))
+	mux.HandleFunc("/api/invites/", requireAdmin(denyReadOnly(handleInvites)))
+	mux.HandleFunc("/api/markers", federate("", handleMarkers))
+	mux.HandleFunc("/api/chapters", federate("", handleChapters))
+	mux.HandleFunc("/api/slideshow", handleSlideshow)
+	mux.HandleFunc("/api/comic", handleComic)
+	mux.HandleFunc("/api/document", handleDocument)
+	mux.HandleFunc("/api/epub/", handleEpub)
+	mux.HandleFunc("/api/worker/", longResponse(handleWorker))
+	mux.HandleFunc("/auth/login", handleSignIn)
+	mux.HandleFunc("/auth/callback", handleSignInCallback)
+	mux.HandleFunc("/auth/logout", handleSignOut)
+	mux.HandleFunc("/auth/password", handlePasswordSignIn)
+	mux.HandleFunc("/auth/invite/", handleInviteSignUp)
+	return requireSignIn(mux)
+}
+
+// newFileInfo describes a file or directory under rootDir, probing videos
+// the index doesn't know to see how the device can play them
+func newFileInfo(ctx context.Context, relativePath string, info os.FileInfo, device transcode.Device) FileInfo {
+	file := indexedFileInfo(relativePath, info, device)
+	if file.Pending {
+		probePlayability(ctx, &file, device)
+	}
+	return file
+}
+
+// probePlayability runs ffprobe on a file the index couldn't vouch for
+func probePlayability(ctx context.Context, file *FileInfo, device transcode.Device) {
+	file.Pending = false
+	probe, err := probeFile(ctx, filepath.Join(rootDir, file.Path))
+	if err != nil {
+		file.Playback, file.PlaybackReason = playTranscode, "ffprobe couldn't read the file"
+		file.CanPlay, file.NeedsTranscode = false, true
+		return
+	}
+	file.decidePlayback(probeCodecs(probe), device)
+}
+
+// indexedFileInfo is newFileInfo without running ffprobe. Videos the index
+// knows nothing about are marked Pending until probePlayability runs.
+func indexedFileInfo(relativePath string, info os.FileInfo, device transcode.Device) FileInfo {
+	name := filepath.Base(relativePath)
+	isDir := info.IsDir()
+	ext := strings.ToLower(filepath.Ext(name))
+	isVideo := videoFormats[ext]
+	_, isAudio := listeningFormats[ext]
+
+	// DVD and Blu-ray backups play as one video rather than being browsed
+	var disc string
+	if isDir || ext == ".iso" {
+		disc = discType(filepath.Join(rootDir, relativePath))
+		if disc != "" {
+			isDir, isVideo = false, true
+		}
+	}
+
+	// Flag files the corruption check found problems with
+	var corrupt bool
+	var checkError string
+	var duration float64
+	var fresh bool
+	libraryMutex.RLock()
+	entry := libraryIndex[relativePath]
+	if entry != nil && entry.Corrupt {
+		corrupt, checkError = true, entry.CheckError
+	}
+	if entry != nil && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		duration = entry.Duration
+		fresh = true
+	}
+	var indexed indexEntry
+	if entry != nil {
+		indexed = *entry
+	}
+	libraryMutex.RUnlock()
+
+	labeled := labelsOf(relativePath)
+	file := FileInfo{
+		Name:       name,
+		Path:       relativePath,
+		IsDir:      isDir,
+		IsVideo:    isVideo,
+		IsAudio:    isAudio && !isDir,
+		IsComic:    comicFormats[ext] && !isDir,
+		IsDocument: documentFormats[ext] && !isDir,
+		CanPlay:    isAudio && !isDir,
+		Corrupt:    corrupt,
+		CheckError: checkError,
+		Disc:       disc,
+		Duration:   duration,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		Rating:     labeled.Rating,
+		Tags:       labeled.Tags,
+	}
+
+	// The index already knows the codecs of unchanged files, which saves
+	// running ffprobe on every file of a big directory
+	if isVideo && !isDir {
+		switch {
+		case disc != "" || handlerFor(relativePath) != nil:
+			file.decidePlayback(fileCodecs{}, device)
+		case fresh && indexed.ProbeError != "":
+			file.Playback, file.PlaybackReason = playTranscode, "ffprobe couldn't read the file"
+			file.NeedsTranscode = true
+		case fresh:
+			file.decidePlayback(fileCodecs{Video: indexed.VideoCodec, Audio: indexed.AudioCodec, Width: indexed.Width, Height: indexed.Height, FrameRate: indexed.FrameRate}, device)
+		default:
+			file.Pending = true
+		}
+	}
+	return file
+}
+
+// browseEntry is a file or directory in a listing, before it is probed
+type browseEntry struct {
+	path string // Relative to rootDir
+	info os.FileInfo
+
+	collection *FileInfo // Set for a collection or remote library listed at the top of the library
+}
+
+// handleBrowse lists a directory. With limit (and optionally offset) only
+// that page of the sorted listing is returned, the full count being in the
+// X-Total-Count header, so huge directories can be loaded a piece at a time.
+// flatten=true lists every video below the directory instead, however deeply
+// nested.
+func handleBrowse(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+
+	// Security check: paths can't leave the root, and folders above the
+	// ones the user may see only list the way down to them
+	path, fullPath, ok := resolvePath(path)
+	if !ok || !canBrowse(r, path) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if name, library, rest := remoteLibraryOf(r, path); library != nil {
+		query := r.URL.Query()
+		query.Set("path", rest)
+		proxyToRemote(w, r, name, library, "/api/browse", query, prefixListing(name))
+		return
+	}
+
+	flatten := r.URL.Query().Get("flatten") == "true"
+
+	var listing []browseEntry
+	var names, fileNames []string
+	if flatten {
+		videos, err := collectVideos(path, true)
+		if err != nil {
+			http.Error(w, "Cannot read directory", http.StatusInternalServerError)
+			return
+		}
+		for _, video := range videos {
+			if !canAccess(r, video) {
+				continue
+			}
+			if info, err := os.Stat(filepath.Join(rootDir, video)); err == nil {
+				listing = append(listing, browseEntry{path: video, info: info})
+			}
+		}
+	} else {
+		entries, err := os.ReadDir(fullPath)
+		if err != nil {
+			http.Error(w, "Cannot read directory", http.StatusInternalServerError)
+			return
+		}
+
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+
+			// Skip hidden files
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			entryPath := apiPath(filepath.Join(path, entry.Name()))
+			if !canBrowse(r, entryPath) {
+				continue
+			}
+			listing = append(listing, browseEntry{path: entryPath, info: info})
+			if !info.IsDir() {
+				fileNames = append(fileNames, entry.Name())
+			}
+			if !info.IsDir() && videoFormats[strings.ToLower(filepath.Ext(entry.Name()))] {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+
+	// Only files and folders with the tag and at least the rating asked for
+	tag := strings.ToLower(r.URL.Query().Get("tag"))
+	minRating, _ := strconv.Atoi(r.URL.Query().Get("minRating"))
+	if tag != "" || minRating > 0 {
+		filtered := listing[:0]
+		for _, entry := range listing {
+			if labelsOf(entry.path).matches(tag, minRating) {
+				filtered = append(filtered, entry)
+			}
+		}
+		listing = filtered
+	}
+
+	sortBrowseEntries(listing, r.URL.Query().Get("sort"))
+
+	// Collections come first in the library, so they page like folders
+	if path == "" && !flatten && tag == "" && minRating <= 0 {
+		var withCollections []browseEntry
+		for _, c := range collectionEntries() {
+			c := c
+			withCollections = append(withCollections, browseEntry{collection: &c})
+		}
+		for _, remote := range remoteLibraryEntries(r) {
+			remote := remote
+			withCollections = append(withCollections, browseEntry{collection: &remote})
+		}
+		listing = append(withCollections, listing...)
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(listing)))
+	listing = pageOf(listing, r.URL.Query().Get("offset"), r.URL.Query().Get("limit"))
+
+	// Only the requested page is probed
+	device := requestDeviceProfile(r)
+	files := []FileInfo{}
+	for _, entry := range listing {
+		if entry.collection != nil {
+			files = append(files, *entry.collection)
+			continue
+		}
+		files = append(files, indexedFileInfo(entry.path, entry.info, device))
+	}
+	probePending(files, device)
+	watching := watchingCounts()
+	for i := range files {
+		files[i].Watching = watching[files[i].Path]
+	}
+
+	// Offer combined playback on the first file of CD1/CD2 style sets. A
+	// flattened listing spans many folders, so it goes without.
+	if !flatten {
+		groups := groupParts(names)
+		for i := range files {
+			if files[i].Collection != "" {
+				continue
+			}
+			for _, part := range groups[files[i].Name] {
+				files[i].Parts = append(files[i].Parts, apiPath(filepath.Join(path, part)))
+			}
+			if files[i].IsVideo {
+				files[i].AudioTracks = sidecarTracks(files[i].Name, fileNames, audioFormats)
+				files[i].Subtitles = sidecarTracks(files[i].Name, fileNames, subtitleFormats)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
+
+// sortBrowseEntries orders a listing the way the UI shows it: directories
+// first, then by path, newest or largest
+func sortBrowseEntries(listing []browseEntry, order string) {
+	sort.SliceStable(listing, func(i, j int) bool {
+		a, b := listing[i].info, listing[j].info
+		if a.IsDir() != b.IsDir() {
+			return a.IsDir()
+		}
+		switch {
+		case order == "newest" && !a.ModTime().Equal(b.ModTime()):
+			return a.ModTime().After(b.ModTime())
+		case order == "size" && a.Size() != b.Size():
+			return a.Size() > b.Size()
+		}
+		return strings.ToLower(listing[i].path) < strings.ToLower(listing[j].path)
+	})
+}
+
+// pageOf applies offset and limit query values to a listing. A missing or
+// invalid limit returns everything from the offset on.
+func pageOf[T any](items []T, offsetValue, limitValue string) []T {
+	offset, _ := strconv.Atoi(offsetValue)
+	offset = max(0, min(offset, len(items)))
+	items = items[offset:]
+
+	if limit, err := strconv.Atoi(limitValue); err == nil && limit >= 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+func handleVideo(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/video/")
+
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	// Count what the player receives when it asks for stats
+	if r.URL.Query().Get("session") != "" {
+		sessionID := sessionIDFromRequest(r)
+		if !limitStreams(w, r, newStreamLogger(w, sessionID), sessionID, path, modeDirect) {
+			return
+		}
+		session := directSession(sessionID, path, fullPath, requestUser(r))
+		if !session.holdWhilePaused(r) {
+			return
+		}
+		session.serving(1)
+		defer session.serving(-1)
+		w = countingWriter{w, session}
+	}
+
+	// Go doesn't know most video types or every audio type, M4B audiobooks
+	// among them
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	if mimeType, ok := videoMimeTypes[ext]; ok {
+		w.Header().Set("Content-Type", mimeType)
+	} else if mimeType, ok := listeningFormats[ext]; ok {
+		w.Header().Set("Content-Type", mimeType)
+	}
+
+	// Serve the file directly. ServeFile answers HEAD and Range requests
+	// itself, and hands the file to sendfile where the OS has it unless the
+	// writer is wrapped to count bytes or hold guests to their bitrate.
+	http.ServeFile(w, r, fullPath)
+}
+
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/stream/")
+
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	// Check if file exists
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Some TVs ask for the headers before playing, which shouldn't start a
+	// transcode or stop the session's current one
+	if r.Method == http.MethodHead {
+		container, _, _, err := streamSettings(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", transcode.Containers[container].MimeType)
+		w.Header().Set("Cache-Control", "no-cache")
+		return
+	}
+
+	// Everything logged about this stream starts with its ID, which the
+	// player is sent too
+	sessionID := sessionIDFromRequest(r)
+	logger := newStreamLogger(w, sessionID)
+
+	// Kill this session's existing transcoding process before starting a new one
+	if !limitStreams(w, r, logger, sessionID, path, modeTranscode) {
+		return
+	}
+	transcodeMutex.Lock()
+	if previous := activeCmds[sessionID]; previous != nil && previous.Process != nil {
+		logger.Printf("Killing existing ffmpeg process to start new transcode for session %s", sessionID)
+		previous.Process.Kill()
+		previous.Wait() // Wait for it to fully exit
+		delete(activeCmds, sessionID)
+	}
+	transcodeMutex.Unlock()
+
+	container, profile, device, err := streamSettings(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Start offset, used when resuming or when the player falls back after stalling
+	start, _ := strconv.ParseFloat(r.URL.Query().Get("start"), 64)
+
+	// An end makes a short segment, for looping part of a video without
+	// transcoding the rest of it
+	var length float64
+	if e := r.URL.Query().Get("end"); e != "" {
+		end, err := strconv.ParseFloat(e, 64)
+		if err != nil || end <= start || end-start > maxSegmentLength {
+			http.Error(w, "Invalid segment end", http.StatusBadRequest)
+			return
+		}
+		length = end - start
+	}
+
+	// Workarounds chosen when retrying a failed transcode
+	retry, err := parseRetry(r.URL.Query().Get("retry"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if retry.Software && (profile.Passthrough || profile.Remux) {
+		profile = transcode.Profiles[0]
+	}
+
+	// Volume boost, for players that can't raise it themselves
+	var volume float64
+	if v := r.URL.Query().Get("volume"); v != "" {
+		volume, err = strconv.ParseFloat(v, 64)
+		if err != nil || volume <= 0 || volume > maxVolume {
+			http.Error(w, "Invalid volume", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Set headers for streaming
+	w.Header().Set("Content-Type", transcode.Containers[container].MimeType)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// Probe the stream layout so files without audio still transcode
+	probe, err := probeFile(r.Context(), fullPath)
+	if err != nil {
+		logger.Printf("Error probing %s, assuming first video and audio streams: %v", path, err)
+	}
+
+	// Multi-part movies are joined into one stream with the concat demuxer
+	var concatList string
+	if r.URL.Query().Get("parts") == "1" {
+		var partPaths []string
+		for _, part := range partsOf(path) {
+			partPaths = append(partPaths, filepath.Join(rootDir, part))
+		}
+		if len(partPaths) < 2 {
+			http.Error(w, "Not a multi-part file", http.StatusBadRequest)
+			return
+		}
+		concatList, err = writeConcatList(partPaths)
+		if err != nil {
+			logger.Printf("Error writing concat list: %v", err)
+			http.Error(w, "Transcoding error", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(concatList)
+	}
+
+	// External audio tracks replace the file's own audio
+	var audioPath string
+	if audio := r.URL.Query().Get("audio"); audio != "" {
+		if audioPath, ok = sidecarPath(path, audio, audioFormats); !ok {
+			http.Error(w, "Unknown audio track", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subtitles are burned in for players that can't show them themselves
+	var subtitlePath string
+	if subtitles := r.URL.Query().Get("subtitles"); subtitles != "" && !retry.NoSubtitles {
+		if subtitlePath, ok = sidecarPath(path, subtitles, subtitleFormats); !ok {
+			http.Error(w, "Unknown subtitles", http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts := transcodeOptions{
+		Container:     container,
+		Profile:       profile,
+		Device:        device,
+		Start:         start,
+		ConcatList:    concatList,
+		ExternalAudio: audioPath,
+		Subtitles:     subtitlePath,
+		SubtitleStyle: subtitleForceStyle(getPreferences(requestUser(r))),
+		Downmix:       getPreferences(requestUser(r)).Downmix,
+		Watermark:     watermarkText(r, path),
+		Retry:         retry,
+		Volume:        volume,
+		Length:        length,
+		Exact:         length > 0,
+	}
+
+	// A warmed up first minute goes out straight away while ffmpeg starts
+	// on the rest
+	var warm string
+	if start == 0 && length == 0 && concatList == "" && audioPath == "" && subtitlePath == "" && retry == (retryOptions{}) && volume == 0 && warmable(r, fullPath, profile) {
+		if warm = warmupFile(fullPath, profile, device, container); warm != "" {
+			opts.Start = warmupLength
+			opts.OutputOffset = warmupLength
+		}
+	}
+	args := transcodeArgs(fullPath, probe, opts)
+	cmd := exec.Command("ffmpeg", append(slices.Clone(progressArgs), args...)...)
+
+	// File types with their own transcode command skip ffmpeg entirely
+	customCommand := false
+	if handler := handlerFor(fullPath); handler != nil && len(handler.Transcode) > 0 && concatList == "" && audioPath == "" && subtitlePath == "" && config().Watermark == nil && !retry.Software && volume == 0 && length == 0 {
+		args := expandCommand(handler.Transcode, fullPath, start, container)
+		cmd = exec.Command(args[0], args[1:]...)
+		customCommand = true
+	}
+
+	// Track this as the session's active command
+	transcodeMutex.Lock()
+	activeCmds[sessionID] = cmd
+	transcodeMutex.Unlock()
+
+	// Capture stderr for debugging
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		logger.Printf("Error creating stderr pipe: %v", err)
+		http.Error(w, "Transcoding error", http.StatusInternalServerError)
+		return
+	}
+
+	// Get stdout pipe
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		logger.Printf("Error creating stdout pipe: %v", err)
+		http.Error(w, "Transcoding error", http.StatusInternalServerError)
+		return
+	}
+
+	session := startSession(sessionID, path, modeTranscode, requestUser(r))
+	session.Container = container
+	session.Profile = profile.Name
+	session.Probe = probe
+	session.log = logger
+	rememberSession(sessionID, resumeState{Path: path, Mode: modeTranscode, Profile: profile.Name, User: requestUser(r), Position: start})
+
+	// A connected worker takes the transcode when it only needs the video
+	// itself, rather than files only this machine has
+	if remoteEnabled && !customCommand && warm == "" && concatList == "" && audioPath == "" && subtitlePath == "" && config().Watermark == nil && workerConnected() {
+		if remote, ok := remoteArgs(args, fullPath); ok {
+			served, written, streamErr := transcodeRemotely(w, r, session, remote, fullPath)
+			if served {
+				transcodeMutex.Lock()
+				if activeCmds[sessionID] == cmd {
+					delete(activeCmds, sessionID)
+				}
+				transcodeMutex.Unlock()
+				session.finish(streamErr)
+				if streamErr != nil {
+					recordFailure(path, streamErr, profile.Name, retry, session.tail.Lines())
+					if written == 0 {
+						writeStreamError(w, streamErr)
+					}
+				} else if written > 0 {
+					clearFailure(path)
+				}
+				return
+			}
+		}
+	}
+
+	// Start the command
+	if err := cmd.Start(); err != nil {
+		logger.Printf("Error starting ffmpeg: %v", err)
+		streamErr := classifyStartError(err)
+		session.finish(streamErr)
+		recordFailure(path, streamErr, profile.Name, retry, nil)
+		writeStreamError(w, streamErr)
+		return
+	}
+
+	// Follow ffmpeg's progress in the background, logging the rest of what
+	// it says and keeping the tail for error classification
+	sessionLog := openSessionLog(logger, path)
+	stderrDone := make(chan bool)
+	go func() {
+		defer close(stderrDone)
+		defer sessionLog.Close()
+		followStderr(stderr, session, sessionLog)
+	}()
+
+	// ffmpeg writes into a buffer rather than straight to the player, so it
+	// keeps encoding through pauses and slow patches on the network
+	output := newStreamBuffer(max(streamBufferMB, 1) << 20)
+	go output.fill(stdout)
+
+	// Monitor for client disconnect and kill ffmpeg if needed
+	done := make(chan int64, 1)
+	go func() {
+		// Copy output to response
+		var written int64
+		var err error
+		player := newFlushWriter(countingWriter{w, session}, w)
+		if warm != "" {
+			written, err = copyWarmup(player, warm, output, container)
+		} else {
+			written, err = io.Copy(player, output)
+		}
+		if err != nil {
+			logger.Printf("Error streaming video: %v", err)
+		}
+		done <- written
+	}()
+
+	// Wait for either completion or context cancellation
+	var written int64
+	select {
+	case written = <-done:
+		// Streaming finished normally
+	case <-r.Context().Done():
+		// Client disconnected
+		logger.Printf("Client disconnected, killing ffmpeg process for: %s", path)
+		if err := cmd.Process.Kill(); err != nil {
+			logger.Printf("Error killing ffmpeg: %v", err)
+		}
+		<-done
+	}
+	output.Close()
+
+	// Clean up active command reference
+	transcodeMutex.Lock()
+	if activeCmds[sessionID] == cmd {
+		delete(activeCmds, sessionID)
+	}
+	transcodeMutex.Unlock()
+
+	// Wait for command to finish
+	<-stderrDone
+	if err := cmd.Wait(); err != nil {
+		// Don't log error if we killed the process intentionally
+		if r.Context().Err() == nil {
+			logger.Printf("FFmpeg error: %v", err)
+			streamErr := classifyFFmpegError(session.stderr())
+			session.finish(streamErr)
+			recordFailure(path, streamErr, profile.Name, retry, session.tail.Lines())
+
+			// Nothing has been sent yet, so the error can still be the response
+			if written == 0 {
+				writeStreamError(w, streamErr)
+			}
+			return
+		}
+	}
+	session.finish(nil)
+	if written > 0 {
+		clearFailure(path)
+	}
+}
+
+func writeStreamError(w http.ResponseWriter, streamErr *streamError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(streamErr)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os/exec"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// version is set when building releases, with -ldflags "-X video-browser/stromboli/internal/server.version=1.2.0"
+var version = "dev"
+
+var startTime = time.Now()
+
+// ffmpegVersion is the version line of the ffmpeg on the PATH, found at startup
+var ffmpegVersion string
+
+type serverInfo struct {
+	Version   string       `json:"version"`
+	Update    string       `json:"update,omitempty"` // Newer release, if there is one
+	Started   time.Time    `json:"started"`
+	Uptime    float64      `json:"uptime"` // Seconds
+	FFmpeg    string       `json:"ffmpeg"`
+	Library   libraryStats `json:"library"`
+	Features  []string     `json:"features"`
+	Languages []string     `json:"languages"`
+}
+
+// buildVersion is the release version, or for development builds the
+// commit they were built from where Go recorded it
+func buildVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 7 {
+				return "dev-" + setting.Value[:7]
+			}
+		}
+	}
+	return version
+}
+
+// detectFFmpegVersion reads the version out of ffmpeg's banner, such as
+// "6.1.1" from "ffmpeg version 6.1.1 Copyright ..."
+func detectFFmpegVersion() string {
+	output, err := exec.Command("ffmpeg", "-version").Output()
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) < 3 || fields[0] != "ffmpeg" || fields[1] != "version" {
+		return ""
+	}
+	return fields[2]
+}
+
+// enabledFeatures lists the optional parts of the server that are turned on
+func enabledFeatures() []string {
+	var features []string
+	if ffmpegVersion != "" {
+		features = append(features, "transcoding")
+	}
+	if warmupEnabled {
+		features = append(features, "warmup")
+	}
+	if sessionLogDir != "" {
+		features = append(features, "ffmpeg-logs")
+	}
+	if streamTokensEnabled {
+		features = append(features, "stream-tokens")
+	}
+	if len(fileHandlers) > 0 {
+		features = append(features, "file-handlers")
+	}
+	if readOnly {
+		features = append(features, "read-only")
+	}
+	for name, task := range tasks {
+		if task.cron != nil {
+			features = append(features, "task:"+name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+func currentServerInfo() serverInfo {
+	libraryMutex.RLock()
+	totals := libraryTotals
+	libraryMutex.RUnlock()
+
+	languages := []string{}
+	for lang := range languagePacks {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+
+	return serverInfo{
+		Version:   buildVersion(),
+		Update:    availableUpdate(),
+		Started:   startTime,
+		Uptime:    time.Since(startTime).Seconds(),
+		FFmpeg:    ffmpegVersion,
+		Library:   totals,
+		Features:  enabledFeatures(),
+		Languages: languages,
+	}
+}
+
+// handleServerInfo describes the running server for the About panel
+func handleServerInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentServerInfo())
+}
+
+// logStartupSummary prints what the server is running with
+func logStartupSummary() {
+	info := currentServerInfo()
+	ffmpeg := info.FFmpeg
+	if ffmpeg == "" {
+		ffmpeg = "not found, transcoding won't work"
+	}
+	log.Printf("Stromboli %s, ffmpeg %s", info.Version, ffmpeg)
+	log.Printf("Library: %d videos, %.1f GB, %.0f hours", info.Library.Videos,
+		float64(info.Library.TotalSize)/(1<<30), info.Library.TotalDuration/3600)
+	log.Printf("Features: %s", strings.Join(info.Features, ", "))
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	serviceName  = "Stromboli"
+	launchdLabel = "com.github.breadcat.stromboli"
+)
+
+// Server flags taking a path, made absolute as services don't start in the
+// directory the installer ran from
+var pathFlags = map[string]bool{
+	"d": true, "data": true, "config": true, "log-file": true, "log-dir": true, "lang-dir": true,
+	"tls-cert": true, "tls-key": true,
+}
+
+// serviceArgs makes the paths in the server flags absolute and fills in a
+// log file and data directory that suit running as a service
+func serviceArgs(args []string, logFile string, dataDir string) ([]string, error) {
+	var result []string
+	seen := map[string]bool{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || !pathFlags[name] {
+			result = append(result, arg)
+			continue
+		}
+		seen[name] = true
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("flag -%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		abs, err := filepath.Abs(value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, "-"+name, abs)
+	}
+	if !seen["d"] {
+		return nil, fmt.Errorf("-d must say which directory to serve")
+	}
+	if !seen["log-file"] {
+		result = append(result, "-log-file", logFile)
+	}
+	if !seen["data"] && dataDir != "" {
+		result = append(result, "-data", dataDir)
+	}
+	return result, nil
+}
+
+func serviceExecutable() string {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal("Cannot find this binary: ", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		log.Fatal("Cannot find this binary: ", err)
+	}
+	return exe
+}
+
+func runInstallServiceCommand(args []string) {
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		fmt.Println("Usage: stromboli install-service -d dir [server flags ...]")
+		fmt.Println("Runs the server with these flags at startup, restarting it if it stops.")
+		return
+	}
+	exe := serviceExecutable()
+
+	switch runtime.GOOS {
+	case "windows":
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			programData = `C:\ProgramData`
+		}
+		dir := filepath.Join(programData, serviceName)
+		flags, err := serviceArgs(args, filepath.Join(dir, "stromboli.log"), dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		installWindowsTask(exe, flags)
+		fmt.Printf("Installed the %s task, logging to %s\n", serviceName, filepath.Join(dir, "stromboli.log"))
+
+	case "darwin":
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		logDir := filepath.Join(home, "Library", "Logs", serviceName)
+		flags, err := serviceArgs(args, filepath.Join(logDir, "stromboli.log"), "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+		plist := installLaunchAgent(home, exe, flags, logDir)
+		fmt.Printf("Installed %s, logging to %s\n", plist, logDir)
+
+	default:
+		log.Fatalf("install-service supports Windows and macOS, not %s", runtime.GOOS)
+	}
+}
+
+func runUninstallServiceCommand(args []string) {
+	switch runtime.GOOS {
+	case "windows":
+		exec.Command("schtasks", "/End", "/TN", serviceName).Run() // Fine if it isn't running
+		if output, err := exec.Command("schtasks", "/Delete", "/TN", serviceName, "/F").CombinedOutput(); err != nil {
+			log.Fatalf("Cannot remove the %s task: %v: %s", serviceName, err, strings.TrimSpace(string(output)))
+		}
+		fmt.Printf("Removed the %s task\n", serviceName)
+
+	case "darwin":
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		plist := launchAgentPath(home)
+		exec.Command("launchctl", "unload", "-w", plist).Run() // Fine if it isn't loaded
+		if err := os.Remove(plist); err != nil {
+			log.Fatal("Cannot remove the launch agent: ", err)
+		}
+		fmt.Printf("Removed %s\n", plist)
+
+	default:
+		log.Fatalf("uninstall-service supports Windows and macOS, not %s", runtime.GOOS)
+	}
+}
+
+// Windows services have to answer the service control manager, which needs
+// more than the standard library, so the server runs as a scheduled task
+// started at boot under the SYSTEM account instead
+func installWindowsTask(exe string, flags []string) {
+	quoted := make([]string, len(flags))
+	for i, flag := range flags {
+		quoted[i] = windowsQuote(flag)
+	}
+
+	var task bytes.Buffer
+	fmt.Fprintf(&task, `<?xml version="1.0" encoding="UTF-16"?>
+<Task version="1.2" xmlns="http://schemas.microsoft.com/windows/2004/02/mit/task">
+  <RegistrationInfo><Description>Stromboli video server</Description></RegistrationInfo>
+  <Triggers><BootTrigger><Enabled>true</Enabled></BootTrigger></Triggers>
+  <Principals><Principal id="Author"><UserId>S-1-5-18</UserId><RunLevel>HighestAvailable</RunLevel></Principal></Principals>
+  <Settings>
+    <MultipleInstancesPolicy>IgnoreNew</MultipleInstancesPolicy>
+    <DisallowStartIfOnBatteries>false</DisallowStartIfOnBatteries>
+    <StopIfGoingOnBatteries>false</StopIfGoingOnBatteries>
+    <ExecutionTimeLimit>PT0S</ExecutionTimeLimit>
+    <RestartOnFailure><Interval>PT1M</Interval><Count>999</Count></RestartOnFailure>
+  </Settings>
+  <Actions Context="Author"><Exec><Command>%s</Command><Arguments>%s</Arguments></Exec></Actions>
+</Task>
+`, xmlEscape(exe), xmlEscape(strings.Join(quoted, " ")))
+
+	// schtasks wants the task definition as UTF-16
+	file, err := os.CreateTemp("", "stromboli-task-*.xml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	binary.Write(file, binary.LittleEndian, utf16.Encode([]rune("\ufeff"+task.String())))
+	file.Close()
+
+	output, err := exec.Command("schtasks", "/Create", "/TN", serviceName, "/XML", file.Name(), "/F").CombinedOutput()
+	if err != nil {
+		log.Fatalf("Cannot create the %s task (run this as an administrator): %v: %s", serviceName, err, strings.TrimSpace(string(output)))
+	}
+	if output, err := exec.Command("schtasks", "/Run", "/TN", serviceName).CombinedOutput(); err != nil {
+		log.Printf("Installed, but cannot start the task: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+}
+
+// windowsQuote quotes an argument the way Windows programs split them
+func windowsQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"") {
+		return arg
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	slashes := 0
+	for _, c := range arg {
+		switch c {
+		case '\\':
+			slashes++
+		case '"':
+			b.WriteString(strings.Repeat(`\`, slashes*2+1))
+			slashes = 0
+		default:
+			b.WriteString(strings.Repeat(`\`, slashes))
+			slashes = 0
+		}
+		if c != '\\' {
+			b.WriteRune(c)
+		}
+	}
+	b.WriteString(strings.Repeat(`\`, slashes*2))
+	b.WriteByte('"')
+	return b.String()
+}
+
+func launchAgentPath(home string) string {
+	return filepath.Join(home, "Library", "LaunchAgents", launchdLabel+".plist")
+}
+
+// installLaunchAgent runs the server as the current user whenever they're
+// logged in, with launchd restarting it if it exits
+func installLaunchAgent(home string, exe string, flags []string, logDir string) string {
+	var arguments strings.Builder
+	for _, arg := range append([]string{exe}, flags...) {
+		fmt.Fprintf(&arguments, "\t\t<string>%s</string>\n", xmlEscape(arg))
+	}
+
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`, launchdLabel, arguments.String(),
+		xmlEscape(filepath.Join(logDir, "stdout.log")), xmlEscape(filepath.Join(logDir, "stderr.log")))
+
+	path := launchAgentPath(home)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatal(err)
+	}
+	exec.Command("launchctl", "unload", path).Run() // Replacing an earlier install
+	if err := os.WriteFile(path, []byte(plist), 0644); err != nil {
+		log.Fatal("Cannot write the launch agent: ", err)
+	}
+	if output, err := exec.Command("launchctl", "load", "-w", path).CombinedOutput(); err != nil {
+		log.Fatalf("Cannot load the launch agent: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return path
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,421 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"video-browser/stromboli/internal/library"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// How long finished sessions are kept around so the player can query their outcome
+const sessionRetention = 10 * time.Minute
+
+// Playback modes recorded on a session
+const (
+	modeDirect    = "direct"
+	modeTranscode = "transcode"
+)
+
+type playbackSession struct {
+	mu         sync.Mutex
+	ID         string
+	Path       string
+	User       string
+	Mode       string
+	Container  string
+	Profile    string
+	Started    time.Time
+	Finished   time.Time
+	Err        *streamError
+	Probe      *library.ProbeResult
+	log        streamLogger // For the stream being transcoded; direct play has none
+	progress   *transcodeProgress
+	published  time.Time // When progress was last sent to pages
+	tail       lineTail  // The end of ffmpeg's output
+	bytesSent  int64
+	lastActive time.Time
+	requests   int // Direct play requests still being answered
+	pausedAt   time.Time
+	resumed    chan struct{} // Closed when a paused player plays again
+
+	// Previous stats sample, used to work out the current bitrate
+	sampleBytes int64
+	sampleTime  time.Time
+}
+
+type sessionInfo struct {
+	ID      string       `json:"id"`
+	Path    string       `json:"path"`
+	Mode    string       `json:"mode"`
+	Started time.Time    `json:"started"`
+	Done    bool         `json:"done"`
+	Error   *streamError `json:"error,omitempty"`
+}
+
+type sessionStats struct {
+	StreamID       string  `json:"streamId"` // To look for in the logs
+	Mode           string  `json:"mode"`
+	Container      string  `json:"container,omitempty"`
+	Profile        string  `json:"profile,omitempty"`
+	VideoCodec     string  `json:"videoCodec,omitempty"`
+	AudioCodec     string  `json:"audioCodec,omitempty"`
+	Width          int     `json:"width,omitempty"`
+	Height         int     `json:"height,omitempty"`
+	BytesSent      int64   `json:"bytesSent"`
+	Elapsed        float64 `json:"elapsed"`
+	AverageBitrate float64 `json:"averageBitrate"`
+	CurrentBitrate float64 `json:"currentBitrate"`
+
+	Transcode *transcodeProgress `json:"transcode,omitempty"` // As ffmpeg reports it
+}
+
+var (
+	sessionsMutex sync.Mutex
+	sessions      = map[string]*playbackSession{}
+)
+
+// sessionIDFromRequest returns the session ID supplied by the player, or a
+// new one if it is missing or malformed
+func sessionIDFromRequest(r *http.Request) string {
+	id := r.URL.Query().Get("session")
+	if !validSessionID(id) {
+		return newSessionID()
+	}
+	return id
+}
+
+func startSession(id string, path string, mode string, user string) *playbackSession {
+	now := time.Now()
+	s := &playbackSession{ID: id, Path: path, User: user, Mode: mode, Started: now, lastActive: now, sampleTime: now}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	pruneSessions()
+	sessions[id] = s
+	return s
+}
+
+// directSession returns the session for a direct play request. The browser
+// makes many range requests for one playback, so they share a session.
+func directSession(id string, path string, fullPath string, user string) *playbackSession {
+	sessionsMutex.Lock()
+	s := sessions[id]
+	sessionsMutex.Unlock()
+
+	if s != nil && s.Path == path {
+		return s
+	}
+
+	s = startSession(id, path, modeDirect, user)
+	go func() {
+		probe, err := probeFile(context.Background(), fullPath)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.Probe = probe
+		s.mu.Unlock()
+	}()
+	return s
+}
+
+// pruneSessions drops sessions that finished, or went quiet, long ago.
+// Callers must hold sessionsMutex.
+func pruneSessions() {
+	for key, old := range sessions {
+		old.mu.Lock()
+		expired := !old.Finished.IsZero() && time.Since(old.Finished) > sessionRetention ||
+			old.Mode == modeDirect && time.Since(old.lastActive) > sessionRetention
+		old.mu.Unlock()
+		if expired {
+			delete(sessions, key)
+		}
+	}
+}
+
+func getSession(id string) *playbackSession {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return sessions[id]
+}
+
+// addStderr records ffmpeg output, keeping only the most recent lines
+func (s *playbackSession) addStderr(output string) {
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		s.tail.add(line)
+	}
+}
+
+// setProgress records how the session's transcode is going, and every so
+// often tells pages with a transcode event
+func (s *playbackSession) setProgress(progress transcodeProgress, last bool) {
+	s.mu.Lock()
+	s.progress = &progress
+	publish := last || time.Since(s.published) >= progressEventInterval
+	if publish {
+		s.published = time.Now()
+	}
+	s.mu.Unlock()
+	if publish {
+		publishEvent("transcode", transcodeEvent{s.ID, progress})
+	}
+}
+
+// addBytes records media data sent to the client
+func (s *playbackSession) addBytes(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytesSent += int64(n)
+	s.lastActive = time.Now()
+}
+
+// serving counts a direct play request while it's answered
+func (s *playbackSession) serving(delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests += delta
+}
+
+// setPaused records whether the player is paused, letting go of any
+// requests held while it was
+func (s *playbackSession) setPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case paused && s.pausedAt.IsZero():
+		s.pausedAt = time.Now()
+		s.resumed = make(chan struct{})
+	case !paused && !s.pausedAt.IsZero():
+		s.pausedAt = time.Time{}
+		close(s.resumed)
+	}
+}
+
+// holdWhilePaused keeps a direct play request waiting while its player has
+// been paused for longer than the config allows, so a forgotten tab can't
+// keep reading the file. It reports false if the browser gave up first.
+func (s *playbackSession) holdWhilePaused(r *http.Request) bool {
+	s.mu.Lock()
+	limit := time.Duration(config().DirectPauseMinutes) * time.Minute
+	held := limit > 0 && !s.pausedAt.IsZero() && time.Since(s.pausedAt) > limit
+	resumed := s.resumed
+	s.mu.Unlock()
+	if !held {
+		return true
+	}
+
+	log.Printf("Holding a request for session %s until it plays again", s.ID)
+	select {
+	case <-resumed:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// streaming reports whether the session is sending video: a transcode until
+// it finishes, direct play while the browser has a request open. Callers
+// must hold s.mu.
+func (s *playbackSession) streaming() bool {
+	if s.Mode == modeDirect {
+		return s.requests > 0
+	}
+	return s.Finished.IsZero()
+}
+
+// streamLimit is how many streams a request's user may run at once, or 0
+// for no limit. Their own limit wins over their groups', where the highest
+// counts, and * covers everyone else.
+func streamLimit(r *http.Request) int {
+	user := requestUser(r)
+	if limit, ok := config().StreamLimits[user]; ok && user != "" {
+		return limit
+	}
+	limit, matched := 0, false
+	for _, group := range requestGroups(r, user) {
+		if groupLimit, ok := config().StreamLimits["@"+group]; ok {
+			if !matched || groupLimit == 0 || limit != 0 && groupLimit > limit {
+				limit = groupLimit
+			}
+			matched = true
+		}
+	}
+	if !matched {
+		limit = config().StreamLimits["*"]
+	}
+	return limit
+}
+
+// limitStreams refuses a stream once the user has as many running as they
+// may. The session's own stream doesn't count, as a new one replaces it.
+// Refusals are recorded against the session so the player can say why.
+func limitStreams(w http.ResponseWriter, r *http.Request, l streamLogger, id string, path string, mode string) bool {
+	limit := streamLimit(r)
+	if limit == 0 {
+		return true
+	}
+	user := requestUser(r)
+	running := 0
+	sessionsMutex.Lock()
+	for key, s := range sessions {
+		s.mu.Lock()
+		if key != id && s.User == user && s.streaming() {
+			running++
+		}
+		s.mu.Unlock()
+	}
+	sessionsMutex.Unlock()
+	if running < limit {
+		return true
+	}
+
+	streamErr := &streamError{"too_many_streams", fmt.Sprintf("You're already playing as many videos as you can at once (%d). Stop one to play this.", limit)}
+	l.Printf("Refused a stream of %s for %q, who has %d running", path, user, running)
+	startSession(id, path, mode, user).finish(streamErr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(streamErr)
+	return false
+}
+
+func (s *playbackSession) finish(err *streamError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Finished = time.Now()
+	s.Err = err
+}
+
+func (s *playbackSession) stderr() string {
+	return s.tail.String()
+}
+
+func (s *playbackSession) info() sessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sessionInfo{
+		ID:      s.ID,
+		Path:    s.Path,
+		Mode:    s.Mode,
+		Started: s.Started,
+		Done:    !s.Finished.IsZero(),
+		Error:   s.Err,
+	}
+}
+
+func (s *playbackSession) stats() sessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	stats := sessionStats{
+		StreamID:  s.ID,
+		Mode:      s.Mode,
+		Container: s.Container,
+		Profile:   s.Profile,
+		BytesSent: s.bytesSent,
+		Elapsed:   now.Sub(s.Started).Seconds(),
+	}
+	if stats.Elapsed > 0 {
+		stats.AverageBitrate = float64(s.bytesSent*8) / stats.Elapsed
+	}
+	if window := now.Sub(s.sampleTime).Seconds(); window > 0 {
+		stats.CurrentBitrate = float64((s.bytesSent-s.sampleBytes)*8) / window
+	}
+	s.sampleBytes = s.bytesSent
+	s.sampleTime = now
+	if s.log.id != "" {
+		stats.StreamID = s.log.id
+	}
+	if s.progress != nil {
+		progress := *s.progress
+		stats.Transcode = &progress
+	}
+
+	if s.Probe != nil {
+		if video := s.Probe.MainVideoStream(); video != nil {
+			stats.VideoCodec = video.CodecName
+			stats.Width = video.Width
+			stats.Height = video.Height
+		}
+		if audio := s.Probe.MainAudioStream(); audio != nil {
+			stats.AudioCodec = audio.CodecName
+		}
+	}
+	return stats
+}
+
+// countingWriter tallies bytes written to the client against a session
+type countingWriter struct {
+	http.ResponseWriter
+	session *playbackSession
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.session.addBytes(n)
+	return n, err
+}
+
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/session/"), "/")
+
+	// Resuming works from saved state, as the session itself is gone after a restart
+	if action == "resume" {
+		handleSessionResume(w, r, id)
+		return
+	}
+
+	// Someone else's session is as good as missing, like saved resume state
+	s := getSession(id)
+	if s == nil || s.User != requestUser(r) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch action {
+	case "":
+		json.NewEncoder(w).Encode(s.info())
+	case "stats":
+		json.NewEncoder(w).Encode(s.stats())
+	case "fallback":
+		handleSessionFallback(w, r, s)
+	default:
+		http.Error(w, "Unknown session action", http.StatusNotFound)
+	}
+}
+
+// handleSessionFallback tells a stalling player what to switch to: direct play
+// falls back to transcoding, and transcodes step down to the next profile
+func handleSessionFallback(w http.ResponseWriter, r *http.Request, s *playbackSession) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	mode, current, logger := s.Mode, s.Profile, s.log
+	s.mu.Unlock()
+
+	next := startProfile(r)
+	if mode == modeTranscode {
+		lower, ok := transcode.LowerProfile(current)
+		if !ok {
+			http.Error(w, "Already at the lowest quality", http.StatusConflict)
+			return
+		}
+		next = lower
+	}
+
+	logger.Printf("Session %s stalling, falling back to %s profile", s.ID, next.Name)
+	json.NewEncoder(w).Encode(map[string]string{"profile": next.Name})
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Audio file formats recognised as external tracks for a video
+var audioFormats = map[string]bool{
+	".aac":  true,
+	".ac3":  true,
+	".dts":  true,
+	".eac3": true,
+	".flac": true,
+	".m4a":  true,
+	".mka":  true,
+	".mp3":  true,
+	".ogg":  true,
+	".opus": true,
+	".wav":  true,
+}
+
+// Subtitle file formats recognised as external tracks for a video
+var subtitleFormats = map[string]bool{
+	".ass": true,
+	".srt": true,
+	".ssa": true,
+	".vtt": true,
+}
+
+// sidecarTrack is an external audio or subtitle track sitting alongside a video
+type sidecarTrack struct {
+	Name  string `json:"name"`
+	Label string `json:"label"` // What's between the video's name and the extension, e.g. "eng"
+}
+
+// sidecarTracks finds files of the given formats sharing a video's base
+// name among the names in its directory, such as "Movie.eng.ac3" or
+// "Movie.commentary.mp3" next to "Movie.mkv"
+func sidecarTracks(videoName string, names []string, formats map[string]bool) []sidecarTrack {
+	base := strings.TrimSuffix(videoName, filepath.Ext(videoName))
+
+	var tracks []sidecarTrack
+	for _, name := range names {
+		ext := filepath.Ext(name)
+		if !formats[strings.ToLower(ext)] || !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		label := strings.TrimPrefix(strings.TrimSuffix(name, ext), base)
+		label = strings.TrimPrefix(label, ".")
+		if label == "" {
+			label = strings.TrimPrefix(strings.ToLower(ext), ".")
+		}
+		tracks = append(tracks, sidecarTrack{Name: name, Label: label})
+	}
+	return tracks
+}
+
+// sidecarPath returns the full path of the named external track for a
+// video, checking it really is one of the video's sidecars
+func sidecarPath(relativePath string, name string, formats map[string]bool) (string, bool) {
+	dir := filepath.Join(rootDir, filepath.Dir(relativePath))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	for _, track := range sidecarTracks(filepath.Base(relativePath), names, formats) {
+		if track.Name == name {
+			return filepath.Join(dir, name), true
+		}
+	}
+	return "", false
+}
+
+// sidecarFiles lists the names of a video's external tracks in its directory
+func sidecarFiles(fullPath string) []string {
+	entries, err := os.ReadDir(filepath.Dir(fullPath))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	var files []string
+	for _, formats := range []map[string]bool{audioFormats, subtitleFormats} {
+		for _, track := range sidecarTracks(filepath.Base(fullPath), names, formats) {
+			files = append(files, track.Name)
+		}
+	}
+	return files
+}
+
+// moveWithSidecars moves a video to another path in the library along with
+// its external tracks, never replacing anything already there
+func moveWithSidecars(from string, to string) error {
+	fromFull := filepath.Join(rootDir, filepath.FromSlash(from))
+	toFull := filepath.Join(rootDir, filepath.FromSlash(to))
+	if _, err := os.Lstat(toFull); err == nil {
+		return errors.New("destination already exists")
+	}
+	sidecars := sidecarFiles(fromFull)
+	if err := os.MkdirAll(filepath.Dir(toFull), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(fromFull, toFull); err != nil {
+		return err
+	}
+
+	// Tracks keep their labels, so "Film.eng.srt" follows "Film.mkv" as "Movie.eng.srt"
+	fromBase := strings.TrimSuffix(filepath.Base(fromFull), filepath.Ext(fromFull))
+	toBase := strings.TrimSuffix(toFull, filepath.Ext(toFull))
+	for _, name := range sidecars {
+		dest := toBase + strings.TrimPrefix(name, fromBase)
+		if _, err := os.Lstat(dest); err == nil {
+			log.Printf("Cannot move %s alongside %s: destination already exists", name, to)
+			continue
+		}
+		if err := os.Rename(filepath.Join(filepath.Dir(fromFull), name), dest); err != nil {
+			log.Printf("Cannot move %s alongside %s: %v", name, to, err)
+		}
+	}
+	return nil
+}
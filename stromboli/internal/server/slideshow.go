@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Image formats shown in slideshows
+var imageFormats = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".avif": true,
+}
+
+// Seconds each photo stays up, unless the player asks for another interval
+const (
+	defaultSlideInterval = 5
+	minSlideInterval     = 2
+	maxSlideInterval     = 120
+)
+
+// slideshow is what the player needs to run a slideshow: the photos to
+// cycle and the music to play under them, in order
+type slideshow struct {
+	Interval int      `json:"interval"`
+	Images   []string `json:"images"`
+	Music    []string `json:"music"`
+}
+
+// fileURL is the /api/video URL of a file, signed when stream tokens are on
+func fileURL(r *http.Request, path string) string {
+	u := "/api/video/" + url.PathEscape(path)
+	if streamTokensEnabled {
+		u += "?token=" + issueStreamToken(requestUser(r), path, time.Now().Add(tokenLifetime))
+	}
+	return u
+}
+
+// handleSlideshow lists the photos in a folder, leaving out its poster, and
+// any audio beside them to play as music (GET /api/slideshow?path=&interval=seconds)
+func handleSlideshow(w http.ResponseWriter, r *http.Request) {
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	show := slideshow{Interval: defaultSlideInterval, Images: []string{}, Music: []string{}}
+	if s := r.URL.Query().Get("interval"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < minSlideInterval || n > maxSlideInterval {
+			http.Error(w, "Interval must be "+strconv.Itoa(minSlideInterval)+" to "+strconv.Itoa(maxSlideInterval)+" seconds", http.StatusBadRequest)
+			return
+		}
+		show.Interval = n
+	}
+
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		http.Error(w, "Cannot read directory", http.StatusInternalServerError)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		filePath := apiPath(filepath.Join(path, entry.Name()))
+		if imageFormats[ext] && !slices.Contains(folderPosters, strings.ToLower(entry.Name())) {
+			show.Images = append(show.Images, fileURL(r, filePath))
+		} else if _, ok := listeningFormats[ext]; ok {
+			show.Music = append(show.Music, fileURL(r, filePath))
+		}
+	}
+	if len(show.Images) == 0 {
+		http.Error(w, "No photos in this folder", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(show)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smartRule is one condition a smart playlist's videos must meet, checked
+// against the library index. Values are strings, as the rule builder sends
+// them, and numbers among them are days, minutes or stars.
+type smartRule struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// smartOps lists the operators each field takes
+var smartOps = map[string][]string{
+	"watched":  {"is"},               // true or false
+	"added":    {"within", "before"}, // Days ago, going by the file's modification time
+	"duration": {"<", ">"},           // Minutes
+	"folder":   {"in", "notIn"},      // Path in the library
+	"name":     {"contains"},         // Text in the file name, any case
+	"tag":      {"is", "isNot"},
+	"rating":   {">=", "<"}, // Stars
+}
+
+// checkSmartRules makes sure a smart playlist's rules can be evaluated,
+// cleaning up the folders and tags in them
+func checkSmartRules(match string, rules []smartRule) error {
+	if match != "all" && match != "any" {
+		return fmt.Errorf("match must be all or any")
+	}
+	for i := range rules {
+		rule := &rules[i]
+		ops, ok := smartOps[rule.Field]
+		if !ok {
+			return fmt.Errorf("rule %d: unknown field %q", i+1, rule.Field)
+		}
+		if !slices.Contains(ops, rule.Op) {
+			return fmt.Errorf("rule %d: %s can't use %q", i+1, rule.Field, rule.Op)
+		}
+
+		switch rule.Field {
+		case "watched":
+			if rule.Value != "true" && rule.Value != "false" {
+				return fmt.Errorf("rule %d: watched is true or false", i+1)
+			}
+		case "added", "duration", "rating":
+			if n, err := strconv.ParseFloat(rule.Value, 64); err != nil || n < 0 {
+				return fmt.Errorf("rule %d: %s needs a number", i+1, rule.Field)
+			}
+		case "folder":
+			// Security check: paths can't leave the root
+			folder, err := cleanAPIPath(rule.Value, runtime.GOOS == "windows")
+			if err != nil {
+				return fmt.Errorf("rule %d: %w", i+1, err)
+			}
+			rule.Value = folder
+		case "name":
+			if rule.Value == "" {
+				return fmt.Errorf("rule %d: name needs some text", i+1)
+			}
+		case "tag":
+			tags, ok := normalizeTags([]string{rule.Value})
+			if !ok {
+				return fmt.Errorf("rule %d: invalid tag", i+1)
+			}
+			rule.Value = tags[0]
+		}
+	}
+	return nil
+}
+
+// smartVideo is what rules are checked against for one indexed video
+type smartVideo struct {
+	entry   *indexEntry
+	watched bool
+	labels  itemLabels
+}
+
+// matches reports whether a video meets the rule. The rule must have
+// passed checkSmartRules.
+func (rule smartRule) matches(video smartVideo, now time.Time) bool {
+	number, _ := strconv.ParseFloat(rule.Value, 64)
+	switch rule.Field {
+	case "watched":
+		return video.watched == (rule.Value == "true")
+	case "added":
+		cutoff := now.Add(-time.Duration(number * float64(24*time.Hour)))
+		return video.entry.ModTime.After(cutoff) == (rule.Op == "within")
+	case "duration":
+		// Videos ffprobe couldn't read have no length to compare
+		if video.entry.Duration == 0 {
+			return false
+		}
+		minutes := video.entry.Duration / 60
+		if rule.Op == "<" {
+			return minutes < number
+		}
+		return minutes > number
+	case "folder":
+		in := rule.Value == "" || strings.HasPrefix(video.entry.Path, rule.Value+"/")
+		return in == (rule.Op == "in")
+	case "name":
+		name := strings.ToLower(filepath.Base(video.entry.Path))
+		return strings.Contains(name, strings.ToLower(rule.Value))
+	case "tag":
+		return video.labels.matches(rule.Value, 0) == (rule.Op == "is")
+	case "rating":
+		if rule.Op == ">=" {
+			return float64(video.labels.Rating) >= number
+		}
+		return float64(video.labels.Rating) < number
+	}
+	return false
+}
+
+// smartPlaylistPaths evaluates rules against every indexed video, returning
+// the paths of those meeting all or any of them, sorted. Whether a video
+// was watched goes by the user's own history.
+func smartPlaylistPaths(user string, match string, rules []smartRule) []string {
+	libraryMutex.RLock()
+	entries := make([]*indexEntry, 0, len(libraryIndex))
+	for _, entry := range libraryIndex {
+		entries = append(entries, entry)
+	}
+	libraryMutex.RUnlock()
+
+	watched := historyOf(user)
+
+	now := time.Now()
+	paths := []string{}
+	for _, entry := range entries {
+		video := smartVideo{entry: entry, watched: watched[entry.Path].Watched, labels: labelsOf(entry.Path)}
+		met := 0
+		for _, rule := range rules {
+			if rule.matches(video, now) {
+				met++
+			}
+		}
+		if match == "all" && met == len(rules) || match == "any" && met > 0 {
+			paths = append(paths, entry.Path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
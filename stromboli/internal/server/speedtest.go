@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto/rand"
+	"net/http"
+	"strconv"
+)
+
+// Sizes of the download players time to estimate their bandwidth, in
+// megabytes. Players stop reading once they've timed enough of it.
+const (
+	defaultSpeedTestSize = 4
+	maxSpeedTestSize     = 32
+)
+
+// speedTestBlock is repeated to make up the download. It's random so
+// nothing along the way can compress it and flatter the connection.
+var speedTestBlock = func() []byte {
+	block := make([]byte, 64<<10)
+	rand.Read(block)
+	return block
+}()
+
+// handleSpeedTest streams random data for measuring throughput
+// (GET /api/speedtest?size=megabytes)
+func handleSpeedTest(w http.ResponseWriter, r *http.Request) {
+	size := defaultSpeedTestSize
+	if s := r.URL.Query().Get("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSpeedTestSize {
+			http.Error(w, "Size must be 1 to "+strconv.Itoa(maxSpeedTestSize)+" megabytes", http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	total := size << 20
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(total))
+	w.Header().Set("Cache-Control", "no-store")
+	for written := 0; written < total; written += len(speedTestBlock) {
+		if _, err := w.Write(speedTestBlock[:min(len(speedTestBlock), total-written)]); err != nil {
+			return // The player has measured enough and hung up
+		}
+	}
+}
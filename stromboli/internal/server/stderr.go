@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Longest line of ffmpeg output kept, the rest of a line being dropped
+const maxStderrLine = 4096
+
+// How much of a stream's ffmpeg output reaches the log: a first burst of
+// lines, then a few a second. The rest is only kept in the session's tail,
+// so a chatty encode can't flood the log or the disk.
+const (
+	stderrLogBurst = 50
+	stderrLogRate  = 5
+)
+
+// stderrLimiter is a token bucket deciding which lines get logged
+type stderrLimiter struct {
+	tokens  float64
+	last    time.Time
+	dropped int // Lines not logged since the last one that was
+}
+
+func newStderrLimiter() *stderrLimiter {
+	return &stderrLimiter{tokens: stderrLogBurst, last: time.Now()}
+}
+
+// allow reports whether a line can be logged now
+func (l *stderrLimiter) allow(now time.Time) bool {
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*stderrLogRate, stderrLogBurst)
+	l.last = now
+	if l.tokens < 1 {
+		l.dropped++
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// readStderrLine reads a line, cutting off what's past maxStderrLine
+func readStderrLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	text := strings.TrimRight(string(line), "\r\n")
+	for err == bufio.ErrBufferFull {
+		_, err = r.ReadSlice('\n')
+	}
+	return text, err
+}
+
+// followStderr reads a transcode's stderr until ffmpeg closes it, never
+// holding ffmpeg up for long. Each block of the -progress report updates the
+// session, and the rest of what ffmpeg says goes to the session's tail and,
+// as far as the rate limit lets it, to the session log.
+func followStderr(stderr io.Reader, session *playbackSession, sessionLog io.Writer) {
+	var progress transcodeProgress
+	limiter := newStderrLimiter()
+	reader := bufio.NewReaderSize(stderr, maxStderrLine)
+	for {
+		line, err := readStderrLine(reader)
+		if match := progressLine.FindStringSubmatch(line); match != nil {
+			if match[1] != "progress" {
+				progress.parseProgressValue(match[1], match[2])
+			} else {
+				progress.Updated = time.Now()
+				session.setProgress(progress, match[2] == "end")
+			}
+		} else if line != "" || err == nil {
+			session.tail.add(line)
+			if limiter.allow(time.Now()) {
+				if limiter.dropped > 0 {
+					fmt.Fprintf(sessionLog, "(%d lines not logged)\n", limiter.dropped)
+					limiter.dropped = 0
+				}
+				sessionLog.Write([]byte(line + "\n"))
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if limiter.dropped > 0 {
+		fmt.Fprintf(sessionLog, "(%d lines not logged)\n", limiter.dropped)
+	}
+}
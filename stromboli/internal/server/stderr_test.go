@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFollowStderr(t *testing.T) {
+	stderr := strings.Join([]string{
+		"frame=0",
+		"fps=0.00",
+		"bitrate=N/A",
+		"out_time_us=N/A",
+		"speed=N/A",
+		"progress=continue",
+		"[h264 @ 0x55d1] co located POCs unavailable",
+		"frame=240",
+		"fps=47.91",
+		"stream_0_0_q=28.0",
+		"bitrate=2311.4kbits/s",
+		"out_time_us=10010000",
+		"drop_frames=2",
+		"speed=1.99x",
+		"progress=end",
+		"",
+	}, "\n")
+
+	session := &playbackSession{ID: "progress"}
+	var logged strings.Builder
+	followStderr(strings.NewReader(stderr), session, &logged)
+
+	want := transcodeProgress{OutTime: 10.01, Speed: 1.99, Bitrate: 2311400, FPS: 47.91, Frames: 240, DroppedFrames: 2}
+	got := session.stats().Transcode
+	if got == nil {
+		t.Fatal("no progress recorded")
+	}
+	got.Updated = want.Updated
+	if *got != want {
+		t.Errorf("progress is %+v, want %+v", *got, want)
+	}
+	if logged.String() != "[h264 @ 0x55d1] co located POCs unavailable\n" || session.stderr() != logged.String() {
+		t.Errorf("logged %q, kept %q", logged.String(), session.stderr())
+	}
+}
+
+func TestFollowStderrFlood(t *testing.T) {
+	var stderr strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&stderr, "[mp3float @ 0x55d1] Header missing %d\n", i)
+	}
+	stderr.WriteString(strings.Repeat("x", maxStderrLine*2) + "\n")
+	stderr.WriteString("Conversion failed!")
+
+	session := &playbackSession{ID: "flood"}
+	var logged strings.Builder
+	followStderr(strings.NewReader(stderr.String()), session, &logged)
+
+	lines := strings.Split(strings.TrimSuffix(logged.String(), "\n"), "\n")
+	if len(lines) > stderrLogBurst+10 || !strings.HasSuffix(lines[len(lines)-1], " lines not logged)") {
+		t.Errorf("logged %d lines, ending %q", len(lines), lines[len(lines)-1])
+	}
+	tail := session.tail.Lines()
+	if len(tail) != stderrTailLines || tail[len(tail)-1] != "Conversion failed!" || len(tail[len(tail)-2]) != maxStderrLine {
+		t.Errorf("kept %d lines, ending %q", len(tail), tail[len(tail)-1])
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Directory where server state (history, caches) is kept
+var dataDir string
+
+func defaultDataDir() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "stromboli")
+	}
+	return ".stromboli"
+}
+
+// loadJSON reads a state file from the data directory. A missing file is not
+// an error and leaves v untouched.
+func loadJSON(name string, v interface{}) error {
+	data, err := os.ReadFile(filepath.Join(dataDir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveJSON writes a state file to the data directory, replacing it atomically
+// so a crash mid-write can't corrupt it
+func saveJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dataDir, name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Megabytes of transcoded output held for each stream, set with -stream-buffer
+var streamBufferMB = 16
+
+// How big a stream's buffer starts out, doubling as ffmpeg gets ahead
+const streamBufferStart = 256 << 10
+
+// streamBuffer is a ring buffer between ffmpeg and the player. ffmpeg keeps
+// encoding into it while the player is paused or its network stalls, and
+// only has to wait once the buffer is full. It grows as it's needed, so
+// players keeping up don't cost the whole size.
+type streamBuffer struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	data   []byte
+	size   int   // The most data may grow to
+	start  int   // Where the oldest unread byte is
+	length int   // How many bytes are unread
+	ended  bool  // The source has no more to give
+	err    error // Why the source ended, if not at the end of its output
+	closed bool  // The player has gone
+}
+
+func newStreamBuffer(size int) *streamBuffer {
+	b := &streamBuffer{data: make([]byte, min(size, streamBufferStart)), size: size}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// fill reads src into the buffer until it ends or the buffer is closed
+func (b *streamBuffer) fill(src io.Reader) {
+	chunk := make([]byte, 64<<10)
+	for {
+		n, err := src.Read(chunk)
+		if n > 0 && !b.write(chunk[:n]) {
+			return
+		}
+		if err != nil {
+			b.mu.Lock()
+			b.ended = true
+			if err != io.EOF {
+				b.err = err
+			}
+			b.cond.Broadcast()
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// write adds p to the buffer, waiting for room, and reports whether
+// anyone is still reading
+func (b *streamBuffer) write(p []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(p) > 0 {
+		for b.length == len(b.data) && !b.closed {
+			if len(b.data) < b.size {
+				b.grow()
+				continue
+			}
+			b.cond.Wait()
+		}
+		if b.closed {
+			return false
+		}
+		end := (b.start + b.length) % len(b.data)
+		room := len(b.data) - b.length
+		if end >= b.start {
+			room = min(room, len(b.data)-end)
+		}
+		n := copy(b.data[end:end+min(room, len(p))], p)
+		b.length += n
+		p = p[n:]
+		b.cond.Broadcast()
+	}
+	return true
+}
+
+// grow doubles the buffer, up to its size, moving the unread bytes to the
+// front. Callers must hold b.mu.
+func (b *streamBuffer) grow() {
+	data := make([]byte, min(2*len(b.data), b.size))
+	n := copy(data, b.data[b.start:min(b.start+b.length, len(b.data))])
+	copy(data[n:], b.data[:b.length-n])
+	b.data, b.start = data, 0
+}
+
+// Read takes buffered output, waiting for ffmpeg when there is none
+func (b *streamBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.length == 0 && !b.ended && !b.closed {
+		b.cond.Wait()
+	}
+	if b.length == 0 {
+		if b.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if b.err != nil {
+			return 0, b.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[b.start:min(b.start+b.length, len(b.data))])
+	b.start = (b.start + n) % len(b.data)
+	b.length -= n
+	b.cond.Broadcast()
+	return n, nil
+}
+
+// Close lets go of a fill waiting for room once the player has gone
+func (b *streamBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+	return nil
+}
+
+// flushWriter sends each chunk on to the player as soon as it's written,
+// rather than leaving it in the server's buffers
+type flushWriter struct {
+	io.Writer
+	controller *http.ResponseController
+}
+
+func newFlushWriter(w io.Writer, rw http.ResponseWriter) flushWriter {
+	return flushWriter{Writer: w, controller: http.NewResponseController(rw)}
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.Writer.Write(p)
+	if err == nil {
+		f.controller.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// The buffer starts small and grows while nobody reads, keeping the order
+func TestStreamBufferGrows(t *testing.T) {
+	b := newStreamBuffer(4 * streamBufferStart)
+	if len(b.data) != streamBufferStart {
+		t.Fatalf("buffer starts at %d bytes", len(b.data))
+	}
+
+	// Wrap around before growing, so the unread bytes are in two pieces
+	b.write(bytes.Repeat([]byte{'x'}, streamBufferStart/2))
+	io.ReadFull(b, make([]byte, streamBufferStart/2))
+	want := make([]byte, 3*streamBufferStart)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	b.write(want)
+	if len(b.data) != 4*streamBufferStart {
+		t.Errorf("buffer grew to %d bytes", len(b.data))
+	}
+
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(b, got); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("output changed on its way through: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// subtitleForceStyle turns the user's subtitle settings into an ASS style
+// override for burning subtitles into a transcode, matching how the
+// browser draws them with ::cue
+func subtitleForceStyle(prefs preferences) string {
+	// ffmpeg renders SRT at 16 points on a 288 line canvas
+	size := (16*prefs.SubtitleSize + 50) / 100
+
+	// ASS colours are &HAABBGGRR, with alpha 00 meaning opaque
+	color := strings.TrimPrefix(prefs.SubtitleColor, "#")
+	primary := "&H00" + strings.ToUpper(color[4:6]+color[2:4]+color[0:2])
+
+	style := []string{"FontSize=" + strconv.Itoa(size), "PrimaryColour=" + primary}
+	switch prefs.SubtitleBackground {
+	case "translucent":
+		style = append(style, "BorderStyle=3", "OutlineColour=&H80000000", "BackColour=&H80000000")
+	case "solid":
+		style = append(style, "BorderStyle=3", "OutlineColour=&H00000000", "BackColour=&H00000000")
+	default:
+		style = append(style, "BorderStyle=1", "Outline=1", "Shadow=0")
+	}
+	if prefs.SubtitlePosition == "top" {
+		style = append(style, "Alignment=8")
+	} else {
+		style = append(style, "Alignment=2")
+	}
+	return strings.Join(append(style, "MarginV=20"), ",")
+}
+
+// escapeFilterValue escapes a value for use as a filter option inside a
+// filtergraph, once for the option parser and once for the graph parser
+func escapeFilterValue(value string) string {
+	option := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(value)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(option)
+}
+
+// subtitleFilter draws a subtitle file onto the video. Seeking restarts
+// the video's timestamps at zero while the subtitles keep the file's
+// timing, so the timestamps are shifted back for the overlay.
+func subtitleFilter(subtitlePath string, style string, start float64) string {
+	filter := "subtitles=filename=" + escapeFilterValue(subtitlePath)
+	if style != "" {
+		filter += ":force_style=" + escapeFilterValue(style)
+	}
+	if start > 0 {
+		offset := strconv.FormatFloat(start, 'f', 3, 64)
+		filter = "setpts=PTS+" + offset + "/TB," + filter + ",setpts=PTS-STARTPTS"
+	}
+	return filter
+}
+
+// handleSubtitles serves a video's sidecar subtitles as WebVTT
+// (GET /api/subtitles/{path}?name=&offset=). Transcoded streams start at
+// the seek offset, so the cues are shifted to match.
+func handleSubtitles(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/subtitles/")
+
+	// Security check: paths can't leave the root
+	path, _, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	subtitlePath, ok := sidecarPath(path, r.URL.Query().Get("name"), subtitleFormats)
+	if !ok {
+		http.Error(w, "Unknown subtitles", http.StatusNotFound)
+		return
+	}
+	offset, _ := strconv.ParseFloat(r.URL.Query().Get("offset"), 64)
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	if offset <= 0 && strings.EqualFold(filepath.Ext(subtitlePath), ".vtt") {
+		http.ServeFile(w, r, subtitlePath)
+		return
+	}
+
+	var stdout bytes.Buffer
+	var stderr tailBuffer
+	var args []string
+	if offset > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(offset, 'f', 3, 64))
+	}
+	cmd := exec.Command("ffmpeg", append(args,
+		"-i", subtitlePath,
+		"-f", "webvtt",
+		"-loglevel", "error",
+		"pipe:1",
+	)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		log.Printf("Error converting subtitles %s: %v: %s", subtitlePath, err, strings.TrimSpace(stderr.String()))
+		http.Error(w, "Cannot convert subtitles", http.StatusInternalServerError)
+		return
+	}
+	w.Write(stdout.Bytes())
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// taggedWith reports whether a file or any folder above it has the tag, so
+// tagging a show's folder covers all its episodes
+func taggedWith(path, tag string) bool {
+	for {
+		if labelsOf(path).matches(tag, 0) {
+			return true
+		}
+		slash := strings.LastIndex(path, "/")
+		if slash < 0 {
+			return false
+		}
+		path = path[:slash]
+	}
+}
+
+// handleSurprise picks a random unwatched video from the library index,
+// from below a folder (?path=, the whole library without one) and with a
+// tag on it or its folders (?tag=) if asked
+func handleSurprise(w http.ResponseWriter, r *http.Request) {
+	// Security check: paths can't leave the root
+	path, _, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	tag := strings.ToLower(r.URL.Query().Get("tag"))
+
+	libraryMutex.RLock()
+	var candidates []string
+	for p := range libraryIndex {
+		if path == "" || strings.HasPrefix(p, path+"/") {
+			candidates = append(candidates, p)
+		}
+	}
+	libraryMutex.RUnlock()
+
+	watched := historyOf(requestUser(r))
+	unwatched := candidates[:0]
+	for _, p := range candidates {
+		if !watched[p].Watched {
+			unwatched = append(unwatched, p)
+		}
+	}
+
+	// Picked in a random order until one is still there to play
+	rand.Shuffle(len(unwatched), func(i, j int) { unwatched[i], unwatched[j] = unwatched[j], unwatched[i] })
+	for _, p := range unwatched {
+		if !canAccess(r, p) || tag != "" && !taggedWith(p, tag) {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(rootDir, filepath.FromSlash(p)))
+		if err != nil {
+			continue
+		}
+		device := requestDeviceProfile(r)
+		files := []FileInfo{indexedFileInfo(p, info, device)}
+		probePending(files, device)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(files[0])
+		return
+	}
+	http.Error(w, "No unwatched videos", http.StatusNotFound)
+}
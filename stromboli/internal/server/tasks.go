@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maintenanceTask is a job the scheduler runs on a cron schedule, which can
+// also be triggered by hand through /api/tasks
+type maintenanceTask struct {
+	mu           sync.Mutex
+	Name         string
+	Schedule     string
+	cron         *cronSchedule
+	run          func() error
+	running      bool
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastError    string
+}
+
+type taskStatus struct {
+	Name         string     `json:"name"`
+	Schedule     string     `json:"schedule"`
+	Running      bool       `json:"running"`
+	LastRun      *time.Time `json:"lastRun,omitempty"`
+	LastDuration float64    `json:"lastDuration"`
+	LastError    string     `json:"lastError,omitempty"`
+	NextRun      *time.Time `json:"nextRun,omitempty"`
+}
+
+// Schedules used for tasks the config file doesn't mention
+var defaultTaskSchedules = map[string]string{
+	"scan":        "0 * * * *",
+	"stats":       "15 * * * *",
+	"thumbnails":  "30 3 * * *",
+	"prune":       "0 4 * * *",
+	"trash":       "45 * * * *",
+	"pregenerate": "0 2 * * *",
+}
+
+var tasks = map[string]*maintenanceTask{}
+
+func setupTasks() error {
+	runners := map[string]func() error{
+		"scan":        func() error { return scanLibrary(context.Background(), func(float64) {}) },
+		"stats":       aggregateStats,
+		"thumbnails":  pregenerateThumbnails,
+		"prune":       pruneCaches,
+		"trash":       emptyTrash,
+		"check":       checkUnchecked,
+		"pregenerate": pregenerate,
+	}
+
+	for name, run := range runners {
+		schedule, cron, err := taskSchedule(config(), name)
+		if err != nil {
+			return err
+		}
+		tasks[name] = &maintenanceTask{Name: name, Schedule: schedule, cron: cron, run: run}
+	}
+	return nil
+}
+
+// taskSchedule is when the config has a task run, or else its default. An
+// empty schedule leaves the task available for manual runs only.
+func taskSchedule(c *Config, name string) (string, *cronSchedule, error) {
+	schedule := defaultTaskSchedules[name]
+	if configured, ok := c.Tasks[name]; ok {
+		schedule = configured
+	}
+	if schedule == "" {
+		return "", nil, nil
+	}
+	cron, err := parseCron(schedule)
+	return schedule, cron, err
+}
+
+// rescheduleTasks gives the tasks the config's schedules, once they have
+// all been checked
+func rescheduleTasks(c *Config) error {
+	type scheduled struct {
+		schedule string
+		cron     *cronSchedule
+	}
+	schedules := map[string]scheduled{}
+	for name := range tasks {
+		schedule, cron, err := taskSchedule(c, name)
+		if err != nil {
+			return err
+		}
+		schedules[name] = scheduled{schedule, cron}
+	}
+	for name, task := range tasks {
+		task.mu.Lock()
+		task.Schedule, task.cron = schedules[name].schedule, schedules[name].cron
+		task.mu.Unlock()
+	}
+	return nil
+}
+
+// start runs the task in the background unless it is already running
+func (t *maintenanceTask) start() bool {
+	t.mu.Lock()
+	if t.running {
+		t.mu.Unlock()
+		return false
+	}
+	t.running = true
+	t.mu.Unlock()
+
+	go func() {
+		started := time.Now()
+		err := t.run()
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.running = false
+		t.lastRun = started
+		t.lastDuration = time.Since(started)
+		t.lastError = ""
+		if err != nil {
+			t.lastError = err.Error()
+			log.Printf("Task %s failed: %v", t.Name, err)
+		}
+	}()
+	return true
+}
+
+func (t *maintenanceTask) status() taskStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := taskStatus{
+		Name:         t.Name,
+		Schedule:     t.Schedule,
+		Running:      t.running,
+		LastDuration: t.lastDuration.Seconds(),
+		LastError:    t.lastError,
+	}
+	if !t.lastRun.IsZero() {
+		lastRun := t.lastRun
+		status.LastRun = &lastRun
+	}
+	if t.cron != nil {
+		next := t.cron.next(time.Now())
+		status.NextRun = &next
+	}
+	return status
+}
+
+// runScheduler checks every minute for tasks that are due
+func runScheduler() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+		tick := time.Now()
+		for _, task := range tasks {
+			task.mu.Lock()
+			cron := task.cron
+			task.mu.Unlock()
+			if cron != nil && cron.matches(tick) {
+				if !task.start() {
+					log.Printf("Task %s is still running, skipping this run", task.Name)
+				}
+			}
+		}
+	}
+}
+
+// handleTasks lists tasks (GET /api/tasks) and triggers them (POST /api/tasks/{name}/run)
+func handleTasks(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tasks"), "/")
+
+	if rest == "" {
+		list := make([]taskStatus, 0, len(tasks))
+		for _, task := range tasks {
+			list = append(list, task.status())
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	name, action, _ := strings.Cut(rest, "/")
+	task := tasks[name]
+	if task == nil || action != "run" {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !task.start() {
+		http.Error(w, "Task already running", http.StatusConflict)
+		return
+	}
+
+	log.Printf("Task %s triggered manually", name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task.status())
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Width of generated thumbnails in pixels
+const thumbnailWidth = 320
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// thumbnailPath returns where the cached thumbnail for a file lives. The
+// modification time is part of the key so replaced files get new thumbnails.
+// Thumbnails other than the usual width have it added to the name.
+func thumbnailPath(fullPath string, modTime time.Time, width int) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d", fullPath, modTime.UnixNano())))
+	name := hex.EncodeToString(sum[:])
+	if width != thumbnailWidth {
+		name += "-" + strconv.Itoa(width)
+	}
+	return filepath.Join(dataDir, "thumbnails", name+".jpg")
+}
+
+// Artwork looked for inside a folder or disc backup
+var folderPosters = []string{"poster.jpg", "poster.png", "folder.jpg", "folder.png", "cover.jpg", "cover.png"}
+
+// posterFor finds artwork that came with a video or folder, preferred over
+// a grabbed frame. Videos use an image sharing their name, optionally with
+// a -poster suffix, as media managers save them.
+func posterFor(fullPath string, isDir bool) string {
+	var candidates []string
+	if isDir {
+		for _, name := range folderPosters {
+			candidates = append(candidates, filepath.Join(fullPath, name))
+		}
+	} else {
+		base := strings.TrimSuffix(fullPath, filepath.Ext(fullPath))
+		for _, suffix := range []string{"-poster.jpg", "-poster.png", ".jpg", ".png"} {
+			candidates = append(candidates, base+suffix)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if fileExists(candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// generateThumbnail grabs a frame a little way into the video, avoiding the
+// black frames most files start with
+func generateThumbnail(ctx context.Context, fullPath string, dest string, width int) error {
+	seek := 30.0
+	if probe, err := probeFile(ctx, fullPath); err == nil {
+		if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil && duration > 0 {
+			seek = min(duration*0.1, 120)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	tmp := dest + ".tmp.jpg"
+	args := append([]string{"-ss", strconv.FormatFloat(seek, 'f', 1, 64)}, inputFile(fullPath)...)
+	cmd := exec.Command("ffmpeg", append(args,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%d:-2", width),
+		"-q:v", "5",
+		"-loglevel", "error",
+		"-y", tmp,
+	)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return os.Rename(tmp, dest)
+}
+
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/thumbnail/")
+
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if poster := posterFor(fullPath, info.IsDir()); poster != "" {
+		w.Header().Set("Cache-Control", "max-age=86400")
+		http.ServeFile(w, r, poster)
+		return
+	}
+	// Comics use their cover
+	if comicFormats[strings.ToLower(filepath.Ext(fullPath))] {
+		http.Redirect(w, r, "/api/comic?page=0&path="+url.QueryEscape(path), http.StatusFound)
+		return
+	}
+	// Plain folders only have artwork if someone put it there
+	if info.IsDir() && discType(fullPath) == "" {
+		http.Error(w, "No artwork", http.StatusNotFound)
+		return
+	}
+
+	width := thumbnailWidth
+	if dataSaver(r) {
+		width = dataSaverThumbnailWidth
+	}
+	thumb := thumbnailPath(fullPath, info.ModTime(), width)
+	if !fileExists(thumb) {
+		if err := generateThumbnail(r.Context(), fullPath, thumb, width); err != nil {
+			log.Printf("Error generating thumbnail for %s: %v", path, err)
+			http.Error(w, "Cannot generate thumbnail", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "max-age=86400")
+	w.Header().Set("Vary", "Save-Data, Cookie")
+	http.ServeFile(w, r, thumb)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// streamTokensEnabled makes video and stream URLs carry a signed token,
+// turned on with -stream-tokens
+var streamTokensEnabled = false
+
+// How long a token lets its video be played, long enough for a film with
+// a few pauses but not for a copied link to work for good
+const tokenLifetime = 6 * time.Hour
+
+// tokenKey signs stream tokens. It's kept in the data directory so tokens
+// survive restarts, as resumed sessions still need theirs.
+var tokenKey []byte
+
+const tokenKeyFile = "stream.key"
+
+func loadTokenKey() error {
+	keyPath := filepath.Join(dataDir, tokenKeyFile)
+	key, err := os.ReadFile(keyPath)
+	if err == nil && len(key) == 32 {
+		tokenKey = key
+		return nil
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, key, 0600); err != nil {
+		return err
+	}
+	tokenKey = key
+	return nil
+}
+
+func tokenSignature(user string, path string, expiry []byte) []byte {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(user))
+	mac.Write([]byte{0})
+	mac.Write([]byte(path))
+	mac.Write([]byte{0})
+	mac.Write(expiry)
+	return mac.Sum(nil)[:16]
+}
+
+// issueStreamToken signs a user's access to one video until it expires
+func issueStreamToken(user string, path string, expires time.Time) string {
+	expiry := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(expiry, tokenSignature(user, path, expiry)...))
+}
+
+// validStreamToken checks a token was issued to this user for this video
+// and hasn't expired
+func validStreamToken(token string, user string, path string) bool {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) != 8+16 {
+		return false
+	}
+	expiry, signature := data[:8], data[8:]
+	if time.Now().Unix() > int64(binary.BigEndian.Uint64(expiry)) {
+		return false
+	}
+	return hmac.Equal(signature, tokenSignature(user, path, expiry))
+}
+
+// requireStreamToken wraps a handler serving /prefix/{path} so it only
+// answers requests carrying a valid token for that path
+func requireStreamToken(prefix string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Peers sign in with their own token, which doesn't run out
+		if streamTokensEnabled && requestPeer(r) == "" {
+			path, err := cleanAPIPath(strings.TrimPrefix(r.URL.Path, prefix), runtime.GOOS == "windows")
+			if err != nil || !validStreamToken(r.URL.Query().Get("token"), requestUser(r), path) {
+				http.Error(w, "Invalid or expired token", http.StatusForbidden)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// handleToken issues a token for playing a video (GET /api/token?path=)
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	if !streamTokensEnabled {
+		http.Error(w, "Stream tokens are turned off", http.StatusNotFound)
+		return
+	}
+	path := r.URL.Query().Get("path")
+
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	// Files in remote libraries are looked up by their own server
+	if _, library, _ := remoteLibraryOf(r, path); library == nil && !fileExists(fullPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	expires := time.Now().Add(tokenLifetime)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":   issueStreamToken(requestUser(r), path, expires),
+		"expires": expires,
+	})
+}
+
+// setupStreamTokens loads the signing key, which also signs the cookies
+// of people signed in through an OpenID Connect provider
+func setupStreamTokens() error {
+	if err := loadTokenKey(); err != nil {
+		return fmt.Errorf("cannot load stream token key: %w", err)
+	}
+	return nil
+}
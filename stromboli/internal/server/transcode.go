@@ -0,0 +1,237 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"video-browser/stromboli/internal/library"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// Container used for transcodes when the request doesn't ask for one
+var defaultContainer = "mp4"
+
+// streamSettings works out the container, quality profile and device
+// profile a transcode request asks for. Without a quality profile the
+// device's audio setting decides, and without a container the device class.
+func streamSettings(r *http.Request) (string, transcode.Profile, transcode.Device, error) {
+	device := requestDeviceProfile(r)
+
+	// Resolution and frame rate caps, from the config and the player
+	maxHeight, maxFrameRate, err := requestLimits(r)
+	if err != nil {
+		return "", transcode.Profile{}, device, err
+	}
+	device = device.WithLimits(config().MaxHeight, config().MaxFrameRate).WithLimits(maxHeight, maxFrameRate)
+
+	// Allow the container to be chosen per request
+	container := r.URL.Query().Get("container")
+	if container == "" {
+		container = defaultContainer
+		if !slices.Contains(device.Containers, container) {
+			container = device.Containers[0]
+		}
+	}
+	if _, ok := transcode.Containers[container]; !ok {
+		return "", transcode.Profile{}, device, errors.New("Unknown container")
+	}
+
+	// Quality profile, used when the player falls back after stalling
+	profileName := r.URL.Query().Get("profile")
+	if profileName == "" {
+		profileName = startProfile(r).Name
+		if getPreferences(requestUser(r)).DeviceAudio[r.URL.Query().Get("device")] == audioPassthrough {
+			profileName = transcode.PassthroughProfile.Name
+		}
+	}
+	profile, ok := transcode.FindProfile(profileName)
+	if !ok {
+		return "", transcode.Profile{}, device, errors.New("Unknown profile")
+	}
+	if device.DataSaver {
+		profile = dataSaverProfile()
+	}
+
+	// Not every MP4 muxer takes DTS or TrueHD, so passthrough always uses MPEG-TS
+	if profile.Passthrough {
+		container = "mpegts"
+	}
+	return container, profile, device, nil
+}
+
+type transcodeOptions struct {
+	Container string
+	Profile   transcode.Profile
+	Device    transcode.Device
+	Start     float64 // Seconds into the file to start from
+
+	// Concat demuxer list to read instead of the file, for multi-part movies
+	ConcatList string
+
+	// Sidecar audio file to use in place of the file's own audio
+	ExternalAudio string
+
+	// Sidecar subtitle file to burn into the picture, and its ASS style override
+	Subtitles     string
+	SubtitleStyle string
+
+	// Watermark text with its placeholders filled in, when one is configured
+	Watermark string
+
+	// Output timestamps start here rather than at zero, for a stream
+	// carrying on from a warmed up first minute
+	OutputOffset float64
+
+	// Stop after this many seconds. Partial transcodes are made ahead of
+	// playback, so they run as fast as ffmpeg can go.
+	Length float64
+
+	// Re-encode the video rather than copying it, so a segment starts on
+	// the frame asked for instead of the keyframe before it
+	Exact bool
+
+	// Workarounds for a file whose transcode failed before
+	Retry retryOptions
+
+	// How audio with more than two channels is mixed, stereo when empty
+	Downmix string
+
+	// Gain for quiet files, 0 to leave the volume alone
+	Volume float64
+}
+
+// Most a player can boost the volume by, past which it's all distortion
+const maxVolume = 4
+
+// Longest segment a player can ask for with an end, in seconds
+const maxSegmentLength = 600
+
+// transcodeArgs builds the ffmpeg arguments to transcode a file to H.264/AAC,
+// fitted to the device profile. A nil probe falls back to mapping the first
+// video and audio streams.
+func transcodeArgs(fullPath string, probe *library.ProbeResult, opts transcodeOptions) []string {
+	if opts.Device.Name == "" {
+		opts.Device = transcode.Devices[0]
+	}
+	var args []string
+	if opts.Length == 0 {
+		args = append(args, "-re") // Read input at native frame rate
+	}
+	if opts.Start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(opts.Start, 'f', 3, 64))
+	}
+	if opts.Retry.Tolerant {
+		args = append(args, "-err_detect", "ignore_err", "-fflags", "+genpts+discardcorrupt")
+	}
+	if opts.ConcatList != "" {
+		args = append(args, "-f", "concat", "-safe", "0", "-i", opts.ConcatList)
+	} else if opts.Retry.Software && discType(fullPath) == "" {
+		args = append(args, "-i", fullPath)
+	} else {
+		args = append(args, inputFile(fullPath)...)
+	}
+	if opts.ExternalAudio != "" {
+		// Input options only apply to the next input, so the seek is repeated
+		if opts.Length == 0 {
+			args = append(args, "-re")
+		}
+		if opts.Start > 0 {
+			args = append(args, "-ss", strconv.FormatFloat(opts.Start, 'f', 3, 64))
+		}
+		args = append(args, "-i", opts.ExternalAudio)
+	}
+
+	hasAudio := probe == nil || probe.MainAudioStream() != nil || opts.ExternalAudio != ""
+	if opts.Retry.NoAudio {
+		args = append(args, transcode.VideoMapArgs(probe)...)
+		hasAudio = false
+	} else {
+		args = append(args, transcode.StreamMapArgs(probe, opts.ExternalAudio != "")...)
+	}
+
+	filter := transcode.VideoFilter(probe, opts.Device.HeightFor(opts.Profile), opts.Device.MaxFrameRate)
+	if opts.Subtitles != "" {
+		if filter != "" {
+			filter += ","
+		}
+		filter += subtitleFilter(opts.Subtitles, opts.SubtitleStyle, opts.Start)
+	}
+	filter = addWatermark(filter, opts.Watermark)
+
+	if (opts.Profile.Passthrough || opts.Profile.Remux) && filter == "" && !opts.Exact && transcode.CopyableVideo(probe, opts.Device) {
+		args = append(args, "-c:v", "copy")
+	} else {
+		crf, maxRate, bufSize := transcode.EncoderSettings(probe, opts.Profile, opts.Device)
+		args = append(args,
+			"-c:v", "libx264",
+			"-preset", "ultrafast",
+			"-tune", "zerolatency",
+			"-profile:v", opts.Device.H264Profile,
+			"-level:v", opts.Device.H264Level,
+			"-crf", crf,
+			"-maxrate", maxRate,
+			"-bufsize", bufSize,
+			"-pix_fmt", "yuv420p",
+		)
+		if filter != "" {
+			args = append(args, "-vf", filter)
+		}
+	}
+
+	if hasAudio && opts.Profile.Passthrough && opts.ExternalAudio == "" && opts.Volume == 0 && transcode.PassthroughAudio[transcode.MainAudioCodec(probe)] {
+		args = append(args, "-c:a", "copy")
+	} else if hasAudio && opts.Profile.Remux && opts.ExternalAudio == "" && opts.Volume == 0 && opts.Downmix != downmixDialogue && transcode.RemuxAudio[transcode.MainAudioCodec(probe)] && slices.Contains(opts.Device.AudioCodecs, transcode.MainAudioCodec(probe)) {
+		args = append(args, "-c:a", "copy")
+	} else if hasAudio {
+		// The probe only knows the file's own audio, so external tracks are stereo
+		source := 2
+		if opts.ExternalAudio == "" {
+			source = transcode.SourceChannels(probe)
+		}
+		channels := min(opts.Device.AudioChannels, source)
+		var filters []string
+		switch opts.Downmix {
+		case downmixDialogue:
+			channels = 2
+			filters = append(filters, transcode.DialogueFilter(source))
+		case downmixSurround:
+			channels = min(transcode.MaxSurroundChannels, source)
+		}
+		if opts.Volume > 0 {
+			filters = append(filters, "volume="+strconv.FormatFloat(opts.Volume, 'f', 2, 64))
+		}
+
+		// AAC needs about the same bitrate for each pair of channels
+		bitrate := opts.Profile.AudioBitrate
+		if kbps, err := strconv.Atoi(strings.TrimSuffix(bitrate, "k")); err == nil && channels > 2 {
+			bitrate = strconv.Itoa(kbps*channels/2) + "k"
+		}
+		args = append(args,
+			"-c:a", "aac",
+			"-b:a", bitrate,
+			"-ac", strconv.Itoa(channels),
+		)
+		if len(filters) > 0 {
+			args = append(args, "-af", strings.Join(filters, ","))
+		}
+	} else {
+		args = append(args, "-an")
+	}
+
+	if opts.Length > 0 {
+		args = append(args, "-t", strconv.FormatFloat(opts.Length, 'f', 3, 64))
+	}
+	if opts.OutputOffset > 0 {
+		args = append(args, "-output_ts_offset", strconv.FormatFloat(opts.OutputOffset, 'f', 3, 64))
+	}
+
+	args = append(args, transcode.Containers[opts.Container].Args...)
+	return append(args,
+		"-loglevel", "warning",
+		"pipe:1",
+	)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"video-browser/stromboli/internal/library"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// argAfter is the value given to an ffmpeg option, or "" if it isn't there
+func argAfter(args []string, option string) string {
+	if i := slices.Index(args, option); i >= 0 && i+1 < len(args) {
+		return args[i+1]
+	}
+	return ""
+}
+
+func TestDownmix(t *testing.T) {
+	surround := &library.ProbeResult{Streams: []library.ProbeStream{
+		{CodecType: "video", CodecName: "hevc", Height: 1080},
+		{CodecType: "audio", CodecName: "dts", Channels: 6},
+	}}
+	tests := []struct {
+		downmix  string
+		channels string
+		bitrate  string
+		filter   string
+	}{
+		{"", "2", "128k", ""},
+		{downmixStereo, "2", "128k", ""},
+		{downmixDialogue, "2", "128k", "pan=stereo|"},
+		{downmixSurround, "6", "384k", ""},
+	}
+	for _, test := range tests {
+		args := transcodeArgs("film.mkv", surround, transcodeOptions{Container: "mp4", Profile: transcode.Profiles[0], Downmix: test.downmix})
+		if got := argAfter(args, "-ac"); got != test.channels {
+			t.Errorf("%q: %s channels, want %s", test.downmix, got, test.channels)
+		}
+		if got := argAfter(args, "-b:a"); got != test.bitrate {
+			t.Errorf("%q: audio at %s, want %s", test.downmix, got, test.bitrate)
+		}
+		if got := argAfter(args, "-af"); !strings.HasPrefix(got, test.filter) || test.filter == "" && got != "" {
+			t.Errorf("%q: audio filter %q, want it to start %q", test.downmix, got, test.filter)
+		}
+	}
+
+	// Stereo sources have nothing to pan, and only get evened out
+	stereo := &library.ProbeResult{Streams: []library.ProbeStream{{CodecType: "audio", CodecName: "aac", Channels: 2}}}
+	args := transcodeArgs("film.mkv", stereo, transcodeOptions{Container: "mp4", Profile: transcode.Profiles[0], Downmix: downmixDialogue, Volume: 2})
+	if got := argAfter(args, "-af"); got != "dynaudnorm=f=150:g=15,volume=2.00" {
+		t.Errorf("stereo dialogue filter is %q", got)
+	}
+}
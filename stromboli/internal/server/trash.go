@@ -0,0 +1,340 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const trashFile = "trash.json"
+
+// trashFolder is where deleted videos wait in the library, hidden from
+// listings and scans by its leading dot
+const trashFolder = ".trash"
+
+// trashState is what's due to go to the trash and what's already there
+type trashState struct {
+	// When videos someone asked to delete go, by path
+	Scheduled map[string]time.Time `json:"scheduled"`
+
+	// Videos kept back from their folder's deleteWatched policy
+	Kept map[string]bool `json:"kept"`
+
+	// When each video in the trash was put there, by its old path
+	Trashed map[string]time.Time `json:"trashed"`
+}
+
+// trashStatus is how a video stands with the trash
+type trashStatus struct {
+	Path string     `json:"path"`
+	Due  *time.Time `json:"due,omitempty"`  // When it goes, if it's scheduled or watched under a policy
+	Days *int       `json:"days,omitempty"` // Days after watching its folder's policy allows
+	Kept bool       `json:"kept,omitempty"`
+}
+
+var (
+	trashMutex sync.Mutex
+	trash      = trashState{
+		Scheduled: map[string]time.Time{},
+		Kept:      map[string]bool{},
+		Trashed:   map[string]time.Time{},
+	}
+)
+
+// setupTrash checks the config file's deleteWatched folders
+func setupTrash(c *Config) error {
+	policies := make(map[string]int, len(c.DeleteWatched))
+	for folder, days := range c.DeleteWatched {
+		cleaned, err := cleanAPIPath(folder, runtime.GOOS == "windows")
+		if err != nil {
+			return fmt.Errorf("folder %q: %w", folder, err)
+		}
+		policies[cleaned] = days
+	}
+	c.DeleteWatched = policies
+	if c.TrashDays < 0 {
+		return fmt.Errorf("trashDays can't be negative")
+	}
+	return nil
+}
+
+func loadTrash() {
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+	if err := loadJSON(trashFile, &trash); err != nil {
+		log.Printf("Error loading trash: %v", err)
+	}
+	if trash.Scheduled == nil {
+		trash.Scheduled = map[string]time.Time{}
+	}
+	if trash.Kept == nil {
+		trash.Kept = map[string]bool{}
+	}
+	if trash.Trashed == nil {
+		trash.Trashed = map[string]time.Time{}
+	}
+}
+
+// saveTrash writes the trash state to disk. Callers must hold trashMutex.
+func saveTrash() {
+	if err := saveJSON(trashFile, trash); err != nil {
+		log.Printf("Error saving trash: %v", err)
+	}
+}
+
+// deleteWatchedDays is how many days after being watched a video goes to
+// the trash, going by the deepest folder with a policy. Negative numbers,
+// and videos outside every such folder, never go.
+func deleteWatchedDays(path string) int {
+	days, longest := -1, -1
+	for folder, d := range config().DeleteWatched {
+		if folder != "" && path != folder && !strings.HasPrefix(path, folder+"/") {
+			continue
+		}
+		if len(folder) > longest {
+			days, longest = d, len(folder)
+		}
+	}
+	return days
+}
+
+// watchedPaths lists the videos the history has as watched: by someone,
+// and with nobody partway through
+func watchedPaths() []string {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	seen := map[string]bool{}
+	var paths []string
+	for _, entries := range history {
+		for path := range entries {
+			if _, ok := watchedByEveryone(path); ok && !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// watchedByEveryone reports when a video was last watched, if anyone has
+// and nobody is still partway through it. Callers must hold historyMutex.
+func watchedByEveryone(path string) (time.Time, bool) {
+	var last time.Time
+	for _, entries := range history {
+		entry := entries[path]
+		if entry == nil {
+			continue
+		}
+		if !entry.Watched {
+			if entry.Position > 0 {
+				return time.Time{}, false
+			}
+			continue
+		}
+		if entry.LastWatched.After(last) {
+			last = entry.LastWatched
+		}
+	}
+	return last, !last.IsZero()
+}
+
+// trashStatusOf works out when a video is due to go. Callers must hold
+// trashMutex.
+func trashStatusOf(path string) trashStatus {
+	status := trashStatus{Path: path, Kept: trash.Kept[path]}
+	if due, ok := trash.Scheduled[path]; ok {
+		status.Due = &due
+		return status
+	}
+	days := deleteWatchedDays(path)
+	if days < 0 || status.Kept {
+		return status
+	}
+	status.Days = &days
+
+	historyMutex.Lock()
+	if watched, ok := watchedByEveryone(path); ok {
+		due := watched.Add(time.Duration(days) * 24 * time.Hour)
+		status.Due = &due
+	}
+	historyMutex.Unlock()
+	return status
+}
+
+// trashCandidates are the videos that might be due to go to the trash:
+// those scheduled to, and watched ones a folder policy may apply to.
+// Callers must hold trashMutex.
+func trashCandidates(watched []string) []string {
+	seen := map[string]bool{}
+	var paths []string
+	for path := range trash.Scheduled {
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	for _, path := range watched {
+		if !seen[path] {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// emptyTrash moves videos whose time has come to the trash, and deletes
+// for good the ones that have been there longer than trashDays. A
+// read-only server leaves them where they are.
+func emptyTrash() error {
+	if readOnly {
+		return nil
+	}
+	watched := watchedPaths()
+
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+	now := time.Now()
+	moved := 0
+	for _, path := range trashCandidates(watched) {
+		status := trashStatusOf(path)
+		if status.Due == nil || status.Due.After(now) {
+			continue
+		}
+		delete(trash.Scheduled, path)
+		if !fileExists(filepath.Join(rootDir, filepath.FromSlash(path))) {
+			continue
+		}
+		if err := moveWithSidecars(path, trashFolder+"/"+path); err != nil {
+			log.Printf("Cannot move %s to the trash: %v", path, err)
+			continue
+		}
+		delete(trash.Kept, path)
+		trash.Trashed[path] = now
+		moved++
+	}
+
+	deleted := 0
+	for path, trashed := range trash.Trashed {
+		if config().TrashDays == 0 || now.Sub(trashed) < time.Duration(config().TrashDays)*24*time.Hour {
+			continue
+		}
+		fullPath := filepath.Join(rootDir, trashFolder, filepath.FromSlash(path))
+		for _, name := range sidecarFiles(fullPath) {
+			os.Remove(filepath.Join(filepath.Dir(fullPath), name))
+		}
+		if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Cannot delete %s from the trash: %v", path, err)
+			continue
+		}
+		delete(trash.Trashed, path)
+		deleted++
+	}
+	saveTrash()
+
+	log.Printf("Moved %d videos to the trash and deleted %d from it", moved, deleted)
+	return nil
+}
+
+// handleTrash shows when a video goes to the trash (GET ?path=), lists
+// what's due to go and what's there already (GET), schedules a video to
+// go in some days (POST ?path=&days=), keeps one back (DELETE ?path=) or
+// restores one from the trash (POST /api/trash/restore?path=)
+func handleTrash(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if r.Method == http.MethodGet && query.Get("path") == "" {
+		listTrash(w, r)
+		return
+	}
+
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, query.Get("path"))
+	if path == "" || !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+	switch {
+	case r.Method == http.MethodGet:
+	case r.Method == http.MethodPost && r.URL.Path == "/api/trash/restore":
+		if _, ok := trash.Trashed[path]; !ok {
+			http.Error(w, "Not in the trash", http.StatusNotFound)
+			return
+		}
+		if err := moveWithSidecars(trashFolder+"/"+path, path); err != nil {
+			log.Printf("Cannot restore %s from the trash: %v", path, err)
+			http.Error(w, "Cannot restore: "+err.Error(), http.StatusConflict)
+			return
+		}
+		delete(trash.Trashed, path)
+		trash.Kept[path] = true
+		saveTrash()
+	case r.Method == http.MethodPost:
+		days, err := strconv.Atoi(query.Get("days"))
+		if err != nil || days < 0 {
+			http.Error(w, "Invalid days", http.StatusBadRequest)
+			return
+		}
+		if !fileExists(fullPath) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		trash.Scheduled[path] = time.Now().Add(time.Duration(days) * 24 * time.Hour)
+		delete(trash.Kept, path)
+		saveTrash()
+	case r.Method == http.MethodDelete:
+		delete(trash.Scheduled, path)
+		trash.Kept[path] = true
+		saveTrash()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trashStatusOf(path))
+}
+
+// listTrash lists the videos due to go to the trash, soonest first, and
+// those in it, most recently trashed first
+func listTrash(w http.ResponseWriter, r *http.Request) {
+	type trashedVideo struct {
+		Path    string    `json:"path"`
+		Trashed time.Time `json:"trashed"`
+	}
+	result := struct {
+		Due     []trashStatus  `json:"due"`
+		Trashed []trashedVideo `json:"trashed"`
+	}{[]trashStatus{}, []trashedVideo{}}
+
+	watched := watchedPaths()
+
+	trashMutex.Lock()
+	for _, path := range trashCandidates(watched) {
+		// Watched videos stay in the history once they're in the trash
+		if _, trashed := trash.Trashed[path]; trashed || !canAccess(r, path) {
+			continue
+		}
+		if status := trashStatusOf(path); status.Due != nil {
+			result.Due = append(result.Due, status)
+		}
+	}
+	for path, trashed := range trash.Trashed {
+		if canAccess(r, path) {
+			result.Trashed = append(result.Trashed, trashedVideo{path, trashed})
+		}
+	}
+	trashMutex.Unlock()
+
+	sort.Slice(result.Due, func(i, j int) bool { return result.Due[i].Due.Before(*result.Due[j].Due) })
+	sort.Slice(result.Trashed, func(i, j int) bool { return result.Trashed[i].Trashed.After(result.Trashed[j].Trashed) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
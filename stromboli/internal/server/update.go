@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const releasesURL = "https://api.github.com/repos/breadcat/stromboli/releases/latest"
+
+// updateKey is the base64 ed25519 public key release checksums are signed
+// with, set on release builds with
+// -ldflags "-X video-browser/stromboli.updateKey=...". Builds without one
+// only verify checksums.
+var updateKey = ""
+
+// updateCheckEnabled is whether the server looks for new releases once a day
+var updateCheckEnabled = true
+
+var (
+	updateMutex   sync.Mutex
+	latestVersion string // Newest release seen, if newer than this build
+)
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+type release struct {
+	Tag    string         `json:"tag_name"`
+	Assets []releaseAsset `json:"assets"`
+}
+
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+func fetchLatestRelease() (*release, error) {
+	resp, err := updateClient.Get(releasesURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("release lookup failed: %s", resp.Status)
+	}
+	var latest release
+	if err := json.NewDecoder(resp.Body).Decode(&latest); err != nil {
+		return nil, err
+	}
+	return &latest, nil
+}
+
+func (r *release) asset(name string) *releaseAsset {
+	for i := range r.Assets {
+		if r.Assets[i].Name == name {
+			return &r.Assets[i]
+		}
+	}
+	return nil
+}
+
+// binaryAssetName is the release file for this platform, such as
+// stromboli-linux-arm64 or stromboli-windows-amd64.exe
+func binaryAssetName() string {
+	name := "stromboli-" + runtime.GOOS + "-" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func download(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download of %s failed: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// parseVersion splits a version such as v1.12.3 into its numbers
+func parseVersion(v string) ([]int, bool) {
+	parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		numbers[i] = n
+	}
+	return numbers, true
+}
+
+// newerVersion reports whether release version a is newer than b. Anything
+// that isn't a release number, like a development build, is never newer.
+func newerVersion(a, b string) bool {
+	va, ok := parseVersion(a)
+	if !ok {
+		return false
+	}
+	vb, ok := parseVersion(b)
+	if !ok {
+		return false
+	}
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+// verifyRelease checks a downloaded binary against the release's
+// checksums.txt, and the checksums against their signature when this build
+// carries a key
+func verifyRelease(latest *release, name string, binary []byte) error {
+	sums := latest.asset("checksums.txt")
+	if sums == nil {
+		return errors.New("release has no checksums.txt")
+	}
+	checksums, err := download(sums.URL)
+	if err != nil {
+		return err
+	}
+
+	if updateKey != "" {
+		key, err := base64.StdEncoding.DecodeString(updateKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("invalid update key")
+		}
+		sig := latest.asset("checksums.txt.sig")
+		if sig == nil {
+			return errors.New("release has no checksums.txt.sig")
+		}
+		signature, err := download(sig.URL)
+		if err != nil {
+			return err
+		}
+		signature, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+		if err != nil || !ed25519.Verify(ed25519.PublicKey(key), checksums, signature) {
+			return errors.New("checksums.txt signature doesn't match")
+		}
+	}
+
+	// sha256sum format: "<hex>  <name>"
+	sum := sha256.Sum256(binary)
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			if fields[0] != hex.EncodeToString(sum[:]) {
+				return fmt.Errorf("checksum of %s doesn't match", name)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no checksum for %s", name)
+}
+
+// replaceExecutable swaps the running binary for a new one. The old one is
+// moved aside rather than overwritten, which Windows doesn't allow while it
+// runs, and is cleaned up by the next update.
+func replaceExecutable(binary []byte) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+
+	next := exe + ".new"
+	old := exe + ".old"
+	if err := os.WriteFile(next, binary, 0755); err != nil {
+		return "", err
+	}
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		os.Remove(next)
+		return "", err
+	}
+	if err := os.Rename(next, exe); err != nil {
+		os.Rename(old, exe) // Put the old one back
+		return "", err
+	}
+	return exe, nil
+}
+
+// checkForUpdate looks up the newest release, noting it if it's newer
+func checkForUpdate() {
+	latest, err := fetchLatestRelease()
+	if err != nil {
+		log.Printf("Cannot check for updates: %v", err)
+		return
+	}
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	if newerVersion(latest.Tag, version) {
+		if latestVersion != latest.Tag {
+			log.Printf("Stromboli %s is available, run stromboli self-update to install it", latest.Tag)
+		}
+		latestVersion = latest.Tag
+	}
+}
+
+// runUpdateChecks checks for new releases at startup and daily after that.
+// Development builds have no version to compare, so they don't check.
+func runUpdateChecks() {
+	if !updateCheckEnabled || version == "dev" {
+		return
+	}
+	for {
+		checkForUpdate()
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// availableUpdate is the newer release found by the last check, if any
+func availableUpdate() string {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	return latestVersion
+}
+
+func runSelfUpdateCommand(args []string) {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	checkOnly := fs.Bool("check", false, "Only report whether an update is available")
+	force := fs.Bool("force", false, "Install the latest release even if it isn't newer")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: stromboli self-update [-check] [-force]")
+		fmt.Fprintln(fs.Output(), "Replaces this binary with the latest release from GitHub, after verifying it.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	latest, err := fetchLatestRelease()
+	if err != nil {
+		log.Fatal("Cannot check for updates: ", err)
+	}
+	if !newerVersion(latest.Tag, version) && !*force {
+		fmt.Printf("Stromboli %s is up to date (latest release %s)\n", buildVersion(), latest.Tag)
+		return
+	}
+	if *checkOnly {
+		fmt.Printf("Stromboli %s is available, this is %s\n", latest.Tag, buildVersion())
+		return
+	}
+
+	name := binaryAssetName()
+	asset := latest.asset(name)
+	if asset == nil {
+		log.Fatalf("Release %s has no build for this platform (%s)", latest.Tag, name)
+	}
+	fmt.Printf("Downloading %s %s\n", name, latest.Tag)
+	binary, err := download(asset.URL)
+	if err != nil {
+		log.Fatal("Download failed: ", err)
+	}
+	if err := verifyRelease(latest, name, binary); err != nil {
+		log.Fatal("Not updating: ", err)
+	}
+
+	exe, err := replaceExecutable(binary)
+	if err != nil {
+		log.Fatal("Cannot replace the binary: ", err)
+	}
+	fmt.Printf("Updated %s to %s, restart the server to use it\n", exe, latest.Tag)
+}
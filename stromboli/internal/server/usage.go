@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type usageEntry struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	IsDir bool   `json:"isDir"`
+	Size  int64  `json:"size"`
+	Files int    `json:"files"`
+}
+
+type usageReport struct {
+	Path     string       `json:"path"`
+	Size     int64        `json:"size"`
+	Files    int          `json:"files"`
+	Children []usageEntry `json:"children"`
+}
+
+// handleUsage totals indexed video sizes under a directory, grouped by its
+// immediate children, largest first
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	// Security check: paths can't leave the root
+	path, _, ok := resolveRequestPath(r, r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	prefix := ""
+	if path != "" {
+		prefix = path + "/"
+	}
+
+	report := usageReport{Path: path, Children: []usageEntry{}}
+	children := map[string]*usageEntry{}
+
+	libraryMutex.RLock()
+	for entryPath, entry := range libraryIndex {
+		if !strings.HasPrefix(entryPath, prefix) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(entryPath, prefix)
+		name, _, isDir := strings.Cut(rest, "/")
+
+		child := children[name]
+		if child == nil {
+			child = &usageEntry{Name: name, Path: apiPath(filepath.Join(path, name)), IsDir: isDir}
+			children[name] = child
+		}
+		child.Size += entry.Size
+		child.Files++
+		report.Size += entry.Size
+		report.Files++
+	}
+	libraryMutex.RUnlock()
+
+	for _, child := range children {
+		report.Children = append(report.Children, *child)
+	}
+	sort.Slice(report.Children, func(i, j int) bool {
+		return report.Children[i].Size > report.Children[j].Size
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Players send a heartbeat every 15 seconds while a video is open, paused
+// or not, and count as watching until a few have been missed
+const viewerTimeout = 45 * time.Second
+
+// viewer is an open player, keyed by its session ID
+type viewer struct {
+	Path    string    `json:"path"`
+	User    string    `json:"user,omitempty"`
+	Paused  bool      `json:"paused"`
+	Started time.Time `json:"started"`
+	seen    time.Time
+}
+
+var (
+	viewersMutex sync.Mutex
+	viewers      = map[string]*viewer{}
+)
+
+// pruneViewers forgets players that stopped sending heartbeats, telling
+// pages how many are left if there were any. Callers must hold viewersMutex.
+func pruneViewers() {
+	pruned := false
+	for id, v := range viewers {
+		if time.Since(v.seen) > viewerTimeout {
+			delete(viewers, id)
+			pruned = true
+		}
+	}
+	if pruned {
+		publishEvent("viewers", len(viewers))
+	}
+}
+
+// expireViewers keeps the count right when players go quiet without saying
+// they've closed, as happens when a phone loses its connection
+func expireViewers() {
+	for {
+		time.Sleep(viewerTimeout / 3)
+		viewersMutex.Lock()
+		pruneViewers()
+		viewersMutex.Unlock()
+	}
+}
+
+// watchingCounts is how many open players there are for each file
+func watchingCounts() map[string]int {
+	viewersMutex.Lock()
+	defer viewersMutex.Unlock()
+	pruneViewers()
+	counts := map[string]int{}
+	for _, v := range viewers {
+		counts[v.Path]++
+	}
+	return counts
+}
+
+// validSessionID reports whether a player's session ID is short and plain
+// enough to use as a key
+func validSessionID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// handleHeartbeat notes that a player still has a video open (POST
+// /api/heartbeat with its session, path and whether it's paused), or that
+// it has closed (DELETE ?session=)
+func handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Session string `json:"session"`
+			Path    string `json:"path"`
+			Paused  bool   `json:"paused"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validSessionID(req.Session) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		// Security check: paths can't leave the root
+		path, _, ok := resolveRequestPath(r, req.Path)
+		if path == "" || !ok {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		viewersMutex.Lock()
+		defer viewersMutex.Unlock()
+		pruneViewers()
+		v := viewers[req.Session]
+		if v != nil && v.User != requestUser(r) {
+			http.Error(w, "Session belongs to someone else", http.StatusForbidden)
+			return
+		}
+		changed := v == nil || v.Path != path || v.Paused != req.Paused
+		if v == nil || v.Path != path {
+			v = &viewer{Path: path, User: requestUser(r), Started: now}
+			viewers[req.Session] = v
+		}
+		v.Paused = req.Paused
+		v.seen = now
+		if changed {
+			publishEvent("viewers", len(viewers))
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		viewersMutex.Lock()
+		id := r.URL.Query().Get("session")
+		if v := viewers[id]; v != nil && v.User == requestUser(r) {
+			delete(viewers, id)
+			publishEvent("viewers", len(viewers))
+		}
+		viewersMutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleViewers says how many players are open on the server, and what
+// they're playing, longest watching first (GET /api/viewers). The count
+// takes in everyone, while the list leaves out files the user can't see.
+func handleViewers(w http.ResponseWriter, r *http.Request) {
+	viewersMutex.Lock()
+	pruneViewers()
+	count := len(viewers)
+	list := []viewer{}
+	for _, v := range viewers {
+		if canAccess(r, v.Path) {
+			list = append(list, *v)
+		}
+	}
+	viewersMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"count": count, "viewers": list})
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"video-browser/stromboli/internal/transcode"
+)
+
+// Seconds of the next episode transcoded ahead of time
+const warmupLength = 60.0
+
+// Warmed up starts are only needed for the next few minutes
+const warmupRetention = 24 * time.Hour
+
+// warmupEnabled is whether players may ask for the next episode to be
+// warmed up, turned off with -warmup=false on servers short of CPU
+var warmupEnabled = true
+
+// One warm-up at a time, so they never compete with playback for long
+var warmupSlots = make(chan struct{}, 1)
+
+var (
+	warmupMutex sync.Mutex
+	warmupJobs  = map[string]string{} // Video path by output file, while running
+)
+
+func warmupDir() string {
+	return filepath.Join(dataDir, "warmup")
+}
+
+// warmupPath is where the first minute of a file is kept for a given
+// profile, device and container, which a stream must match to use it
+func warmupPath(fullPath string, info os.FileInfo, profile transcode.Profile, device transcode.Device, container string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%s|%s|%s", fullPath, info.ModTime().UnixNano(), profile.Name, device.Name, container)))
+	ext := ".mp4"
+	if container == "mpegts" {
+		ext = ".ts"
+	}
+	return filepath.Join(warmupDir(), hex.EncodeToString(sum[:8])+ext)
+}
+
+// warmupFile returns the warmed up first minute for a stream, if there is one
+func warmupFile(fullPath string, profile transcode.Profile, device transcode.Device, container string) string {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return ""
+	}
+	output := warmupPath(fullPath, info, profile, device, container)
+	if !fileExists(output) {
+		return ""
+	}
+	return output
+}
+
+// warmable reports whether a stream can start from a warmed up first minute.
+// Copied video can only be cut at keyframes, so passthrough and remuxed
+// streams never join up cleanly, custom transcode commands aren't ffmpeg
+// at all and watermarks can name the viewer. Warmed up audio is plain
+// stereo, so users who mix it differently don't get it.
+func warmable(r *http.Request, fullPath string, profile transcode.Profile) bool {
+	if profile.Passthrough || profile.Remux || config().Watermark != nil || getPreferences(requestUser(r)).Downmix != downmixStereo {
+		return false
+	}
+	handler := handlerFor(fullPath)
+	return handler == nil || len(handler.Transcode) == 0
+}
+
+func runWarmup(path string, fullPath string, profile transcode.Profile, device transcode.Device, container string, output string) {
+	warmupSlots <- struct{}{}
+	defer func() { <-warmupSlots }()
+	defer func() {
+		warmupMutex.Lock()
+		delete(warmupJobs, output)
+		warmupMutex.Unlock()
+	}()
+
+	if err := os.MkdirAll(warmupDir(), 0755); err != nil {
+		log.Printf("Cannot create warm-up directory: %v", err)
+		return
+	}
+
+	probe, err := probeFile(context.Background(), fullPath)
+	if err != nil {
+		log.Printf("Error probing %s for warm-up: %v", path, err)
+	}
+
+	// Written through a pipe like a live stream, as MP4 written to a file
+	// gets an index at the end that would sit in the middle of the stream
+	tmp := output + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		log.Printf("Cannot create warm-up file: %v", err)
+		return
+	}
+	cmd := exec.Command("ffmpeg", transcodeArgs(fullPath, probe, transcodeOptions{
+		Container: container,
+		Profile:   profile,
+		Device:    device,
+		Length:    warmupLength,
+	})...)
+	var stderr tailBuffer
+	cmd.Stdout = file
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	file.Close()
+	if err != nil {
+		os.Remove(tmp)
+		log.Printf("Warm-up of %s failed: %v: %s", path, err, strings.TrimSpace(stderr.String()))
+		return
+	}
+	if err := os.Rename(tmp, output); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	log.Printf("Warmed up the first minute of %s", path)
+}
+
+// handleWarmup transcodes the first minute of a video ahead of time
+// (POST /api/warmup?path=), taking the same container, profile and device
+// parameters as /api/stream, so a player about to move on to the next
+// episode can start it without waiting for ffmpeg
+func handleWarmup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !warmupEnabled {
+		http.Error(w, "Warm-up is turned off", http.StatusNotFound)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() && discType(fullPath) == "" {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	container, profile, device, err := streamSettings(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !warmable(r, fullPath, profile) {
+		http.Error(w, "Cannot warm up this stream", http.StatusConflict)
+		return
+	}
+
+	output := warmupPath(fullPath, info, profile, device, container)
+	state := jobDone
+	warmupMutex.Lock()
+	if _, running := warmupJobs[output]; running {
+		state = jobRunning
+	} else if !fileExists(output) {
+		warmupJobs[output] = path
+		state = jobQueued
+		go runWarmup(path, fullPath, profile, device, container, output)
+	}
+	warmupMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"state": state})
+}
+
+// copyWarmup sends a warmed up first minute followed by the live transcode
+// of the rest. An MP4 continuation starts with its own header boxes, which
+// the player already has from the first minute, so they are dropped.
+func copyWarmup(w io.Writer, warm string, live io.Reader, container string) (int64, error) {
+	file, err := os.Open(warm)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(w, file)
+	file.Close()
+	if err != nil {
+		return written, err
+	}
+
+	if container == "mp4" {
+		if live, err = skipInitSegment(live); err != nil {
+			return written, err
+		}
+	}
+	n, err := io.Copy(w, live)
+	return written + n, err
+}
+
+// skipInitSegment reads past the boxes a fragmented MP4 starts with (ftyp,
+// moov) up to the first fragment
+func skipInitSegment(r io.Reader) (io.Reader, error) {
+	reader := bufio.NewReader(r)
+	for {
+		header, err := reader.Peek(8)
+		if err != nil {
+			return nil, err
+		}
+		if string(header[4:8]) == "moof" {
+			return reader, nil
+		}
+
+		size := uint64(binary.BigEndian.Uint32(header[0:4]))
+		if size == 1 {
+			large, err := reader.Peek(16)
+			if err != nil {
+				return nil, err
+			}
+			size = binary.BigEndian.Uint64(large[8:16])
+		}
+		if size < 8 {
+			return nil, fmt.Errorf("invalid MP4 box size %d", size)
+		}
+		if _, err := io.CopyN(io.Discard, reader, int64(size)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// pruneWarmups deletes warmed up starts nobody played
+func pruneWarmups() {
+	entries, err := os.ReadDir(warmupDir())
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-warmupRetention)
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(warmupDir(), entry.Name()))
+		}
+	}
+}
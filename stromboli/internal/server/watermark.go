@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// watermarkConfig stamps text or an image onto every transcoded stream,
+// for screeners or to label shared streams with who is watching
+type watermarkConfig struct {
+	Text     string  `json:"text"`     // {user}, {file} and {date} are filled in
+	Image    string  `json:"image"`    // PNG to overlay instead of text
+	Position string  `json:"position"` // top-left, top-right, bottom-left, bottom-right or center
+	Opacity  float64 `json:"opacity"`  // 0 to 1, 0.5 if unset
+	Size     int     `json:"size"`     // Text height in pixels, 24 if unset
+}
+
+// Where each position puts the watermark, for drawtext (w, h, tw, th) and
+// for overlay (W, H, w, h), 10 pixels in from the edges
+var watermarkPositions = map[string][2]string{
+	"top-left":     {"x=10:y=10", "x=10:y=10"},
+	"top-right":    {"x=w-tw-10:y=10", "x=W-w-10:y=10"},
+	"bottom-left":  {"x=10:y=h-th-10", "x=10:y=H-h-10"},
+	"bottom-right": {"x=w-tw-10:y=h-th-10", "x=W-w-10:y=H-h-10"},
+	"center":       {"x=(w-tw)/2:y=(h-th)/2", "x=(W-w)/2:y=(H-h)/2"},
+}
+
+// setupWatermark checks the watermark settings and fills in defaults
+func setupWatermark(c *Config) error {
+	wm := c.Watermark
+	if wm == nil {
+		return nil
+	}
+	if wm.Text == "" && wm.Image == "" {
+		return fmt.Errorf("watermark needs text or an image")
+	}
+	if wm.Image != "" {
+		image, err := filepath.Abs(wm.Image)
+		if err != nil || !fileExists(image) {
+			return fmt.Errorf("watermark image %s not found", wm.Image)
+		}
+		wm.Image = image
+	}
+	if wm.Position == "" {
+		wm.Position = "bottom-right"
+	}
+	if _, ok := watermarkPositions[wm.Position]; !ok {
+		return fmt.Errorf("unknown watermark position %q", wm.Position)
+	}
+	if wm.Opacity == 0 {
+		wm.Opacity = 0.5
+	}
+	if wm.Opacity < 0 || wm.Opacity > 1 {
+		return fmt.Errorf("watermark opacity must be between 0 and 1")
+	}
+	if wm.Size == 0 {
+		wm.Size = 24
+	}
+	return nil
+}
+
+// watermarkText fills in the placeholders of the watermark text for a
+// stream. Without accounts the viewer is named by their address.
+func watermarkText(r *http.Request, path string) string {
+	if config().Watermark == nil {
+		return ""
+	}
+	user := requestUser(r)
+	if user == "" {
+		user, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	return strings.NewReplacer(
+		"{user}", user,
+		"{file}", filepath.Base(path),
+		"{date}", time.Now().Format("2006-01-02"),
+	).Replace(config().Watermark.Text)
+}
+
+// addWatermark appends the watermark to a -vf filter chain. Images come in
+// through a movie source, which makes the chain a small graph.
+func addWatermark(filter string, text string) string {
+	wm := config().Watermark
+	if wm == nil {
+		return filter
+	}
+	position := watermarkPositions[wm.Position]
+	opacity := strconv.FormatFloat(wm.Opacity, 'f', 2, 64)
+
+	if wm.Image != "" {
+		if filter == "" {
+			filter = "null"
+		}
+		return filter + "[base];" +
+			"movie=filename=" + escapeFilterValue(wm.Image) + ",format=rgba,colorchannelmixer=aa=" + opacity + "[mark];" +
+			"[base][mark]overlay=" + position[1]
+	}
+
+	if filter != "" {
+		filter += ","
+	}
+	return filter + "drawtext=expansion=none:text=" + escapeFilterValue(text) +
+		":fontsize=" + strconv.Itoa(wm.Size) +
+		":fontcolor=white@" + opacity +
+		":shadowcolor=black@" + opacity + ":shadowx=1:shadowy=1:" + position[0]
+}
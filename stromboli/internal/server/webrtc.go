@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Whether players may ask for WebRTC streams, set with -webrtc
+var webrtcEnabled = false
+
+// webrtcSession is one WebRTC viewer. ffmpeg sends RTP to local UDP ports,
+// and the packets are passed on to the peer connection's tracks.
+type webrtcSession struct {
+	id    string
+	path  string
+	close func()
+}
+
+var (
+	webrtcMutex    sync.Mutex
+	webrtcSessions = map[string]*webrtcSession{}
+)
+
+// rtpForwarder listens for ffmpeg's RTP packets and writes them to a track
+type rtpForwarder struct {
+	conn  net.PacketConn
+	track *webrtc.TrackLocalStaticRTP
+}
+
+func newRTPForwarder(kind string, mimeType string) (*rtpForwarder, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType}, kind, "stromboli")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return &rtpForwarder{conn: conn, track: track}, nil
+}
+
+// url is where ffmpeg sends the packets. RTCP goes to the same port and is
+// dropped, since the browser gets its own from the peer connection.
+func (f *rtpForwarder) url() string {
+	port := strconv.Itoa(f.conn.LocalAddr().(*net.UDPAddr).Port)
+	return "rtp://127.0.0.1:" + port + "?rtcpport=" + port + "&pkt_size=1200"
+}
+
+func (f *rtpForwarder) forward() {
+	packet := make([]byte, 1500)
+	for {
+		n, _, err := f.conn.ReadFrom(packet)
+		if err != nil {
+			return
+		}
+		// RTCP packet types land on 192-223 in the second byte (RFC 5761)
+		if n < 2 || (packet[1] >= 192 && packet[1] <= 223) {
+			continue
+		}
+		if _, err := f.track.Write(packet[:n]); err != nil && err != io.ErrClosedPipe {
+			return
+		}
+	}
+}
+
+// webrtcArgs encodes for WebRTC: H.264 without B-frames, which every
+// browser decodes, and Opus audio. Keyframes come every two seconds or so
+// and carry their own parameter sets, so a viewer can start on any of them.
+func webrtcArgs(fullPath string, start float64, video *rtpForwarder, audio *rtpForwarder) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-re"}
+	if start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(start, 'f', 3, 64))
+	}
+	args = append(args, "-i", fullPath,
+		"-map", "0:v:0", "-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency",
+		"-profile:v", "baseline", "-bf", "0", "-g", "50", "-pix_fmt", "yuv420p",
+		"-f", "rtp", video.url())
+	if audio != nil {
+		args = append(args, "-map", "0:a:0", "-c:a", "libopus", "-b:a", "128k", "-ac", "2", "-ar", "48000",
+			"-f", "rtp", audio.url())
+	}
+	return args
+}
+
+// handleWHEP starts a WebRTC stream (POST /api/whep/{path}?start=, with the
+// player's SDP offer as the body), answering with the server's SDP and the
+// session's URL in Location, as WHEP does. Only host candidates are
+// gathered, so it works on the local network.
+func handleWHEP(w http.ResponseWriter, r *http.Request) {
+	if !webrtcEnabled {
+		http.Error(w, "WebRTC is turned off", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/whep/")
+
+	// Security check: paths can't leave the root
+	path, fullPath, ok := resolveRequestPath(r, path)
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(fullPath); err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+	if err == nil {
+		_, err = offer.Unmarshal()
+	}
+	if err != nil {
+		http.Error(w, "Invalid SDP offer", http.StatusBadRequest)
+		return
+	}
+	start, _ := strconv.ParseFloat(r.URL.Query().Get("start"), 64)
+
+	hasAudio := false
+	if probe, err := probeFile(r.Context(), fullPath); err == nil {
+		hasAudio = probe.MainAudioStream() != nil
+	}
+
+	session, answer, err := startWebRTC(path, fullPath, start, hasAudio, offer)
+	if err != nil {
+		log.Printf("Error starting WebRTC stream for %s: %v", path, err)
+		http.Error(w, "Cannot start WebRTC stream", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/api/webrtc/"+session.id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// startWebRTC answers the offer and starts ffmpeg, which runs until the
+// video ends, the connection drops or the player hangs up
+func startWebRTC(path string, fullPath string, start float64, hasAudio bool, offer webrtc.SessionDescription) (*webrtcSession, string, error) {
+	peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, "", err
+	}
+	var forwarders []*rtpForwarder
+	cleanup := func() {
+		peer.Close()
+		for _, f := range forwarders {
+			f.conn.Close()
+		}
+	}
+
+	video, err := newRTPForwarder("video", webrtc.MimeTypeH264)
+	if err != nil {
+		cleanup()
+		return nil, "", err
+	}
+	forwarders = append(forwarders, video)
+	var audio *rtpForwarder
+	if hasAudio {
+		if audio, err = newRTPForwarder("audio", webrtc.MimeTypeOpus); err != nil {
+			cleanup()
+			return nil, "", err
+		}
+		forwarders = append(forwarders, audio)
+	}
+	for _, f := range forwarders {
+		sender, err := peer.AddTrack(f.track)
+		if err != nil {
+			cleanup()
+			return nil, "", err
+		}
+		// RTCP from the browser has to be read for the connection to work
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	if err := peer.SetRemoteDescription(offer); err != nil {
+		cleanup()
+		return nil, "", err
+	}
+	answer, err := peer.CreateAnswer(nil)
+	if err != nil {
+		cleanup()
+		return nil, "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(peer)
+	if err := peer.SetLocalDescription(answer); err != nil {
+		cleanup()
+		return nil, "", err
+	}
+	<-gathered
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &webrtcSession{id: newSessionID(), path: path}
+	session.close = sync.OnceFunc(func() {
+		cancel()
+		cleanup()
+		webrtcMutex.Lock()
+		delete(webrtcSessions, session.id)
+		webrtcMutex.Unlock()
+	})
+	peer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			session.close()
+		}
+	})
+	webrtcMutex.Lock()
+	webrtcSessions[session.id] = session
+	webrtcMutex.Unlock()
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", webrtcArgs(fullPath, start, video, audio)...)
+	var stderr tailBuffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		session.close()
+		return nil, "", err
+	}
+	for _, f := range forwarders {
+		go f.forward()
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+			log.Printf("WebRTC ffmpeg error for %s: %v: %s", path, err, strings.TrimSpace(stderr.String()))
+		}
+		session.close()
+	}()
+	log.Printf("Started WebRTC stream %s for %s", session.id, path)
+	return session, peer.LocalDescription().SDP, nil
+}
+
+// handleWebRTCSession ends a WebRTC stream (DELETE /api/webrtc/{id})
+func handleWebRTCSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	webrtcMutex.Lock()
+	session := webrtcSessions[strings.TrimPrefix(r.URL.Path, "/api/webrtc/")]
+	webrtcMutex.Unlock()
+	if session == nil || !canAccess(r, session.path) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	session.close()
+	w.WriteHeader(http.StatusOK)
+}
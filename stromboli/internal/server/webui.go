@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+
+	"video-browser/stromboli/internal/webui"
+)
+
+// handleIndex serves the UI. Deep links to a folder (?path=) or video
+// (?play=) are restored by the page itself, but get a matching title here
+// so bookmarks and shared links read sensibly. The user's text size is
+// filled in too, so the page never flashes up at the wrong size, along
+// with the UI strings for the language the browser asks for.
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	title := "Stromboli"
+	target := r.URL.Query().Get("play")
+	if target == "" {
+		target = r.URL.Query().Get("path")
+	}
+	if name := path.Base(path.Clean("/" + target)); name != "/" {
+		title = name + " - Stromboli"
+	}
+
+	lang := negotiateLanguage(r.Header.Get("Accept-Language"))
+	messages, _ := json.Marshal(messagesFor(lang))
+	targetNames := []string{}
+	if isAdmin(r) {
+		for name := range config().BroadcastTargets {
+			targetNames = append(targetNames, name)
+		}
+	}
+	sort.Strings(targetNames)
+	targets, _ := json.Marshal(targetNames)
+
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	webui.ServeVersioned(w, "index.html", "text/html",
+		"<title>Stromboli</title>", "<title>"+html.EscapeString(title)+"</title>",
+		`<html lang="en">`, `<html lang="`+html.EscapeString(lang)+`">`,
+		"__FONT_SIZE__", strconv.Itoa(getPreferences(requestUser(r)).FontSize),
+		"__MESSAGES__", string(messages),
+		"__STREAM_TOKENS__", strconv.FormatBool(streamTokensEnabled),
+		"__GUEST__", strconv.FormatBool(isGuest(r)),
+		"__ADMIN__", strconv.FormatBool(isAdmin(r)),
+		"__READ_ONLY__", strconv.FormatBool(readOnly),
+		"__SIGNED_IN__", strconv.FormatBool(requestSignIn(r) != nil),
+		"__HAS_ACCOUNTS__", strconv.FormatBool(hasAccounts()),
+		"__WEBRTC__", strconv.FormatBool(webrtcEnabled),
+		"__DATA_SAVER__", strconv.FormatBool(dataSaver(r)),
+		"__AUDIOBOOK_MINUTES__", strconv.Itoa(audiobookMinutes),
+		"__BROADCAST_TARGETS__", string(targets))
+}
+
+// handleServiceWorker serves the service worker from the root so its scope covers the whole UI
+func handleServiceWorker(w http.ResponseWriter, r *http.Request) {
+	webui.ServeVersioned(w, "sw.js", "application/javascript")
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Placeholder for the input URL in the ffmpeg arguments sent to workers.
+// Workers are other machines running "stromboli worker", which ask the
+// server for jobs so only the server needs to be reachable. They read the
+// video from the server over HTTP and send the encoded stream back, which
+// the server passes on to the player.
+const workerInput = "{input}"
+
+// How long a worker's request for a job is held open, how long a stream
+// waits for a worker to take it before transcoding locally, and how long a
+// worker has to start sending once it has
+const (
+	workerPollTimeout  = 30 * time.Second
+	workerClaimTimeout = 2 * time.Second
+	workerStartTimeout = 30 * time.Second
+)
+
+// remoteJob is one transcode handed to a worker
+type remoteJob struct {
+	ID       string   `json:"id"`
+	Args     []string `json:"args"`
+	fullPath string
+	output   chan io.Reader    // The worker's upload, once it starts
+	finished chan struct{}     // Closed when the player is done with the upload
+	result   chan workerReport // How ffmpeg exited
+}
+
+// workerReport is what a worker says about a job once ffmpeg exits
+type workerReport struct {
+	Error  string `json:"error,omitempty"`
+	Stderr string `json:"stderr"`
+}
+
+var (
+	remoteQueue   = make(chan *remoteJob)
+	remoteMutex   sync.Mutex
+	remoteJobs    = map[string]*remoteJob{}
+	workersSeen   = map[string]time.Time{}
+	remoteEnabled = false
+)
+
+// setupWorkers turns on remote transcoding when the config file has a
+// secret for workers to connect with
+func setupWorkers(c *Config) {
+	remoteEnabled = c.WorkerSecret != ""
+}
+
+// workerConnected reports whether any worker has asked for a job lately
+func workerConnected() bool {
+	remoteMutex.Lock()
+	defer remoteMutex.Unlock()
+	for name, seen := range workersSeen {
+		if time.Since(seen) < 2*workerPollTimeout {
+			return true
+		}
+		delete(workersSeen, name)
+	}
+	return false
+}
+
+// remoteArgs turns ffmpeg arguments into ones a worker can run, reading
+// the file from the server. Only transcodes whose one local file is the
+// input can go remote.
+func remoteArgs(args []string, fullPath string) ([]string, bool) {
+	remote := append([]string{}, args...)
+	inputs := 0
+	for i, arg := range remote {
+		if arg == "-i" && i+1 < len(remote) {
+			if remote[i+1] != fullPath {
+				return nil, false
+			}
+			remote[i+1] = workerInput
+			inputs++
+		}
+	}
+	return remote, inputs == 1
+}
+
+// transcodeRemotely hands a transcode to a worker and streams its output to
+// the player. It returns false, having sent nothing, when no worker took
+// the job or the worker couldn't start ffmpeg, so the caller can transcode
+// locally instead.
+func transcodeRemotely(w http.ResponseWriter, r *http.Request, session *playbackSession, args []string, fullPath string) (bool, int64, *streamError) {
+	job := &remoteJob{
+		ID:       newSessionID() + newSessionID(),
+		Args:     args,
+		fullPath: fullPath,
+		output:   make(chan io.Reader, 1),
+		finished: make(chan struct{}),
+		result:   make(chan workerReport, 1),
+	}
+	remoteMutex.Lock()
+	remoteJobs[job.ID] = job
+	remoteMutex.Unlock()
+	defer func() {
+		remoteMutex.Lock()
+		delete(remoteJobs, job.ID)
+		remoteMutex.Unlock()
+	}()
+
+	select {
+	case remoteQueue <- job:
+	case <-time.After(workerClaimTimeout):
+		return false, 0, nil
+	}
+
+	// However this ends, the worker's upload is let go so it stops ffmpeg
+	finish := sync.OnceFunc(func() { close(job.finished) })
+	defer finish()
+
+	var output io.Reader
+	select {
+	case output = <-job.output:
+	case report := <-job.result:
+		session.log.Printf("Worker couldn't start ffmpeg, transcoding locally: %s", report.Error)
+		return false, 0, nil
+	case <-time.After(workerStartTimeout):
+		session.log.Printf("Worker didn't start sending, transcoding locally")
+		return false, 0, nil
+	case <-r.Context().Done():
+		return true, 0, nil
+	}
+
+	written, err := io.Copy(newFlushWriter(countingWriter{w, session}, w), output)
+	if err != nil && r.Context().Err() == nil {
+		session.log.Printf("Error streaming from worker: %v", err)
+	}
+	finish()
+
+	// A player that went away isn't a failed transcode
+	if r.Context().Err() != nil {
+		return true, written, nil
+	}
+	select {
+	case report := <-job.result:
+		session.addStderr(report.Stderr)
+		if report.Error != "" {
+			session.log.Printf("Worker ffmpeg error: %s", report.Error)
+			return true, written, classifyFFmpegError(report.Stderr)
+		}
+	case <-time.After(workerStartTimeout):
+		session.log.Printf("Worker didn't report how ffmpeg exited")
+	}
+	return true, written, nil
+}
+
+// checkWorkerSecret makes sure a request comes from a worker. Without a
+// secret there are no workers, or "Bearer " alone would do.
+func checkWorkerSecret(w http.ResponseWriter, r *http.Request) bool {
+	secret := config().WorkerSecret
+	if !remoteEnabled || secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+secret)) != 1 {
+		http.Error(w, "Unknown worker", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func findRemoteJob(id string) *remoteJob {
+	remoteMutex.Lock()
+	defer remoteMutex.Unlock()
+	return remoteJobs[id]
+}
+
+// handleWorker answers workers: asking for a job (GET /api/worker/next?name=),
+// reading its input (GET /api/worker/input/{id}), sending its output
+// (POST /api/worker/output/{id}) and reporting how ffmpeg exited
+// (POST /api/worker/done/{id}). Job IDs are unguessable, so ffmpeg can read
+// the input without the secret.
+func handleWorker(w http.ResponseWriter, r *http.Request) {
+	action, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/worker/"), "/")
+	if action == "input" {
+		job := findRemoteJob(id)
+		if job == nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		http.ServeFile(w, r, job.fullPath)
+		return
+	}
+	if !checkWorkerSecret(w, r) {
+		return
+	}
+
+	switch action {
+	case "next":
+		name := r.URL.Query().Get("name")
+		remoteMutex.Lock()
+		workersSeen[name] = time.Now()
+		remoteMutex.Unlock()
+
+		select {
+		case job := <-remoteQueue:
+			log.Printf("Worker %s took a transcode", name)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(job)
+		case <-time.After(workerPollTimeout):
+			w.WriteHeader(http.StatusNoContent)
+		case <-r.Context().Done():
+		}
+
+	case "output":
+		job := findRemoteJob(id)
+		if job == nil || r.Method != http.MethodPost {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		// The upload lasts as long as the video
+		http.NewResponseController(w).SetReadDeadline(time.Time{})
+		job.output <- r.Body
+		<-job.finished
+
+	case "done":
+		job := findRemoteJob(id)
+		if job == nil || r.Method != http.MethodPost {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		var report workerReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			http.Error(w, "Invalid report", http.StatusBadRequest)
+			return
+		}
+		job.result <- report
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// runWorkerCommand runs transcodes for a server until stopped
+func runWorkerCommand(args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	server := fs.String("connect", "", "URL of the server to transcode for")
+	secret := fs.String("secret", os.Getenv("STROMBOLI_WORKER_SECRET"), "The server's workerSecret (or set STROMBOLI_WORKER_SECRET)")
+	hostname, _ := os.Hostname()
+	name := fs.String("name", hostname, "Name the server logs this worker by")
+	jobs := fs.Int("jobs", 2, "How many transcodes to run at once")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: stromboli worker -connect URL -secret secret [-name name] [-jobs n]")
+		fmt.Fprintln(fs.Output(), "Runs transcodes for a server, which passes the output on to its players.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *server == "" || *secret == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	w := worker{server: strings.TrimSuffix(*server, "/"), secret: *secret, name: *name}
+
+	log.Printf("Transcoding for %s", w.server)
+	slots := make(chan struct{}, max(*jobs, 1))
+	for {
+		slots <- struct{}{}
+		job, err := w.next()
+		if err != nil {
+			log.Printf("Cannot reach the server: %v", err)
+			<-slots
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		if job == nil {
+			<-slots
+			continue
+		}
+		go func() {
+			defer func() { <-slots }()
+			w.run(job)
+		}()
+	}
+}
+
+type worker struct {
+	server string
+	secret string
+	name   string
+}
+
+func (w worker) request(method string, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, w.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+w.secret)
+	return http.DefaultClient.Do(req)
+}
+
+// next waits for a job, returning nil when none came up
+func (w worker) next() (*remoteJob, error) {
+	resp, err := w.request(http.MethodGet, "/api/worker/next?name="+strings.ReplaceAll(w.name, " ", "+"), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var job remoteJob
+		if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+			return nil, err
+		}
+		return &job, nil
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+}
+
+// run transcodes one job, sending the output as it's made and then how
+// ffmpeg exited. The server hanging up on the output means the player has
+// gone, so ffmpeg is stopped.
+func (w worker) run(job *remoteJob) {
+	args := make([]string, len(job.Args))
+	for i, arg := range job.Args {
+		args[i] = strings.ReplaceAll(arg, workerInput, w.server+"/api/worker/input/"+job.ID)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr tailBuffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		w.report(job.ID, workerReport{Error: err.Error()})
+		return
+	}
+	log.Printf("Started job %s", job.ID)
+
+	// Only the server hanging up stops ffmpeg. A finished upload leaves it
+	// to exit by itself, so a failure is still reported as one.
+	uploaded := make(chan struct{})
+	hungUp := false
+	go func() {
+		defer close(uploaded)
+		resp, err := w.request(http.MethodPost, "/api/worker/output/"+job.ID, stdout)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if err != nil || resp.StatusCode >= 300 {
+			hungUp = true
+			cancel()
+		}
+	}()
+
+	// The upload reads stdout to the end, which has to happen before Wait
+	<-uploaded
+	err = cmd.Wait()
+	report := workerReport{Stderr: stderr.String()}
+	if err != nil && !hungUp {
+		report.Error = err.Error()
+	}
+	w.report(job.ID, report)
+	log.Printf("Finished job %s", job.ID)
+}
+
+func (w worker) report(id string, report workerReport) {
+	data, _ := json.Marshal(report)
+	resp, err := w.request(http.MethodPost, "/api/worker/done/"+id, bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Cannot report job %s: %v", id, err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// A worker whose ffmpeg fails says so, rather than reporting the job done
+func TestWorkerReportsFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffmpeg is a shell script")
+	}
+	bin := t.TempDir()
+	writeTestFile(t, filepath.Join(bin, "ffmpeg"), "#!/bin/sh\nprintf 'some output'\necho 'Invalid data found when processing input' >&2\nexit 1\n", 0755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	reports := make(chan workerReport, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/worker/output/job1", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	})
+	mux.HandleFunc("/api/worker/done/job1", func(w http.ResponseWriter, r *http.Request) {
+		var report workerReport
+		json.NewDecoder(r.Body).Decode(&report)
+		reports <- report
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	worker{server: server.URL, secret: "secret", name: "test"}.run(&remoteJob{ID: "job1", Args: []string{"-i", workerInput, "pipe:1"}})
+	report := <-reports
+	if report.Error == "" {
+		t.Errorf("a failed ffmpeg was reported as done, stderr %q", report.Stderr)
+	}
+}
+
+// Workers need the secret, and there are none without one
+func TestWorkerSecret(t *testing.T) {
+	t.Cleanup(func() { currentConfig.Store(&Config{}); setupWorkers(config()) })
+	check := func(auth string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/worker/next", nil)
+		r.Header.Set("Authorization", auth)
+		checkWorkerSecret(w, r)
+		return w.Code
+	}
+
+	currentConfig.Store(&Config{})
+	setupWorkers(config())
+	remoteEnabled = true
+	if code := check("Bearer "); code != http.StatusUnauthorized {
+		t.Errorf("an empty secret let a worker in: %d", code)
+	}
+
+	currentConfig.Store(&Config{WorkerSecret: "shh"})
+	setupWorkers(config())
+	if code := check("Bearer nope"); code != http.StatusUnauthorized {
+		t.Errorf("the wrong secret let a worker in: %d", code)
+	}
+	if code := check("Bearer shh"); code != http.StatusOK {
+		t.Errorf("the secret didn't let a worker in: %d", code)
+	}
+}
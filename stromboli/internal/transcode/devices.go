@@ -0,0 +1,131 @@
+package transcode
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"video-browser/stromboli/internal/library"
+)
+
+// Device describes what a class of player can decode. Transcodes are
+// fitted to it, rather than one set of settings serving every player.
+type Device struct {
+	Name          string
+	Containers    []string // Transcode containers it plays, preferred first
+	VideoCodecs   []string // Video it decodes, which passthrough can copy
+	AudioCodecs   []string
+	H264Profile   string // baseline, main or high
+	H264Level     string
+	MaxHeight     int // 0 for no limit beyond the quality profile's
+	MaxFrameRate  int // 0 for no limit
+	AudioChannels int // Most channels it takes, sources with fewer keep theirs
+
+	DataSaver bool // The browser asked to save data
+}
+
+// Built-in device profiles. Desktop is the fallback for anything unrecognised.
+var Devices = []Device{
+	{
+		Name:          "desktop",
+		Containers:    []string{"mp4", "mpegts"},
+		VideoCodecs:   []string{"h264", "vp9", "av1"},
+		AudioCodecs:   []string{"aac", "mp3", "opus", "vorbis", "flac"},
+		H264Profile:   "high",
+		H264Level:     "5.1",
+		AudioChannels: 2,
+	},
+	{
+		Name:          "iphone",
+		Containers:    []string{"mp4"},
+		VideoCodecs:   []string{"h264", "hevc"},
+		AudioCodecs:   []string{"aac", "mp3", "flac"},
+		H264Profile:   "high",
+		H264Level:     "4.2",
+		AudioChannels: 2,
+	},
+	{
+		Name:          "android",
+		Containers:    []string{"mp4"},
+		VideoCodecs:   []string{"h264", "vp9"},
+		AudioCodecs:   []string{"aac", "mp3", "opus", "vorbis"},
+		H264Profile:   "high",
+		H264Level:     "4.1",
+		AudioChannels: 2,
+	},
+	{
+		// Older smart TV browsers play MPEG-TS more reliably than fragmented
+		// MP4, and stutter on anything above 1080p main profile
+		Name:          "smarttv",
+		Containers:    []string{"mpegts", "mp4"},
+		VideoCodecs:   []string{"h264"},
+		AudioCodecs:   []string{"aac", "ac3", "mp3"},
+		H264Profile:   "main",
+		H264Level:     "4.0",
+		MaxHeight:     1080,
+		AudioChannels: 6,
+	},
+}
+
+func FindDevice(name string) (Device, bool) {
+	for _, d := range Devices {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return Device{}, false
+}
+
+// User agent fragments of smart TV browsers
+var smartTVAgents = []string{"smart-tv", "smarttv", "tizen", "web0s", "webos", "netcast", "bravia", "hbbtv", "viera", "aquos"}
+
+// DetectDevice guesses the device class from the user agent
+func DetectDevice(userAgent string) Device {
+	agent := strings.ToLower(userAgent)
+	name := "desktop"
+	switch {
+	case slices.ContainsFunc(smartTVAgents, func(s string) bool { return strings.Contains(agent, s) }):
+		name = "smarttv"
+	case strings.Contains(agent, "iphone") || strings.Contains(agent, "ipad"):
+		name = "iphone"
+	case strings.Contains(agent, "android"):
+		name = "android"
+	}
+	device, _ := FindDevice(name)
+	return device
+}
+
+// WithLimits lowers the device's resolution and frame rate caps, for weak
+// players or servers. Its name changes with them, so warmed up starts made
+// for one set of caps aren't used for another.
+func (d Device) WithLimits(maxHeight int, maxFrameRate int) Device {
+	if maxHeight > 0 && (d.MaxHeight == 0 || maxHeight < d.MaxHeight) {
+		d.MaxHeight = maxHeight
+		d.Name += "-" + strconv.Itoa(maxHeight) + "p"
+	}
+	if maxFrameRate > 0 && (d.MaxFrameRate == 0 || maxFrameRate < d.MaxFrameRate) {
+		d.MaxFrameRate = maxFrameRate
+		d.Name += "-" + strconv.Itoa(maxFrameRate) + "fps"
+	}
+	return d
+}
+
+// HeightFor is the lower of the quality profile's and the device's limits
+func (d Device) HeightFor(profile Profile) int {
+	if d.MaxHeight > 0 && (profile.MaxHeight == 0 || d.MaxHeight < profile.MaxHeight) {
+		return d.MaxHeight
+	}
+	return profile.MaxHeight
+}
+
+// SourceChannels is how many channels a file's main audio has, which
+// transcodes never go above. Sources that couldn't be probed are taken to
+// be stereo.
+func SourceChannels(probe *library.ProbeResult) int {
+	if probe != nil {
+		if audio := probe.MainAudioStream(); audio != nil && audio.Channels > 0 {
+			return audio.Channels
+		}
+	}
+	return 2
+}
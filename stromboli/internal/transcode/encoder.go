@@ -0,0 +1,139 @@
+package transcode
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"video-browser/stromboli/internal/library"
+)
+
+// EncoderRule is how many bits a picture up to some height needs next to
+// 1080p, and how much to change the CRF by for it
+type EncoderRule struct {
+	MaxHeight int     `json:"maxHeight"` // 0 for anything taller than the rules before
+	RateScale float64 `json:"rateScale"`
+	CRF       int     `json:"crf"`
+}
+
+// Built-in rules. Small pictures are cheap to encode well, so they get
+// fewer bits and a lower CRF, while 4K gets more headroom.
+var DefaultEncoderRules = []EncoderRule{
+	{MaxHeight: 480, RateScale: 0.4, CRF: -2},
+	{MaxHeight: 576, RateScale: 0.5, CRF: -2},
+	{MaxHeight: 720, RateScale: 0.7, CRF: -1},
+	{MaxHeight: 1080, RateScale: 1},
+	{MaxHeight: 1440, RateScale: 1.6},
+	{RateScale: 2.5},
+}
+
+// encoderRules are the rules in use, the config file's or the built-in ones
+var encoderRules = DefaultEncoderRules
+
+// Transcodes never get more than this many times their source's bitrate.
+// Re-encoding can't add detail, but H.264 can take twice the bits of HEVC
+// or AV1 for the same picture.
+const maxSourceRateFactor = 2
+
+// SetEncoderRules checks a config's encoder rules, which replace the
+// built-in ones, go from the shortest height up and end with the tallest,
+// then puts them in use. No rules puts the built-in ones back.
+func SetEncoderRules(rules []EncoderRule) error {
+	if len(rules) == 0 {
+		encoderRules = DefaultEncoderRules
+		return nil
+	}
+	for i, rule := range rules {
+		switch {
+		case rule.RateScale <= 0:
+			return fmt.Errorf("rule %d has no rate scale", i+1)
+		case rule.CRF < -20 || rule.CRF > 20:
+			return fmt.Errorf("rule %d changes the CRF by more than 20", i+1)
+		case rule.MaxHeight < 0:
+			return fmt.Errorf("rule %d has a negative height", i+1)
+		case rule.MaxHeight == 0 && i < len(rules)-1:
+			return errors.New("only the last rule can be for any height")
+		case i > 0 && rule.MaxHeight != 0 && rule.MaxHeight <= rules[i-1].MaxHeight:
+			return fmt.Errorf("rule %d isn't taller than the one before", i+1)
+		}
+	}
+	encoderRules = rules
+	return nil
+}
+
+// encoderRuleFor picks the rule for a picture height, the last rule
+// covering anything taller than the others
+func encoderRuleFor(height int) EncoderRule {
+	for _, rule := range encoderRules {
+		if rule.MaxHeight == 0 || height <= rule.MaxHeight {
+			return rule
+		}
+	}
+	return encoderRules[len(encoderRules)-1]
+}
+
+// EncoderSettings fits a quality profile's CRF, maxrate and buffer size to
+// the file being encoded. The profile's settings are for the height it's
+// capped at, or 1080p without a cap, and change by as much as the output
+// height's rule differs from that height's. Files that couldn't be probed
+// keep the profile's.
+func EncoderSettings(probe *library.ProbeResult, profile Profile, device Device) (string, string, string) {
+	var video *library.ProbeStream
+	if probe != nil {
+		video = probe.MainVideoStream()
+	}
+	if video == nil || video.Height == 0 {
+		return profile.CRF, profile.MaxRate, profile.BufSize
+	}
+
+	height := video.Height
+	if limit := device.HeightFor(profile); limit > 0 && limit < height {
+		height = limit
+	}
+	nominal := profile.MaxHeight
+	if nominal == 0 {
+		nominal = 1080
+	}
+	out, base := encoderRuleFor(height), encoderRuleFor(nominal)
+
+	scale := out.RateScale / base.RateScale
+	sourceRate, _ := strconv.Atoi(probe.Format.BitRate)
+	if maxRate, ok := parseRate(profile.MaxRate); ok && sourceRate > 0 {
+		scale = min(scale, maxSourceRateFactor*float64(sourceRate)/1000/float64(maxRate))
+	}
+	crf := profile.CRF
+	if n, err := strconv.Atoi(profile.CRF); err == nil {
+		crf = strconv.Itoa(max(0, min(51, n+out.CRF-base.CRF)))
+	}
+	return crf, scaleRate(profile.MaxRate, scale), scaleRate(profile.BufSize, scale)
+}
+
+// parseRate reads an ffmpeg bitrate such as 1500k or 3M in kbit/s
+func parseRate(rate string) (int, bool) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(rate, "M"):
+		multiplier = 1000
+		rate = strings.TrimSuffix(rate, "M")
+	case strings.HasSuffix(rate, "k"):
+		rate = strings.TrimSuffix(rate, "k")
+	default:
+		return 0, false
+	}
+	n, err := strconv.Atoi(rate)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n * multiplier, true
+}
+
+// scaleRate multiplies an ffmpeg bitrate, leaving ones it can't read alone
+func scaleRate(rate string, scale float64) string {
+	kbps, ok := parseRate(rate)
+	if !ok || scale == 1 {
+		return rate
+	}
+	return strconv.Itoa(max(1, int(math.Round(float64(kbps)*scale)))) + "k"
+}
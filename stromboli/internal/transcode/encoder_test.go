@@ -0,0 +1,41 @@
+package transcode
+
+import (
+	"testing"
+
+	"video-browser/stromboli/internal/library"
+)
+
+func TestEncoderSettings(t *testing.T) {
+	high, medium := Profiles[0], Profiles[1]
+	tests := []struct {
+		name    string
+		height  int
+		bitrate string // Of the source, in bit/s
+		profile Profile
+		want    [3]string // CRF, maxrate and buffer size
+	}{
+		{"1080p", 1080, "", high, [3]string{"23", "3M", "6M"}},
+		{"480p", 480, "", high, [3]string{"21", "1200k", "2400k"}},
+		{"4K", 2160, "", high, [3]string{"23", "7500k", "15000k"}},
+		{"4K scaled down", 2160, "", medium, [3]string{"26", "1500k", "3M"}},
+		{"480p on medium", 480, "", medium, [3]string{"25", "857k", "1714k"}},
+		{"low bitrate source", 1080, "1000000", high, [3]string{"23", "2000k", "4000k"}},
+	}
+	for _, test := range tests {
+		probe := &library.ProbeResult{Streams: []library.ProbeStream{{CodecType: "video", CodecName: "h264", Height: test.height}}}
+		probe.Format.BitRate = test.bitrate
+		crf, maxRate, bufSize := EncoderSettings(probe, test.profile, Devices[0])
+		if got := [3]string{crf, maxRate, bufSize}; got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	defer SetEncoderRules(nil)
+	if err := SetEncoderRules([]EncoderRule{{MaxHeight: 720, RateScale: 1}, {MaxHeight: 480, RateScale: 1}}); err == nil {
+		t.Error("rules out of order were accepted")
+	}
+	if err := SetEncoderRules([]EncoderRule{{RateScale: 1}, {MaxHeight: 480, RateScale: 1}}); err == nil {
+		t.Error("a rule for any height before the last was accepted")
+	}
+}
@@ -0,0 +1,107 @@
+package transcode
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"video-browser/stromboli/internal/library"
+)
+
+// Most channels a surround transcode keeps: 5.1, which every AAC decoder
+// takes
+const MaxSurroundChannels = 6
+
+// DialogueFilter mixes surround sound down to stereo with the centre
+// channel, where the dialogue is, louder than the rest, then evens out the
+// loudness so quiet lines aren't lost under explosions. 5.1 and 7.1 start
+// front left, front right, centre, LFE, then the rear or side pair.
+func DialogueFilter(channels int) string {
+	const normalize = "dynaudnorm=f=150:g=15"
+	if channels < 6 {
+		return normalize
+	}
+	return "pan=stereo|c0=c2+0.3*c0+0.3*c4|c1=c2+0.3*c1+0.3*c5," + normalize
+}
+
+// CopyableVideo reports whether the main video stream can be remuxed as is:
+// H.264, as every transcode container takes it, that the device decodes
+func CopyableVideo(probe *library.ProbeResult, device Device) bool {
+	if probe == nil {
+		return false
+	}
+	video := probe.MainVideoStream()
+	return video != nil && video.CodecName == "h264" && slices.Contains(device.VideoCodecs, video.CodecName)
+}
+
+// MainAudioCodec is the codec of the main audio stream, or "" if there's none
+func MainAudioCodec(probe *library.ProbeResult) string {
+	if probe == nil {
+		return ""
+	}
+	if audio := probe.MainAudioStream(); audio != nil {
+		return audio.CodecName
+	}
+	return ""
+}
+
+// VideoFilter builds the -vf chain: deinterlacing for interlaced sources
+// such as broadcast captures, then scaling down to maxHeight and dropping
+// frames down to maxFrameRate where they're set. Probed sources already
+// within the caps are left alone, so they can still be copied.
+func VideoFilter(probe *library.ProbeResult, maxHeight int, maxFrameRate int) string {
+	var video *library.ProbeStream
+	if probe != nil {
+		video = probe.MainVideoStream()
+	}
+
+	var filters []string
+	if video != nil && video.Interlaced() {
+		filters = append(filters, "yadif")
+	}
+	if maxHeight > 0 && (video == nil || video.Height == 0 || video.Height > maxHeight) {
+		filters = append(filters, fmt.Sprintf("scale=-2:'min(%d,ih)'", maxHeight))
+	}
+	// Without a probed frame rate there's no telling whether fps would drop
+	// frames or duplicate them, so it's only used on sources known to be faster
+	if maxFrameRate > 0 && video != nil && video.FramesPerSecond() > float64(maxFrameRate)+0.01 {
+		filters = append(filters, "fps="+strconv.Itoa(maxFrameRate))
+	}
+	return strings.Join(filters, ",")
+}
+
+// VideoMapArgs selects the main video stream alone
+func VideoMapArgs(probe *library.ProbeResult) []string {
+	if probe == nil {
+		return []string{"-map", "0:v:0"}
+	}
+	if video := probe.MainVideoStream(); video != nil {
+		return []string{"-map", "0:" + strconv.Itoa(video.Index)}
+	}
+	return nil
+}
+
+// StreamMapArgs selects the main video and audio streams, skipping cover art
+// and attachments. Without probe data the first of each is used. With
+// external audio the audio comes from the second input instead.
+func StreamMapArgs(probe *library.ProbeResult, externalAudio bool) []string {
+	audioMap := []string{"-map", "0:a:0"}
+	if externalAudio {
+		audioMap = []string{"-map", "1:a:0"}
+	}
+	if probe == nil {
+		return append([]string{"-map", "0:v:0"}, audioMap...)
+	}
+
+	var args []string
+	if video := probe.MainVideoStream(); video != nil {
+		args = append(args, "-map", "0:"+strconv.Itoa(video.Index))
+	}
+	if externalAudio {
+		args = append(args, audioMap...)
+	} else if audio := probe.MainAudioStream(); audio != nil {
+		args = append(args, "-map", "0:"+strconv.Itoa(audio.Index))
+	}
+	return args
+}
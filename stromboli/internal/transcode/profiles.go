@@ -0,0 +1,102 @@
+// Package transcode holds what decides how a file is transcoded: the
+// quality profiles players step down through, the device profiles fitted to
+// each class of player, the encoder settings for each picture size and the
+// ffmpeg filters and stream maps built from a probe.
+package transcode
+
+// Container is a format transcodes can be written out in
+type Container struct {
+	MimeType string
+	Args     []string
+}
+
+// Containers the transcoder can produce. MPEG-TS is for clients and proxies
+// that buffer fragmented MP4 poorly. Both are written out packet by packet,
+// MP4 in fragments of at most a second and MPEG-TS without the usual mux
+// delay, so playback can start within a second or two.
+var Containers = map[string]Container{
+	"mp4": {
+		MimeType: "video/mp4",
+		Args:     []string{"-movflags", "frag_keyframe+empty_moov+faststart", "-frag_duration", "1000000", "-flush_packets", "1", "-f", "mp4"},
+	},
+	"mpegts": {
+		MimeType: "video/mp2t",
+		Args:     []string{"-mpegts_flags", "resend_headers", "-muxdelay", "0", "-flush_packets", "1", "-f", "mpegts"},
+	},
+}
+
+// Profile is a quality level the transcoder can encode at
+type Profile struct {
+	Name         string
+	CRF          string
+	MaxRate      string
+	BufSize      string
+	MaxHeight    int // 0 keeps the source resolution
+	AudioBitrate string
+
+	// Passthrough copies surround audio untouched, and H.264 video too,
+	// for players feeding an AV receiver that decodes it
+	Passthrough bool
+
+	// Remux copies H.264 video into the container, along with audio the
+	// device plays, for files that only need a different container
+	Remux bool
+}
+
+// Profiles from best to worst. Players step down this list when they stall.
+var Profiles = []Profile{
+	{Name: "high", CRF: "23", MaxRate: "3M", BufSize: "6M", AudioBitrate: "128k"},
+	{Name: "medium", CRF: "26", MaxRate: "1500k", BufSize: "3M", MaxHeight: 720, AudioBitrate: "128k"},
+	{Name: "low", CRF: "30", MaxRate: "700k", BufSize: "1400k", MaxHeight: 480, AudioBitrate: "96k"},
+}
+
+// PassthroughProfile remuxes rather than transcodes where it can. It's
+// chosen per device rather than being a step on the quality ladder.
+var PassthroughProfile = Profile{Name: "passthrough", CRF: "23", MaxRate: "3M", BufSize: "6M", AudioBitrate: "128k", Passthrough: true}
+
+// RemuxProfile is picked per file, for videos whose codecs the device
+// decodes in a container it doesn't play
+var RemuxProfile = Profile{Name: "remux", CRF: "23", MaxRate: "3M", BufSize: "6M", AudioBitrate: "128k", Remux: true}
+
+// Audio codecs remuxing copies, as both transcode containers carry them
+var RemuxAudio = map[string]bool{
+	"aac": true,
+	"mp3": true,
+}
+
+// Audio codecs AV receivers decode themselves
+var PassthroughAudio = map[string]bool{
+	"ac3":    true,
+	"eac3":   true,
+	"dts":    true,
+	"truehd": true,
+}
+
+func FindProfile(name string) (Profile, bool) {
+	if name == PassthroughProfile.Name {
+		return PassthroughProfile, true
+	}
+	if name == RemuxProfile.Name {
+		return RemuxProfile, true
+	}
+	for _, p := range Profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// LowerProfile returns the next profile down from the named one. A
+// stalling passthrough or remux stream drops to the top of the ladder.
+func LowerProfile(name string) (Profile, bool) {
+	if name == PassthroughProfile.Name || name == RemuxProfile.Name {
+		return Profiles[0], true
+	}
+	for i, p := range Profiles {
+		if p.Name == name && i+1 < len(Profiles) {
+			return Profiles[i+1], true
+		}
+	}
+	return Profile{}, false
+}
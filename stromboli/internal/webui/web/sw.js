@@ -0,0 +1,47 @@
+// Service worker caching the app shell so the UI loads offline.
+// The cache name carries the embedded asset version, so a new build
+// replaces the old shell rather than serving it forever.
+const CACHE = 'stromboli-__ASSET_VERSION__';
+const SHELL = [
+    '/',
+    '/static/manifest.webmanifest?v=__ASSET_VERSION__',
+    '/static/icon-192.png',
+    '/static/icon-512.png'
+];
+
+self.addEventListener('install', event => {
+    event.waitUntil(
+        caches.open(CACHE)
+            .then(cache => cache.addAll(SHELL))
+            .then(() => self.skipWaiting())
+    );
+});
+
+self.addEventListener('activate', event => {
+    event.waitUntil(
+        caches.keys()
+            .then(keys => Promise.all(keys.filter(key => key !== CACHE).map(key => caches.delete(key))))
+            .then(() => self.clients.claim())
+    );
+});
+
+self.addEventListener('fetch', event => {
+    const url = new URL(event.request.url);
+
+    // Media and API calls always go to the server
+    if (event.request.method !== 'GET' || url.origin !== location.origin || url.pathname.startsWith('/api/')) {
+        return;
+    }
+
+    // Pages are network first so the UI stays current, falling back to the cached shell
+    if (event.request.mode === 'navigate') {
+        event.respondWith(
+            fetch(event.request).catch(() => caches.match('/'))
+        );
+        return;
+    }
+
+    event.respondWith(
+        caches.match(event.request).then(cached => cached || fetch(event.request))
+    );
+});
@@ -0,0 +1,72 @@
+// Package webui is the browser frontend, embedded in the binary
+package webui
+
+import (
+	"crypto/sha1"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+//go:embed web
+var webFS embed.FS
+
+// Version is a hash of the embedded frontend, used to bust caches
+// whenever the binary ships a different UI
+var Version = hashAssets()
+
+func hashAssets() string {
+	h := sha1.New()
+	fs.WalkDir(webFS, "web", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := webFS.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		h.Write([]byte(path))
+		h.Write(data)
+		return nil
+	})
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// LanguagePacks are the built-in UI translations, one JSON file for each
+// language tag
+func LanguagePacks() fs.FS {
+	packs, _ := fs.Sub(webFS, "web/i18n")
+	return packs
+}
+
+// ServeVersioned writes an embedded text asset, such as index.html, with
+// its version placeholder filled in, along with any extra old, new
+// replacement pairs
+func ServeVersioned(w http.ResponseWriter, name string, contentType string, replacements ...string) {
+	data, err := webFS.ReadFile("web/" + name)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	replacer := strings.NewReplacer(append([]string{"__ASSET_VERSION__", Version}, replacements...)...)
+	w.Write([]byte(replacer.Replace(string(data))))
+}
+
+// Static serves embedded icons and the web app manifest under /static/
+func Static() http.Handler {
+	static, _ := fs.Sub(webFS, "web/static")
+	files := http.StripPrefix("/static/", http.FileServer(http.FS(static)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".webmanifest") {
+			w.Header().Set("Content-Type", "application/manifest+json")
+		}
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Header().Set("ETag", `"`+Version+`"`)
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,33 @@
+// Package stromboli serves a folder of videos to browsers, transcoding what
+// they can't play. It's the part of the server other Go programs can
+// embed; the server itself lives in internal/server, with the transcoder's
+// settings in internal/transcode, probing in internal/library and the web
+// UI in internal/webui.
+package stromboli
+
+import "video-browser/stromboli/internal/server"
+
+// Options are the settings the command line takes
+type Options = server.Options
+
+// Server is the web UI and API for one library. Its state is kept across
+// the server package, so a program can only run one.
+type Server = server.Server
+
+// DefaultOptions are the command line's defaults
+func DefaultOptions() Options {
+	return server.DefaultOptions()
+}
+
+// New sets up a server: reading the config file, loading what was saved
+// last time and starting the maintenance schedule
+func New(opts Options) (*Server, error) {
+	return server.New(opts)
+}
+
+// RunCommand runs one of the subcommands: check, self-update,
+// install-service, uninstall-service, worker, export or import. It reports
+// false for any other name.
+func RunCommand(name string, args []string) bool {
+	return server.RunCommand(name, args)
+}